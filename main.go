@@ -1,9 +1,17 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -27,6 +35,12 @@ func main() {
 	search.DefineElasticClient()
 
 	router := gin.Default()
+	if err := router.SetTrustedProxies(search.TrustedProxies()); err != nil {
+		slog.Error("Invalid SEARCH_TRUSTED_PROXIES", "error", err.Error())
+		os.Exit(1)
+	}
+	router.Use(search.RequestID())
+	router.Use(search.LimitRequestBody())
 
 	if err := search.EnsureTableExists(); err != nil {
 		fmt.Println("Failed to ensure BigQuery table exists: ", err)
@@ -34,34 +48,86 @@ func main() {
 
 	router.GET("/status", search.HealthCheck)
 
+	// Every endpoint but the health check requires an API key when
+	// SEARCH_API_KEYS is set.
+	api := router.Group("", search.RequireAPIKey())
+
+	// Searches and filter listings are rate limited separately, each sharing
+	// its limit across its routes, when SEARCH_RATE_LIMIT_<ROUTE> is set.
+	searchLimit := search.RateLimit("search")
+	filtersLimit := search.RateLimit("filters")
+
+	// Search responses can run to megabytes so are gzipped for clients that
+	// accept it.  The CSV export streams its rows and is left uncompressed.
+	searches := api.Group("", searchLimit, search.CompressResponse())
+
 	// Define generic search endpoint, searches across all available entities
-	router.POST("/search", search.SearchGeneric)
-	router.POST("/search/datasets", search.DatasetSearch)
-	router.POST("/search/tools", search.ToolSearch)
-	router.POST("/search/collections", search.CollectionSearch)
-	router.POST("/search/dur", search.DataUseSearch)
-	router.POST("/search/publications", search.PublicationSearch)
-	router.POST("/search/data_providers", search.DataProviderSearch)
-	router.POST("/search/data_custodian_networks", search.DataCustodianNetworkSearch)
-
-	router.POST("/settings/tools", search.DefineToolSettings)
-	router.POST("/settings/collections", search.DefineCollectionSettings)
-	router.POST("/settings/data_custodian_networks", search.DefineDataCustodianNetworkSettings)
-
-	router.POST("/mappings/datasets", search.DefineDatasetMappings)
-	router.POST("/mappings/collections", search.DefineCollectionMappings)
-	router.POST("/mappings/dur", search.DefineDataUseMappings)
-	router.POST("/mappings/publications", search.DefinePublicationMappings)
-	router.POST("/mappings/tools", search.DefineToolMappings)
-	router.POST("/mappings/data_providers", search.DefineDataProviderMappings)
-	router.POST("/mappings/data_custodian_networks", search.DefineDataCustodianNetworkMappings)
-
-	router.POST("/filters", search.ListFilters)
-	router.POST("/similar/datasets", search.SearchSimilarDatasets)
-
-	router.POST("/search/federated_papers/doi", search.DOISearch)
-	router.POST("/search/federated_papers/field_search", search.FieldSearch)
-	router.POST("/search/federated_papers/field_search/array", search.ArrayFieldSearch)
-
-	router.Run(os.Getenv("SEARCHSERVICE_HOST"))
+	searches.POST("/search", search.SearchGeneric)
+	for path, handler := range search.EntityRoutes() {
+		searches.POST(path, handler)
+	}
+	api.POST("/search/export", searchLimit, search.ExportSearch)
+	searches.POST("/search/aggregate", search.Aggregate)
+	api.POST("/search/count", searchLimit, search.Count)
+	api.POST("/search/raw", searchLimit, search.RawSearch)
+	searches.POST("/search/document", search.GetByID)
+
+	api.POST("/settings/tools", search.DefineToolSettings)
+	api.POST("/settings/collections", search.DefineCollectionSettings)
+	api.POST("/settings/data_custodian_networks", search.DefineDataCustodianNetworkSettings)
+
+	api.POST("/mappings/datasets", search.DefineDatasetMappings)
+	api.POST("/mappings/collections", search.DefineCollectionMappings)
+	api.POST("/mappings/dur", search.DefineDataUseMappings)
+	api.POST("/mappings/publications", search.DefinePublicationMappings)
+	api.POST("/mappings/tools", search.DefineToolMappings)
+	api.POST("/mappings/data_providers", search.DefineDataProviderMappings)
+	api.POST("/mappings/data_custodian_networks", search.DefineDataCustodianNetworkMappings)
+
+	// Runtime switches that change the behaviour of the running service are
+	// only open to requests with SEARCH_ADMIN_TOKEN.
+	admin := api.Group("", search.RequireAdminToken())
+	admin.POST("/settings/explanations", search.SetExplanationExtraction)
+	admin.POST("/mappings/refresh", search.RefreshMappings)
+
+	api.POST("/filters", filtersLimit, search.ListFilters)
+	api.POST("/filters/search", filtersLimit, search.FilterSearch)
+	api.POST("/similar/datasets", searchLimit, search.SearchSimilarDatasets)
+
+	api.POST("/search/federated_papers/doi", searchLimit, search.DOISearch)
+	api.POST("/search/federated_papers/field_search", searchLimit, search.FieldSearch)
+	api.POST("/search/federated_papers/field_search/array", searchLimit, search.ArrayFieldSearch)
+	api.POST("/search/federated_papers/publications", searchLimit, search.FederatedPublicationSearch)
+
+	addr := os.Getenv("SEARCHSERVICE_HOST")
+	if addr == "" {
+		addr = ":" + cmp.Or(os.Getenv("PORT"), "8080")
+	}
+	server := &http.Server{Addr: addr, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Search service stopped", "error", err.Error())
+			os.Exit(1)
+		}
+	}()
+
+	// On SIGTERM stop accepting requests, then let the requests and background
+	// work in progress finish before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	timeout, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"))
+	if err != nil || timeout <= 0 {
+		timeout = 30
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Failed to shut down server", "error", err.Error())
+	}
+	if err := search.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Failed to shut down search service", "error", err.Error())
+	}
 }
@@ -0,0 +1,79 @@
+package search
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AggregateQuery represents a request for the aggregations of a search.  It
+// accepts the same body as the search endpoints plus the entity type to
+// search.
+type AggregateQuery struct {
+	Query
+	Type string `json:"type"`
+}
+
+// Aggregate performs a search of the requested entity type and returns only
+// the aggregations requested, for refreshing the filter buckets without
+// fetching the hits.
+func Aggregate(c *gin.Context) {
+	var query AggregateQuery
+	if err := c.BindJSON(&query); err != nil {
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret aggregate query", "error", err.Error())
+		return
+	}
+	query.RequestID = requestIDFrom(c)
+	if err := validateQuery(query.Query); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return
+	}
+
+	if query.Type == "" {
+		query.Type = "dataset"
+	}
+	if _, ok := entityConfig(query.Type); !ok {
+		c.JSON(http.StatusBadRequest, errorBody(c, fmt.Sprintf("aggregations of type %s are not supported", query.Type)))
+		return
+	}
+	aggregations, err := defaultService().aggregate(query.Type, withoutStopPhrases(query.Query))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorBody(c, fmt.Sprintf("Aggregations of %s failed", query.Type)))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"aggregations": aggregations})
+}
+
+// aggregate runs the search query of the entity type without returning any
+// hits, so without highlighting or explanations, and returns its flattened
+// aggregations, with the variants of each funder merged, along with an error if the search could not be run or kept
+// failing, see executeSearchWithRetry.
+func (s *SearchService) aggregate(entityType string, query Query) (map[string]interface{}, error) {
+	config, ok := entityConfig(entityType)
+	if !ok {
+		return nil, fmt.Errorf("aggregations of type %s are not supported", entityType)
+	}
+
+	index := config.Index
+	elasticResp, body, err := s.executeSearchWithRetry(index, query.RequestID, func() gin.H {
+		return withoutHits(config.ElasticConfig(query))
+	})
+	if err != nil {
+		logElasticError(body, index, query.RequestID)
+		return nil, err
+	}
+	aggregations := flattenAggs(elasticResp, query.AggPercentages)
+	normaliseFunderBuckets(aggregations)
+	return aggregations, nil
+}
+
+// withoutHits returns the elastic query changed to return no hits, dropping
+// the options that only apply to hits.
+func withoutHits(elasticQuery gin.H) gin.H {
+	for _, key := range []string{"from", "highlight", "explain", "sort", "search_after"} {
+		delete(elasticQuery, key)
+	}
+	elasticQuery["size"] = 0
+	return elasticQuery
+}
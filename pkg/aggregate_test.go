@@ -0,0 +1,128 @@
+package search
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregate(t *testing.T) {
+	var elasticQuery map[string]interface{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &elasticQuery)
+		return http.StatusOK, `{
+			"hits": {"hits": [], "total": {"value": 12}},
+			"aggregations": {
+				"programmingLanguage": {
+					"doc_count": 12,
+					"programmingLanguage": {"buckets": [{"key": "Python", "doc_count": 7}]}
+				}
+			}
+		}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query":     "sequencing",
+		"type":      "tool",
+		"size":      50,
+		"highlight": gin.H{"fragmentSize": 100},
+		"aggs":      []gin.H{{"type": "tool", "keys": "programmingLanguage"}},
+	})
+
+	Aggregate(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, 0, elasticQuery["size"])
+	assert.NotContains(t, elasticQuery, "highlight")
+	assert.NotContains(t, elasticQuery, "explain")
+	assert.Contains(t, elasticQuery, "aggs")
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NotContains(t, response, "hits")
+	buckets := response["aggregations"].(map[string]interface{})["programmingLanguage"].(map[string]interface{})["buckets"]
+	assert.Len(t, buckets, 1)
+}
+
+func TestAggregateNormalisesFunders(t *testing.T) {
+	setTestFunders(t)
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusOK, `{
+			"hits": {"hits": [], "total": {"value": 7}},
+			"aggregations": {
+				"fundersAndSponsors": {
+					"doc_count": 7,
+					"fundersAndSponsors": {"buckets": [
+						{"key": "MRC", "doc_count": 4},
+						{"key": "Medical Research Council", "doc_count": 3}
+					]}
+				}
+			}
+		}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query": "asthma",
+		"type":  "dataUseRegister",
+		"aggs":  []gin.H{{"type": "dataUseRegister", "keys": "fundersAndSponsors"}},
+	})
+
+	Aggregate(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	buckets := response["aggregations"].(map[string]interface{})["fundersAndSponsors"].(map[string]interface{})["buckets"]
+	assert.EqualValues(
+		t,
+		[]interface{}{map[string]interface{}{"key": "Medical Research Council", "doc_count": 7.0}},
+		buckets,
+	)
+}
+
+func TestAggregateUnsupported(t *testing.T) {
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "type": "unknown"})
+
+	Aggregate(c)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAggregateRetryExhausted(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+	requests := 0
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		requests++
+		return http.StatusBadRequest, fielddataErrorResponse
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query": "asthma",
+		"type":  "collection",
+		"aggs":  []gin.H{{"type": "collection", "keys": "publisherName"}},
+	})
+
+	Aggregate(c)
+
+	assert.EqualValues(t, http.StatusBadGateway, w.Code)
+	assert.EqualValues(t, 2, requests)
+}
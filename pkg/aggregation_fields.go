@@ -0,0 +1,248 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// aggregationFieldOverrides maps a filter key to the field that should be
+// aggregated on in its place, typically the .keyword sub-field of a text
+// field that elastic refuses to aggregate on directly.
+var aggregationFieldOverrides = map[string]string{}
+var aggregationFieldOverridesMu sync.RWMutex
+
+// aggregationFieldOverridesFileMu serialises updates of the overrides file, so
+// that overrides discovered at the same time are not lost.
+var aggregationFieldOverridesFileMu sync.Mutex
+
+// keywordAggregationFields lists, per entity type, the fields known to be text
+// fields that must be aggregated on through their .keyword sub-field.  They are
+// seeded into aggregationFieldOverrides at start up so the first request for
+// them does not fail; fields missing from here are still discovered from the
+// errors elastic returns.
+var keywordAggregationFields = map[string][]string{
+	"dataset": {"publisherName"},
+	"tool":    {"programmingLanguage", "license"},
+}
+
+// fielddataRegex extracts the field name from the error elastic returns when
+// asked to aggregate on a text field without fielddata enabled.  Depending on
+// the elastic version the field is given as "Fielddata is disabled on [field]"
+// and/or "set fielddata=true on [field]", where field may be a dotted path to
+// a nested or multi-field.
+var fielddataRegex = regexp.MustCompile(
+	`(?i)(?:fielddata is disabled on|fielddata=true on)\s+(?:field\s+)?\[([^\]]+)\]`,
+)
+
+// resolveAggregationField returns the field to aggregate on for the given
+// filter key of the index.  Where the index mapping gives the type of the key
+// text fields are aggregated on their .keyword sub-field and all other types,
+// such as booleans, numbers and dates, on the key itself.  Keys missing from
+// the mapping fall back to the known overrides.
+func resolveAggregationField(index string, key string) string {
+	types := fieldTypes(index)
+	if _, ok := types[key]; ok {
+		if keyword, ok := keywordSubField(types, key); ok {
+			return keyword
+		}
+		return key
+	}
+	return aggregationFieldOverride(key)
+}
+
+// aggregationFieldOverride returns the field to aggregate on in place of key,
+// which is the key itself unless an override is known.
+func aggregationFieldOverride(key string) string {
+	aggregationFieldOverridesMu.RLock()
+	defer aggregationFieldOverridesMu.RUnlock()
+
+	if field, ok := aggregationFieldOverrides[key]; ok {
+		return field
+	}
+	return key
+}
+
+// seedAggregationFieldOverrides adds an override to the .keyword sub-field for
+// each of the keywordAggregationFields.
+func seedAggregationFieldOverrides() {
+	aggregationFieldOverridesMu.Lock()
+	defer aggregationFieldOverridesMu.Unlock()
+
+	for _, fields := range keywordAggregationFields {
+		for _, field := range fields {
+			aggregationFieldOverrides[field] = field + ".keyword"
+		}
+	}
+}
+
+// setAggregationFieldOverride records that aggregations on key should use
+// field instead.  If AGGREGATION_FIELD_OVERRIDES_FILE is set the override is
+// also merged into that file so that it is known on the next start up.
+func setAggregationFieldOverride(key string, field string) {
+	aggregationFieldOverridesMu.Lock()
+	aggregationFieldOverrides[key] = field
+	aggregationFieldOverridesMu.Unlock()
+
+	if path := os.Getenv("AGGREGATION_FIELD_OVERRIDES_FILE"); path != "" {
+		if err := persistAggregationFieldOverride(path, key, field); err != nil {
+			slog.Warn("Could not persist aggregation field override", "field", key, "error", err.Error())
+		}
+	}
+}
+
+// loadAggregationFieldOverrides merges the overrides stored in the JSON file at
+// path into the current overrides.  A missing file is not an error, as it is
+// only created once the first override is discovered.
+func loadAggregationFieldOverrides(path string) error {
+	overrides, err := readAggregationFieldOverrides(path)
+	if err != nil {
+		return err
+	}
+
+	aggregationFieldOverridesMu.Lock()
+	defer aggregationFieldOverridesMu.Unlock()
+	for key, field := range overrides {
+		aggregationFieldOverrides[key] = field
+	}
+	return nil
+}
+
+func readAggregationFieldOverrides(path string) (map[string]string, error) {
+	overrides := map[string]string{}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// persistAggregationFieldOverride adds the override to those already in the
+// file at path, so that overrides discovered by other instances are kept.  The
+// file is replaced by renaming a temporary file over it, so that it is never
+// left partly written.
+func persistAggregationFieldOverride(path string, key string, field string) error {
+	aggregationFieldOverridesFileMu.Lock()
+	defer aggregationFieldOverridesFileMu.Unlock()
+
+	overrides, err := readAggregationFieldOverrides(path)
+	if err != nil {
+		return err
+	}
+	if overrides[key] == field {
+		return nil
+	}
+	overrides[key] = field
+
+	content, err := json.MarshalIndent(overrides, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// writeFileAtomic writes content to a temporary file in the directory of path
+// and renames it to path, so that readers see either the old or the new file.
+func writeFileAtomic(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// updateAggregationOverridesFromError checks an elastic error response for a
+// failure to aggregate on a text field and, if one is found, overrides that
+// field with its .keyword sub-field.  It reports whether any new override was
+// added, in which case the failed query is worth retrying.
+func updateAggregationOverridesFromError(body []byte) bool {
+	updated := false
+	for _, field := range fielddataFields(string(body)) {
+		if aggregationFieldOverride(field) != field {
+			continue
+		}
+		slog.Info("Aggregating on keyword sub-field in place of text field", "field", field, "aggregationField", field+".keyword")
+		setAggregationFieldOverride(field, field+".keyword")
+		updated = true
+	}
+	return updated
+}
+
+// fielddataFields returns the fields named in any fielddata errors in the
+// message, without any .keyword suffix and with duplicates removed.
+func fielddataFields(message string) []string {
+	fields := []string{}
+	seen := make(map[string]bool)
+	for _, match := range fielddataRegex.FindAllStringSubmatch(message, -1) {
+		field := strings.TrimSuffix(strings.TrimSpace(match[1]), ".keyword")
+		if field == "" || seen[field] {
+			continue
+		}
+		seen[field] = true
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// errSearchRetriesExhausted is returned by executeSearchWithRetry when the query
+// still failed after being retried with aggregation field overrides.
+var errSearchRetriesExhausted = errors.New("elastic query failed after retrying with aggregation field overrides")
+
+// searchRetriesExhausted counts the queries that executeSearchWithRetry gave up
+// on, reported by HealthCheck.
+var searchRetriesExhausted atomic.Int64
+
+// executeSearchWithRetry builds and runs a query against the named index,
+// retrying once with a rebuilt query if elastic rejected an aggregation on a
+// text field that can be replaced with its .keyword sub-field.  If the retried
+// query fails as well errSearchRetriesExhausted is returned along with the
+// failed response, so that callers can tell the failure from a search with no
+// results.
+func (s *SearchService) executeSearchWithRetry(index string, requestID string, buildQuery func() gin.H) (SearchResponse, []byte, error) {
+	elasticResp, body, err := s.executeElasticQuery(index, requestID, buildQuery())
+	if errors.Is(err, errElasticResponse) && updateAggregationOverridesFromError(body) {
+		requestLogger(requestID).Debug("Retrying query with aggregation field overrides", "index", index)
+		elasticResp, body, err = s.executeElasticQuery(index, requestID, buildQuery())
+		if errors.Is(err, errElasticResponse) {
+			searchRetriesExhausted.Add(1)
+			rootCause := logElasticError(body, index, requestID)
+			requestLogger(requestID).Error(
+				"Elastic query still failing after retry, giving up",
+				"index", index,
+				"type", rootCause.Type,
+				"reason", rootCause.Reason,
+			)
+			err = fmt.Errorf("%w: %s", errSearchRetriesExhausted, index)
+		}
+	}
+	return elasticResp, body, err
+}
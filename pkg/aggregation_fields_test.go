@@ -0,0 +1,276 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"hdruk/search-service/utils/mocks"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const fielddataErrorResponse = `{
+	"error": {
+		"root_cause": [
+			{
+				"type": "illegal_argument_exception",
+				"reason": "Text fields are not optimised for operations that require per-document field data like aggregations and sorting, so these operations are disabled by default. Please use a keyword field instead. Alternatively, set fielddata=true on [publisherName] in order to load field data by uninverting the inverted index. Note that this can use significant memory."
+			}
+		]
+	},
+	"status": 400
+}`
+
+func resetAggregationFieldOverrides(t *testing.T) {
+	aggregationFieldOverrides = map[string]string{}
+	t.Cleanup(func() { aggregationFieldOverrides = map[string]string{} })
+}
+
+func TestResolveAggregationField(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+
+	assert.EqualValues(t, "publisherName", resolveAggregationField("dataset", "publisherName"))
+	setAggregationFieldOverride("publisherName", "publisherName.keyword")
+	assert.EqualValues(t, "publisherName.keyword", resolveAggregationField("dataset", "publisherName"))
+}
+
+func TestAggregationFieldOverridesPersist(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	t.Setenv("AGGREGATION_FIELD_OVERRIDES_FILE", path)
+
+	// a missing file is created when the first override is discovered
+	err := loadAggregationFieldOverrides(path)
+	assert.Nil(t, err)
+	setAggregationFieldOverride("publisherName", "publisherName.keyword")
+
+	// overrides written by another instance are kept
+	content, _ := json.Marshal(map[string]string{
+		"publisherName": "publisherName.keyword",
+		"license":       "license.keyword",
+	})
+	os.WriteFile(path, content, 0644)
+	setAggregationFieldOverride("programmingLanguage", "programmingLanguage.keyword")
+
+	aggregationFieldOverrides = map[string]string{}
+	err = loadAggregationFieldOverrides(path)
+	assert.Nil(t, err)
+	assert.EqualValues(
+		t,
+		map[string]string{
+			"publisherName":       "publisherName.keyword",
+			"license":             "license.keyword",
+			"programmingLanguage": "programmingLanguage.keyword",
+		},
+		aggregationFieldOverrides,
+	)
+}
+
+func TestAggregationFieldOverridesPersistConcurrently(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "overrides.json")
+	t.Setenv("AGGREGATION_FIELD_OVERRIDES_FILE", path)
+
+	var wg sync.WaitGroup
+	want := map[string]string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("field%d", i)
+		want[key] = key + ".keyword"
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			setAggregationFieldOverride(key, key+".keyword")
+		}()
+	}
+	wg.Wait()
+
+	overrides, err := readAggregationFieldOverrides(path)
+	assert.Nil(t, err)
+	assert.EqualValues(t, want, overrides)
+
+	// no temporary files are left behind
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1)
+}
+
+func TestUpdateAggregationOverridesFromError(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+
+	assert.True(t, updateAggregationOverridesFromError([]byte(fielddataErrorResponse)))
+	assert.EqualValues(t, "publisherName.keyword", resolveAggregationField("dataset", "publisherName"))
+
+	// an override that is already known is not worth retrying for
+	assert.False(t, updateAggregationOverridesFromError([]byte(fielddataErrorResponse)))
+	assert.False(t, updateAggregationOverridesFromError([]byte(`{"took": 3}`)))
+}
+
+func TestExecuteSearchWithRetry(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+
+	var requests []string
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		body, _ := io.ReadAll(req.Body)
+		requests = append(requests, string(body))
+		if len(requests) == 1 {
+			return http.StatusBadRequest, fielddataErrorResponse
+		}
+		return http.StatusOK, `{"took": 3, "aggregations": {"publisherName": {"buckets": []}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+	logs := captureLogs(t)
+
+	filter := map[string]interface{}{"type": "dataset", "keys": "publisherName"}
+	elasticResp, _, err := executeSearchWithRetry("dataset", "retry-request", func() gin.H {
+		return filtersRequest(filter, 10)
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, requests, 2)
+	assert.NotContains(t, requests[0], "publisherName.keyword")
+	assert.Contains(t, requests[1], "\"field\":\"publisherName.keyword\"")
+	assert.Contains(t, elasticResp.Aggregations, "publisherName")
+
+	attrs, ok := logs.find("Retrying query with aggregation field overrides")
+	assert.True(t, ok)
+	assert.EqualValues(t, "dataset", attrs["index"])
+	attrs, ok = logs.find("Aggregating on keyword sub-field in place of text field")
+	assert.True(t, ok)
+	assert.EqualValues(t, "publisherName", attrs["field"])
+	assert.EqualValues(t, "publisherName.keyword", attrs["aggregationField"])
+}
+
+func TestSeedAggregationFieldOverrides(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+
+	seedAggregationFieldOverrides()
+	for _, fields := range keywordAggregationFields {
+		for _, field := range fields {
+			assert.EqualValues(t, field+".keyword", resolveAggregationField("dataset", field))
+		}
+	}
+
+	// the first request for a seeded field already uses the .keyword field
+	filter := map[string]interface{}{"type": "tool", "keys": "license"}
+	aggs := filtersRequest(filter, 10)["aggs"].(gin.H)
+	assert.EqualValues(
+		t,
+		"license.keyword",
+		aggs["license"].(gin.H)["terms"].(gin.H)["field"],
+	)
+
+	// fields that were not anticipated still resolve to themselves until
+	// discovered from an elastic error
+	assert.EqualValues(t, "keywords", resolveAggregationField("dataset", "keywords"))
+	assert.True(t, updateAggregationOverridesFromError(
+		[]byte("set fielddata=true on [keywords] in order to load field data"),
+	))
+	assert.EqualValues(t, "keywords.keyword", resolveAggregationField("dataset", "keywords"))
+}
+
+func TestFielddataFields(t *testing.T) {
+	testCases := []struct {
+		name     string
+		message  string
+		expected []string
+	}{
+		{
+			name:     "elastic 6 message",
+			message:  "Fielddata is disabled on text fields by default. Set fielddata=true on [publisherName] in order to load fielddata in memory by uninverting the inverted index. Note that this can however use significant memory. Alternatively use a keyword field instead.",
+			expected: []string{"publisherName"},
+		},
+		{
+			name:     "elastic 7 message with a nested field",
+			message:  "Text fields are not optimised for operations that require per-document field data like aggregations and sorting, so these operations are disabled by default. Please use a keyword field instead. Alternatively, set fielddata=true on [metadata.publisher.name] in order to load field data by uninverting the inverted index. Note that this can use significant memory.",
+			expected: []string{"metadata.publisher.name"},
+		},
+		{
+			name:     "elastic 8 message naming the field and index",
+			message:  "Fielddata is disabled on [metadata.summary.keywords] in [dataset]. Text fields are not optimised for operations that require per-document field data like aggregations and sorting, so these operations are disabled by default. Please use a keyword field instead. Alternatively, set fielddata=true on [metadata.summary.keywords] in order to load field data by uninverting the inverted index. Note that this can use significant memory.",
+			expected: []string{"metadata.summary.keywords"},
+		},
+		{
+			name:     "field name containing a space",
+			message:  "Alternatively, set fielddata=true on [data use title] in order to load field data",
+			expected: []string{"data use title"},
+		},
+		{
+			name:     "multi-field keyword suffix",
+			message:  "set fielddata=true on [license.keyword] in order to load field data",
+			expected: []string{"license"},
+		},
+		{
+			name:     "several failed aggregations",
+			message:  `{"root_cause": [{"reason": "set fielddata=true on [publisherName] in order"}, {"reason": "set fielddata=true on [programmingLanguage] in order"}]}`,
+			expected: []string{"publisherName", "programmingLanguage"},
+		},
+		{
+			name:     "unrelated error",
+			message:  "No mapping found for [startDate] in order to sort on",
+			expected: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.EqualValues(t, tc.expected, fielddataFields(tc.message))
+		})
+	}
+}
+
+func TestExecuteSearchWithRetryExhausted(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+
+	requests := 0
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		requests++
+		return http.StatusBadRequest, fielddataErrorResponse
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+	exhausted := searchRetriesExhausted.Load()
+
+	filter := map[string]interface{}{"type": "dataset", "keys": "publisherName"}
+	_, body, err := executeSearchWithRetry("dataset", "", func() gin.H {
+		return filtersRequest(filter, 10)
+	})
+	assert.ErrorIs(t, err, errSearchRetriesExhausted)
+	assert.EqualValues(t, fielddataErrorResponse, string(body))
+	assert.EqualValues(t, 2, requests)
+	assert.EqualValues(t, exhausted+1, searchRetriesExhausted.Load())
+
+	// the override is now known, so the query is not retried again, and the
+	// failure is returned as is
+	resetAggregationFieldOverrides(t)
+	aggregationFieldOverrides["publisherName"] = "publisherName.keyword"
+	_, _, err = executeSearchWithRetry("dataset", "", func() gin.H {
+		return filtersRequest(filter, 10)
+	})
+	assert.ErrorIs(t, err, errElasticResponse)
+	assert.NotErrorIs(t, err, errSearchRetriesExhausted)
+	assert.EqualValues(t, 3, requests)
+}
+
+func TestDatasetSearchRetryExhausted(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusBadRequest, fielddataErrorResponse
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query": "asthma",
+		"aggs":  []gin.H{{"type": "dataset", "keys": "publisherName"}},
+	})
+	EntitySearch("dataset")(c)
+
+	assert.EqualValues(t, http.StatusBadGateway, w.Code)
+}
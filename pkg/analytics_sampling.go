@@ -0,0 +1,38 @@
+package search
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"strings"
+)
+
+// analyticsSampled reports whether the search analytics of the query should be
+// uploaded.  SEARCH_ANALYTICS_SAMPLE_PERCENT (default 100) of searches with a
+// query string are recorded, and SEARCH_ANALYTICS_EMPTY_QUERY_SAMPLE_PERCENT
+// (default the same) of browses with an empty query string.
+// The decision is made from the request ID, so that a sampled generic search is
+// recorded for every entity type or none of them.
+func analyticsSampled(query Query) bool {
+	percent := envInt("SEARCH_ANALYTICS_SAMPLE_PERCENT", 100)
+	if strings.TrimSpace(query.QueryString) == "" {
+		percent = envInt("SEARCH_ANALYTICS_EMPTY_QUERY_SAMPLE_PERCENT", percent)
+	}
+	if percent >= 100 {
+		return true
+	}
+	if percent <= 0 {
+		return false
+	}
+	return sampleBucket(query.RequestID) < percent
+}
+
+// sampleBucket assigns the request ID to one of 100 buckets.  Requests without
+// an ID are assigned a bucket at random.
+func sampleBucket(requestID string) int {
+	if requestID == "" {
+		return rand.IntN(100)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(requestID))
+	return int(hash.Sum32() % 100)
+}
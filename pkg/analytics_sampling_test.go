@@ -0,0 +1,41 @@
+package search
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyticsSampled(t *testing.T) {
+	assert.True(t, analyticsSampled(Query{QueryString: "asthma", RequestID: "a"}))
+
+	t.Setenv("SEARCH_ANALYTICS_SAMPLE_PERCENT", "0")
+	assert.False(t, analyticsSampled(Query{QueryString: "asthma", RequestID: "a"}))
+	assert.False(t, analyticsSampled(Query{RequestID: "a"}))
+
+	t.Setenv("SEARCH_ANALYTICS_SAMPLE_PERCENT", "100")
+	t.Setenv("SEARCH_ANALYTICS_EMPTY_QUERY_SAMPLE_PERCENT", "10")
+	sampled := 0
+	for i := range 1000 {
+		requestID := fmt.Sprintf("request-%d", i)
+		assert.True(t, analyticsSampled(Query{QueryString: "asthma", RequestID: requestID}))
+
+		query := Query{QueryString: " ", RequestID: requestID}
+		if analyticsSampled(query) {
+			sampled++
+		}
+		// the same request is always sampled the same way
+		assert.EqualValues(t, analyticsSampled(query), analyticsSampled(query))
+	}
+	assert.InDelta(t, 100, sampled, 40)
+}
+
+func TestSampleBucket(t *testing.T) {
+	assert.EqualValues(t, sampleBucket("request-1"), sampleBucket("request-1"))
+	for _, requestID := range []string{"", "a", "5b0f7c5e-2d1a-4c3b-9e8f-1a2b3c4d5e6f"} {
+		bucket := sampleBucket(requestID)
+		assert.GreaterOrEqual(t, bucket, 0)
+		assert.Less(t, bucket, 100)
+	}
+}
@@ -0,0 +1,100 @@
+package search
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// builtinAnalyzers are the analyzers built in to elastic that are available
+// on every index.
+var builtinAnalyzers = []string{
+	"standard",
+	"simple",
+	"whitespace",
+	"stop",
+	"english",
+	"french",
+	"german",
+	"italian",
+	"spanish",
+	"portuguese",
+	"dutch",
+}
+
+// entityAnalyzers lists, per entity type, the custom analyzers defined in the
+// settings of its index, see DefineDatasetMappings.
+var entityAnalyzers = map[string][]string{
+	"dataset": {"medterms_search_analyzer"},
+}
+
+// defaultEntityAnalyzers sets the analyzer used to search each entity type
+// when the query does not choose one.  Entity types not listed use the
+// analyzer of the fields searched.
+var defaultEntityAnalyzers = map[string]string{
+	"dataset": "medterms_search_analyzer",
+}
+
+// knownAnalyzers returns the analyzers a query may request: the built in
+// analyzers, the custom analyzers of each entity type and any further
+// analyzers configured on the indices, given as a comma separated list in
+// SEARCH_ANALYZERS.
+func knownAnalyzers() []string {
+	known := slices.Clone(builtinAnalyzers)
+	for _, analyzers := range entityAnalyzers {
+		known = append(known, analyzers...)
+	}
+	for _, analyzer := range strings.Split(os.Getenv("SEARCH_ANALYZERS"), ",") {
+		if analyzer = strings.TrimSpace(analyzer); analyzer != "" {
+			known = append(known, analyzer)
+		}
+	}
+	return known
+}
+
+// validateAnalyzer checks that the analyzer requested by the query, if any,
+// is one elastic is known to have.
+func validateAnalyzer(query Query) error {
+	if query.Analyzer == "" || slices.Contains(knownAnalyzers(), query.Analyzer) {
+		return nil
+	}
+	return fmt.Errorf("analyzer %s is not a known analyzer", query.Analyzer)
+}
+
+// searchAnalyzer returns the analyzer to search the entity type with.  This is
+// the analyzer requested by the query unless it is a custom analyzer of
+// another entity type's index, in which case the entity type's default is used.
+func searchAnalyzer(query Query, entityType string) string {
+	if query.Analyzer == "" {
+		return defaultEntityAnalyzers[entityType]
+	}
+	for otherType, analyzers := range entityAnalyzers {
+		if otherType != entityType && slices.Contains(analyzers, query.Analyzer) &&
+			!slices.Contains(entityAnalyzers[entityType], query.Analyzer) {
+			slog.Debug("Analyzer is not defined, using the default", "analyzer", query.Analyzer, "entityType", entityType)
+			return defaultEntityAnalyzers[entityType]
+		}
+	}
+	return query.Analyzer
+}
+
+// applyAnalyzer sets the analyzer of each multi_match and simple_query_string
+// clause of the main query, leaving them unchanged if analyzer is empty.
+func applyAnalyzer(mainQuery gin.H, analyzer string) {
+	if analyzer == "" {
+		return
+	}
+	should, _ := mainQuery["bool"].(gin.H)["should"].([]gin.H)
+	for _, clause := range should {
+		if multiMatch, ok := clause["multi_match"].(gin.H); ok {
+			multiMatch["analyzer"] = analyzer
+		}
+		if simpleQuery, ok := clause["simple_query_string"].(gin.H); ok {
+			simpleQuery["analyzer"] = analyzer
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func shouldAnalyzers(config gin.H) []interface{} {
+	analyzers := []interface{}{}
+	should := config["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	for _, clause := range should {
+		if multiMatch, ok := clause["multi_match"].(gin.H); ok {
+			analyzers = append(analyzers, multiMatch["analyzer"])
+		}
+	}
+	return analyzers
+}
+
+func TestDefaultAnalyzers(t *testing.T) {
+	TestQuery := Query{QueryString: "asthma"}
+
+	for _, analyzer := range shouldAnalyzers(entityQuery("dataset", TestQuery)) {
+		assert.EqualValues(t, "medterms_search_analyzer", analyzer)
+	}
+	for _, analyzer := range shouldAnalyzers(entityQuery("tool", TestQuery)) {
+		assert.Nil(t, analyzer)
+	}
+}
+
+func TestRequestedAnalyzer(t *testing.T) {
+	TestQuery := Query{QueryString: "asthme", Analyzer: "french"}
+	assert.Nil(t, validateQuery(TestQuery))
+
+	for _, analyzer := range shouldAnalyzers(entityQuery("dataset", TestQuery)) {
+		assert.EqualValues(t, "french", analyzer)
+	}
+	for _, analyzer := range shouldAnalyzers(entityQuery("collection", TestQuery)) {
+		assert.EqualValues(t, "french", analyzer)
+	}
+
+	// custom analyzers are only used for the entity types whose index has them
+	TestQuery.Analyzer = "medterms_search_analyzer"
+	assert.Nil(t, validateQuery(TestQuery))
+	assert.EqualValues(t, "medterms_search_analyzer", searchAnalyzer(TestQuery, "dataset"))
+	assert.EqualValues(t, "", searchAnalyzer(TestQuery, "tool"))
+}
+
+func TestValidateAnalyzer(t *testing.T) {
+	err := validateQuery(Query{QueryString: "asthma", Analyzer: "klingon"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "analyzer klingon is not a known analyzer")
+
+	t.Setenv("SEARCH_ANALYZERS", "welsh_analyzer, klingon")
+	assert.Nil(t, validateQuery(Query{QueryString: "asthma", Analyzer: "klingon"}))
+}
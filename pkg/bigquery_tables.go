@@ -0,0 +1,66 @@
+package search
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// BigQueryTables names the BigQuery tables the service writes to.  Search
+// analytics are uploaded by the service to AnalyticsTable in Dataset, with the
+// schema searchAnalyticsSchema, while search explanations are written by the
+// search explanation extractor to the table named by ExplanationTable.
+type BigQueryTables struct {
+	Dataset          string
+	AnalyticsTable   string
+	ExplanationTable string
+	// ExplanationTables overrides ExplanationTable for the entity types it
+	// names, by their SettingName, e.g. "dur".
+	ExplanationTables map[string]string
+}
+
+// bigQueryTables returns the BigQuery tables set by BQ_DATASET_NAME,
+// BQ_TABLE_NAME, SEARCH_EXPLANATION_TABLE and SEARCH_EXPLANATION_TABLE_<TYPE>,
+// e.g. SEARCH_EXPLANATION_TABLE_TOOL, where <TYPE> is the SettingName of the
+// entity type.
+func bigQueryTables() BigQueryTables {
+	tables := BigQueryTables{
+		Dataset:           os.Getenv("BQ_DATASET_NAME"),
+		AnalyticsTable:    os.Getenv("BQ_TABLE_NAME"),
+		ExplanationTable:  os.Getenv("SEARCH_EXPLANATION_TABLE"),
+		ExplanationTables: make(map[string]string),
+	}
+	for _, config := range entities {
+		if table := os.Getenv("SEARCH_EXPLANATION_TABLE_" + strings.ToUpper(config.SettingName)); table != "" {
+			tables.ExplanationTables[config.SettingName] = table
+		}
+	}
+	return tables
+}
+
+// analytics returns the search analytics table of the client.
+func (t BigQueryTables) analytics(client *bigquery.Client) *bigquery.Table {
+	return client.Dataset(t.Dataset).Table(t.AnalyticsTable)
+}
+
+// explanation returns the table the extractor should write explanations of
+// searches of the entity type, named by its SettingName, to.  This is the table set for the entity type,
+// if any, otherwise ExplanationTable for datasets and ExplanationTable
+// suffixed with the entity type for anything else.
+func (t BigQueryTables) explanation(entityType string) string {
+	if table, ok := t.ExplanationTables[entityType]; ok {
+		return table
+	}
+	if entityType == "dataset" {
+		return t.ExplanationTable
+	}
+	return fmt.Sprintf("%s_%s", t.ExplanationTable, entityType)
+}
+
+// explanationTable returns the table explanations of searches of the entity
+// type are written to, see BigQueryTables.explanation.
+func explanationTable(entityType string) string {
+	return bigQueryTables().explanation(entityType)
+}
@@ -0,0 +1,108 @@
+package search
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+
+	defaultEPMCBreakerThreshold = 5
+	defaultEPMCBreakerCooldown  = 30 * time.Second
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker stops calls to a failing dependency once it has failed
+// threshold times in a row.  While open, calls are refused immediately until
+// cooldown has passed, after which a single call is let through as a probe:
+// if it succeeds the breaker closes again, otherwise it reopens.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		state:     circuitClosed,
+	}
+}
+
+// epmcBreaker guards the calls made to the EuropePMC API.  It is configured
+// from EPMC_BREAKER_THRESHOLD and EPMC_BREAKER_COOLDOWN_SECONDS in
+// DefineElasticClient.
+var epmcBreaker = newCircuitBreaker("EPMC", defaultEPMCBreakerThreshold, defaultEPMCBreakerCooldown)
+
+// allow reports whether a call should be made.  Once the cooldown of an open
+// breaker has passed the first caller is allowed through as the probe, with
+// everyone else refused until the probe reports back.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		slog.Info("Circuit breaker half-open, probing", "breaker", b.name)
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// recordSuccess closes the breaker and resets the failure count.
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != circuitClosed {
+		slog.Info("Circuit breaker closed", "breaker", b.name)
+	}
+	b.state = circuitClosed
+	b.failures = 0
+}
+
+// recordFailure counts a failed call, opening the breaker if the threshold of
+// consecutive failures is reached or the half-open probe failed.
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state != circuitOpen {
+			slog.Warn("Circuit breaker open", "breaker", b.name, "failures", b.failures)
+		}
+		b.state = circuitOpen
+		b.openedAt = b.now()
+	}
+}
+
+// State returns the current state of the breaker: closed, open or half-open.
+func (b *circuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
@@ -0,0 +1,44 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker("test", 2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	assert.True(t, breaker.allow())
+	breaker.recordFailure()
+	assert.EqualValues(t, circuitClosed, breaker.State())
+
+	// a success resets the count of consecutive failures
+	breaker.recordSuccess()
+	breaker.recordFailure()
+	assert.EqualValues(t, circuitClosed, breaker.State())
+
+	breaker.recordFailure()
+	assert.EqualValues(t, circuitOpen, breaker.State())
+	assert.False(t, breaker.allow())
+
+	// after the cooldown a single probe is let through
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	assert.EqualValues(t, circuitHalfOpen, breaker.State())
+	assert.False(t, breaker.allow())
+
+	// a failed probe reopens the breaker for another cooldown
+	breaker.recordFailure()
+	assert.EqualValues(t, circuitOpen, breaker.State())
+	assert.False(t, breaker.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, breaker.allow())
+	breaker.recordSuccess()
+	assert.EqualValues(t, circuitClosed, breaker.State())
+	assert.True(t, breaker.allow())
+}
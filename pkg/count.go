@@ -0,0 +1,117 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CountQuery represents a request for the number of results of a search of
+// each of the given entity types.  It accepts the same body as the generic
+// search plus the entity types to count, defaulting to all of them.
+type CountQuery struct {
+	Query
+	Types []string `json:"types"`
+}
+
+// Count performs searches of the requested entity types returning no hits,
+// aggregations or highlights, and responds with the total number of results
+// of each, e.g. {"dataset": 120, "tool": 4}.
+func Count(c *gin.Context) {
+	var query CountQuery
+	if err := c.BindJSON(&query); err != nil {
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret count query", "error", err.Error())
+		return
+	}
+	query.RequestID = requestIDFrom(c)
+	if err := validateQuery(query.Query); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return
+	}
+	query.Filters = mergeSharedFilters(normaliseFilterEntityTypes(query.Filters))
+
+	types := query.Types
+	if len(types) == 0 {
+		types = entityTypes()
+	}
+	for _, entityType := range types {
+		if _, ok := entityConfig(entityType); !ok {
+			c.JSON(http.StatusBadRequest, errorBody(
+				c, fmt.Sprintf("Counts of type %s are not supported", entityType),
+			))
+			return
+		}
+	}
+
+	counts, err := defaultService().count(c.Request.Context(), types, withoutStopPhrases(query.Query))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorBody(c, "Count failed"))
+		return
+	}
+	c.JSON(http.StatusOK, counts)
+}
+
+// entityCount is the total number of results of the search of one entity
+// type in a count.
+type entityCount struct {
+	entity string
+	total  int
+	err    error
+}
+
+// count searches the indices of the entity types concurrently and returns the
+// total number of results of each, keyed by entity type.  The searches still
+// running are cancelled as soon as one fails or ctx is done.
+func (s *SearchService) count(ctx context.Context, types []string, query Query) (map[string]int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	query.Aggregations = nil
+	query.Highlight.Fields = &[]string{}
+	query.ReturnQuery = false
+
+	counts := make(chan entityCount, len(types))
+	for _, entityType := range types {
+		go func() {
+			config, _ := entityConfig(entityType)
+			total, err := s.countEntity(ctx, config, query)
+			counts <- entityCount{entity: config.Name, total: total, err: err}
+		}()
+	}
+
+	results := make(map[string]int, len(types))
+	for range types {
+		select {
+		case result := <-counts:
+			if result.err != nil {
+				return nil, result.err
+			}
+			results[result.entity] = result.total
+		case <-ctx.Done():
+			query.logger().Debug("Count cancelled", "error", ctx.Err().Error())
+			return nil, ctx.Err()
+		}
+	}
+	return results, nil
+}
+
+// countEntity runs the search query of the entity type without returning any
+// hits and returns its exact total number of results.
+func (s *SearchService) countEntity(ctx context.Context, config EntityConfig, query Query) (int, error) {
+	elasticQuery := withoutHits(config.ElasticConfig(query))
+	delete(elasticQuery, "aggs")
+	elasticQuery["track_total_hits"] = true
+
+	elasticResp, body, err := s.executeElasticQueryContext(ctx, config.Index, query.RequestID, elasticQuery)
+	if err != nil {
+		return 0, err
+	}
+	if isElasticError(body) {
+		logElasticError(body, config.Index, query.RequestID)
+		return 0, fmt.Errorf("count of %s failed", config.Name)
+	}
+	total, _ := elasticResp.Hits.Total["value"].(float64)
+	return int(total), nil
+}
@@ -0,0 +1,78 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCount(t *testing.T) {
+	var mu sync.Mutex
+	elasticQueries := make(map[string]map[string]interface{})
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		index := strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]
+		var elasticQuery map[string]interface{}
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &elasticQuery)
+		mu.Lock()
+		elasticQueries[index] = elasticQuery
+		mu.Unlock()
+		if index == "dataset" {
+			return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 12345, "relation": "eq"}}}`
+		}
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 4, "relation": "eq"}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query": "asthma",
+		"types": []string{"dataset", "dataUseRegister"},
+		"aggs":  []gin.H{{"type": "dataset", "keys": "publisherName"}},
+	})
+
+	Count(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var response map[string]int
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.EqualValues(t, map[string]int{"dataset": 12345, "dataUseRegister": 4}, response)
+
+	assert.Len(t, elasticQueries, 2)
+	for _, elasticQuery := range elasticQueries {
+		assert.EqualValues(t, 0, elasticQuery["size"])
+		assert.EqualValues(t, true, elasticQuery["track_total_hits"])
+		assert.NotContains(t, elasticQuery, "aggs")
+		assert.NotContains(t, elasticQuery, "highlight")
+		assert.NotContains(t, elasticQuery, "explain")
+	}
+}
+
+func TestCountUnsupported(t *testing.T) {
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "asthma", "types": []string{"dataset", "unknown"}})
+
+	Count(c)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+}
+
+func TestCountCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := defaultService().count(ctx, entityTypes(), Query{QueryString: "asthma"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
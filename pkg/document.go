@@ -0,0 +1,99 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DocumentRequest identifies a single document to fetch with GetByID.
+type DocumentRequest struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// GetDocumentResponse is the response elastic returns from a get request.
+type GetDocumentResponse struct {
+	Index  string                 `json:"_index"`
+	Id     string                 `json:"_id"`
+	Found  bool                   `json:"found"`
+	Source map[string]interface{} `json:"_source"`
+}
+
+// GetByID fetches a single document by its ID from the index of the requested
+// entity type, e.g.
+//
+//	{"type": "dataset", "id": "123"}
+//
+// and returns its _source, or 404 if there is no such document.  Entity types
+// are named as in the search results, with paper accepted for publication.
+func GetByID(c *gin.Context) {
+	var request DocumentRequest
+	if err := c.BindJSON(&request); err != nil {
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret document request", "error", err.Error())
+		return
+	}
+
+	entityType := canonicalEntityType(request.Type)
+	if !slices.Contains(entityTypes(), entityType) {
+		c.JSON(http.StatusBadRequest, errorBody(
+			c, fmt.Sprintf("Documents of type %s are not supported", request.Type),
+		))
+		return
+	}
+	if err := validateIDs(Query{IDs: []string{request.ID}}); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return
+	}
+
+	document, err := getDocument(entityIndex(entityType), request.ID, requestIDFrom(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+		return
+	}
+	if !document.Found {
+		c.JSON(http.StatusNotFound, errorBody(
+			c, fmt.Sprintf("No %s found with id %s", entityType, request.ID),
+		))
+		return
+	}
+
+	c.JSON(http.StatusOK, document.Source)
+}
+
+// getDocument fetches the document with the given ID from the index.  A
+// document that does not exist is returned with Found false rather than as an
+// error.
+func (s *SearchService) getDocument(index string, id string, requestID string) (GetDocumentResponse, error) {
+	var document GetDocumentResponse
+
+	response, err := s.Elastic.Get(indexName(index), id, s.Elastic.Get.WithOpaqueID(requestID))
+	if err != nil {
+		requestLogger(requestID).Debug("Failed to get document", "id", id, "index", index, "error", err.Error())
+		return document, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		requestLogger(requestID).Debug("Failed to read elastic response", "error", err.Error())
+		return document, err
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		return document, nil
+	}
+	if response.IsError() {
+		requestLogger(requestID).Warn("Failed to get document", "id", id, "index", index, "response", string(body))
+		return document, fmt.Errorf("elastic returned status %d", response.StatusCode)
+	}
+
+	if err := json.Unmarshal(body, &document); err != nil {
+		return document, err
+	}
+	return document, nil
+}
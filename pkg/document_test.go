@@ -0,0 +1,61 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetByID(t *testing.T) {
+	var paths []string
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		paths = append(paths, req.Method+" "+req.URL.Path)
+		if req.URL.Path == "/publication/_doc/404" {
+			return http.StatusNotFound, `{"_index": "publication", "_id": "404", "found": false}`
+		}
+		return http.StatusOK, `{"_index": "datauseregister", "_id": "123", "found": true, "_source": {"projectTitle": "A project"}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"type": "dataUseRegister", "id": "123"})
+
+	GetByID(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var source map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &source)
+	assert.EqualValues(t, map[string]interface{}{"projectTitle": "A project"}, source)
+
+	w = httptest.NewRecorder()
+	c = GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"type": "paper", "id": "404"})
+
+	GetByID(c)
+
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+	assert.EqualValues(t, []string{"GET /datauseregister/_doc/123", "GET /publication/_doc/404"}, paths)
+}
+
+func TestGetByIDRejectsInvalidRequests(t *testing.T) {
+	for _, body := range []gin.H{
+		{"type": "unknown", "id": "123"},
+		{"type": "dataset", "id": "../_search"},
+		{"type": "dataset"},
+	} {
+		w := httptest.NewRecorder()
+		c := GetTestGinContext(w)
+		MockPostWithBody(c, body)
+
+		GetByID(c)
+
+		assert.EqualValues(t, http.StatusBadRequest, w.Code, "request %v", body)
+	}
+}
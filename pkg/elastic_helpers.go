@@ -0,0 +1,434 @@
+package search
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultMaxConcurrentQueries bounds the elastic searches run at once across
+// all requests, see elasticQuerySlots.
+const defaultMaxConcurrentQueries = 50
+
+// elasticQuerySlots bounds the number of elastic searches in flight across all
+// requests to SEARCH_MAX_CONCURRENT_QUERIES, so that a burst of generic
+// searches, each searching every index at once, queues in the service rather
+// than overloading the cluster.  nil leaves the searches unbounded.
+var elasticQuerySlots chan struct{}
+
+// elasticQueriesInFlight and elasticQueriesQueued count the elastic searches
+// running and waiting for a slot, reported by HealthCheck.
+var (
+	elasticQueriesInFlight atomic.Int64
+	elasticQueriesQueued   atomic.Int64
+)
+
+// newElasticQuerySlots returns the slots bounding concurrent elastic searches,
+// or nil if SEARCH_MAX_CONCURRENT_QUERIES is 0 or less.
+func newElasticQuerySlots() chan struct{} {
+	limit := envInt("SEARCH_MAX_CONCURRENT_QUERIES", defaultMaxConcurrentQueries)
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+// acquireElasticQuerySlot waits for a slot to run an elastic search in,
+// giving up if ctx is done first.  The returned func releases the slot.
+func acquireElasticQuerySlot(ctx context.Context) (func(), error) {
+	slots := elasticQuerySlots
+	if slots != nil {
+		elasticQueriesQueued.Add(1)
+		select {
+		case slots <- struct{}{}:
+			elasticQueriesQueued.Add(-1)
+		case <-ctx.Done():
+			elasticQueriesQueued.Add(-1)
+			return nil, ctx.Err()
+		}
+	}
+	elasticQueriesInFlight.Add(1)
+	return func() {
+		elasticQueriesInFlight.Add(-1)
+		if slots != nil {
+			<-slots
+		}
+	}, nil
+}
+
+// errElasticResponse is returned, wrapped with the status, by
+// executeElasticQuery when elastic responds with an error status, so that a
+// rejected or failed query is not taken for one without results.
+var errElasticResponse = errors.New("elastic returned an error")
+
+// executeElasticQuery runs the given query body against the named elastic
+// index.  It returns the decoded response along with the raw response body so
+// that callers can inspect any error returned by elastic, which is also
+// reported as errElasticResponse.
+func (s *SearchService) executeElasticQuery(index string, requestID string, elasticQuery gin.H) (SearchResponse, []byte, error) {
+	return s.executeElasticQueryContext(context.Background(), index, requestID, elasticQuery)
+}
+
+// executeElasticQueryContext is executeElasticQuery abandoning the query once
+// ctx is done.
+func (s *SearchService) executeElasticQueryContext(ctx context.Context, index string, requestID string, elasticQuery gin.H) (SearchResponse, []byte, error) {
+	var buf bytes.Buffer
+	var elasticResp SearchResponse
+
+	if _, ok := elasticQuery["track_total_hits"]; !ok {
+		if track := trackTotalHits(); track != nil {
+			elasticQuery["track_total_hits"] = track
+		}
+	}
+	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
+		requestLogger(requestID).Debug(
+			"Failed to encode elastic query",
+			"query", elasticQuery,
+			"error", err.Error(),
+		)
+		return elasticResp, nil, err
+	}
+
+	release, err := acquireElasticQuerySlot(ctx)
+	if err != nil {
+		requestLogger(requestID).Debug("Gave up waiting to execute elastic query", "error", err.Error())
+		return elasticResp, nil, err
+	}
+	defer release()
+
+	response, err := s.Elastic.Search(
+		s.Elastic.Search.WithContext(ctx),
+		s.Elastic.Search.WithIndex(indexName(index)),
+		s.Elastic.Search.WithBody(&buf),
+		s.Elastic.Search.WithOpaqueID(requestID),
+	)
+	if err != nil {
+		requestLogger(requestID).Debug("Failed to execute elastic query", "error", err.Error())
+		return elasticResp, nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		requestLogger(requestID).Debug("Failed to read elastic response", "error", err.Error())
+		return elasticResp, body, err
+	}
+
+	json.Unmarshal(body, &elasticResp)
+	if response.IsError() {
+		return elasticResp, body, fmt.Errorf("%w: %s from %s", errElasticResponse, response.Status(), index)
+	}
+
+	return elasticResp, body, nil
+}
+
+// trackTotalHits returns the track_total_hits setting of the elastic queries,
+// from SEARCH_TRACK_TOTAL_HITS.  "true" counts every hit exactly, at some cost
+// to performance, while a number counts hits exactly up to that number.  When
+// unset, or invalid, elastic's default of counting up to 10,000 is used.
+func trackTotalHits() interface{} {
+	value := os.Getenv("SEARCH_TRACK_TOTAL_HITS")
+	if track, err := strconv.Atoi(value); err == nil {
+		return track
+	}
+	if track, err := strconv.ParseBool(value); err == nil {
+		return track
+	}
+	return nil
+}
+
+// isElasticError reports whether body is an elastic error response rather
+// than search results.
+func isElasticError(body []byte) bool {
+	var elasticError SearchErrorResponse
+	json.Unmarshal(body, &elasticError)
+	return elasticError.Status >= 400 || len(elasticError.Error) > 0
+}
+
+// logElasticError logs a warning for a search of index that returned null hits.
+// When there are genuinely no matches elastic returns hits == [], so null hits
+// imply something has actually gone wrong, for example an aggregation that
+// cannot be calculated.  The root cause of the error is logged and returned if
+// elastic gave one in the response body, otherwise a generic warning is logged
+// and the returned RootCause is empty.
+func logElasticError(body []byte, index string, requestID string) RootCause {
+	var elasticError SearchErrorResponse
+	json.Unmarshal(body, &elasticError)
+
+	var rootCause RootCause
+	if causes := elasticError.Error["root_cause"]; len(causes) > 0 {
+		rootCause = causes[0]
+	}
+
+	if rootCause.Reason != "" {
+		requestLogger(requestID).Warn(
+			"Search query returned elastic error",
+			"index", index,
+			"type", rootCause.Type,
+			"reason", rootCause.Reason,
+		)
+	} else {
+		requestLogger(requestID).Warn("Hits from elastic are null, query may be malformed", "index", index)
+	}
+	return rootCause
+}
+
+// idOrderSort returns the sort that orders hits by their position in ids,
+// placing any hits not in ids after them, with relevance as a tiebreaker.
+func idOrderSort(ids []string) []gin.H {
+	return []gin.H{
+		{
+			"_script": gin.H{
+				"type": "number",
+				"script": gin.H{
+					"lang": "painless",
+					"source": "int i = params.order.indexOf(doc['_id'].value); " +
+						"return i < 0 ? params.order.size() : i;",
+					"params": gin.H{
+						"order": ids,
+					},
+				},
+				"order": "asc",
+			},
+		},
+		{"_score": "desc"},
+	}
+}
+
+// withPatternQueries combines the main query of a search with the prefix and
+// wildcard queries requested, so that only documents matching both are
+// returned.  The main query is returned unchanged if there are none.
+func withPatternQueries(mainQuery gin.H, query Query) gin.H {
+	patternQueries := []gin.H{}
+	for _, field := range slices.Sorted(maps.Keys(query.Prefix)) {
+		patternQueries = append(patternQueries, gin.H{
+			"prefix": gin.H{
+				field: gin.H{"value": query.Prefix[field], "case_insensitive": true},
+			},
+		})
+	}
+	for _, field := range slices.Sorted(maps.Keys(query.Wildcard)) {
+		patternQueries = append(patternQueries, gin.H{
+			"wildcard": gin.H{
+				field: gin.H{"value": query.Wildcard[field], "case_insensitive": true},
+			},
+		})
+	}
+	if len(patternQueries) == 0 {
+		return mainQuery
+	}
+	return gin.H{
+		"bool": gin.H{
+			"must": append([]gin.H{mainQuery}, patternQueries...),
+		},
+	}
+}
+
+// withRecencyBoost returns the main query wrapped in a function_score adding a
+// decay function over the date field to the score of each hit, so that recent
+// entities rank higher when otherwise similarly relevant, see
+// RecencyBoostOptions.  The main query is returned unchanged if the query does
+// not ask for the boost or the entity type has no date field to decay over.
+func withRecencyBoost(mainQuery gin.H, query Query, field string) gin.H {
+	if query.RecencyBoost == nil || field == "" {
+		return mainQuery
+	}
+	options := *query.RecencyBoost
+	if options.Function == "" {
+		options.Function = defaultRecencyFunction
+	}
+	if options.Scale == "" {
+		options.Scale = cmp.Or(os.Getenv("SEARCH_RECENCY_SCALE"), defaultRecencyScale)
+	}
+	if options.Offset == "" {
+		options.Offset = cmp.Or(os.Getenv("SEARCH_RECENCY_OFFSET"), defaultRecencyOffset)
+	}
+	if options.Decay == 0 {
+		options.Decay = defaultRecencyDecay
+	}
+	if options.Weight == 0 {
+		options.Weight = defaultRecencyWeight
+	}
+	return gin.H{
+		"function_score": gin.H{
+			"query": mainQuery,
+			"functions": []gin.H{
+				{
+					options.Function: gin.H{
+						field: gin.H{
+							"origin": "now",
+							"scale":  options.Scale,
+							"offset": options.Offset,
+							"decay":  options.Decay,
+						},
+					},
+					"weight": options.Weight,
+				},
+			},
+			"score_mode": "sum",
+			"boost_mode": "sum",
+		},
+	}
+}
+
+// randomScore returns the random_score function shuffling the hits of searches
+// without a query string.  The hits are shuffled anew on every search unless
+// the query gives a seed, with which the order is stable so that paging
+// through the hits with the same seed neither repeats nor skips any.
+func randomScore(query Query) gin.H {
+	if query.Seed == nil {
+		return gin.H{}
+	}
+	return gin.H{"seed": *query.Seed, "field": "_seq_no"}
+}
+
+// randomOrder reports whether the hits of the query are returned in the random
+// order of searches without a query string, rather than sorted.
+func randomOrder(query Query) bool {
+	return query.QueryString == "" && len(query.IDs) == 0 &&
+		(query.EmptyQueryOrder == "" || query.EmptyQueryOrder == emptyQueryOrderRandom)
+}
+
+// withSeed returns the query with a newly generated seed if its hits are
+// returned in a random order and it does not already give one.  The seed is
+// returned with the results so that the next page can be requested with it.
+func withSeed(query Query) Query {
+	if randomOrder(query) && query.Seed == nil {
+		seed := rand.IntN(math.MaxInt32)
+		query.Seed = &seed
+	}
+	return query
+}
+
+// emptyQuerySort returns the sort of the hits of a search of the entity type
+// without a query string for the query's emptyQueryOrder, or nil to keep the
+// random order.  "alphabetical" sorts on the entity type's SortField and
+// "recent" on its RecencyField, newest first, falling back to alphabetical
+// for entity types without one.
+func emptyQuerySort(query Query, entityType string) []gin.H {
+	if query.QueryString != "" {
+		return nil
+	}
+	config, _ := entityConfig(entityType)
+	alphabetical := []gin.H{{config.SortField: gin.H{"order": "asc", "missing": "_last"}}}
+	switch query.EmptyQueryOrder {
+	case emptyQueryOrderAlphabetical:
+		return alphabetical
+	case emptyQueryOrderRecent:
+		if config.RecencyField == "" {
+			return alphabetical
+		}
+		return append(
+			[]gin.H{{config.RecencyField: gin.H{"order": "desc", "missing": "_last"}}},
+			alphabetical...,
+		)
+	}
+	return nil
+}
+
+// excludeIDs wraps the main query of a search so that the documents with the
+// given IDs are never matched, leaving it unchanged if there are none.
+func excludeIDs(mainQuery gin.H, ids []string) gin.H {
+	if len(ids) == 0 {
+		return mainQuery
+	}
+	return gin.H{
+		"bool": gin.H{
+			"must": mainQuery,
+			"must_not": []gin.H{
+				{"terms": gin.H{"_id": ids}},
+			},
+		},
+	}
+}
+
+// withFiltersInQuery moves the filters of a search from its post_filter into a
+// filter on the main query, so that they restrict the hits before scoring,
+// min_score and aggregation rather than only the hits returned.
+func withFiltersInQuery(elasticQuery gin.H, mustFilters []gin.H) gin.H {
+	delete(elasticQuery, "post_filter")
+	if len(mustFilters) == 0 {
+		return elasticQuery
+	}
+	elasticQuery["query"] = gin.H{
+		"bool": gin.H{
+			"must":   elasticQuery["query"],
+			"filter": mustFilters,
+		},
+	}
+	return elasticQuery
+}
+
+// cursorTiebreak is appended to the sort of cursor paginated queries so that
+// every hit has a unique set of sort values to resume from.
+var cursorTiebreak = gin.H{"_id": "asc"}
+
+// withSearchAfter sets up the given elastic query for cursor pagination
+// using search_after, resuming after the given cursor.  An empty cursor
+// requests the first page.
+// search_after requires a deterministic sort, so results are sorted by
+// relevance with the document id as a tiebreak, unless the query already
+// defines a sort in which case the tiebreak is added to the end of it.
+func withSearchAfter(elasticQuery gin.H, cursor []interface{}) gin.H {
+	sortQuery, ok := elasticQuery["sort"].([]gin.H)
+	if !ok || len(sortQuery) == 0 {
+		sortQuery = []gin.H{{"_score": "desc"}}
+	}
+	elasticQuery["sort"] = append(sortQuery, cursorTiebreak)
+
+	if len(cursor) > 0 {
+		elasticQuery["search_after"] = cursor
+	}
+
+	return elasticQuery
+}
+
+// collapsedInnerHits names the inner_hits holding the hits folded into each
+// hit by withCollapse.
+const collapsedInnerHits = "collapsed"
+
+// withCollapse collapses the hits of the elastic query on the query's
+// collapseField, if set, so that only the highest scoring hit of each value of
+// the field is returned.  Text fields are collapsed on their .keyword
+// sub-field.  The collapsed hits are returned as the inner_hits of the hit
+// kept if collapseInnerHits is set.  Collapsing does not change the
+// aggregations or hits.total, which still count every matching document.
+func withCollapse(elasticQuery gin.H, query Query, index string) gin.H {
+	if query.CollapseField == "" {
+		return elasticQuery
+	}
+
+	collapse := gin.H{"field": resolveAggregationField(index, query.CollapseField)}
+	if query.CollapseInnerHits > 0 {
+		collapse["inner_hits"] = gin.H{
+			"name": collapsedInnerHits,
+			"size": query.CollapseInnerHits,
+			"sort": []gin.H{{"_score": "desc"}},
+		}
+	}
+	elasticQuery["collapse"] = collapse
+	return elasticQuery
+}
+
+// nextCursor returns the cursor from which to request the page of results
+// following the given response, or nil if the response has no hits.
+func nextCursor(elasticResp SearchResponse) []interface{} {
+	hits := elasticResp.Hits.Hits
+	if len(hits) == 0 {
+		return nil
+	}
+	return hits[len(hits)-1].Sort
+}
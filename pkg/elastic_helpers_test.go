@@ -0,0 +1,375 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteElasticQuery(t *testing.T) {
+	elasticResp, body, err := executeElasticQuery("dataset", "", gin.H{"size": 1})
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, body)
+	assert.EqualValues(t, 3, elasticResp.Took)
+	assert.NotNil(t, elasticResp.Hits.Hits)
+}
+
+func TestElasticQuerySlots(t *testing.T) {
+	started := make(chan struct{}, 2)
+	finish := make(chan struct{})
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		started <- struct{}{}
+		<-finish
+		return http.StatusOK, `{"hits": {"hits": []}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	elasticQuerySlots = make(chan struct{}, 1)
+	defer func() { elasticQuerySlots = nil }()
+
+	done := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, _, err := executeElasticQuery("dataset", "", gin.H{"size": 1})
+			done <- err
+		}()
+	}
+
+	<-started
+	assert.Eventually(t, func() bool {
+		return elasticQueriesInFlight.Load() == 1 && elasticQueriesQueued.Load() == 1
+	}, time.Second, time.Millisecond)
+
+	// A query waiting for a slot gives up when its context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := defaultService().executeElasticQueryContext(ctx, "dataset", "", gin.H{"size": 1})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	close(finish)
+	assert.Nil(t, <-done)
+	assert.Nil(t, <-done)
+	assert.EqualValues(t, 0, elasticQueriesInFlight.Load())
+	assert.EqualValues(t, 0, elasticQueriesQueued.Load())
+}
+
+func TestNewElasticQuerySlots(t *testing.T) {
+	assert.EqualValues(t, defaultMaxConcurrentQueries, cap(newElasticQuerySlots()))
+
+	t.Setenv("SEARCH_MAX_CONCURRENT_QUERIES", "5")
+	assert.EqualValues(t, 5, cap(newElasticQuerySlots()))
+
+	t.Setenv("SEARCH_MAX_CONCURRENT_QUERIES", "0")
+	assert.Nil(t, newElasticQuerySlots())
+}
+
+func TestLogElasticError(t *testing.T) {
+	logs := captureLogs(t)
+
+	rootCause := logElasticError(nil, "tool", "")
+	assert.Empty(t, rootCause)
+	attrs, ok := logs.find("Hits from elastic are null, query may be malformed")
+	assert.True(t, ok)
+	assert.EqualValues(t, "tool", attrs["index"])
+
+	rootCause = logElasticError([]byte(`{
+		"error": {
+			"root_cause": [{"type": "illegal_argument_exception", "reason": "Fielddata is disabled"}],
+			"type": "search_phase_execution_exception",
+			"reason": "all shards failed"
+		},
+		"status": 400
+	}`), "dataset", "abc-123")
+	assert.EqualValues(t, "illegal_argument_exception", rootCause.Type)
+	assert.EqualValues(t, "Fielddata is disabled", rootCause.Reason)
+	attrs, ok = logs.find("Search query returned elastic error")
+	assert.True(t, ok)
+	assert.EqualValues(t, "dataset", attrs["index"])
+	assert.EqualValues(t, "Fielddata is disabled", attrs["reason"])
+	assert.EqualValues(t, "abc-123", attrs["request_id"])
+
+	rootCause = logElasticError([]byte(`{"error": {"root_cause": []}, "status": 500}`), "collection", "")
+	assert.Empty(t, rootCause)
+	assert.Len(t, *logs.records, 3)
+	assert.EqualValues(t, "Hits from elastic are null, query may be malformed", (*logs.records)[2].Message)
+}
+
+func TestWithSearchAfter(t *testing.T) {
+	firstPage := withSearchAfter(gin.H{"size": 10}, []interface{}{})
+	assert.EqualValues(t, []gin.H{{"_score": "desc"}, {"_id": "asc"}}, firstPage["sort"])
+	assert.NotContains(t, firstPage, "search_after")
+
+	cursor := []interface{}{1.5, "123"}
+	nextPage := withSearchAfter(gin.H{"size": 10}, cursor)
+	assert.EqualValues(t, cursor, nextPage["search_after"])
+
+	scriptSort := gin.H{"_script": gin.H{"type": "number"}}
+	sortedPage := withSearchAfter(gin.H{"sort": []gin.H{scriptSort}}, cursor)
+	assert.EqualValues(t, []gin.H{scriptSort, {"_id": "asc"}}, sortedPage["sort"])
+}
+
+func TestNextCursor(t *testing.T) {
+	assert.Nil(t, nextCursor(SearchResponse{}))
+
+	elasticResp := SearchResponse{
+		Hits: HitsField{
+			Hits: []Hit{
+				{Id: "1", Sort: []interface{}{3.2, "1"}},
+				{Id: "2", Sort: []interface{}{1.1, "2"}},
+			},
+		},
+	}
+	assert.EqualValues(t, []interface{}{1.1, "2"}, nextCursor(elasticResp))
+}
+
+func TestDatasetElasticConfigSearchAfter(t *testing.T) {
+	datasetConfig := entityQuery("dataset", Query{QueryString: "asthma"})
+	assert.NotContains(t, datasetConfig, "sort")
+
+	datasetConfig = entityQuery("dataset", Query{
+		QueryString: "asthma",
+		SearchAfter: []interface{}{2.4, "42"},
+	})
+	assert.Contains(t, datasetConfig, "sort")
+	assert.EqualValues(t, []interface{}{2.4, "42"}, datasetConfig["search_after"])
+}
+
+func TestIDOrderSortWithQueryString(t *testing.T) {
+	ids := []string{"3", "1", "2"}
+	for _, config := range []gin.H{
+		entityQuery("dataset", Query{QueryString: "asthma", IDs: ids}),
+		entityQuery("tool", Query{QueryString: "asthma", IDs: ids}),
+		entityQuery("publication", Query{QueryString: "asthma", IDs: ids}),
+		entityQuery("dataset", Query{IDs: ids}),
+	} {
+		sortQuery := config["sort"].([]gin.H)
+		assert.Len(t, sortQuery, 2)
+		script := sortQuery[0]["_script"].(gin.H)["script"].(gin.H)
+		assert.EqualValues(t, ids, script["params"].(gin.H)["order"])
+		assert.EqualValues(t, gin.H{"_score": "desc"}, sortQuery[1])
+	}
+
+	datasetConfig := entityQuery("dataset", Query{QueryString: "asthma", IDs: ids})
+	assert.Contains(t, datasetConfig["query"], "bool")
+}
+
+func TestExcludeIDs(t *testing.T) {
+	mainQuery := gin.H{"match_all": gin.H{}}
+	assert.EqualValues(t, mainQuery, excludeIDs(mainQuery, nil))
+
+	datasetConfig := entityQuery("dataset", Query{
+		IDs:        []string{"1", "2", "3"},
+		ExcludeIDs: []string{"2"},
+		Filters: map[string]map[string]interface{}{
+			"dataset": {"publisherName": []interface{}{"Publisher A"}},
+		},
+	})
+	boolQuery := datasetConfig["query"].(gin.H)["bool"].(gin.H)
+	assert.EqualValues(t, []gin.H{{"terms": gin.H{"_id": []string{"2"}}}}, boolQuery["must_not"])
+	assert.Contains(t, boolQuery["must"], "function_score")
+	assert.Contains(t, datasetConfig, "sort")
+	assert.Contains(t, datasetConfig, "post_filter")
+}
+
+func TestExcludedIDsNotInHits(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		var elasticQuery struct {
+			Query struct {
+				Bool struct {
+					MustNot []struct {
+						Terms struct {
+							Id []string `json:"_id"`
+						} `json:"terms"`
+					} `json:"must_not"`
+				} `json:"bool"`
+			} `json:"query"`
+		}
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &elasticQuery)
+
+		hits := []string{}
+		for _, id := range []string{"1", "2", "3", "4"} {
+			excluded := false
+			for _, mustNot := range elasticQuery.Query.Bool.MustNot {
+				excluded = excluded || slices.Contains(mustNot.Terms.Id, id)
+			}
+			if !excluded {
+				hits = append(hits, fmt.Sprintf(`{"_id": "%s", "_score": 1}`, id))
+			}
+		}
+		return http.StatusOK, fmt.Sprintf(`{"hits": {"hits": [%s]}}`, strings.Join(hits, ","))
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	results, _ := defaultService().Search("tool", Query{QueryString: "related", ExcludeIDs: []string{"1", "3"}})
+
+	ids := []string{}
+	for _, hit := range results.Hits.Hits {
+		ids = append(ids, hit.Id)
+	}
+	assert.EqualValues(t, []string{"2", "4"}, ids)
+}
+
+func TestMissingIDs(t *testing.T) {
+	hits := []Hit{{Id: "3"}, {Id: "1"}}
+
+	assert.EqualValues(t, []string{"2", "4"}, missingIDs([]string{"1", "2", "3", "4", "2"}, hits))
+	assert.EqualValues(t, []string{}, missingIDs([]string{"3", "1"}, hits))
+	assert.EqualValues(t, []string{"5"}, missingIDs([]string{"5"}, nil))
+}
+
+func TestSearchReportsMissingIDs(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusOK, `{"hits": {"hits": [{"_id": "12", "_score": 1}, {"_id": "10", "_score": 1}]}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	results, _ := defaultService().Search("tool", Query{IDs: []string{"12", "11", "10"}})
+	assert.EqualValues(t, []string{"11"}, results.MissingIDs)
+
+	results, _ = defaultService().Search("tool", Query{QueryString: "sequencing"})
+	assert.Nil(t, results.MissingIDs)
+}
+
+func TestFilterInQuery(t *testing.T) {
+	TestQuery := Query{
+		QueryString: "asthma",
+		Filters: map[string]map[string]interface{}{
+			"dataset": {"publisherName": []interface{}{"Publisher A"}},
+		},
+		Aggregations: []map[string]interface{}{
+			{"type": "dataset", "keys": "dataType"},
+		},
+	}
+
+	postFiltered := entityQuery("dataset", TestQuery)
+	assert.Contains(t, postFiltered, "post_filter")
+	aggFilter, _ := json.Marshal(postFiltered["aggs"].(gin.H)["dataType"].(gin.H)["filter"])
+	assert.Contains(t, string(aggFilter), "Publisher A")
+
+	TestQuery.FilterInQuery = true
+	filtered := entityQuery("dataset", TestQuery)
+	assert.NotContains(t, filtered, "post_filter")
+
+	boolQuery := filtered["query"].(gin.H)["bool"].(gin.H)
+	filterJson, _ := json.Marshal(boolQuery["filter"])
+	assert.Contains(t, string(filterJson), "Publisher A")
+	assert.Contains(t, boolQuery["must"], "bool")
+
+	aggFilter, _ = json.Marshal(filtered["aggs"].(gin.H)["dataType"].(gin.H)["filter"])
+	assert.NotContains(t, string(aggFilter), "Publisher A")
+
+	noFilters := entityQuery("tool", Query{QueryString: "asthma", FilterInQuery: true})
+	assert.NotContains(t, noFilters, "post_filter")
+	assert.Contains(t, noFilters["query"].(gin.H)["bool"], "should")
+}
+
+func TestWithPatternQueries(t *testing.T) {
+	mainQuery := gin.H{"match_all": gin.H{}}
+	assert.EqualValues(t, mainQuery, withPatternQueries(mainQuery, Query{}))
+
+	toolConfig := entityQuery("tool", Query{
+		QueryString: "sequencing",
+		Prefix:      map[string]string{"name": "bio"},
+		Wildcard:    map[string]string{"programmingLanguage": "py*"},
+	})
+	must := toolConfig["query"].(gin.H)["bool"].(gin.H)["must"].([]gin.H)
+	assert.Len(t, must, 3)
+	assert.Contains(t, must[0], "bool")
+	assert.EqualValues(t, gin.H{
+		"prefix": gin.H{"name": gin.H{"value": "bio", "case_insensitive": true}},
+	}, must[1])
+	assert.EqualValues(t, gin.H{
+		"wildcard": gin.H{"programmingLanguage": gin.H{"value": "py*", "case_insensitive": true}},
+	}, must[2])
+}
+
+func TestWithCollapse(t *testing.T) {
+	assert.NotContains(t, entityQuery("publication", Query{QueryString: "asthma"}), "collapse")
+
+	publicationConfig := entityQuery("publication", Query{QueryString: "asthma", CollapseField: "doi"})
+	assert.EqualValues(t, gin.H{"field": "doi"}, publicationConfig["collapse"])
+	assert.Contains(t, publicationConfig, "aggs")
+
+	setIndexFieldTypes("dataset", map[string]string{"title": "text", "title.keyword": "keyword"})
+	t.Cleanup(func() { setIndexFieldTypes("dataset", map[string]string{}) })
+	datasetConfig := entityQuery("dataset", Query{
+		QueryString:       "asthma",
+		CollapseField:     "title",
+		CollapseInnerHits: 3,
+	})
+	assert.EqualValues(t, gin.H{
+		"field": "title.keyword",
+		"inner_hits": gin.H{
+			"name": "collapsed",
+			"size": 3,
+			"sort": []gin.H{{"_score": "desc"}},
+		},
+	}, datasetConfig["collapse"])
+
+	assert.Nil(t, validateQuery(Query{CollapseField: "doi", From: 20, CollapseInnerHits: 100}))
+	assert.NotNil(t, validateQuery(Query{CollapseField: "doi", SearchAfter: []interface{}{}}))
+	assert.NotNil(t, validateQuery(Query{CollapseField: "doi", CollapseInnerHits: 101}))
+	assert.NotNil(t, validateQuery(Query{CollapseField: "doi", CollapseInnerHits: -1}))
+}
+
+func TestCollapsedInnerHits(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusOK, `{"hits": {"hits": [{
+			"_id": "1",
+			"_score": 2,
+			"inner_hits": {"collapsed": {"hits": {"hits": [{"_id": "2", "_score": 1}]}}}
+		}]}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	results, _ := defaultService().Search("publication", Query{QueryString: "asthma", CollapseField: "doi", CollapseInnerHits: 5})
+	assert.Len(t, results.Hits.Hits, 1)
+	assert.Contains(t, results.Hits.Hits[0].InnerHits, "collapsed")
+}
+
+func TestTrackTotalHits(t *testing.T) {
+	var elasticQuery map[string]interface{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &elasticQuery)
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 10000, "relation": "gte"}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	executeElasticQuery("dataset", "", gin.H{"size": 1})
+	assert.NotContains(t, elasticQuery, "track_total_hits")
+
+	t.Setenv("SEARCH_TRACK_TOTAL_HITS", "true")
+	elasticResp, _, _ := executeElasticQuery("dataset", "", gin.H{"size": 1})
+	assert.EqualValues(t, true, elasticQuery["track_total_hits"])
+	total, exact := elasticResp.Hits.TotalHits()
+	assert.EqualValues(t, 10000, total)
+	assert.False(t, exact)
+
+	t.Setenv("SEARCH_TRACK_TOTAL_HITS", "50000")
+	executeElasticQuery("dataset", "", gin.H{"size": 1})
+	assert.EqualValues(t, 50000, elasticQuery["track_total_hits"])
+
+	executeElasticQuery("dataset", "", gin.H{"size": 0, "track_total_hits": false})
+	assert.EqualValues(t, false, elasticQuery["track_total_hits"])
+}
+
+func TestTotalLabel(t *testing.T) {
+	assert.EqualValues(t, "0", totalLabel(HitsField{Total: map[string]interface{}{"value": 0.0, "relation": "eq"}}))
+	assert.EqualValues(t, "999", totalLabel(HitsField{Total: map[string]interface{}{"value": 999.0, "relation": "eq"}}))
+	assert.EqualValues(t, "1,234,567", totalLabel(HitsField{Total: map[string]interface{}{"value": 1234567.0, "relation": "eq"}}))
+	assert.EqualValues(t, "10,000+", totalLabel(HitsField{Total: map[string]interface{}{"value": 10000.0, "relation": "gte"}}))
+}
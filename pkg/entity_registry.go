@@ -0,0 +1,349 @@
+package search
+
+import (
+	"cmp"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EntityConfig describes an entity type searched by the service.  Once
+// registered with registerEntity an entity type is searched by the generic
+// search, served by its own search endpoint and can be filtered, aggregated
+// and exported, with the query built from its config by entityElasticConfig.
+type EntityConfig struct {
+	// Name is the entity type, which is the key of its filters and of its
+	// results in the generic search, e.g. "dataUseRegister".
+	Name string
+	// Index is the elastic index holding the entities, defaulting to the
+	// lower case Name.
+	Index string
+	// Route is the path of the entity type's search endpoint under /search,
+	// e.g. "dur".
+	Route string
+	// AnalyticsType names the entity type in the search analytics, defaulting
+	// to Index.
+	AnalyticsType string
+	// SettingName names the entity type in the settings of searches, e.g.
+	// SEARCH_MINIMUM_SHOULD_MATCH_DUR, and in SEARCH_EXPLANATION_ENTITY_TYPES,
+	// defaulting to Name.
+	SettingName string
+	// SearchFields are the fields matched against the query string.
+	SearchFields []string
+	// FieldBoosts weights matches on the search fields it names, e.g.
+	// {"named_entities": 4}, see queryFields.
+	FieldBoosts map[string]float64
+	// RelatedFields are fields describing the entities each entity is linked
+	// to, e.g. the titles of a collection's datasets.  If set the first fuzzy
+	// clause matches the query string against them rather than the
+	// SearchFields, and is left out of titleOnly searches.
+	RelatedFields []string
+	// AnyTerms lets the second fuzzy clause match any of the terms of the
+	// query string rather than requiring all of them.
+	AnyTerms bool
+	// MatchBoost weights the second fuzzy clause, unboosted if 0, and
+	// PhraseBoost the phrase clause, defaulting to 2.
+	MatchBoost  int
+	PhraseBoost int
+	// StructuralMetadata matches the query string against the structural
+	// metadata of the entities when enabled, see structuralMetadataQuery.
+	StructuralMetadata bool
+	// TitleFields are the title or name fields the query string is matched
+	// against in a titleOnly search.
+	TitleFields []string
+	// PrefixFields are the title fields matched by matchPhrasePrefix.
+	PrefixFields []string
+	// RecencyField is the date field decayed over by recencyBoost, leaving
+	// the entity type unboosted if empty, and sorted on by the recent
+	// emptyQueryOrder.
+	RecencyField string
+	// SortField is the keyword title field sorted on by the alphabetical
+	// emptyQueryOrder.
+	SortField string
+	// HighlightFields are the fields highlighted by default, and
+	// HighlightableFields those that may be requested, see buildHighlight.
+	HighlightFields     []string
+	HighlightableFields []string
+	// ExportFields are the _source fields exported as CSV columns, in order,
+	// defaulting to the SearchFields followed by the RelatedFields.
+	ExportFields []string
+	// FilterBuilders build the filters on the keys whose values are not a
+	// list of values to match, e.g. date ranges, by filter key.  Each
+	// returns false if the value is unusable, in which case the filter is
+	// ignored.
+	FilterBuilders map[string]func(terms interface{}) (gin.H, bool)
+	// Collapsible entity types can have their hits collapsed on a field, see
+	// withCollapse.
+	Collapsible bool
+	// CursorPaged entity types can be paged through with searchAfter, see
+	// withSearchAfter.
+	CursorPaged bool
+}
+
+// ElasticConfig builds the body of the elastic query for a search of the
+// entity type, see entityElasticConfig.
+func (config EntityConfig) ElasticConfig(query Query) gin.H {
+	return entityElasticConfig(config, query)
+}
+
+// Search runs a search of the entity type, see searchEntity.
+func (config EntityConfig) Search(s *SearchService, query Query) (SearchResponse, error) {
+	return s.searchEntity(config, query)
+}
+
+// entities holds the registered entity types, in the order they are searched
+// and reported in the generic search.
+var entities []EntityConfig
+
+// registerEntity adds the entity type to those searched by the service,
+// filling in the defaults of any options it leaves unset.
+func registerEntity(config EntityConfig) {
+	if config.Index == "" {
+		config.Index = strings.ToLower(config.Name)
+	}
+	if config.AnalyticsType == "" {
+		config.AnalyticsType = config.Index
+	}
+	if config.SettingName == "" {
+		config.SettingName = config.Name
+	}
+	if config.PhraseBoost == 0 {
+		config.PhraseBoost = 2
+	}
+	if config.ExportFields == nil {
+		config.ExportFields = slices.Concat(config.SearchFields, config.RelatedFields)
+	}
+	entities = append(entities, config)
+}
+
+// entityConfig returns the registered config of the entity type, resolving any
+// alias of its name.
+func entityConfig(entityType string) (EntityConfig, bool) {
+	name := canonicalEntityType(entityType)
+	for _, config := range entities {
+		if config.Name == name {
+			return config, true
+		}
+	}
+	return EntityConfig{}, false
+}
+
+// entityTypes returns the names of the registered entity types.
+func entityTypes() []string {
+	names := make([]string, 0, len(entities))
+	for _, config := range entities {
+		names = append(names, config.Name)
+	}
+	return names
+}
+
+// searchIndices returns the elastic indices of the registered entity types.
+func searchIndices() []string {
+	indices := make([]string, 0, len(entities))
+	for _, config := range entities {
+		indices = append(indices, config.Index)
+	}
+	return indices
+}
+
+// indexName returns the name of the elastic index, or alias, searched for the
+// index.  This is the index itself unless ELASTIC_INDEX_<INDEX> is set, e.g.
+// ELASTIC_INDEX_DATASET=dataset_v3, so that the service can be pointed at a
+// versioned index or an alias without changing the entity types of the API.
+func indexName(index string) string {
+	return cmp.Or(os.Getenv("ELASTIC_INDEX_"+strings.ToUpper(index)), index)
+}
+
+// EntityRoutes maps the path of each registered entity type's search endpoint,
+// e.g. "/search/tools", to its handler.
+func EntityRoutes() map[string]gin.HandlerFunc {
+	routes := make(map[string]gin.HandlerFunc, len(entities))
+	for _, config := range entities {
+		routes["/search/"+config.Route] = EntitySearch(config.Name)
+	}
+	return routes
+}
+
+func init() {
+	registerEntity(EntityConfig{
+		Name:      "dataset",
+		Route:     "datasets",
+		SortField: "title.keyword",
+		SearchFields: []string{
+			"abstract",
+			"keywords",
+			"description",
+			"shortTitle",
+			"title",
+			"named_entities",
+			"datasetDOI",
+		},
+		FieldBoosts:         map[string]float64{"named_entities": 4},
+		MatchBoost:          2,
+		PhraseBoost:         3,
+		StructuralMetadata:  true,
+		TitleFields:         []string{"title", "shortTitle"},
+		PrefixFields:        []string{"title", "shortTitle"},
+		RecencyField:        "startDate",
+		HighlightFields:     []string{"description", "abstract"},
+		HighlightableFields: []string{"abstract", "description", "keywords", "shortTitle", "title"},
+		ExportFields: []string{
+			"title",
+			"shortTitle",
+			"publisherName",
+			"abstract",
+			"description",
+			"keywords",
+			"datasetDOI",
+			"startDate",
+			"endDate",
+			"populationSize",
+		},
+		FilterBuilders: map[string]func(terms interface{}) (gin.H, bool){
+			"dateRange": func(terms interface{}) (gin.H, bool) {
+				return dateRangeFilter(terms, "startDate", "endDate")
+			},
+			"populationSize": populationSizeFilter,
+		},
+		Collapsible: true,
+		CursorPaged: true,
+	})
+	registerEntity(EntityConfig{
+		Name:      "tool",
+		Route:     "tools",
+		SortField: "name.keyword",
+		SearchFields: []string{
+			"tags",
+			"programmingLanguage",
+			"name",
+			"link",
+			"description",
+			"resultsInsights",
+			"license",
+		},
+		TitleFields:         []string{"name"},
+		PrefixFields:        []string{"name"},
+		HighlightFields:     []string{"name", "description"},
+		HighlightableFields: []string{"description", "name", "resultsInsights", "tags"},
+	})
+	registerEntity(EntityConfig{
+		Name:                "collection",
+		Route:               "collections",
+		SortField:           "name.keyword",
+		SearchFields:        []string{"description", "name", "keywords"},
+		RelatedFields:       []string{"datasetTitles", "datasetAbstracts"},
+		AnyTerms:            true,
+		MatchBoost:          2,
+		PhraseBoost:         3,
+		TitleFields:         []string{"name"},
+		PrefixFields:        []string{"name"},
+		HighlightFields:     []string{"description", "name", "keywords"},
+		HighlightableFields: []string{"description", "keywords", "name"},
+	})
+	registerEntity(EntityConfig{
+		Name:        "dataUseRegister",
+		Route:       "dur",
+		SettingName: "dur",
+		SortField:   "projectTitle.keyword",
+		SearchFields: []string{
+			"projectTitle",
+			"laySummary",
+			"publicBenefitStatement",
+			"technicalSummary",
+			"fundersAndSponsors",
+			"datasetTitles",
+			"keywords",
+			"collectionNames",
+			"publisherName",
+		},
+		TitleFields:         []string{"projectTitle"},
+		HighlightFields:     []string{"laySummary"},
+		HighlightableFields: []string{"keywords", "laySummary", "projectTitle", "publicBenefitStatement", "technicalSummary"},
+	})
+	registerEntity(EntityConfig{
+		Name:      "publication",
+		Route:     "publications",
+		SortField: "title.keyword",
+		SearchFields: []string{
+			"title",
+			"journalName",
+			"abstract",
+			"publicationType",
+			"authors",
+			"datasetTitles",
+			"doi",
+		},
+		TitleFields:         []string{"title"},
+		RecencyField:        "publicationDate",
+		HighlightFields:     []string{"title", "abstract"},
+		HighlightableFields: []string{"abstract", "authors", "journalName", "title"},
+		ExportFields: []string{
+			"title",
+			"authors",
+			"journalName",
+			"publicationType",
+			"publicationDate",
+			"doi",
+			"abstract",
+			"datasetTitles",
+		},
+		FilterBuilders: map[string]func(terms interface{}) (gin.H, bool){
+			"publicationDate": func(terms interface{}) (gin.H, bool) {
+				return dateRangeFilter(terms, "publicationDate", "publicationDate")
+			},
+		},
+		Collapsible: true,
+	})
+	registerEntity(EntityConfig{
+		Name:      "dataProvider",
+		Route:     "data_providers",
+		SortField: "name.keyword",
+		SearchFields: []string{
+			"name",
+			"datasetTitles",
+			"geographicLocation",
+			"publicationTitles",
+			"collectionNames",
+			"durTitles",
+			"toolNames",
+			"teamAliases",
+		},
+		TitleFields:         []string{"name", "teamAliases"},
+		HighlightableFields: []string{"name", "teamAliases"},
+		FilterBuilders: map[string]func(terms interface{}) (gin.H, bool){
+			geoLocationField: func(terms interface{}) (gin.H, bool) {
+				if geoFilter, ok := geoDistanceFilter(geoLocationField, terms); ok {
+					return geoFilter, true
+				}
+				// locations can still be filtered on by name
+				values, ok := terms.([]interface{})
+				if !ok {
+					return nil, false
+				}
+				return valuesFilter(fieldTypes("dataprovider"), geoLocationField, values), true
+			},
+		},
+	})
+	registerEntity(EntityConfig{
+		Name:         "datacustodiannetwork",
+		Route:        "data_custodian_networks",
+		SortField:    "name.keyword",
+		SearchFields: []string{"name", "summary"},
+		RelatedFields: []string{
+			"publisherNames",
+			"datasetTitles",
+			"durTitles",
+			"toolNames",
+			"publicationTitles",
+			"collectionNames",
+		},
+		AnyTerms:            true,
+		MatchBoost:          2,
+		PhraseBoost:         3,
+		TitleFields:         []string{"name"},
+		HighlightFields:     []string{"name", "summary"},
+		HighlightableFields: []string{"name", "summary"},
+	})
+}
@@ -0,0 +1,127 @@
+package search
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// entityQuery returns the body of the elastic query for a search of the
+// registered entity type.
+func entityQuery(entityType string, query Query) gin.H {
+	config, _ := entityConfig(entityType)
+	return config.ElasticConfig(query)
+}
+
+func registerTestEntity(t *testing.T) {
+	registered := entities
+	registerEntity(EntityConfig{
+		Name:            "workflow",
+		Route:           "workflows",
+		SearchFields:    []string{"name", "steps"},
+		HighlightFields: []string{"name"},
+	})
+	setIndexFieldTypes("workflow", map[string]string{})
+	t.Cleanup(func() {
+		entities = registered
+		indexFieldTypesMu.Lock()
+		delete(indexFieldTypes, "workflow")
+		indexFieldTypesMu.Unlock()
+	})
+}
+
+func TestRegisterEntityDefaults(t *testing.T) {
+	registerTestEntity(t)
+
+	config, ok := entityConfig("workflow")
+	assert.True(t, ok)
+	assert.EqualValues(t, "workflow", config.Index)
+	assert.EqualValues(t, "workflow", config.AnalyticsType)
+	assert.EqualValues(t, "workflow", config.SettingName)
+	assert.EqualValues(t, 2, config.PhraseBoost)
+	assert.Contains(t, entityTypes(), "workflow")
+	assert.Contains(t, searchIndices(), "workflow")
+	assert.Contains(t, EntityRoutes(), "/search/workflows")
+
+	elasticQuery := config.ElasticConfig(Query{
+		QueryString: "alignment",
+		Filters:     map[string]map[string]interface{}{"workflow": {"language": []interface{}{"CWL"}}},
+	})
+	multiMatch := elasticQuery["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)[0]["multi_match"].(gin.H)
+	assert.EqualValues(t, []string{"name", "steps"}, multiMatch["fields"])
+	assert.Contains(t, elasticQuery["highlight"].(gin.H)["fields"], "name")
+	assert.Contains(t, elasticQuery, "post_filter")
+}
+
+func TestSearchGenericIncludesRegisteredEntities(t *testing.T) {
+	registerTestEntity(t)
+	searchedIndices := make(chan string, len(entities))
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		searchedIndices <- strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]
+		return http.StatusOK, `{"took": 1, "hits": {"hits": [], "total": {"value": 0}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "alignment"})
+
+	SearchGeneric(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	body, _ := io.ReadAll(w.Body)
+	var response map[string]interface{}
+	json.Unmarshal(body, &response)
+	assert.Contains(t, response, "workflow")
+
+	close(searchedIndices)
+	indices := []string{}
+	for index := range searchedIndices {
+		indices = append(indices, index)
+	}
+	assert.ElementsMatch(t, searchIndices(), indices)
+}
+
+func TestIndexName(t *testing.T) {
+	t.Setenv("ELASTIC_INDEX_DATASET", "dataset_v3")
+	var paths []string
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		paths = append(paths, req.URL.Path)
+		if strings.Contains(req.URL.Path, "/_doc/") {
+			return http.StatusOK, `{"_index": "dataset_v3", "_id": "1", "found": true, "_source": {}}`
+		}
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 0, "relation": "eq"}}, "aggregations": {}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	assert.EqualValues(t, "dataset_v3", indexName("dataset"))
+	assert.EqualValues(t, "tool", indexName("tool"))
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "asthma"})
+	EntitySearch("dataset")(c)
+
+	w = httptest.NewRecorder()
+	c = GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"filters": []gin.H{{"type": "dataset", "keys": "publisherName"}}})
+	ListFilters(c)
+
+	getDocument("dataset", "1", "")
+	similarSearch("1", "dataset", "")
+
+	assert.EqualValues(t, []string{
+		"/dataset_v3/_search",
+		"/dataset_v3/_search",
+		"/dataset_v3/_doc/1",
+		"/dataset_v3/_search",
+	}, paths)
+}
@@ -0,0 +1,67 @@
+package search
+
+import "strings"
+
+// entityTypeAliases maps the alternative names clients use for an entity type
+// to its canonical name.  Publications were historically filtered under
+// "paper", which is still accepted.
+var entityTypeAliases = map[string]string{
+	"paper": "publication",
+}
+
+// canonicalEntityType returns the canonical name of the entity type, resolving
+// any alias.
+func canonicalEntityType(entityType string) string {
+	if canonical, ok := entityTypeAliases[entityType]; ok {
+		return canonical
+	}
+	return entityType
+}
+
+// entityIndex returns the elastic index holding entities of the given type,
+// e.g. datauseregister for dataUseRegister.
+func entityIndex(entityType string) string {
+	if config, ok := entityConfig(entityType); ok {
+		return config.Index
+	}
+	return strings.ToLower(canonicalEntityType(entityType))
+}
+
+// normaliseFilterEntityTypes returns the filters keyed by canonical entity
+// type, merging the filters given under an alias into those of the canonical
+// name.  Where both set the same filter key the canonical name takes
+// precedence.  The filters passed in are not modified.
+func normaliseFilterEntityTypes(filters map[string]map[string]interface{}) map[string]map[string]interface{} {
+	hasAlias := false
+	for entityType := range filters {
+		if _, ok := entityTypeAliases[entityType]; ok {
+			hasAlias = true
+			break
+		}
+	}
+	if !hasAlias {
+		return filters
+	}
+
+	normalised := make(map[string]map[string]interface{})
+	for entityType, entityFilters := range filters {
+		if _, ok := entityTypeAliases[entityType]; !ok {
+			normalised[entityType] = entityFilters
+		}
+	}
+	for alias, canonical := range entityTypeAliases {
+		aliasFilters, ok := filters[alias]
+		if !ok {
+			continue
+		}
+		merged := make(map[string]interface{})
+		for key, terms := range aliasFilters {
+			merged[key] = terms
+		}
+		for key, terms := range filters[canonical] {
+			merged[key] = terms
+		}
+		normalised[canonical] = merged
+	}
+	return normalised
+}
@@ -0,0 +1,64 @@
+package search
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntityIndex(t *testing.T) {
+	assert.Equal(t, "publication", entityIndex("paper"))
+	assert.Equal(t, "publication", entityIndex("publication"))
+	assert.Equal(t, "datauseregister", entityIndex("dataUseRegister"))
+	assert.Equal(t, "dataprovider", entityIndex("dataProvider"))
+	assert.Equal(t, "dataset", entityIndex("dataset"))
+}
+
+func TestNormaliseFilterEntityTypes(t *testing.T) {
+	filters := map[string]map[string]interface{}{
+		"paper": {
+			"publicationType": []interface{}{"Research articles"},
+			"publicationDate": []interface{}{"2019", "2020"},
+		},
+		"publication": {
+			"publicationDate": []interface{}{"2021", "2022"},
+		},
+		"dataset": {
+			"publisherName": []interface{}{"Publisher A"},
+		},
+	}
+	normalised := normaliseFilterEntityTypes(filters)
+
+	assert.NotContains(t, normalised, "paper")
+	assert.EqualValues(t, []interface{}{"Research articles"}, normalised["publication"]["publicationType"])
+	assert.EqualValues(t, []interface{}{"2021", "2022"}, normalised["publication"]["publicationDate"])
+	assert.EqualValues(t, filters["dataset"], normalised["dataset"])
+	assert.Contains(t, filters, "paper")
+}
+
+func TestPublicationFilterAliases(t *testing.T) {
+	publicationFilters := map[string]interface{}{
+		"publicationType": []interface{}{"Research articles"},
+		"publicationDate": []interface{}{"2020", "2021"},
+	}
+	paperQuery := Query{
+		QueryString: "search term test",
+		Filters:     map[string]map[string]interface{}{"paper": publicationFilters},
+	}
+	publicationQuery := Query{
+		QueryString: "search term test",
+		Filters:     map[string]map[string]interface{}{"publication": publicationFilters},
+	}
+
+	paperJson, _ := json.Marshal(entityQuery("publication", paperQuery))
+	publicationJson, _ := json.Marshal(entityQuery("publication", publicationQuery))
+	assert.JSONEq(t, string(paperJson), string(publicationJson))
+	assert.Contains(t, string(publicationJson), "Research articles")
+
+	assert.Equal(
+		t,
+		buildQueryString(FieldQuery{QueryString: "test", Field: []string{"TITLE"}, Filters: paperQuery.Filters}),
+		buildQueryString(FieldQuery{QueryString: "test", Field: []string{"TITLE"}, Filters: publicationQuery.Filters}),
+	)
+}
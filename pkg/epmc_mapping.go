@@ -0,0 +1,105 @@
+package search
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// epmcSource is the value of the "source" field of hits mapped from EuropePMC
+// papers, distinguishing them from hits of the local publications index.
+const epmcSource = "epmc"
+
+// defaultEPMCFieldMapping maps each publications index field to the field of a
+// EuropePMC paper it is filled from.  Nested fields are separated by dots, with
+// list elements given by their position.
+var defaultEPMCFieldMapping = map[string]string{
+	"title":           "title",
+	"authors":         "authorString",
+	"abstract":        "abstractText",
+	"doi":             "doi",
+	"publicationDate": "pubYear",
+	"journalName":     "journalInfo.journal.title",
+	"publicationType": "pubTypeList.pubType",
+	"fullTextUrl":     "fullTextUrlList.fullTextUrl.0.url",
+}
+
+// epmcFieldMapping is the mapping used by paperToHit, the defaults with any
+// overrides loaded by loadEPMCFieldMapping.
+var epmcFieldMapping = defaultEPMCFieldMapping
+
+// loadEPMCFieldMapping reads overrides of the EuropePMC field mapping from the
+// JSON file at path.  The file maps publications index fields to the EuropePMC
+// field to fill them from, an empty EuropePMC field leaving the index field
+// unmapped:
+//
+//	{
+//		"journalName": "bookOrReportDetails.publisher",
+//		"fullTextUrl": ""
+//	}
+func loadEPMCFieldMapping(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var overrides map[string]string
+	if err := json.Unmarshal(content, &overrides); err != nil {
+		return err
+	}
+
+	mapping := make(map[string]string)
+	for field, epmcField := range defaultEPMCFieldMapping {
+		mapping[field] = epmcField
+	}
+	for field, epmcField := range overrides {
+		if epmcField == "" {
+			delete(mapping, field)
+			continue
+		}
+		mapping[field] = epmcField
+	}
+	epmcFieldMapping = mapping
+	return nil
+}
+
+// mapEPMCPaper maps a EuropePMC paper onto the fields of the publications index
+// using epmcFieldMapping.  Fields missing from the paper or empty are left out
+// rather than set to empty values.
+func mapEPMCPaper(paper PaperCore) map[string]interface{} {
+	var record map[string]interface{}
+	content, _ := json.Marshal(paper)
+	json.Unmarshal(content, &record)
+
+	source := map[string]interface{}{"source": epmcSource}
+	for field, epmcField := range epmcFieldMapping {
+		value := epmcFieldValue(record, epmcField)
+		if value == nil || value == "" {
+			continue
+		}
+		source[field] = value
+	}
+	return source
+}
+
+// epmcFieldValue returns the value at the dot separated path in the record, or
+// nil if there is none.
+func epmcFieldValue(record interface{}, path string) interface{} {
+	value := record
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			value = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			value = v[i]
+		default:
+			return nil
+		}
+	}
+	return value
+}
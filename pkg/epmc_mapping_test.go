@@ -0,0 +1,64 @@
+package search
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapEPMCPaper(t *testing.T) {
+	source := mapEPMCPaper(PaperCore{
+		ID:           "123",
+		Title:        "A publication",
+		AuthorString: "Smith J, Jones A.",
+		PubYear:      "2021",
+		JournalInfo: map[string]interface{}{
+			"journal": map[string]interface{}{"title": "Journal of Health"},
+		},
+		FullTextUrlList: map[string][]PaperUrl{
+			"fullTextUrl": {{Url: "https://example.org/1"}, {Url: "https://example.org/2"}},
+		},
+	})
+
+	assert.EqualValues(t, "A publication", source["title"])
+	assert.EqualValues(t, "Smith J, Jones A.", source["authors"])
+	assert.EqualValues(t, "2021", source["publicationDate"])
+	assert.EqualValues(t, "Journal of Health", source["journalName"])
+	assert.EqualValues(t, "https://example.org/1", source["fullTextUrl"])
+	assert.EqualValues(t, "epmc", source["source"])
+
+	// missing fields are left out rather than set empty
+	assert.NotContains(t, source, "doi")
+	assert.NotContains(t, source, "abstract")
+	assert.NotContains(t, source, "publicationType")
+
+	source = mapEPMCPaper(PaperCore{})
+	assert.EqualValues(t, map[string]interface{}{"source": "epmc"}, source)
+}
+
+func TestLoadEPMCFieldMapping(t *testing.T) {
+	t.Cleanup(func() { epmcFieldMapping = defaultEPMCFieldMapping })
+
+	path := filepath.Join(t.TempDir(), "epmc_mapping.json")
+	os.WriteFile(path, []byte(`{"journalName": "bookOrReportDetails.publisher", "fullTextUrl": ""}`), 0644)
+
+	err := loadEPMCFieldMapping(path)
+	assert.Nil(t, err)
+
+	source := mapEPMCPaper(PaperCore{
+		Title:               "A book",
+		BookOrReportDetails: map[string]interface{}{"publisher": "A Publisher"},
+		FullTextUrlList: map[string][]PaperUrl{
+			"fullTextUrl": {{Url: "https://example.org/1"}},
+		},
+	})
+	assert.EqualValues(t, "A book", source["title"])
+	assert.EqualValues(t, "A Publisher", source["journalName"])
+	assert.NotContains(t, source, "fullTextUrl")
+	assert.EqualValues(t, "journalInfo.journal.title", defaultEPMCFieldMapping["journalName"])
+
+	err = loadEPMCFieldMapping(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
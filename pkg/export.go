@@ -0,0 +1,228 @@
+package search
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportQuery represents a request to export search results.  It accepts the
+// same body as the search endpoints plus the entity type to search and the
+// format to export results in.
+type ExportQuery struct {
+	Query
+	Type   string `json:"type"`
+	Format string `json:"format"`
+}
+
+const (
+	// exportPageSize is the number of hits fetched from elastic, and written
+	// to the response, at a time while paging through the results of an
+	// export.
+	exportPageSize = 500
+	// defaultMaxExportRows is the most hits exported, unless overridden with
+	// SEARCH_MAX_EXPORT_ROWS.
+	defaultMaxExportRows = 10000
+)
+
+// exportTruncatedHeader is set on exports cut short at the maximum number of
+// rows, so that clients can tell they do not hold every matching hit.
+const exportTruncatedHeader = "X-Export-Truncated"
+
+// ExportSearch performs a search of the requested entity type and streams the
+// hits back as a CSV file, one row per hit with a column per ExportFields
+// field of the entity type.  Every matching hit is exported, up to
+// SEARCH_MAX_EXPORT_ROWS, beyond which the export is cut short and the
+// X-Export-Truncated header set.
+// Only "csv" is currently supported as a format.
+func ExportSearch(c *gin.Context) {
+	var query ExportQuery
+	if err := c.BindJSON(&query); err != nil {
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret export query", "error", err.Error())
+		return
+	}
+	query.RequestID = requestIDFrom(c)
+	if err := validateQuery(query.Query); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return
+	}
+
+	if query.Type == "" {
+		query.Type = "dataset"
+	}
+	if query.Format == "" {
+		query.Format = "csv"
+	}
+
+	config, ok := entityConfig(query.Type)
+	if !ok {
+		c.JSON(http.StatusBadRequest, errorBody(
+			c, fmt.Sprintf("Export of type %s is not supported", query.Type),
+		))
+		return
+	}
+	if query.Format != "csv" {
+		c.JSON(http.StatusBadRequest, errorBody(
+			c, fmt.Sprintf("Export format %s is not supported", query.Format),
+		))
+		return
+	}
+
+	s := defaultService()
+	exportQuery := exportSearchQuery(query.Query)
+	maxRows := maxExportRows()
+	// The first page is fetched before responding so that a failing search
+	// can still be reported with 502.
+	elasticResp, err := s.exportPage(config, exportQuery, nil, maxRows)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorBody(c, "Export search failed"))
+		return
+	}
+
+	if total, _ := elasticResp.Hits.Total["value"].(float64); total > float64(maxRows) {
+		c.Header(exportTruncatedHeader, "true")
+	}
+	c.Header("Content-Type", "text/csv")
+	c.Header(
+		"Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"%s_search_results.csv\"", query.Type),
+	)
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	if err := writer.Write(append([]string{"id"}, config.ExportFields...)); err != nil {
+		query.logger().Warn("Failed to write search results export", "error", err.Error())
+		return
+	}
+	rows := 0
+	for {
+		page := elasticResp.Hits.Hits
+		if rows+len(page) > maxRows {
+			page = page[:maxRows-rows]
+		}
+		if err := writeCSV(c.Writer, writer, config.ExportFields, page); err != nil {
+			query.logger().Warn("Failed to write search results export", "rows", rows, "error", err.Error())
+			return
+		}
+		rows += len(page)
+		if rows >= maxRows || len(elasticResp.Hits.Hits) < exportPageSize {
+			return
+		}
+
+		elasticResp, err = s.exportPage(config, exportQuery, nextCursor(elasticResp), maxRows)
+		if err != nil {
+			query.logger().Warn("Export search failed, export cut short", "rows", rows, "error", err.Error())
+			return
+		}
+	}
+}
+
+// maxExportRows returns the most hits exported, SEARCH_MAX_EXPORT_ROWS.
+func maxExportRows() int {
+	maxRows := envInt("SEARCH_MAX_EXPORT_ROWS", defaultMaxExportRows)
+	if maxRows <= 0 {
+		return defaultMaxExportRows
+	}
+	return maxRows
+}
+
+// exportSearchQuery returns the query paged through by an export.  Pages are
+// fetched with search_after, which unlike from and size is not limited by
+// the index's max_result_window, and a query without a query string is
+// seeded so that its random order is the same on every page.
+func exportSearchQuery(query Query) Query {
+	query = withSeed(withoutStopPhrases(query))
+	query.From = 0
+	query.Size = exportPageSize
+	query.SearchAfter = nil
+	query.Aggregations = nil
+	// elastic cannot page collapsed hits with search_after unless sorted on
+	// the collapse field, so every hit is exported.
+	query.CollapseField = ""
+	return query
+}
+
+// exportPage fetches the page of the export of the entity type following the
+// cursor, the first page if it is nil.  Only the ExportFields of the hits are
+// fetched, and hits are counted up to one more than maxRows so that a
+// truncated export can be told from the first page.
+func (s *SearchService) exportPage(config EntityConfig, query Query, cursor []interface{}, maxRows int) (SearchResponse, error) {
+	elasticResp, _, err := s.executeSearchWithRetry(config.Index, query.RequestID, func() gin.H {
+		elasticQuery := withSearchAfter(config.ElasticConfig(query), cursor)
+		delete(elasticQuery, "explain")
+		delete(elasticQuery, "highlight")
+		elasticQuery["_source"] = config.ExportFields
+		elasticQuery["track_total_hits"] = maxRows + 1
+		return elasticQuery
+	})
+	if err != nil {
+		query.logger().Debug("Export search failed", "index", config.Index, "error", err.Error())
+	}
+	return elasticResp, err
+}
+
+// writeCSV writes a row per hit to writer, the hit id followed by the value
+// of each of the columns in its _source, and flushes them to the client so
+// that the export is streamed rather than held in memory.
+func writeCSV(w http.ResponseWriter, writer *csv.Writer, columns []string, hits []Hit) error {
+	for _, hit := range hits {
+		row := make([]string, 0, len(columns)+1)
+		row = append(row, hit.Id)
+		for _, column := range columns {
+			row = append(row, exportValue(hit.Source[column]))
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return writer.Error()
+}
+
+// exportValue flattens a single _source value into a CSV cell.  Lists of
+// scalar values are joined with "; ", other structured values are written
+// as JSON.
+func exportValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				parts = append(parts, exportJSON(item))
+			default:
+				parts = append(parts, exportValue(item))
+			}
+		}
+		return strings.Join(parts, "; ")
+	case map[string]interface{}:
+		return exportJSON(v)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func exportJSON(value interface{}) string {
+	valueJson, err := json.Marshal(value)
+	if err != nil {
+		slog.Debug("Could not marshal export value", "error", err.Error())
+		return ""
+	}
+	return string(valueJson)
+}
@@ -0,0 +1,238 @@
+package search
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportSearch(t *testing.T) {
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "type": "tool", "format": "csv"})
+
+	ExportSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "tool_search_results.csv")
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	assert.EqualValues(
+		t,
+		[][]string{{"id", "tags", "programmingLanguage", "name", "link", "description", "resultsInsights", "license"}},
+		records,
+	)
+}
+
+// mockExportHits serves the given number of tool hits from elastic, sorted by
+// score and id and paged by the size and search_after of each query, and
+// returns the bodies of the queries.  Queries with a random_score are scored
+// by its seed, or at random if it has none.
+func mockExportHits(t *testing.T, total int) *[]map[string]interface{} {
+	queries := []map[string]interface{}{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		if strings.HasSuffix(req.URL.Path, "/_mapping") {
+			return http.StatusOK, `{}`
+		}
+		var elasticQuery map[string]interface{}
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &elasticQuery)
+		queries = append(queries, elasticQuery)
+
+		score := func(i int) float64 { return 1 }
+		functionScore, _ := elasticQuery["query"].(map[string]interface{})["function_score"].(map[string]interface{})
+		if randomScore, ok := functionScore["random_score"].(map[string]interface{}); ok {
+			seed, seeded := randomScore["seed"].(float64)
+			if !seeded {
+				seed = float64(rand.IntN(1000))
+			}
+			score = func(i int) float64 { return float64((i*7919 + int(seed)*104729) % 1000) }
+		}
+
+		hits := []gin.H{}
+		for i := 0; i < total; i++ {
+			id := fmt.Sprintf("%04d", i)
+			hits = append(hits, gin.H{
+				"_id":     id,
+				"_source": gin.H{"name": "Tool " + id},
+				"sort":    []interface{}{score(i), id},
+			})
+		}
+		sortKey := func(hit gin.H) (float64, string) {
+			sort := hit["sort"].([]interface{})
+			return sort[0].(float64), sort[1].(string)
+		}
+		slices.SortFunc(hits, func(a, b gin.H) int {
+			aScore, aID := sortKey(a)
+			bScore, bID := sortKey(b)
+			return cmp.Or(cmp.Compare(bScore, aScore), cmp.Compare(aID, bID))
+		})
+		if after, ok := elasticQuery["search_after"].([]interface{}); ok {
+			afterScore, afterID := after[0].(float64), after[1].(string)
+			hits = slices.DeleteFunc(hits, func(hit gin.H) bool {
+				hitScore, hitID := sortKey(hit)
+				return hitScore > afterScore || (hitScore == afterScore && hitID <= afterID)
+			})
+		}
+		size := int(elasticQuery["size"].(float64))
+		hits = hits[:min(size, len(hits))]
+
+		tracked := total
+		if track, ok := elasticQuery["track_total_hits"].(float64); ok {
+			tracked = min(total, int(track))
+		}
+		response, _ := json.Marshal(gin.H{"hits": gin.H{
+			"hits":  hits,
+			"total": gin.H{"value": tracked},
+		}})
+		return http.StatusOK, string(response)
+	})
+	t.Cleanup(func() { ElasticClient = mocks.MockElasticClient() })
+	return &queries
+}
+
+// exportIDs returns the ids of the exported rows, checking that each row has
+// the name column of tools.
+func exportIDs(t *testing.T, body io.Reader) []string {
+	records, err := csv.NewReader(body).ReadAll()
+	assert.Nil(t, err)
+	nameColumn := slices.Index(records[0], "name")
+	assert.Positive(t, nameColumn)
+	ids := []string{}
+	for _, record := range records[1:] {
+		assert.EqualValues(t, "Tool "+record[0], record[nameColumn])
+		ids = append(ids, record[0])
+	}
+	return ids
+}
+
+func TestExportSearchPages(t *testing.T) {
+	queries := mockExportHits(t, 1200)
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "type": "tool", "size": 10, "debug": true})
+
+	ExportSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(exportTruncatedHeader))
+	assert.Len(t, *queries, 3)
+	for _, query := range *queries {
+		assert.NotContains(t, query, "explain")
+		assert.NotContains(t, query, "highlight")
+		assert.Contains(t, query["_source"], "name")
+	}
+
+	ids := exportIDs(t, w.Body)
+	assert.Len(t, ids, 1200)
+	assert.EqualValues(t, "0000", ids[0])
+	assert.EqualValues(t, "1199", ids[1199])
+}
+
+func TestExportSearchEmptyQuery(t *testing.T) {
+	queries := mockExportHits(t, 1200)
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "", "type": "tool"})
+
+	ExportSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.Len(t, *queries, 3)
+	ids := exportIDs(t, w.Body)
+	assert.Len(t, ids, 1200)
+	slices.Sort(ids)
+	assert.Len(t, slices.Compact(ids), 1200)
+}
+
+func TestExportSearchTruncated(t *testing.T) {
+	mockExportHits(t, 1200)
+	t.Setenv("SEARCH_MAX_EXPORT_ROWS", "700")
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "type": "tool"})
+
+	ExportSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "true", w.Header().Get(exportTruncatedHeader))
+
+	ids := exportIDs(t, w.Body)
+	assert.Len(t, ids, 700)
+	assert.EqualValues(t, "0699", ids[699])
+}
+
+func TestExportSearchUnsupported(t *testing.T) {
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "format": "xlsx"})
+
+	ExportSearch(c)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	c = GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "type": "unknown"})
+
+	ExportSearch(c)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWriteCSV(t *testing.T) {
+	hits := []Hit{
+		{
+			Id: "1",
+			Source: map[string]interface{}{
+				"title":          "Dataset A",
+				"publisherName":  "Publisher A",
+				"keywords":       []interface{}{"asthma", "copd"},
+				"populationSize": float64(25000),
+			},
+		},
+		{
+			Id: "2",
+			Source: map[string]interface{}{
+				"title":    "Dataset B",
+				"metadata": map[string]interface{}{"version": "1.0"},
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	columns := []string{"title", "publisherName", "keywords", "populationSize", "metadata"}
+	err := writeCSV(w, csv.NewWriter(w), columns, hits)
+	assert.Nil(t, err)
+
+	records, err := csv.NewReader(w.Body).ReadAll()
+	assert.Nil(t, err)
+	assert.EqualValues(
+		t,
+		[]string{"1", "Dataset A", "Publisher A", "asthma; copd", "25000", ""},
+		records[0],
+	)
+	assert.EqualValues(
+		t,
+		[]string{"2", "Dataset B", "", "", "", "{\"version\":\"1.0\"}"},
+		records[1],
+	)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strings"
@@ -15,7 +16,10 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-type HTTPClient interface {
+// HTTPDoer sends HTTP requests.  The requests to EuropePMC and the search
+// explanation extractor are sent with Client, so that tests can replace it with
+// a client that records the requests, see mocks.RecordingClient.
+type HTTPDoer interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
@@ -68,13 +72,9 @@ type ArrayFieldQuery struct {
 }
 
 var (
-	Client HTTPClient
+	Client HTTPDoer = http.DefaultClient
 )
 
-func init() {
-	Client = &http.Client{}
-}
-
 // DOISearch takes the given candidate doi string, attempts to extract the DOI
 // number from it, then searches the EuropePMC articles API for papers 
 // matching that doi.
@@ -205,29 +205,47 @@ func epmcFieldQuey(query string, queryArray ArrayFieldQuery) PMCCoreResponse {
 func getPMC(urlPath string) []byte {
 	req, err := http.NewRequest("GET", urlPath, strings.NewReader(""))
 	if err != nil {
-		slog.Info(fmt.Sprintf("Failed to build EPMC query with: %s", err.Error()))
+		slog.Info("Failed to build EPMC query", "error", err.Error())
 	}
 	req.Header.Add("Content-Type", "application/json")
 
-	response, err := Client.Do(req)
+	response, err := doPMC(req)
 	if err != nil {
-		slog.Info(fmt.Sprintf("Failed to execute EPMC query with: %s", err.Error()))
+		slog.Info("Failed to execute EPMC query", "error", err.Error())
+		return nil
 	}
 	defer response.Body.Close()
 
 	respBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		slog.Warn(fmt.Sprintf("Failed to get EPMC response with: %s", err.Error()))
+		slog.Warn("Failed to get EPMC response", "error", err.Error())
 	}
 
 	return respBody
 }
 
+// doPMC sends the request to EuropePMC through the epmcBreaker, so that
+// requests fail fast while EuropePMC is known to be down.  Server errors count
+// as failures as well as requests that could not be sent.
+func doPMC(req *http.Request) (*http.Response, error) {
+	if !epmcBreaker.allow() {
+		return nil, fmt.Errorf("EPMC is unavailable: %w", errCircuitOpen)
+	}
+
+	response, err := Client.Do(req)
+	if err != nil || response.StatusCode >= http.StatusInternalServerError {
+		epmcBreaker.recordFailure()
+	} else {
+		epmcBreaker.recordSuccess()
+	}
+	return response, err
+}
+
 // extractDOI attempts to extract a doi number (starting "10.") from the doi string.
 func extractDOI(doi string) string {
 	startInd := strings.Index(doi, "10")
 	if startInd == -1 {
-		slog.Debug(fmt.Sprintf("String is not a valid doi: %s", doi))
+		slog.Debug("String is not a valid doi", "doi", doi)
 		return doi
 	}
 	endInd := len(doi)
@@ -242,7 +260,7 @@ func buildDoiQuery(query Query) string {
 	doi := extractDOI(query.QueryString)
 	queryString := fmt.Sprintf("query=(DOI:%s)", doi)
 
-	_, ok := query.Filters["paper"]
+	_, ok := normaliseFilterEntityTypes(query.Filters)["publication"]
 	if ok {
 		filterString := getFilters(query.Filters)
 		queryString = fmt.Sprintf("%s%%20AND%%20%s", queryString, filterString)
@@ -270,7 +288,7 @@ func buildQueryString(query FieldQuery) string {
 			)
 		}
 	}
-	_, ok := query.Filters["paper"]
+	_, ok := normaliseFilterEntityTypes(query.Filters)["publication"]
 	if ok {
 		filterString := getFilters(query.Filters)
 		fullString := fmt.Sprintf("%s%%20AND%%20%s", queryString, filterString)
@@ -284,18 +302,19 @@ func getFilters(filters map[string]map[string]interface{}) string {
 	var queryString string
 	var filterType []string
 	var allFilterType string
-	if val, ok := filters["paper"]["publicationDate"]; ok {
-		filterDate := fmt.Sprintf(
-			"PUB_YEAR:[%s%%20TO%%20%s]", 
-			val.([]interface{})[0].(string),
-			val.([]interface{})[1].(string),
-		)
-		queryString = filterDate
+	filters = normaliseFilterEntityTypes(filters)
+	if bounds, ok := filters["publication"]["publicationDate"].([]interface{}); ok && len(bounds) == 2 {
+		from, fromOK := bounds[0].(string)
+		to, toOK := bounds[1].(string)
+		if fromOK && toOK {
+			queryString = fmt.Sprintf("PUB_YEAR:[%s%%20TO%%20%s]", from, to)
+		}
 	}
-	if val, ok := filters["paper"]["publicationType"]; ok {
-		for _, t := range(val.([]interface{})) {
-			str := publicationTypeFilter(t.(string))
-			filterType = append(filterType, str)
+	if val, ok := filters["publication"]["publicationType"].([]interface{}); ok {
+		for _, t := range val {
+			if pubType, ok := t.(string); ok {
+				filterType = append(filterType, publicationTypeFilter(pubType))
+			}
 		}
 		allFilterType = strings.Join(filterType, "%20OR%20")
 		if (queryString != "") {
@@ -320,7 +339,7 @@ func publicationTypeFilter(pubType string) string {
 	} else if (pubType == "Books and documents") {
 		filterStr = "HAS_BOOK:Y"
 	} else {
-		slog.Debug(fmt.Sprintf("Unknown filter option: %s", pubType))
+		slog.Debug("Unknown filter option", "publicationType", pubType)
 	}
 
 	return filterStr
@@ -333,7 +352,7 @@ func calculateAggregations(results PMCCoreResponse) gin.H {
 	for _, res := range(results.ResultList["result"]) {
 		d, err := time.Parse("2006", res.PubYear)
 		if err != nil {
-			slog.Info(fmt.Sprintf("Failed to convert year to date: %s", res.PubYear))
+			slog.Info("Failed to convert year to date", "year", res.PubYear)
 			continue
 		}
 		if (d.Before(minDate)) {
@@ -377,3 +396,180 @@ func shuffleArrays[A any](results [][]A) (shuffledResults []A) {
 	}
 	return
 }
+
+// FederatedPublicationQuery represents a search of EuropePMC publications,
+// optionally merged with the publications hosted on the Gateway.
+// PageSize and CursorMark page through the EuropePMC results, pass the
+// nextCursorMark of each response to fetch the next page.
+type FederatedPublicationQuery struct {
+	Query
+	IncludeLocal bool   `json:"includeLocal"`
+	PageSize     int    `json:"pageSize"`
+	CursorMark   string `json:"cursorMark"`
+}
+
+// FederatedPublicationResponse is a SearchResponse of publications along with
+// the cursor mark for the next page of EuropePMC results.  EPMCAvailable is
+// false if EuropePMC could not be searched, in which case only Gateway hosted
+// publications are returned.
+type FederatedPublicationResponse struct {
+	SearchResponse
+	NextCursorMark string `json:"nextCursorMark,omitempty"`
+	EPMCAvailable  bool   `json:"epmcAvailable"`
+}
+
+const (
+	defaultEPMCPageSize = 25
+	maxEPMCPageSize     = 1000
+)
+
+// FederatedPublicationSearch searches the EuropePMC articles API for papers
+// matching the query string and returns them as hits in the same shape as
+// the publications index.  If includeLocal is set the results of searching the
+// local publications index are returned first, followed by any EuropePMC
+// papers that do not share a DOI with them.
+func FederatedPublicationSearch(c *gin.Context) {
+	var query FederatedPublicationQuery
+	if err := c.BindJSON(&query); err != nil {
+		requestLogger(requestIDFrom(c)).Debug(fmt.Sprintf(
+			"Failed to interpret search query with %s", err.Error(),
+		))
+		return
+	}
+	query.RequestID = requestIDFrom(c)
+	if err := validateQuery(query.Query); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return
+	}
+
+	results := FederatedPublicationResponse{
+		SearchResponse: SearchResponse{
+			Hits: HitsField{
+				Total: map[string]interface{}{"value": 0.0, "relation": "eq"},
+				Hits:  []Hit{},
+			},
+		},
+	}
+	var localErr error
+	if query.IncludeLocal {
+		var localResults SearchResponse
+		localResults, localErr = defaultService().Search("publication", withoutStopPhrases(query.Query))
+		if localErr != nil {
+			query.logger().Warn("Local publication search failed, returning EPMC results only", "error", localErr.Error())
+		} else {
+			results.SearchResponse = localResults
+		}
+	}
+
+	epmcResults, err := searchEPMC(query)
+	if err != nil {
+		if localErr != nil {
+			c.JSON(http.StatusBadGateway, errorBody(c, "Publication search failed"))
+			return
+		}
+		query.logger().Warn("EPMC search failed, returning local results only", "error", err.Error())
+		c.JSON(http.StatusOK, results)
+		return
+	}
+	results.EPMCAvailable = true
+	results.NextCursorMark = epmcResults.NextCursorMark
+	mergeEPMCResults(&results.SearchResponse, epmcResults)
+
+	c.JSON(http.StatusOK, results)
+}
+
+// searchEPMC queries the EuropePMC articles API with the query string, using
+// the paging options of the query.  The page size defaults to EPMC_PAGE_SIZE
+// and is capped at EPMC_MAX_PAGE_SIZE.
+func searchEPMC(query FederatedPublicationQuery) (PMCCoreResponse, error) {
+	var result PMCCoreResponse
+
+	pageSize := query.PageSize
+	if pageSize <= 0 {
+		pageSize = envInt("EPMC_PAGE_SIZE", defaultEPMCPageSize)
+	}
+	pageSize = min(pageSize, envInt("EPMC_MAX_PAGE_SIZE", maxEPMCPageSize))
+	cursorMark := query.CursorMark
+	if cursorMark == "" {
+		cursorMark = "*"
+	}
+
+	urlPath := fmt.Sprintf(
+		"%s/search?query=%s&resultType=core&format=json&pageSize=%d&cursorMark=%s",
+		os.Getenv("PMC_URL"),
+		url.QueryEscape(query.QueryString),
+		pageSize,
+		url.QueryEscape(cursorMark),
+	)
+
+	respBody, err := fetchPMC(urlPath)
+	if err != nil {
+		return result, err
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return result, err
+	}
+	// EuropePMC returns the cursor mark it was given once there are no more
+	// results, clear it so callers know to stop paging.
+	if result.NextCursorMark == cursorMark {
+		result.NextCursorMark = ""
+	}
+	return result, nil
+}
+
+// fetchPMC queries the EuropePMC articles API using the given urlPath,
+// returning an error if EuropePMC could not be reached or did not respond
+// with 200 OK.
+func fetchPMC(urlPath string) ([]byte, error) {
+	req, err := http.NewRequest("GET", urlPath, strings.NewReader(""))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	response, err := doPMC(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("EPMC responded with %s", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// mergeEPMCResults appends the EuropePMC papers to the hits of the response,
+// skipping any with the same DOI as a hit already present, and adds the
+// EuropePMC hit count to the total.
+func mergeEPMCResults(response *SearchResponse, epmcResults PMCCoreResponse) {
+	seenDOIs := make(map[string]bool)
+	for _, hit := range response.Hits.Hits {
+		if doi, ok := hit.Source["doi"].(string); ok && doi != "" {
+			seenDOIs[strings.ToLower(doi)] = true
+		}
+	}
+
+	for _, paper := range epmcResults.ResultList["result"] {
+		if paper.DOI != "" && seenDOIs[strings.ToLower(paper.DOI)] {
+			continue
+		}
+		response.Hits.Hits = append(response.Hits.Hits, paperToHit(paper))
+	}
+
+	total, _ := response.Hits.Total["value"].(float64)
+	response.Hits.Total = map[string]interface{}{
+		"value":    total + float64(epmcResults.HitCount),
+		"relation": "eq",
+	}
+	assignRanks(response.Hits.Hits)
+}
+
+// paperToHit maps a EuropePMC paper onto a Hit with the fields used by the
+// publications index, see mapEPMCPaper.
+func paperToHit(paper PaperCore) Hit {
+	return Hit{
+		Id:     paper.ID,
+		Source: mapEPMCPaper(paper),
+	}
+}
@@ -3,12 +3,16 @@ package search
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"hdruk/search-service/utils/mocks"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -307,3 +311,152 @@ func TestShuffleArrays(t *testing.T) {
 
 	assert.EqualValues(t, expected, shuffled)
 }
+
+func TestFederatedPublicationSearch(t *testing.T) {
+	var requestUrl string
+	mocks.GetDoFunc = func(req *http.Request) (*http.Response, error) {
+		requestUrl = req.URL.String()
+		r := io.NopCloser(bytes.NewReader([]byte(epmcRespJson)))
+		return &http.Response{
+			StatusCode: 200,
+			Body:       r,
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query":        "asthma inhalers",
+		"includeLocal": true,
+		"pageSize":     10,
+		"cursorMark":   "AoE/abc",
+	})
+
+	FederatedPublicationSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.Contains(t, requestUrl, "query=asthma+inhalers")
+	assert.Contains(t, requestUrl, "pageSize=10")
+	assert.Contains(t, requestUrl, "cursorMark=AoE%2Fabc")
+
+	var testResp FederatedPublicationResponse
+	json.Unmarshal(w.Body.Bytes(), &testResp)
+
+	assert.True(t, testResp.EPMCAvailable)
+	assert.Len(t, testResp.Hits.Hits, 1)
+	hit := testResp.Hits.Hits[0]
+	assert.EqualValues(t, "0000000", hit.Id)
+	assert.EqualValues(t, 1, hit.Rank)
+	assert.EqualValues(t, "A publication", hit.Source["title"])
+	assert.EqualValues(t, "Journal of Health", hit.Source["journalName"])
+	assert.EqualValues(t, "10.123/abc", hit.Source["doi"])
+	assert.EqualValues(t, "epmc", hit.Source["source"])
+}
+
+func TestSearchEPMCPaging(t *testing.T) {
+	t.Setenv("EPMC_PAGE_SIZE", "50")
+	t.Setenv("EPMC_MAX_PAGE_SIZE", "100")
+
+	var requestUrl string
+	nextCursorMark := "AoE/next"
+	mocks.GetDoFunc = func(req *http.Request) (*http.Response, error) {
+		requestUrl = req.URL.String()
+		body := fmt.Sprintf(`{"hitCount": 120, "nextCursorMark": %q, "resultList": {"result": []}}`, nextCursorMark)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}, nil
+	}
+
+	result, err := searchEPMC(FederatedPublicationQuery{Query: Query{QueryString: "asthma"}})
+	assert.Nil(t, err)
+	assert.Contains(t, requestUrl, "pageSize=50")
+	assert.Contains(t, requestUrl, "cursorMark=%2A")
+	assert.EqualValues(t, "AoE/next", result.NextCursorMark)
+
+	_, err = searchEPMC(FederatedPublicationQuery{Query: Query{QueryString: "asthma"}, PageSize: 500})
+	assert.Nil(t, err)
+	assert.Contains(t, requestUrl, "pageSize=100")
+
+	// the last page returns the cursor mark it was given
+	result, err = searchEPMC(FederatedPublicationQuery{
+		Query:      Query{QueryString: "asthma"},
+		CursorMark: "AoE/next",
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, requestUrl, "cursorMark=AoE%2Fnext")
+	assert.Empty(t, result.NextCursorMark)
+}
+
+func TestFederatedPublicationSearchEPMCUnavailable(t *testing.T) {
+	mocks.GetDoFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+			Body:       io.NopCloser(bytes.NewReader([]byte{})),
+		}, nil
+	}
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "asthma", "includeLocal": true})
+
+	FederatedPublicationSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+
+	var testResp FederatedPublicationResponse
+	json.Unmarshal(w.Body.Bytes(), &testResp)
+
+	assert.False(t, testResp.EPMCAvailable)
+	assert.EqualValues(t, 3, testResp.Took)
+}
+
+func TestMergeEPMCResultsSkipsDuplicateDOIs(t *testing.T) {
+	var epmcResults PMCCoreResponse
+	json.Unmarshal([]byte(epmcRespJson), &epmcResults)
+
+	response := SearchResponse{
+		Hits: HitsField{
+			Total: map[string]interface{}{"value": 1.0},
+			Hits: []Hit{
+				{Id: "1", Source: map[string]interface{}{"doi": "10.123/ABC"}},
+			},
+		},
+	}
+	mergeEPMCResults(&response, epmcResults)
+
+	assert.Len(t, response.Hits.Hits, 1)
+	assert.EqualValues(t, "1", response.Hits.Hits[0].Id)
+	assert.EqualValues(t, 2.0, response.Hits.Total["value"])
+}
+
+func TestFederatedPublicationSearchCircuitBreaker(t *testing.T) {
+	epmcBreaker = newCircuitBreaker("EPMC", 2, time.Minute)
+	t.Cleanup(func() {
+		epmcBreaker = newCircuitBreaker("EPMC", defaultEPMCBreakerThreshold, defaultEPMCBreakerCooldown)
+	})
+
+	calls := 0
+	mocks.GetDoFunc = func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, errors.New("connection timed out")
+	}
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		c := GetTestGinContext(w)
+		MockPostWithBody(c, gin.H{"query": "asthma", "includeLocal": true})
+
+		FederatedPublicationSearch(c)
+
+		assert.EqualValues(t, http.StatusOK, w.Code)
+		var testResp FederatedPublicationResponse
+		json.Unmarshal(w.Body.Bytes(), &testResp)
+		assert.False(t, testResp.EPMCAvailable)
+	}
+
+	// the third search is short-circuited without calling EPMC
+	assert.EqualValues(t, 2, calls)
+	assert.EqualValues(t, circuitOpen, epmcBreaker.State())
+}
@@ -0,0 +1,228 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// indexFieldTypes caches, per index, the elastic type of each field in the
+// index mapping.  Nested fields and multi-fields are named by their dotted path,
+// e.g. "publisherName.keyword".
+var indexFieldTypes = map[string]map[string]string{}
+var indexFieldTypesMu sync.RWMutex
+
+// indexFieldTypesFailed records, per index, when fetching its mapping last
+// failed, so that searches do not each ask elastic for it again.  Guarded by
+// indexFieldTypesMu.
+var indexFieldTypesFailed = map[string]time.Time{}
+
+// fieldTypesRetryInterval is how long after failing to fetch the mapping of
+// an index fieldTypes waits before fetching it again.
+const fieldTypesRetryInterval = 30 * time.Second
+
+// fieldTypesNow returns the current time, replaced in tests.
+var fieldTypesNow = time.Now
+
+// errIndexNotFound is returned when fetching the mapping of an index that
+// does not exist yet.
+var errIndexNotFound = errors.New("index not found")
+
+// indexMapping is the part of elastic's get mapping response used to find the
+// field types of an index.
+type indexMapping struct {
+	Mappings struct {
+		Properties map[string]mappingProperty `json:"properties"`
+	} `json:"mappings"`
+}
+
+type mappingProperty struct {
+	Type       string                     `json:"type"`
+	Properties map[string]mappingProperty `json:"properties"`
+	Fields     map[string]mappingProperty `json:"fields"`
+}
+
+// fieldTypes returns the type of each field in the mapping of the index,
+// fetching the mapping from elastic the first time the index is asked for.
+// If the mapping cannot be fetched nil is returned, and it is not fetched again
+// until fieldTypesRetryInterval has passed.
+func fieldTypes(index string) map[string]string {
+	if index == "" {
+		return nil
+	}
+	indexFieldTypesMu.RLock()
+	types, ok := indexFieldTypes[index]
+	failedAt, failed := indexFieldTypesFailed[index]
+	indexFieldTypesMu.RUnlock()
+	if ok {
+		return types
+	}
+	if failed && fieldTypesNow().Sub(failedAt) < fieldTypesRetryInterval {
+		return nil
+	}
+
+	types, err := fetchFieldTypes(index)
+	if errors.Is(err, errIndexNotFound) {
+		slog.Debug("Index does not exist yet, mapping not loaded", "index", index)
+		setFieldTypesFailed(index)
+		return nil
+	}
+	if err != nil {
+		slog.Warn("Could not fetch index mapping", "index", index, "error", err.Error())
+		setFieldTypesFailed(index)
+		return nil
+	}
+	setIndexFieldTypes(index, types)
+	return types
+}
+
+// setIndexFieldTypes replaces the cached field types of the index.
+func setIndexFieldTypes(index string, types map[string]string) {
+	indexFieldTypesMu.Lock()
+	defer indexFieldTypesMu.Unlock()
+	indexFieldTypes[index] = types
+	delete(indexFieldTypesFailed, index)
+}
+
+// setFieldTypesFailed records that the mapping of the index could not be
+// fetched.
+func setFieldTypesFailed(index string) {
+	indexFieldTypesMu.Lock()
+	defer indexFieldTypesMu.Unlock()
+	indexFieldTypesFailed[index] = fieldTypesNow()
+}
+
+// loadIndexMappings fetches the mapping of each of the searchIndices and caches
+// its field types, returning the error for each index whose mapping could not
+// be fetched.  The cached field types of an index are kept if its mapping
+// cannot be fetched, unless the index no longer exists.  Indices that do not
+// exist yet are not an error at start up; their mappings are fetched when they
+// are first searched.
+func loadIndexMappings() map[string]error {
+	failed := make(map[string]error)
+	for _, index := range searchIndices() {
+		types, err := fetchFieldTypes(index)
+		if errors.Is(err, errIndexNotFound) {
+			slog.Info("Index does not exist yet, mapping not loaded", "index", index)
+			indexFieldTypesMu.Lock()
+			delete(indexFieldTypes, index)
+			indexFieldTypesMu.Unlock()
+			failed[index] = err
+			continue
+		}
+		if err != nil {
+			slog.Warn("Could not fetch index mapping", "index", index, "error", err.Error())
+			failed[index] = err
+			continue
+		}
+		setIndexFieldTypes(index, types)
+	}
+	return failed
+}
+
+// RefreshMappings fetches the mappings of the indices again, for use after
+// the mappings or indices have been changed.  The response lists the number
+// of fields now known for each index and the error for any index whose
+// mapping could not be fetched.
+func RefreshMappings(c *gin.Context) {
+	failed := loadIndexMappings()
+
+	fields := gin.H{}
+	errs := gin.H{}
+	for _, index := range searchIndices() {
+		if err, ok := failed[index]; ok {
+			errs[index] = err.Error()
+			continue
+		}
+		fields[index] = len(fieldTypes(index))
+	}
+
+	status := http.StatusOK
+	if len(failed) == len(entities) {
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, gin.H{"fields": fields, "errors": errs})
+}
+
+// fetchFieldTypes gets the mapping of the index from elastic and returns the
+// type of each of its fields.
+func fetchFieldTypes(index string) (map[string]string, error) {
+	response, err := ElasticClient.Indices.GetMapping(
+		ElasticClient.Indices.GetMapping.WithIndex(indexName(index)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", errIndexNotFound, index)
+	}
+	if response.IsError() {
+		return nil, fmt.Errorf("elastic returned status %d: %s", response.StatusCode, body)
+	}
+
+	// The mapping is keyed by the concrete index name, which differs from the
+	// name searched if that is an alias.
+	var mappings map[string]indexMapping
+	if err := json.Unmarshal(body, &mappings); err != nil {
+		return nil, err
+	}
+	types := make(map[string]string)
+	for _, mapping := range mappings {
+		addFieldTypes(types, "", mapping.Mappings.Properties)
+	}
+	return types, nil
+}
+
+// addFieldTypes adds the types of the properties, and of their sub-fields and
+// multi-fields, to types.
+func addFieldTypes(types map[string]string, prefix string, properties map[string]mappingProperty) {
+	for name, property := range properties {
+		field := prefix + name
+		if property.Type != "" {
+			types[field] = property.Type
+		} else if len(property.Properties) > 0 {
+			types[field] = "object"
+		}
+		addFieldTypes(types, field+".", property.Properties)
+		addFieldTypes(types, field+".", property.Fields)
+	}
+}
+
+// keywordSubField returns the .keyword sub-field of key if key is a text field
+// with one in the index mapping.
+func keywordSubField(types map[string]string, key string) (string, bool) {
+	if types[key] == "text" && types[key+".keyword"] == "keyword" {
+		return key + ".keyword", true
+	}
+	return "", false
+}
+
+// filterTerm builds the term query filtering on key having value, given the
+// field types of the index searched.  Text fields are filtered on their
+// .keyword sub-field so that the value must match exactly, and boolean values
+// given as strings are converted, other fields are filtered on directly.
+func filterTerm(types map[string]string, key string, value interface{}) gin.H {
+	field := key
+	if keyword, ok := keywordSubField(types, key); ok {
+		field = keyword
+	} else if s, ok := value.(string); ok && types[key] == "boolean" {
+		if b, err := strconv.ParseBool(s); err == nil {
+			value = b
+		}
+	}
+	return gin.H{"term": gin.H{field: value}}
+}
@@ -0,0 +1,203 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const testToolMapping = `{
+	"tool": {
+		"mappings": {
+			"properties": {
+				"name": {"type": "text", "fields": {"keyword": {"type": "keyword"}}},
+				"programmingLanguage": {"type": "keyword"},
+				"isOpenSource": {"type": "boolean"},
+				"downloads": {"type": "integer"},
+				"createdAt": {"type": "date"},
+				"description": {"type": "text"},
+				"publisher": {"properties": {"name": {"type": "text", "fields": {"keyword": {"type": "keyword"}}}}}
+			}
+		}
+	}
+}`
+
+func mockToolMapping(t *testing.T) *int {
+	mappingRequests := 0
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		if strings.HasSuffix(req.URL.Path, "/_mapping") {
+			mappingRequests++
+			return http.StatusOK, testToolMapping
+		}
+		return http.StatusOK, `{"hits": {"hits": []}}`
+	})
+	indexFieldTypesMu.Lock()
+	delete(indexFieldTypes, "tool")
+	delete(indexFieldTypesFailed, "tool")
+	indexFieldTypesMu.Unlock()
+	t.Cleanup(func() {
+		ElasticClient = mocks.MockElasticClient()
+		setIndexFieldTypes("tool", map[string]string{})
+	})
+	return &mappingRequests
+}
+
+func TestFieldTypes(t *testing.T) {
+	mappingRequests := mockToolMapping(t)
+
+	types := fieldTypes("tool")
+	assert.EqualValues(t, "text", types["name"])
+	assert.EqualValues(t, "keyword", types["name.keyword"])
+	assert.EqualValues(t, "boolean", types["isOpenSource"])
+	assert.EqualValues(t, "integer", types["downloads"])
+	assert.EqualValues(t, "date", types["createdAt"])
+	assert.EqualValues(t, "object", types["publisher"])
+	assert.EqualValues(t, "keyword", types["publisher.name.keyword"])
+
+	fieldTypes("tool")
+	assert.EqualValues(t, 1, *mappingRequests)
+}
+
+func TestFieldTypesErrorCachedBriefly(t *testing.T) {
+	mappingRequests := 0
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		mappingRequests++
+		return http.StatusNotFound, `{"error": {"type": "index_not_found_exception"}, "status": 404}`
+	})
+	now := time.Now()
+	fieldTypesNow = func() time.Time { return now }
+	indexFieldTypesMu.Lock()
+	delete(indexFieldTypes, "tool")
+	delete(indexFieldTypesFailed, "tool")
+	indexFieldTypesMu.Unlock()
+	t.Cleanup(func() {
+		ElasticClient = mocks.MockElasticClient()
+		fieldTypesNow = time.Now
+		setIndexFieldTypes("tool", map[string]string{})
+	})
+
+	assert.Nil(t, fieldTypes("tool"))
+	assert.Nil(t, fieldTypes("tool"))
+	assert.EqualValues(t, 1, mappingRequests)
+	assert.EqualValues(t, "downloads", resolveAggregationField("tool", "downloads"))
+
+	now = now.Add(fieldTypesRetryInterval)
+	assert.Nil(t, fieldTypes("tool"))
+	assert.EqualValues(t, 2, mappingRequests)
+
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		mappingRequests++
+		return http.StatusOK, testToolMapping
+	})
+	now = now.Add(fieldTypesRetryInterval)
+	assert.EqualValues(t, "boolean", fieldTypes("tool")["isOpenSource"])
+	assert.EqualValues(t, 3, mappingRequests)
+}
+
+func TestResolveAggregationFieldFromMapping(t *testing.T) {
+	mockToolMapping(t)
+
+	assert.EqualValues(t, "name.keyword", resolveAggregationField("tool", "name"))
+	assert.EqualValues(t, "programmingLanguage", resolveAggregationField("tool", "programmingLanguage"))
+	assert.EqualValues(t, "isOpenSource", resolveAggregationField("tool", "isOpenSource"))
+	assert.EqualValues(t, "downloads", resolveAggregationField("tool", "downloads"))
+	assert.EqualValues(t, "createdAt", resolveAggregationField("tool", "createdAt"))
+	assert.EqualValues(t, "publisher.name.keyword", resolveAggregationField("tool", "publisher.name"))
+	// A text field without a keyword sub-field is left for elastic to report.
+	assert.EqualValues(t, "description", resolveAggregationField("tool", "description"))
+}
+
+func TestFilterTerm(t *testing.T) {
+	mockToolMapping(t)
+	types := fieldTypes("tool")
+
+	assert.EqualValues(t, gin.H{"term": gin.H{"name.keyword": "BLAST"}}, filterTerm(types, "name", "BLAST"))
+	assert.EqualValues(t, gin.H{"term": gin.H{"programmingLanguage": "Go"}}, filterTerm(types, "programmingLanguage", "Go"))
+	assert.EqualValues(t, gin.H{"term": gin.H{"isOpenSource": true}}, filterTerm(types, "isOpenSource", "true"))
+	assert.EqualValues(t, gin.H{"term": gin.H{"isOpenSource": false}}, filterTerm(types, "isOpenSource", false))
+	assert.EqualValues(t, gin.H{"term": gin.H{"downloads": 100.0}}, filterTerm(types, "downloads", 100.0))
+	assert.EqualValues(t, gin.H{"term": gin.H{"createdAt": "2024-01-01"}}, filterTerm(types, "createdAt", "2024-01-01"))
+	assert.EqualValues(t, gin.H{"term": gin.H{"unmapped": "x"}}, filterTerm(types, "unmapped", "x"))
+}
+
+func TestToolFiltersUseFieldTypes(t *testing.T) {
+	mockToolMapping(t)
+
+	config := entityQuery("tool", Query{
+		QueryString: "sequencing",
+		Filters: map[string]map[string]interface{}{
+			"tool": {
+				"isOpenSource": []interface{}{"true"},
+				"name":         []interface{}{"BLAST"},
+			},
+		},
+		Aggregations: []map[string]interface{}{
+			{"type": "tool", "keys": "isOpenSource"},
+			{"type": "tool", "keys": "name"},
+		},
+	})
+
+	aggs := config["aggs"].(gin.H)
+	isOpenSource := aggs["isOpenSource"].(gin.H)["aggs"].(gin.H)["isOpenSource"].(gin.H)
+	assert.EqualValues(t, "isOpenSource", isOpenSource["terms"].(gin.H)["field"])
+	name := aggs["name"].(gin.H)["aggs"].(gin.H)["name"].(gin.H)
+	assert.EqualValues(t, "name.keyword", name["terms"].(gin.H)["field"])
+
+	postFilter := config["post_filter"].(gin.H)["bool"].(gin.H)["must"].([]gin.H)
+	terms := []gin.H{}
+	for _, filter := range postFilter {
+		terms = append(terms, filter["bool"].(gin.H)["should"].([]gin.H)...)
+	}
+	assert.Contains(t, terms, gin.H{"term": gin.H{"isOpenSource": true}})
+	assert.Contains(t, terms, gin.H{"term": gin.H{"name.keyword": "BLAST"}})
+}
+
+func TestRefreshMappings(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		switch req.URL.Path {
+		case "/tool/_mapping":
+			return http.StatusOK, testToolMapping
+		case "/dataset/_mapping":
+			return http.StatusNotFound, `{"error": {"type": "index_not_found_exception"}, "status": 404}`
+		default:
+			return http.StatusInternalServerError, `{"error": {"type": "exception"}, "status": 500}`
+		}
+	})
+	setIndexFieldTypes("dataset", map[string]string{"title": "text"})
+	setIndexFieldTypes("collection", map[string]string{"name": "text"})
+	t.Cleanup(func() {
+		ElasticClient = mocks.MockElasticClient()
+		for _, index := range searchIndices() {
+			setIndexFieldTypes(index, map[string]string{})
+		}
+	})
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{})
+	RefreshMappings(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var response struct {
+		Fields map[string]int    `json:"fields"`
+		Errors map[string]string `json:"errors"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.EqualValues(t, map[string]int{"tool": 10}, response.Fields)
+	assert.Len(t, response.Errors, len(searchIndices())-1)
+	assert.Contains(t, response.Errors["dataset"], "index not found")
+
+	indexFieldTypesMu.RLock()
+	defer indexFieldTypesMu.RUnlock()
+	assert.NotContains(t, indexFieldTypes, "dataset")
+	assert.EqualValues(t, map[string]string{"name": "text"}, indexFieldTypes["collection"])
+	assert.EqualValues(t, "boolean", indexFieldTypes["tool"]["isOpenSource"])
+}
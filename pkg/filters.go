@@ -1,13 +1,14 @@
 package search
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,6 +21,24 @@ type Aggregations struct {
 
 type FilterRequest struct {
 	Filters	[]map[string]interface{} `json:"filters"`
+	Size    int                      `json:"size"`
+	Combine bool                     `json:"combine"`
+}
+
+const (
+	defaultAggregationSize    = 1000
+	defaultMaxAggregationSize = 10000
+	defaultFilterSearchSize   = 20
+	maxFilterSearchSize       = 100
+)
+
+// FilterSearchRequest asks for the values of a single filter matching a
+// prefix typed by the user, see FilterSearch.
+type FilterSearchRequest struct {
+	Type   string `json:"type"`
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	Size   int    `json:"size"`
 }
 
 /*
@@ -40,68 +59,87 @@ The expected structure of a FilterRequest is:
 			"type": "dataset",
 			"keys": "containsTissue"
 		}
-	]
+	],
+	"size": 2000
 }
 ```
+
+The optional `size` sets the maximum number of values returned per filter,
+see aggregationSize.  If `combine` is set the values of all the filters of
+each index are listed with a single search, see combinedFilterValues.
 */
 func ListFilters(c *gin.Context) {
+	requestID := requestIDFrom(c)
+	logger := requestLogger(requestID)
+
 	var filterRequest FilterRequest
 	if err := c.BindJSON(&filterRequest); err != nil {
-		slog.Warn(fmt.Sprintf("Could not bind filter request: %s", c.Request.Body))
+		logger.Warn("Could not bind filter request", "error", err.Error())
 	}
 
 	var allFilters []gin.H
+	size := aggregationSize(filterRequest.Size)
 
-	for _, filter := range(filterRequest.Filters) {
-		var buf bytes.Buffer
-		elasticQuery := filtersRequest(filter)
-		if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-			slog.Info(fmt.Sprintf("Failed to encode filters request: %s", err.Error()))
-		}
+	combined := make(map[int]map[string]interface{})
+	if filterRequest.Combine {
+		combined = combinedFilterValues(filterRequest.Filters, size, requestID)
+	}
 
+	for i, filter := range filterRequest.Filters {
 		filterType, ok := filter["type"].(string)
 		if !ok {
-			slog.Debug(fmt.Sprintf("Filter type in %s not recognised", filter))
-		}
-		var index string
-		if (filterType == "dataUseRegister" || filterType == "dataProvider") {
-			index = strings.ToLower(filterType)
-		} else if (filterType == "paper") {
-			index = "publication"
-		} else {
-			index = filterType
+			logger.Debug("Filter type not recognised", "filter", filter)
 		}
+		index := entityIndex(filterType)
 
 		filterKey, ok := filter["keys"].(string)
 		if !ok {
-			slog.Debug(fmt.Sprintf("Filter keys in %s not recognised", filter))
+			logger.Debug("Filter keys not recognised", "filter", filter)
 		}
 
-		response, err := ElasticClient.Search(
-			ElasticClient.Search.WithIndex(index),
-			ElasticClient.Search.WithBody(&buf),
-		)
-
-		if err != nil {
-			slog.Warn(err.Error())
-		}
-		defer response.Body.Close()
-	
-		body, err := io.ReadAll(response.Body)
-		if err != nil {
-			slog.Warn(err.Error())
+		var elasticResp SearchResponse
+		if aggregations, ok := combined[i]; ok {
+			elasticResp.Aggregations = aggregations
+		} else if isHighCardinalityFilter(filterKey) {
+			elasticResp.Aggregations = compositeFilterValues(index, filterKey, size, requestID)
+		} else {
+			var err error
+			elasticResp, _, err = executeSearchWithRetry(index, requestID, func() gin.H {
+				return filtersRequest(filter, size)
+			})
+			if err != nil {
+				logger.Warn(
+					"Filter search failed",
+					"index", index,
+					"filterType", filterType,
+					"filterKey", filterKey,
+					"error", err.Error(),
+				)
+			}
 		}
 
-		var elasticResp SearchResponse
-		json.Unmarshal(body, &elasticResp)
+		if index == "datauseregister" {
+			normaliseFunderBuckets(elasticResp.Aggregations)
+		}
 
 		if (len(elasticResp.Aggregations) == 0) {
-			slog.Warn(fmt.Sprintf("No aggreations returned for filter: %s - %s", filterType, filterKey))
+			logger.Warn(
+				"No aggregations returned for filter",
+				"index", index,
+				"filterType", filterType,
+				"filterKey", filterKey,
+			)
 		}
+		warnTruncatedBuckets(filterType, elasticResp.Aggregations)
 
 		if (filterKey == "dateRange") || (filterKey == "publicationDate") {
-			startValue := elasticResp.Aggregations["startDate"].(map[string]interface{})["value_as_string"]
-			endValue := elasticResp.Aggregations["endDate"].(map[string]interface{})["value_as_string"]
+			startDate, hasStart := elasticResp.Aggregations["startDate"].(map[string]interface{})
+			endDate, hasEnd := elasticResp.Aggregations["endDate"].(map[string]interface{})
+			if !hasStart || !hasEnd {
+				continue
+			}
+			startValue := startDate["value_as_string"]
+			endValue := endDate["value_as_string"]
 			allFilters = append(allFilters, gin.H{
 				filterType: gin.H{
 					filterKey: gin.H{
@@ -126,11 +164,13 @@ func ListFilters(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"filters": allFilters})
 }
 
-func filtersRequest(filter map[string]interface{}) gin.H {
+func filtersRequest(filter map[string]interface{}, size int) gin.H {
+	filterType, _ := filter["type"].(string)
+	index := entityIndex(filterType)
 	filterKey, ok := filter["keys"].(string)
 	var aggs gin.H
 	if !ok {
-		slog.Info(fmt.Sprintf("Filter key in %s not recognised", filter["keys"]))
+		slog.Info("Filter key not recognised", "filterKey", filter["keys"])
 	}
 	if (filterKey == "dateRange") {
 		aggs = gin.H{
@@ -156,6 +196,14 @@ func filtersRequest(filter map[string]interface{}) gin.H {
 				},
 			},
 		}
+	} else if metric, ok := metricAggregation(filter, filterKey); ok {
+		aggs = gin.H{
+			"size": 0,
+			"aggs": gin.H{filterKey: metric},
+		}
+		if reported, ok := reportedValuesFilter(filterKey); ok {
+			aggs["query"] = reported
+		}
 	} else if (filterKey == "populationSize") {
 		ranges := populationRanges()
 		aggs = gin.H{
@@ -172,12 +220,307 @@ func filtersRequest(filter map[string]interface{}) gin.H {
 			"aggs": gin.H{
 				filter["keys"].(string) : gin.H{
 					"terms": gin.H{
-						"field": filter["keys"].(string), 
-						"size":1000,
+						"field": resolveAggregationField(index, filter["keys"].(string)),
+						"size":  size,
 					},
 				},
 			},
 		}
 	}
 	return aggs
-}
\ No newline at end of file
+}
+
+// FilterSearch lists the values of a single filter containing a word that
+// starts with the given prefix, ignoring case, along with their doc counts,
+// e.g.
+//
+//	{"type": "dataset", "key": "publisherName", "prefix": "bio"}
+//
+// matches "UK Biobank" and "biobank" but not "Symbiosis".  This lets the
+// values of filters with thousands of values be searched as the user types
+// rather than listed in full.  At most `size` values are returned (default 20,
+// at most 100), those in the most documents first, in the same shape as a
+// single filter of ListFilters.  An empty prefix matches every value.
+func FilterSearch(c *gin.Context) {
+	var request FilterSearchRequest
+	if err := c.BindJSON(&request); err != nil {
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret filter search", "error", err.Error())
+		return
+	}
+	requestID := requestIDFrom(c)
+
+	if _, ok := entityConfig(request.Type); !ok {
+		c.JSON(http.StatusBadRequest, errorBody(
+			c, fmt.Sprintf("Filters of type %s are not supported", request.Type),
+		))
+		return
+	}
+	if request.Key == "" {
+		c.JSON(http.StatusBadRequest, errorBody(c, "key is required"))
+		return
+	}
+	if request.Size < 0 {
+		c.JSON(http.StatusBadRequest, errorBody(c, "size must not be negative"))
+		return
+	}
+	size := request.Size
+	if size == 0 {
+		size = defaultFilterSearchSize
+	}
+	size = min(size, maxFilterSearchSize)
+
+	index := entityIndex(request.Type)
+	elasticResp, _, err := executeSearchWithRetry(index, requestID, func() gin.H {
+		terms := gin.H{
+			"field": resolveAggregationField(index, request.Key),
+			"size":  size,
+		}
+		if request.Prefix != "" {
+			terms["include"] = filterPrefixPattern(request.Prefix)
+		}
+		return gin.H{
+			"size": 0,
+			"aggs": gin.H{request.Key: gin.H{"terms": terms}},
+		}
+	})
+	if err != nil {
+		requestLogger(requestID).Warn(
+			"Filter search failed",
+			"index", index,
+			"filterKey", request.Key,
+			"error", err.Error(),
+		)
+		c.JSON(http.StatusBadGateway, errorBody(c, "Filter search failed"))
+		return
+	}
+
+	if index == "datauseregister" {
+		normaliseFunderBuckets(elasticResp.Aggregations)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"filters": []gin.H{{request.Type: elasticResp.Aggregations}},
+	})
+}
+
+// filterPrefixPattern returns the regular expression for the include of a
+// terms aggregation matching values with a word starting with the prefix.
+// Elastic's regular expressions are always anchored and case sensitive, so
+// each letter of the prefix is matched in either case and the characters
+// elastic treats as operators are escaped.
+func filterPrefixPattern(prefix string) string {
+	var pattern strings.Builder
+	pattern.WriteString("(.*[^a-zA-Z0-9])?")
+	for _, r := range prefix {
+		lower, upper := unicode.ToLower(r), unicode.ToUpper(r)
+		switch {
+		case lower != upper:
+			fmt.Fprintf(&pattern, "[%c%c]", lower, upper)
+		case strings.ContainsRune(`.?+*|{}[]()"\#@&<>~`, r):
+			pattern.WriteRune('\\')
+			pattern.WriteRune(r)
+		default:
+			pattern.WriteRune(r)
+		}
+	}
+	pattern.WriteString(".*")
+	return pattern.String()
+}
+
+// combinedFilterValues lists the values of the filters with one search of each
+// index, rather than one search per filter, returning the aggregations of
+// each filter keyed by its position in filters.  The aggregations of each
+// filter, see filtersRequest, are named in the search with its position as a
+// prefix so that they cannot collide, and returned under their own names.
+// High cardinality filters are left out, as they are paged through
+// separately, see compositeFilterValues, as are filters that only aggregate
+// some documents, see reportedValuesFilter.
+func combinedFilterValues(filters []map[string]interface{}, size int, requestID string) map[int]map[string]interface{} {
+	indexFilters := make(map[string][]int)
+	for i, filter := range filters {
+		filterType, _ := filter["type"].(string)
+		filterKey, _ := filter["keys"].(string)
+		if isHighCardinalityFilter(filterKey) {
+			continue
+		}
+		if _, scoped := filtersRequest(filter, size)["query"]; scoped {
+			continue
+		}
+		index := entityIndex(filterType)
+		indexFilters[index] = append(indexFilters[index], i)
+	}
+
+	values := make(map[int]map[string]interface{}, len(filters))
+	for index, positions := range indexFilters {
+		elasticResp, _, err := executeSearchWithRetry(index, requestID, func() gin.H {
+			aggs := gin.H{}
+			for _, i := range positions {
+				for name, agg := range filtersRequest(filters[i], size)["aggs"].(gin.H) {
+					aggs[fmt.Sprintf("%d_%s", i, name)] = agg
+				}
+			}
+			return gin.H{"size": 0, "aggs": aggs}
+		})
+		if err != nil {
+			requestLogger(requestID).Warn(
+				"Combined filter search failed",
+				"index", index,
+				"filters", len(positions),
+				"error", err.Error(),
+			)
+			continue
+		}
+
+		for _, i := range positions {
+			values[i] = make(map[string]interface{})
+		}
+		for name, agg := range elasticResp.Aggregations {
+			position, aggName, _ := strings.Cut(name, "_")
+			i, err := strconv.Atoi(position)
+			if _, ok := values[i]; err != nil || !ok {
+				continue
+			}
+			values[i][aggName] = agg
+		}
+	}
+	return values
+}
+
+// aggregationSize returns the number of buckets to request for a terms
+// aggregation.  This is SEARCH_NO_RECORDS_AGGREGATION unless a positive size
+// is requested, and is capped at SEARCH_MAX_AGGREGATION_SIZE.
+func aggregationSize(requested int) int {
+	size := envInt("SEARCH_NO_RECORDS_AGGREGATION", defaultAggregationSize)
+	if requested > 0 {
+		size = requested
+	}
+	maxSize := envInt("SEARCH_MAX_AGGREGATION_SIZE", defaultMaxAggregationSize)
+	if size > maxSize {
+		slog.Debug("Aggregation size capped", "size", size, "maxSize", maxSize)
+		size = maxSize
+	}
+	return size
+}
+
+// subAggregationSize returns the number of buckets to request for the
+// sub-aggregation of a terms aggregation of parentSize buckets.  Each of those
+// buckets holds the buckets of the sub-aggregation, so the size is reduced
+// until their product is within SEARCH_MAX_AGGREGATION_SIZE.
+func subAggregationSize(requested int, parentSize int) int {
+	size := aggregationSize(requested)
+	if parentSize <= 0 {
+		return size
+	}
+	maxSize := envInt("SEARCH_MAX_AGGREGATION_SIZE", defaultMaxAggregationSize)
+	if size*parentSize > maxSize {
+		slog.Debug("Sub-aggregation size capped", "size", size, "parentSize", parentSize, "maxSize", maxSize)
+		size = max(maxSize/parentSize, 1)
+	}
+	return size
+}
+
+// warnTruncatedBuckets logs a warning for any terms aggregation in aggs that
+// did not return all of its buckets, meaning the list of filter values is
+// incomplete.
+func warnTruncatedBuckets(filterType string, aggs map[string]interface{}) {
+	for key, agg := range aggs {
+		aggMap, ok := agg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		otherCount, ok := aggMap["sum_other_doc_count"].(float64)
+		if ok && otherCount > 0 {
+			slog.Warn(
+				"Filter values truncated, documents in buckets not returned",
+				"filterType", filterType,
+				"filterKey", key,
+				"otherDocCount", otherCount,
+			)
+		}
+	}
+}
+
+// isHighCardinalityFilter reports whether the filter key is listed in
+// FILTER_HIGH_CARDINALITY_KEYS, meaning it has too many distinct values to
+// reliably list with a single terms aggregation.
+func isHighCardinalityFilter(filterKey string) bool {
+	for _, key := range strings.Split(os.Getenv("FILTER_HIGH_CARDINALITY_KEYS"), ",") {
+		if strings.TrimSpace(key) == filterKey && filterKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// compositeFilterValues lists every value of the filter key in the index by
+// paging through a composite aggregation pageSize buckets at a time.
+// The buckets are returned in the same shape as a terms aggregation, ordered
+// by doc count, so that callers cannot tell which path produced them.
+func compositeFilterValues(index string, filterKey string, pageSize int, requestID string) map[string]interface{} {
+	buckets := []interface{}{}
+	var afterKey interface{}
+
+	for {
+		elasticResp, _, err := executeSearchWithRetry(index, requestID, func() gin.H {
+			composite := gin.H{
+				"size": pageSize,
+				"sources": []gin.H{
+					{filterKey: gin.H{
+						"terms": gin.H{"field": resolveAggregationField(index, filterKey)},
+					}},
+				},
+			}
+			if afterKey != nil {
+				composite["after"] = afterKey
+			}
+			return gin.H{
+				"size": 0,
+				"aggs": gin.H{filterKey: gin.H{"composite": composite}},
+			}
+		})
+		if err != nil {
+			requestLogger(requestID).Warn(
+				"Failed to page filter values",
+				"index", index,
+				"filterKey", filterKey,
+				"error", err.Error(),
+			)
+			break
+		}
+
+		agg, ok := elasticResp.Aggregations[filterKey].(map[string]interface{})
+		if !ok {
+			break
+		}
+		page, _ := agg["buckets"].([]interface{})
+		for _, b := range page {
+			bucket, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key, _ := bucket["key"].(map[string]interface{})
+			buckets = append(buckets, map[string]interface{}{
+				"key":       key[filterKey],
+				"doc_count": bucket["doc_count"],
+			})
+		}
+
+		afterKey = agg["after_key"]
+		if len(page) < pageSize || afterKey == nil {
+			break
+		}
+	}
+
+	sort.SliceStable(buckets, func(i, j int) bool {
+		iCount, _ := buckets[i].(map[string]interface{})["doc_count"].(float64)
+		jCount, _ := buckets[j].(map[string]interface{})["doc_count"].(float64)
+		return iCount > jCount
+	})
+
+	return map[string]interface{}{
+		filterKey: map[string]interface{}{
+			"doc_count_error_upper_bound": 0.0,
+			"sum_other_doc_count":         0.0,
+			"buckets":                     buckets,
+		},
+	}
+}
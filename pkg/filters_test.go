@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -56,4 +57,265 @@ func TestListFilters(t *testing.T) {
 
 	assert.Contains(t, testResp, "filters")
 	assert.Contains(t, testResp["filters"].([]interface{})[0], "dataset")
-}
\ No newline at end of file
+}
+func TestAggregationSize(t *testing.T) {
+	t.Setenv("SEARCH_NO_RECORDS_AGGREGATION", "500")
+	t.Setenv("SEARCH_MAX_AGGREGATION_SIZE", "2000")
+
+	assert.EqualValues(t, 500, aggregationSize(0))
+	assert.EqualValues(t, 1500, aggregationSize(1500))
+	assert.EqualValues(t, 2000, aggregationSize(50000))
+
+	t.Setenv("SEARCH_NO_RECORDS_AGGREGATION", "")
+	t.Setenv("SEARCH_MAX_AGGREGATION_SIZE", "")
+	assert.EqualValues(t, 1000, aggregationSize(0))
+	assert.EqualValues(t, 10000, aggregationSize(50000))
+}
+
+func TestFiltersRequestSize(t *testing.T) {
+	aggs := filtersRequest(map[string]interface{}{"type": "dataset", "keys": "publisherName"}, 250)
+	aggsJson, _ := json.Marshal(aggs)
+	assert.Contains(t, string(aggsJson), "\"size\":250")
+}
+
+func TestWarnTruncatedBuckets(t *testing.T) {
+	logs := captureLogs(t)
+
+	warnTruncatedBuckets("dataset", map[string]interface{}{
+		"dataType": map[string]interface{}{
+			"sum_other_doc_count": 0.0,
+			"buckets":             []interface{}{},
+		},
+	})
+	assert.Empty(t, *logs.records)
+
+	warnTruncatedBuckets("dataset", map[string]interface{}{
+		"publisherName": map[string]interface{}{
+			"sum_other_doc_count": 12.0,
+			"buckets":             []interface{}{},
+		},
+	})
+	attrs, ok := logs.find("Filter values truncated, documents in buckets not returned")
+	assert.True(t, ok)
+	assert.EqualValues(t, "WARN", attrs["level"])
+	assert.EqualValues(t, "dataset", attrs["filterType"])
+	assert.EqualValues(t, "publisherName", attrs["filterKey"])
+	assert.EqualValues(t, 12, attrs["otherDocCount"])
+}
+
+func TestListFiltersLogsMissingAggregations(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusOK, `{"took": 1, "hits": {"hits": []}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+	logs := captureLogs(t)
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"filters": []gin.H{{"type": "tool", "keys": "programmingLanguage"}}})
+
+	ListFilters(c)
+
+	attrs, ok := logs.find("No aggregations returned for filter")
+	assert.True(t, ok)
+	assert.EqualValues(t, "WARN", attrs["level"])
+	assert.EqualValues(t, "tool", attrs["index"])
+	assert.EqualValues(t, "tool", attrs["filterType"])
+	assert.EqualValues(t, "programmingLanguage", attrs["filterKey"])
+}
+
+func TestCompositeFilterValues(t *testing.T) {
+	var requests []string
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		body, _ := io.ReadAll(req.Body)
+		requests = append(requests, string(body))
+		if !strings.Contains(string(body), "after") {
+			return http.StatusOK, `{
+				"aggregations": {
+					"publisherName": {
+						"after_key": {"publisherName": "B"},
+						"buckets": [
+							{"key": {"publisherName": "A"}, "doc_count": 2},
+							{"key": {"publisherName": "B"}, "doc_count": 5}
+						]
+					}
+				}
+			}`
+		}
+		return http.StatusOK, `{
+			"aggregations": {
+				"publisherName": {
+					"buckets": [
+						{"key": {"publisherName": "C"}, "doc_count": 3}
+					]
+				}
+			}
+		}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	aggs := compositeFilterValues("dataset", "publisherName", 2, "")
+
+	assert.Len(t, requests, 2)
+	assert.Contains(t, requests[1], "\"after\":{\"publisherName\":\"B\"}")
+
+	publisherAgg := aggs["publisherName"].(map[string]interface{})
+	assert.EqualValues(t, 0, publisherAgg["sum_other_doc_count"])
+	assert.EqualValues(
+		t,
+		[]interface{}{
+			map[string]interface{}{"key": "B", "doc_count": 5.0},
+			map[string]interface{}{"key": "C", "doc_count": 3.0},
+			map[string]interface{}{"key": "A", "doc_count": 2.0},
+		},
+		publisherAgg["buckets"],
+	)
+}
+
+func TestIsHighCardinalityFilter(t *testing.T) {
+	t.Setenv("FILTER_HIGH_CARDINALITY_KEYS", "publisherName, datasetTitles")
+
+	assert.True(t, isHighCardinalityFilter("publisherName"))
+	assert.True(t, isHighCardinalityFilter("datasetTitles"))
+	assert.False(t, isHighCardinalityFilter("dataType"))
+	assert.False(t, isHighCardinalityFilter(""))
+}
+
+func TestListFiltersCombined(t *testing.T) {
+	requests := make(map[string]int)
+	var datasetAggs map[string]interface{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		index := strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]
+		requests[index]++
+		if index == "tool" {
+			return http.StatusOK, `{"aggregations": {
+				"2_programmingLanguage": {"buckets": [{"key": "Go", "doc_count": 2}]}
+			}}`
+		}
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		datasetAggs = body["aggs"].(map[string]interface{})
+		return http.StatusOK, `{"aggregations": {
+			"0_publisherName": {"buckets": [{"key": "HDR UK", "doc_count": 5}]},
+			"1_startDate": {"value_as_string": "2020-01-01"},
+			"1_endDate": {"value_as_string": "2024-01-01"},
+			"3_dataType": {"buckets": []}
+		}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"combine": true,
+		"filters": []gin.H{
+			{"type": "dataset", "keys": "publisherName"},
+			{"type": "dataset", "keys": "dateRange"},
+			{"type": "tool", "keys": "programmingLanguage"},
+			{"type": "dataset", "keys": "dataType"},
+		},
+	})
+
+	ListFilters(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, map[string]int{"dataset": 1, "tool": 1}, requests)
+	assert.Contains(t, datasetAggs, "0_publisherName")
+	assert.Contains(t, datasetAggs, "1_startDate")
+	assert.Contains(t, datasetAggs, "3_dataType")
+
+	var response struct {
+		Filters []map[string]map[string]interface{} `json:"filters"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Filters, 4)
+	assert.EqualValues(t, "HDR UK", response.Filters[0]["dataset"]["publisherName"].(map[string]interface{})["buckets"].([]interface{})[0].(map[string]interface{})["key"])
+	dateBuckets := response.Filters[1]["dataset"]["dateRange"].(map[string]interface{})["buckets"].([]interface{})
+	assert.EqualValues(t, "2020-01-01", dateBuckets[0].(map[string]interface{})["value"])
+	assert.Contains(t, response.Filters[2]["tool"], "programmingLanguage")
+	assert.Contains(t, response.Filters[3]["dataset"], "dataType")
+}
+
+func TestListFiltersCombinedFailure(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusInternalServerError, `{"error": {"type": "exception"}, "status": 500}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	filters := []map[string]interface{}{
+		{"type": "dataset", "keys": "dateRange"},
+		{"type": "publication", "keys": "publicationDate"},
+		{"type": "dataset", "keys": "dataType"},
+	}
+	assert.Empty(t, combinedFilterValues(filters, 10, ""))
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"combine": true, "filters": filters})
+
+	ListFilters(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var response struct {
+		Filters []map[string]map[string]interface{} `json:"filters"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Filters, 1)
+	assert.Contains(t, response.Filters[0], "dataset")
+}
+
+func TestFilterSearch(t *testing.T) {
+	var elasticQuery map[string]interface{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &elasticQuery)
+		return http.StatusOK, `{"aggregations": {"publisherName": {"buckets": [{"key": "UK Biobank", "doc_count": 12}]}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"type": "dataset", "key": "publisherName", "prefix": "bio", "size": 500})
+
+	FilterSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	terms := elasticQuery["aggs"].(map[string]interface{})["publisherName"].(map[string]interface{})["terms"].(map[string]interface{})
+	assert.EqualValues(t, maxFilterSearchSize, terms["size"])
+	assert.EqualValues(t, filterPrefixPattern("bio"), terms["include"])
+
+	var testResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &testResp)
+	dataset := testResp["filters"].([]interface{})[0].(map[string]interface{})["dataset"].(map[string]interface{})
+	assert.Contains(t, dataset, "publisherName")
+
+	for _, body := range []gin.H{
+		{"type": "workflow", "key": "publisherName"},
+		{"type": "dataset"},
+		{"type": "dataset", "key": "publisherName", "size": -1},
+	} {
+		w := httptest.NewRecorder()
+		c := GetTestGinContext(w)
+		MockPostWithBody(c, body)
+		FilterSearch(c)
+		assert.EqualValues(t, http.StatusBadRequest, w.Code, "%v", body)
+	}
+}
+
+func TestFilterPrefixPattern(t *testing.T) {
+	assert.EqualValues(t, "(.*[^a-zA-Z0-9])?[bB][iI][oO].*", filterPrefixPattern("bio"))
+	assert.EqualValues(t, `(.*[^a-zA-Z0-9])?[uU][kK] \([nN].*`, filterPrefixPattern("UK (n"))
+	assert.EqualValues(t, `(.*[^a-zA-Z0-9])?1\.5.*`, filterPrefixPattern("1.5"))
+}
+
+func TestFiltersRequestMetric(t *testing.T) {
+	request := filtersRequest(map[string]interface{}{
+		"type": "dataset", "keys": "populationSize", "metric": "stats",
+	}, 10)
+	assert.EqualValues(t, gin.H{"stats": gin.H{"field": "populationSize"}}, request["aggs"].(gin.H)["populationSize"])
+	assert.EqualValues(t, gin.H{"range": gin.H{"populationSize": gin.H{"gt": unreportedPopulationSize}}}, request["query"])
+
+	request = filtersRequest(map[string]interface{}{"type": "dataset", "keys": "populationSize"}, 10)
+	assert.Contains(t, request["aggs"].(gin.H)["populationSize"], "range")
+	assert.NotContains(t, request, "query")
+}
@@ -0,0 +1,158 @@
+package search
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+)
+
+// funderField is the data use field holding the free text funder names.
+const funderField = "fundersAndSponsors"
+
+// funderAliases maps the lower case form of each known funder name variant
+// to its canonical name.
+var funderAliases = map[string]string{}
+
+// canonicalFunders maps each canonical funder name to all of its known
+// variants, including the canonical name itself.
+var canonicalFunders = map[string][]string{}
+
+// loadFunderNormalisation reads the funder normalisation map from the JSON
+// file at path.  The file is expected to map each canonical funder name to
+// a list of the variant spellings that should be treated as that funder:
+//
+//	{
+//		"Medical Research Council": ["MRC", "UKRI MRC"]
+//	}
+func loadFunderNormalisation(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var funders map[string][]string
+	if err := json.Unmarshal(content, &funders); err != nil {
+		return err
+	}
+
+	setFunderNormalisation(funders)
+	return nil
+}
+
+// setFunderNormalisation replaces the current funder normalisation map.
+func setFunderNormalisation(funders map[string][]string) {
+	aliases := make(map[string]string)
+	canonical := make(map[string][]string)
+	for name, variants := range funders {
+		all := append([]string{name}, variants...)
+		for _, variant := range all {
+			aliases[normaliseFunderKey(variant)] = name
+		}
+		canonical[name] = all
+	}
+	funderAliases = aliases
+	canonicalFunders = canonical
+}
+
+func normaliseFunderKey(funder string) string {
+	return strings.ToLower(strings.TrimSpace(funder))
+}
+
+// canonicalFunder returns the canonical name for the given funder, or the
+// funder unchanged if it has no known canonical form.
+func canonicalFunder(funder string) string {
+	if name, ok := funderAliases[normaliseFunderKey(funder)]; ok {
+		return name
+	}
+	return funder
+}
+
+// isFunderField reports whether the filter or aggregation key refers to the
+// funder field, with or without a .keyword suffix.
+func isFunderField(key string) bool {
+	return strings.TrimSuffix(key, ".keyword") == funderField
+}
+
+// expandFunderTerms returns the filter values for the funder field with every
+// selected funder expanded to all of its known variants, so that selecting
+// the canonical funder matches documents using any spelling of it.
+func expandFunderTerms(terms []interface{}) []interface{} {
+	expanded := []interface{}{}
+	seen := make(map[string]bool)
+	for _, t := range terms {
+		funder, ok := t.(string)
+		if !ok {
+			expanded = append(expanded, t)
+			continue
+		}
+		variants, ok := canonicalFunders[canonicalFunder(funder)]
+		if !ok {
+			variants = []string{funder}
+		}
+		for _, variant := range variants {
+			if !seen[variant] {
+				seen[variant] = true
+				expanded = append(expanded, variant)
+			}
+		}
+	}
+	return expanded
+}
+
+// normaliseFunderBuckets merges the terms aggregation buckets of any funder
+// aggregations in aggs so that all variants of a funder are reported as a
+// single bucket under the canonical name, with the doc counts summed.
+// Note a document listing more than one variant of the same funder is
+// counted once per variant.
+func normaliseFunderBuckets(aggs map[string]interface{}) {
+	if len(funderAliases) == 0 {
+		return
+	}
+	for key, agg := range aggs {
+		if !isFunderField(key) {
+			continue
+		}
+		aggMap, ok := agg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		buckets, ok := aggMap["buckets"].([]interface{})
+		if !ok {
+			continue
+		}
+
+		merged := []interface{}{}
+		byName := make(map[string]map[string]interface{})
+		for _, b := range buckets {
+			bucket, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			funder, ok := bucket["key"].(string)
+			if !ok {
+				merged = append(merged, bucket)
+				continue
+			}
+			name := canonicalFunder(funder)
+			count, _ := bucket["doc_count"].(float64)
+			if existing, ok := byName[name]; ok {
+				existingCount, _ := existing["doc_count"].(float64)
+				existing["doc_count"] = existingCount + count
+				continue
+			}
+			mergedBucket := map[string]interface{}{"key": name, "doc_count": count}
+			byName[name] = mergedBucket
+			merged = append(merged, mergedBucket)
+		}
+
+		sort.SliceStable(merged, func(i, j int) bool {
+			iCount, _ := merged[i].(map[string]interface{})["doc_count"].(float64)
+			jCount, _ := merged[j].(map[string]interface{})["doc_count"].(float64)
+			return iCount > jCount
+		})
+		aggMap["buckets"] = merged
+		slog.Debug("Normalised funder buckets", "buckets", len(buckets), "merged", len(merged))
+	}
+}
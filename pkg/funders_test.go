@@ -0,0 +1,100 @@
+package search
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setTestFunders(t *testing.T) {
+	setFunderNormalisation(map[string][]string{
+		"Medical Research Council": {"MRC", "UKRI MRC"},
+	})
+	t.Cleanup(func() { setFunderNormalisation(map[string][]string{}) })
+}
+
+func TestLoadFunderNormalisation(t *testing.T) {
+	t.Cleanup(func() { setFunderNormalisation(map[string][]string{}) })
+
+	path := filepath.Join(t.TempDir(), "funders.json")
+	content, _ := json.Marshal(map[string][]string{"Wellcome Trust": {"Wellcome"}})
+	os.WriteFile(path, content, 0644)
+
+	err := loadFunderNormalisation(path)
+	assert.Nil(t, err)
+	assert.EqualValues(t, "Wellcome Trust", canonicalFunder("wellcome "))
+	assert.EqualValues(t, "Unknown Funder", canonicalFunder("Unknown Funder"))
+
+	err = loadFunderNormalisation(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestExpandFunderTerms(t *testing.T) {
+	setTestFunders(t)
+
+	expanded := expandFunderTerms([]interface{}{"MRC", "Other Funder"})
+	assert.ElementsMatch(
+		t,
+		[]interface{}{"Medical Research Council", "MRC", "UKRI MRC", "Other Funder"},
+		expanded,
+	)
+}
+
+func TestNormaliseFunderBuckets(t *testing.T) {
+	setTestFunders(t)
+
+	aggs := map[string]interface{}{
+		"fundersAndSponsors": map[string]interface{}{
+			"buckets": []interface{}{
+				map[string]interface{}{"key": "Wellcome Trust", "doc_count": 6.0},
+				map[string]interface{}{"key": "MRC", "doc_count": 4.0},
+				map[string]interface{}{"key": "Medical Research Council", "doc_count": 3.0},
+				map[string]interface{}{"key": "ukri mrc", "doc_count": 1.0},
+			},
+		},
+		"sector": map[string]interface{}{
+			"buckets": []interface{}{
+				map[string]interface{}{"key": "MRC", "doc_count": 1.0},
+			},
+		},
+	}
+
+	normaliseFunderBuckets(aggs)
+
+	funderBuckets := aggs["fundersAndSponsors"].(map[string]interface{})["buckets"].([]interface{})
+	assert.Len(t, funderBuckets, 2)
+	assert.EqualValues(
+		t,
+		map[string]interface{}{"key": "Medical Research Council", "doc_count": 8.0},
+		funderBuckets[0],
+	)
+	assert.EqualValues(
+		t,
+		map[string]interface{}{"key": "Wellcome Trust", "doc_count": 6.0},
+		funderBuckets[1],
+	)
+
+	// other aggregations are left untouched
+	sectorBuckets := aggs["sector"].(map[string]interface{})["buckets"].([]interface{})
+	assert.EqualValues(t, "MRC", sectorBuckets[0].(map[string]interface{})["key"])
+}
+
+func TestDataUseElasticConfigFunderFilter(t *testing.T) {
+	setTestFunders(t)
+
+	durConfig := entityQuery("dataUseRegister", Query{
+		Filters: map[string]map[string]interface{}{
+			"dataUseRegister": {
+				"fundersAndSponsors": []interface{}{"Medical Research Council"},
+			},
+		},
+	})
+
+	filterJson, _ := json.Marshal(durConfig["post_filter"])
+	assert.Contains(t, string(filterJson), "\"fundersAndSponsors\":\"MRC\"")
+	assert.Contains(t, string(filterJson), "\"fundersAndSponsors\":\"UKRI MRC\"")
+	assert.Contains(t, string(filterJson), "\"fundersAndSponsors\":\"Medical Research Council\"")
+}
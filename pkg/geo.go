@@ -0,0 +1,106 @@
+package search
+
+import (
+	"log/slog"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// geoLocationField is the data provider field holding the provider's location.
+// Filtering and aggregating on distance requires it to be mapped as a geo_point.
+const geoLocationField = "geographicLocation"
+
+// defaultGeoDistanceRanges are the distance bands, in the aggregation unit,
+// used when a geo distance aggregation does not set its own ranges.
+var defaultGeoDistanceRanges = []gin.H{
+	{"to": 10},
+	{"from": 10, "to": 50},
+	{"from": 50, "to": 100},
+	{"from": 100},
+}
+
+// geoPointErrorRegex matches the errors elastic returns when a geo query or
+// aggregation is run against a field that is not mapped as a geo_point.
+var geoPointErrorRegex = regexp.MustCompile(
+	`(?i)(geo_point|failed to find geo field|is not a geo field)`,
+)
+
+// geoDistanceFilter builds a geo_distance query on key from a filter value of
+// the form
+//
+//	{"lat": 51.5, "lon": -0.12, "distance": "50km"}
+//
+// Returns false if the value is not of that form.
+func geoDistanceFilter(key string, terms interface{}) (gin.H, bool) {
+	value, ok := terms.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	lat, latOk := value["lat"].(float64)
+	lon, lonOk := value["lon"].(float64)
+	distance, distanceOk := value["distance"].(string)
+	if !latOk || !lonOk || !distanceOk || distance == "" {
+		return nil, false
+	}
+
+	return gin.H{
+		"geo_distance": gin.H{
+			"distance": distance,
+			key:        gin.H{"lat": lat, "lon": lon},
+		},
+	}, true
+}
+
+// geoDistanceAggregation builds a geo_distance aggregation on key, bucketing
+// documents by their distance from the origin of the requested aggregation:
+//
+//	{"type": "dataProvider", "keys": "geographicLocation", "origin": {"lat": 51.5, "lon": -0.12}, "unit": "km"}
+//
+// The ranges default to defaultGeoDistanceRanges and the unit to km.
+// Returns false if the aggregation has no usable origin.
+func geoDistanceAggregation(agg map[string]interface{}, key string) (gin.H, bool) {
+	origin, ok := agg["origin"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	lat, latOk := origin["lat"].(float64)
+	lon, lonOk := origin["lon"].(float64)
+	if !latOk || !lonOk {
+		return nil, false
+	}
+
+	unit, ok := agg["unit"].(string)
+	if !ok || unit == "" {
+		unit = "km"
+	}
+	var ranges interface{} = defaultGeoDistanceRanges
+	if requested, ok := agg["ranges"].([]interface{}); ok && len(requested) > 0 {
+		ranges = requested
+	}
+
+	return gin.H{
+		"geo_distance": gin.H{
+			"field":  key,
+			"origin": gin.H{"lat": lat, "lon": lon},
+			"unit":   unit,
+			"ranges": ranges,
+		},
+	}, true
+}
+
+// logGeoPointErrors logs a clear error if elastic rejected the query because
+// the location field is not mapped as a geo_point, rather than leaving it to
+// the generic null hits warning.
+func logGeoPointErrors(index string, body []byte) bool {
+	if !geoPointErrorRegex.Match(body) {
+		return false
+	}
+	slog.Error(
+		"Geo distance search failed, the field must be mapped as a geo_point",
+		"index", index,
+		"field", geoLocationField,
+		"response", string(body),
+	)
+	return true
+}
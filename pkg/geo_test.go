@@ -0,0 +1,79 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoDistanceFilter(t *testing.T) {
+	filter, ok := geoDistanceFilter(
+		geoLocationField,
+		map[string]interface{}{"lat": 51.5, "lon": -0.12, "distance": "50km"},
+	)
+	assert.True(t, ok)
+	assert.EqualValues(t, gin.H{
+		"geo_distance": gin.H{
+			"distance":       "50km",
+			geoLocationField: gin.H{"lat": 51.5, "lon": -0.12},
+		},
+	}, filter)
+
+	_, ok = geoDistanceFilter(geoLocationField, []interface{}{"London"})
+	assert.False(t, ok)
+
+	_, ok = geoDistanceFilter(geoLocationField, map[string]interface{}{"lat": 51.5, "lon": -0.12})
+	assert.False(t, ok)
+}
+
+func TestDataProviderGeoDistanceFilter(t *testing.T) {
+	query := Query{
+		QueryString: "",
+		Filters: map[string]map[string]interface{}{
+			"dataProvider": {
+				geoLocationField: map[string]interface{}{"lat": 51.5, "lon": -0.12, "distance": "50km"},
+			},
+		},
+	}
+	elasticConfig := entityQuery("dataProvider", query)
+
+	mustFilters := elasticConfig["post_filter"].(gin.H)["bool"].(gin.H)["must"].([]gin.H)
+	assert.Contains(t, mustFilters, gin.H{
+		"geo_distance": gin.H{
+			"distance":       "50km",
+			geoLocationField: gin.H{"lat": 51.5, "lon": -0.12},
+		},
+	})
+
+	// locations given by name are filtered on as values
+	query.Filters["dataProvider"][geoLocationField] = []interface{}{"London"}
+	elasticConfig = entityQuery("dataProvider", query)
+	mustFilters = elasticConfig["post_filter"].(gin.H)["bool"].(gin.H)["must"].([]gin.H)
+	assert.Len(t, mustFilters, 1)
+	assert.Contains(t, mustFilters[0], "bool")
+}
+
+func TestBuildAggregationsGeoDistance(t *testing.T) {
+	query := Query{
+		Aggregations: []map[string]interface{}{
+			{
+				"type":   "dataProvider",
+				"keys":   geoLocationField,
+				"origin": map[string]interface{}{"lat": 51.5, "lon": -0.12},
+			},
+		},
+	}
+	aggs := buildAggregations(query, []gin.H{})
+
+	geoAgg := aggs[geoLocationField].(gin.H)["aggs"].(gin.H)[geoLocationField].(gin.H)["geo_distance"].(gin.H)
+	assert.EqualValues(t, geoLocationField, geoAgg["field"])
+	assert.EqualValues(t, "km", geoAgg["unit"])
+	assert.EqualValues(t, defaultGeoDistanceRanges, geoAgg["ranges"])
+}
+
+func TestLogGeoPointErrors(t *testing.T) {
+	body := []byte(`{"error":{"root_cause":[{"type":"query_shard_exception","reason":"field [geographicLocation] is not a geo_point field"}]},"status":400}`)
+	assert.True(t, logGeoPointErrors("dataprovider", body))
+	assert.False(t, logGeoPointErrors("dataprovider", []byte(`{"hits":{"hits":[]}}`)))
+}
@@ -0,0 +1,266 @@
+package search
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMaxRequestBytes     = 1 << 20
+	defaultMaxJSONDepth        = 20
+	defaultCompressionMinBytes = 1024
+)
+
+// LimitRequestBody returns middleware that guards the handlers against
+// malformed or abusive request bodies.  Bodies larger than
+// SEARCH_MAX_REQUEST_BYTES (default 1MiB) are rejected with 413 and JSON
+// bodies nested deeper than SEARCH_MAX_JSON_DEPTH (default 20) with 400.
+func LimitRequestBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		maxBytes := int64(envInt("SEARCH_MAX_REQUEST_BYTES", defaultMaxRequestBytes))
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, errorBody(
+					c, fmt.Sprintf("request body exceeds the maximum of %d bytes", maxBytes),
+				))
+				return
+			}
+			requestLogger(requestIDFrom(c)).Debug("Failed to read request body", "error", err.Error())
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+
+		maxDepth := envInt("SEARCH_MAX_JSON_DEPTH", defaultMaxJSONDepth)
+		if jsonDepth(body) > maxDepth {
+			c.AbortWithStatusJSON(http.StatusBadRequest, errorBody(
+				c, fmt.Sprintf("request body is nested deeper than the maximum of %d", maxDepth),
+			))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
+
+// RequireAPIKey returns middleware that rejects requests with 401 unless they
+// carry one of the comma separated keys in SEARCH_API_KEYS, either as
+// "X-API-Key: <key>" or as "Authorization: Bearer <key>".  When no keys are
+// set every request is let through, so that deployments relying on the
+// gateway alone keep working.
+func RequireAPIKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := apiKeys()
+		if len(keys) == 0 {
+			c.Next()
+			return
+		}
+
+		key := apiKeyFrom(c)
+		if key == "" || !validAPIKey(key, keys) {
+			requestLogger(requestIDFrom(c)).Debug("Rejected request without a valid API key", "path", c.Request.URL.Path)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorBody(c, "a valid API key is required"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// apiKeyFrom returns the API key sent with the request, from X-API-Key or
+// else as the bearer token of Authorization, or "" if there is none.
+func apiKeyFrom(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return key
+	}
+	return ""
+}
+
+// apiKeys returns the API keys set in SEARCH_API_KEYS, ignoring blank entries.
+func apiKeys() []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv("SEARCH_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// validAPIKey reports whether key is one of keys, comparing each in constant
+// time.
+func validAPIKey(key string, keys []string) bool {
+	valid := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// jsonDepth returns the deepest level of object and array nesting in the
+// JSON document.  Invalid JSON is measured up to the point it becomes invalid
+// and left for the handler to reject.
+func jsonDepth(body []byte) int {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	depth, maxDepth := 0, 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return maxDepth
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			maxDepth = max(maxDepth, depth)
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// CompressResponse returns middleware that gzips the response of the handlers
+// it wraps when the client accepts gzip in Accept-Encoding.  Responses are
+// buffered until they reach SEARCH_COMPRESSION_MIN_BYTES (default 1KiB), and
+// those smaller than that are sent uncompressed as gzip would save little or
+// nothing.  Responses the handler has already encoded itself, or flushed
+// while streaming, are also passed through unchanged.  Every response varies
+// by Accept-Encoding, so caches don't serve a compressed response to clients
+// that didn't ask for one or the other way round.
+func CompressResponse() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		writer := &gzipWriter{
+			ResponseWriter: c.Writer,
+			minBytes:       envInt("SEARCH_COMPRESSION_MIN_BYTES", defaultCompressionMinBytes),
+		}
+		c.Writer = writer
+		defer func() {
+			c.Writer = writer.ResponseWriter
+		}()
+
+		c.Next()
+		if err := writer.close(); err != nil {
+			requestLogger(requestIDFrom(c)).Debug("Failed to write compressed response", "error", err.Error())
+		}
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header lists gzip, or any
+// encoding, without a q value of 0.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		name = strings.TrimSpace(name)
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		quality, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if value, err := strconv.ParseFloat(quality, 64); ok && err == nil && value == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter buffers the response written through it until it reaches
+// minBytes, then writes the buffer and everything after it gzipped.
+type gzipWriter struct {
+	gin.ResponseWriter
+	minBytes int
+	buffer   []byte
+	gzip     *gzip.Writer
+	// passthrough is set once the response is being written uncompressed.
+	passthrough bool
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	switch {
+	case w.gzip != nil:
+		return w.gzip.Write(data)
+	case w.passthrough:
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buffer = append(w.buffer, data...)
+	if len(w.buffer) < w.minBytes {
+		return len(data), nil
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		return len(data), w.writeBuffer()
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.gzip = gzip.NewWriter(w.ResponseWriter)
+	buffer := w.buffer
+	w.buffer = nil
+	if _, err := w.gzip.Write(buffer); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *gzipWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+// Flush sends what has been written so far to the client.  A response flushed
+// before it has been compressed is streamed the rest of the way uncompressed.
+func (w *gzipWriter) Flush() {
+	if w.gzip != nil {
+		w.gzip.Flush()
+	} else if err := w.writeBuffer(); err != nil {
+		return
+	}
+	w.ResponseWriter.Flush()
+}
+
+// writeBuffer writes the buffered response uncompressed and passes the rest
+// of the response through as written.
+func (w *gzipWriter) writeBuffer() error {
+	w.passthrough = true
+	buffer := w.buffer
+	w.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(buffer)
+	return err
+}
+
+// close finishes the response, writing out any buffered response too small to
+// have been compressed.
+func (w *gzipWriter) close() error {
+	if w.gzip != nil {
+		return w.gzip.Close()
+	}
+	return w.writeBuffer()
+}
@@ -0,0 +1,175 @@
+package search
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func limitedRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(LimitRequestBody())
+	router.POST("/search/tools", EntitySearch("tool"))
+	return router
+}
+
+func TestLimitRequestBodySize(t *testing.T) {
+	t.Setenv("SEARCH_MAX_REQUEST_BYTES", "64")
+	router := limitedRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/search/tools", strings.NewReader(`{"query": "asthma"}`))
+	router.ServeHTTP(w, req)
+	assert.EqualValues(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	largeQuery := `{"query": "` + strings.Repeat("a", 100) + `"}`
+	req, _ = http.NewRequest("POST", "/search/tools", strings.NewReader(largeQuery))
+	router.ServeHTTP(w, req)
+	assert.EqualValues(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "exceeds the maximum of 64 bytes")
+}
+
+func TestLimitRequestBodyDepth(t *testing.T) {
+	t.Setenv("SEARCH_MAX_JSON_DEPTH", "4")
+	router := limitedRouter()
+
+	w := httptest.NewRecorder()
+	query := `{"query": "asthma", "filters": {"tool": {"license": ["MIT"]}}}`
+	req, _ := http.NewRequest("POST", "/search/tools", strings.NewReader(query))
+	router.ServeHTTP(w, req)
+	assert.EqualValues(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	deepQuery := `{"query": "asthma", "filters": {"tool": {"license": [[["MIT"]]]}}}`
+	req, _ = http.NewRequest("POST", "/search/tools", strings.NewReader(deepQuery))
+	router.ServeHTTP(w, req)
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "nested deeper than the maximum of 4")
+}
+
+func TestJSONDepth(t *testing.T) {
+	assert.EqualValues(t, 0, jsonDepth([]byte(`"asthma"`)))
+	assert.EqualValues(t, 1, jsonDepth([]byte(`{"query": "asthma"}`)))
+	assert.EqualValues(t, 3, jsonDepth([]byte(`{"a": [{"b": 1}], "c": {}}`)))
+	assert.EqualValues(t, 2, jsonDepth([]byte(`{"a": [1, `)))
+}
+
+func compressedRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(CompressResponse())
+	router.POST("/search/datasets", EntitySearch("dataset"))
+	router.POST("/stream", func(c *gin.Context) {
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		c.Writer.WriteString("id,title\n")
+		c.Writer.Flush()
+		c.Writer.WriteString(strings.Repeat("1,asthma\n", 500))
+	})
+	return router
+}
+
+func TestCompressResponse(t *testing.T) {
+	hits := make([]string, 100)
+	for i := range hits {
+		hits[i] = fmt.Sprintf(
+			`{"_id": "%d", "_score": 1, "_source": {"title": "Asthma cohort %d", "abstract": "%s"}}`,
+			i, i, strings.Repeat("A longitudinal cohort of adults with asthma. ", 20),
+		)
+	}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusOK, `{"hits": {"total": {"value": 100}, "hits": [` + strings.Join(hits, ",") + `]}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+	router := compressedRouter()
+
+	search := func(acceptEncoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/search/datasets", strings.NewReader(`{"query": "asthma"}`))
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	plain := search("")
+	assert.EqualValues(t, http.StatusOK, plain.Code)
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "Accept-Encoding", plain.Header().Get("Vary"))
+
+	compressed := search("deflate, gzip;q=0.8")
+	assert.EqualValues(t, http.StatusOK, compressed.Code)
+	assert.EqualValues(t, "gzip", compressed.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "Accept-Encoding", compressed.Header().Get("Vary"))
+	assert.Less(t, compressed.Body.Len(), plain.Body.Len())
+
+	reader, err := gzip.NewReader(compressed.Body)
+	assert.Nil(t, err)
+	body, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.JSONEq(t, plain.Body.String(), string(body))
+
+	assert.Empty(t, search("gzip;q=0").Header().Get("Content-Encoding"))
+
+	t.Setenv("SEARCH_COMPRESSION_MIN_BYTES", "1000000")
+	small := search("gzip")
+	assert.Empty(t, small.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, []string{"Accept-Encoding"}, small.Header().Values("Vary"))
+	assert.JSONEq(t, plain.Body.String(), small.Body.String())
+}
+
+func TestCompressResponseStreaming(t *testing.T) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	compressedRouter().ServeHTTP(w, req)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.EqualValues(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.EqualValues(t, "id,title\n"+strings.Repeat("1,asthma\n", 500), w.Body.String())
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	assert.True(t, acceptsGzip("gzip"))
+	assert.True(t, acceptsGzip("br, gzip;q=0.5"))
+	assert.True(t, acceptsGzip("*"))
+	assert.False(t, acceptsGzip(""))
+	assert.False(t, acceptsGzip("deflate, br"))
+	assert.False(t, acceptsGzip("gzip;q=0"))
+	assert.False(t, acceptsGzip("gzip; q=0.000"))
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	router := gin.New()
+	router.Use(RequireAPIKey())
+	router.POST("/search/tools", EntitySearch("tool"))
+	status := func(header string, value string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/search/tools", strings.NewReader(`{"query": "asthma"}`))
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// no keys leaves the endpoints open
+	assert.EqualValues(t, http.StatusOK, status("", ""))
+
+	t.Setenv("SEARCH_API_KEYS", "first, second")
+	assert.EqualValues(t, http.StatusOK, status("X-API-Key", "first"))
+	assert.EqualValues(t, http.StatusOK, status("Authorization", "Bearer second"))
+	assert.EqualValues(t, http.StatusUnauthorized, status("", ""))
+	assert.EqualValues(t, http.StatusUnauthorized, status("X-API-Key", "third"))
+	assert.EqualValues(t, http.StatusUnauthorized, status("Authorization", "second"))
+	assert.EqualValues(t, http.StatusUnauthorized, status("Authorization", "Bearer "))
+}
@@ -0,0 +1,154 @@
+package search
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimitSweepInterval is how often the buckets of clients that have been
+// idle long enough to refill are dropped, see rateLimiter.sweep.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the tokens left to a client and when they were counted.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token bucket per client.  Each bucket holds up to burst
+// tokens and is refilled at rate tokens a second, with each request taking a
+// token and requests refused while the bucket is empty.
+type rateLimiter struct {
+	name  string
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimiter(name string, rate float64, burst float64) *rateLimiter {
+	return &rateLimiter{
+		name:    name,
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of the client, reporting whether there
+// was one and, if not, how long until there will be.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.swept) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that would be full by now, as a new bucket is the
+// same, so that clients seen once are not kept forever.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.swept = now
+}
+
+// RateLimit returns middleware limiting the rate of requests each client can
+// make to the routes it is mounted on, responding with 429 and a Retry-After
+// header once the limit is exceeded.  Routes of differing cost are limited
+// separately, with the limit of each named route set by
+// SEARCH_RATE_LIMIT_<ROUTE>, e.g. SEARCH_RATE_LIMIT_SEARCH=10, in requests a
+// second, and the burst of requests allowed above it by
+// SEARCH_RATE_LIMIT_<ROUTE>_BURST, which defaults to the limit.  Clients are
+// identified by their API key if they send a valid one, see RequireAPIKey,
+// otherwise by their IP.  Without a limit the middleware does nothing.
+//
+// The returned middleware holds the buckets of the clients, so must be shared
+// by all the routes counted against the same limit.
+func RateLimit(route string) gin.HandlerFunc {
+	name := "SEARCH_RATE_LIMIT_" + strings.ToUpper(route)
+	rate, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || rate <= 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	burst := float64(envInt(name+"_BURST", int(math.Ceil(rate))))
+	limiter := newRateLimiter(route, rate, max(burst, 1))
+
+	return func(c *gin.Context) {
+		allowed, wait := limiter.allow(rateLimitClient(c))
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			requestLogger(requestIDFrom(c)).Debug(
+				"Rate limited request",
+				"route", limiter.name,
+				"ip", c.ClientIP(),
+				"retryAfter", retryAfter,
+			)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, errorBody(
+				c, fmt.Sprintf("rate limit exceeded, retry after %d seconds", retryAfter),
+			))
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimitClient identifies the client of a request for rate limiting, by
+// the API key it sends if that is one of SEARCH_API_KEYS or else its IP, so
+// that a client can't escape its limit by sending made up keys.
+func rateLimitClient(c *gin.Context) string {
+	if key := apiKeyFrom(c); key != "" && validAPIKey(key, apiKeys()) {
+		return "key:" + key
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// TrustedProxies returns the proxies, as IPs or CIDRs, trusted to set the
+// client IP in X-Forwarded-For, given as a comma separated list in
+// SEARCH_TRUSTED_PROXIES.  Without any the client IP is always that of the
+// connection.
+func TrustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("SEARCH_TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
@@ -0,0 +1,89 @@
+package search
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter("search", 2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for range 3 {
+		allowed, _ := limiter.allow("ip:1.2.3.4")
+		assert.True(t, allowed)
+	}
+	allowed, wait := limiter.allow("ip:1.2.3.4")
+	assert.False(t, allowed)
+	assert.EqualValues(t, 500*time.Millisecond, wait)
+
+	// other clients have their own bucket
+	allowed, _ = limiter.allow("ip:5.6.7.8")
+	assert.True(t, allowed)
+
+	now = now.Add(500 * time.Millisecond)
+	allowed, _ = limiter.allow("ip:1.2.3.4")
+	assert.True(t, allowed)
+	allowed, _ = limiter.allow("ip:1.2.3.4")
+	assert.False(t, allowed)
+
+	// idle clients are dropped once their buckets would be full
+	now = now.Add(rateLimitSweepInterval)
+	limiter.allow("ip:1.2.3.4")
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimit(t *testing.T) {
+	status := func(router *gin.Engine, apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/filters", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	newRouter := func() *gin.Engine {
+		router := gin.New()
+		router.GET("/filters", RateLimit("filters"), func(c *gin.Context) { c.Status(http.StatusOK) })
+		return router
+	}
+
+	// no limit leaves the routes unlimited
+	router := newRouter()
+	for range 10 {
+		assert.EqualValues(t, http.StatusOK, status(router, "").Code)
+	}
+
+	t.Setenv("SEARCH_API_KEYS", "first,second")
+	t.Setenv("SEARCH_RATE_LIMIT_FILTERS", "0.5")
+	router = newRouter()
+	assert.EqualValues(t, http.StatusOK, status(router, "first").Code)
+	w := status(router, "first")
+	assert.EqualValues(t, http.StatusTooManyRequests, w.Code)
+	assert.EqualValues(t, "2", w.Header().Get("Retry-After"))
+	assert.EqualValues(t, http.StatusOK, status(router, "second").Code)
+
+	// keys that aren't valid are limited by IP, so can't be made up to get
+	// around the limit
+	assert.EqualValues(t, http.StatusOK, status(router, "made-up").Code)
+	assert.EqualValues(t, http.StatusTooManyRequests, status(router, "made-up-too").Code)
+
+	t.Setenv("SEARCH_RATE_LIMIT_FILTERS_BURST", "3")
+	router = newRouter()
+	for range 3 {
+		assert.EqualValues(t, http.StatusOK, status(router, "first").Code)
+	}
+	assert.EqualValues(t, http.StatusTooManyRequests, status(router, "first").Code)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	assert.Empty(t, TrustedProxies())
+
+	t.Setenv("SEARCH_TRUSTED_PROXIES", "10.0.0.0/8, ,192.168.1.1")
+	assert.EqualValues(t, []string{"10.0.0.0/8", "192.168.1.1"}, TrustedProxies())
+}
@@ -0,0 +1,113 @@
+package search
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RawSearchRequest is an elastic query body to run as given against the index
+// of an entity type, see RawSearch.
+type RawSearchRequest struct {
+	Index string `json:"index"`
+	Body  gin.H  `json:"body"`
+}
+
+// RawSearch runs a raw elastic query body against the index of an entity
+// type, bypassing the query builders, and responds with elastic's response as
+// is, e.g.
+//
+//	{"index": "dataset", "body": {"query": {"match": {"title": "asthma"}}}}
+//
+// The index is named either by its entity type or by the index itself.  It is
+// meant for debugging relevance and trying out new queries, so is only
+// enabled if SEARCH_ADMIN_TOKEN is set, and requests must be authorised with
+// that token as "Authorization: Bearer <token>".
+func RawSearch(c *gin.Context) {
+	if !requireAdmin(c, "Raw search") {
+		return
+	}
+
+	var request RawSearchRequest
+	if err := c.BindJSON(&request); err != nil {
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret raw search request", "error", err.Error())
+		return
+	}
+	index, ok := rawSearchIndex(request.Index)
+	if !ok {
+		c.JSON(http.StatusBadRequest, errorBody(
+			c, fmt.Sprintf("Raw searches of index %s are not supported", request.Index),
+		))
+		return
+	}
+	if request.Body == nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, "Raw search requires a body"))
+		return
+	}
+
+	requestLogger(requestIDFrom(c)).Info("Executing raw elastic query", "index", index, "query", request.Body)
+	_, body, err := executeElasticQuery(index, requestIDFrom(c), request.Body)
+	if errors.Is(err, errElasticResponse) || (err == nil && isElasticError(body)) {
+		c.Data(http.StatusBadGateway, "application/json", body)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, errorBody(c, "Raw search failed"))
+		return
+	}
+	c.Data(http.StatusOK, "application/json", body)
+}
+
+// RequireAdminToken returns middleware restricting the routes it is mounted
+// on to requests authorised with SEARCH_ADMIN_TOKEN, as for RawSearch.  The
+// routes are not found while no admin token is set.
+func RequireAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requireAdmin(c, "This endpoint") {
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireAdmin reports whether the request is authorised with
+// SEARCH_ADMIN_TOKEN, otherwise aborting it with 404 if there is no admin
+// token or 401 if it doesn't send it.
+func requireAdmin(c *gin.Context, name string) bool {
+	token := os.Getenv("SEARCH_ADMIN_TOKEN")
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, errorBody(c, name+" is not enabled"))
+		return false
+	}
+	if !authorisedAdmin(c.GetHeader("Authorization"), token) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, errorBody(c, name+" requires the admin token"))
+		return false
+	}
+	return true
+}
+
+// authorisedAdmin reports whether the Authorization header carries the admin
+// token as a bearer token.
+func authorisedAdmin(header string, token string) bool {
+	given, ok := strings.CutPrefix(header, "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// rawSearchIndex returns the index of the registered entity type named by
+// either its entity type or its index, reporting whether there is one.
+func rawSearchIndex(name string) (string, bool) {
+	if config, ok := entityConfig(name); ok {
+		return config.Index, true
+	}
+	for _, config := range entities {
+		if config.Index == name {
+			return config.Index, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,106 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawSearch(t *testing.T) {
+	var path string
+	var elasticQuery map[string]interface{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		path = req.URL.Path
+		json.NewDecoder(req.Body).Decode(&elasticQuery)
+		return http.StatusOK, `{"hits": {"hits": [{"_id": "1"}]}, "aggregations": {"types": {}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+	t.Setenv("SEARCH_ADMIN_TOKEN", "secret")
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"index": "dataUseRegister", "body": gin.H{"query": gin.H{"match_all": gin.H{}}}})
+	c.Request.Header.Set("Authorization", "Bearer secret")
+
+	RawSearch(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, "/datauseregister/_search", path)
+	assert.EqualValues(t, map[string]interface{}{"match_all": map[string]interface{}{}}, elasticQuery["query"])
+	assert.JSONEq(t, `{"hits": {"hits": [{"_id": "1"}]}, "aggregations": {"types": {}}}`, w.Body.String())
+
+	// elastic's errors are passed back as is
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusBadRequest, `{"error": {"type": "parsing_exception"}, "status": 400}`
+	})
+	w = httptest.NewRecorder()
+	c = GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"index": "dataset", "body": gin.H{"query": gin.H{"match": "asthma"}}})
+	c.Request.Header.Set("Authorization", "Bearer secret")
+
+	RawSearch(c)
+
+	assert.EqualValues(t, http.StatusBadGateway, w.Code)
+	assert.JSONEq(t, `{"error": {"type": "parsing_exception"}, "status": 400}`, w.Body.String())
+}
+
+func TestRawSearchRejectsUnauthorisedRequests(t *testing.T) {
+	body := gin.H{"index": "dataset", "body": gin.H{"query": gin.H{"match_all": gin.H{}}}}
+
+	// disabled without an admin token
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, body)
+	c.Request.Header.Set("Authorization", "Bearer ")
+	RawSearch(c)
+	assert.EqualValues(t, http.StatusNotFound, w.Code)
+
+	t.Setenv("SEARCH_ADMIN_TOKEN", "secret")
+	for _, header := range []string{"", "secret", "Bearer wrong"} {
+		w = httptest.NewRecorder()
+		c = GetTestGinContext(w)
+		MockPostWithBody(c, body)
+		c.Request.Header.Set("Authorization", header)
+		RawSearch(c)
+		assert.EqualValues(t, http.StatusUnauthorized, w.Code, "header %q", header)
+	}
+
+	for _, body := range []gin.H{
+		{"index": "unknown", "body": gin.H{}},
+		{"index": "dataset,tool", "body": gin.H{}},
+		{"index": "dataset"},
+	} {
+		w = httptest.NewRecorder()
+		c = GetTestGinContext(w)
+		MockPostWithBody(c, body)
+		c.Request.Header.Set("Authorization", "Bearer secret")
+		RawSearch(c)
+		assert.EqualValues(t, http.StatusBadRequest, w.Code, "request %v", body)
+	}
+}
+
+func TestRequireAdminToken(t *testing.T) {
+	status := func(header string) int {
+		router := gin.New()
+		router.POST("/mappings/refresh", RequireAdminToken(), func(c *gin.Context) { c.Status(http.StatusOK) })
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/mappings/refresh", nil)
+		req.Header.Set("Authorization", header)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// disabled without an admin token
+	assert.EqualValues(t, http.StatusNotFound, status("Bearer "))
+
+	t.Setenv("SEARCH_ADMIN_TOKEN", "secret")
+	assert.EqualValues(t, http.StatusUnauthorized, status(""))
+	assert.EqualValues(t, http.StatusUnauthorized, status("Bearer wrong"))
+	assert.EqualValues(t, http.StatusOK, status("Bearer secret"))
+}
@@ -0,0 +1,60 @@
+package search
+
+import (
+	"log/slog"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "requestID"
+)
+
+// RequestID returns middleware that gives every request a correlation ID,
+// taken from the X-Request-ID header if the caller sent one and generated
+// otherwise.  The ID is returned in the X-Request-ID response header, included
+// in error responses and logs, and sent to elastic as X-Opaque-Id so that its
+// slow logs can be matched to the request.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header(requestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// requestIDFrom returns the correlation ID of the request, or an empty string
+// if the RequestID middleware has not run.
+func requestIDFrom(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// requestLogger returns a logger that adds the request ID to every record.
+func requestLogger(requestID string) *slog.Logger {
+	if requestID == "" {
+		return slog.Default()
+	}
+	return slog.With("request_id", requestID)
+}
+
+// logger returns a logger that adds the ID of the request the query came from
+// to every record.
+func (query Query) logger() *slog.Logger {
+	return requestLogger(query.RequestID)
+}
+
+// errorBody returns the body of an error response with the given message,
+// including the request ID so that the failure can be traced in the logs.
+func errorBody(c *gin.Context, message string) gin.H {
+	body := gin.H{"error": message}
+	if requestID := requestIDFrom(c); requestID != "" {
+		body["requestId"] = requestID
+	}
+	return body
+}
@@ -0,0 +1,71 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func tracedRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(RequestID())
+	router.POST("/search/tools", EntitySearch("tool"))
+	router.POST("/search/datasets", EntitySearch("dataset"))
+	return router
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	router := tracedRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/search/tools", strings.NewReader(`{"query": "asthma"}`))
+	router.ServeHTTP(w, req)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	_, err := uuid.Parse(w.Header().Get(requestIDHeader))
+	assert.Nil(t, err)
+}
+
+func TestRequestIDPropagatedToElastic(t *testing.T) {
+	opaqueIDs := []string{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		opaqueIDs = append(opaqueIDs, req.Header.Get("X-Opaque-Id"))
+		return http.StatusOK, `{"hits": {"hits": []}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	router := tracedRouter()
+	for _, path := range []string{"/search/tools", "/search/datasets"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(`{"query": "asthma"}`))
+		req.Header.Set(requestIDHeader, "gateway-request-1")
+		router.ServeHTTP(w, req)
+
+		assert.EqualValues(t, "gateway-request-1", w.Header().Get(requestIDHeader))
+	}
+	assert.EqualValues(t, []string{"gateway-request-1", "gateway-request-1"}, opaqueIDs)
+}
+
+func TestRequestIDInErrorResponses(t *testing.T) {
+	router := tracedRouter()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/search/tools", strings.NewReader(`{"query": "asthma", "from": -1}`))
+	req.Header.Set(requestIDHeader, "gateway-request-2")
+	router.ServeHTTP(w, req)
+
+	var testResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &testResp)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+	assert.EqualValues(t, "gateway-request-2", testResp["requestId"])
+	assert.NotEmpty(t, testResp["error"])
+}
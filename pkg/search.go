@@ -2,6 +2,7 @@ package search
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -9,14 +10,20 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"math"
 	"net/http"
 	"os"
-	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -35,6 +42,58 @@ var (
 func DefineElasticClient() {
 	ElasticClient = elastic.DefaultClient()
 	BigQueryClient = bigqueryclient.DefaultBigQueryClient()
+
+	if funderFile := os.Getenv("FUNDER_NORMALISATION_FILE"); funderFile != "" {
+		if err := loadFunderNormalisation(funderFile); err != nil {
+			slog.Warn("Could not load funder normalisation", "error", err.Error())
+		}
+	}
+	if synonymsFile := os.Getenv("SEARCH_SYNONYMS_FILE"); synonymsFile != "" {
+		if err := loadSynonyms(synonymsFile); err != nil {
+			slog.Warn("Could not load search synonyms", "error", err.Error())
+		}
+		reloadInterval := time.Duration(envInt(
+			"SEARCH_SYNONYMS_RELOAD_SECONDS",
+			int(defaultSynonymsReloadInterval.Seconds()),
+		)) * time.Second
+		if reloadInterval > 0 {
+			go watchSynonyms(synonymsFile, reloadInterval)
+		}
+	}
+	if stopPhrasesFile := os.Getenv("SEARCH_STOP_PHRASES_FILE"); stopPhrasesFile != "" {
+		if err := loadStopPhrases(stopPhrasesFile); err != nil {
+			slog.Warn("Could not load search stop phrases", "error", err.Error())
+		}
+		reloadInterval := time.Duration(envInt(
+			"SEARCH_STOP_PHRASES_RELOAD_SECONDS",
+			int(defaultStopPhrasesReloadInterval.Seconds()),
+		)) * time.Second
+		if reloadInterval > 0 {
+			go watchStopPhrases(stopPhrasesFile, reloadInterval)
+		}
+	}
+	epmcBreaker = newCircuitBreaker(
+		"EPMC",
+		envInt("EPMC_BREAKER_THRESHOLD", defaultEPMCBreakerThreshold),
+		time.Duration(envInt(
+			"EPMC_BREAKER_COOLDOWN_SECONDS",
+			int(defaultEPMCBreakerCooldown.Seconds()),
+		))*time.Second,
+	)
+	explanationSlots = newExplanationSlots()
+	elasticQuerySlots = newElasticQuerySlots()
+	seedAggregationFieldOverrides()
+	if overridesFile := os.Getenv("AGGREGATION_FIELD_OVERRIDES_FILE"); overridesFile != "" {
+		if err := loadAggregationFieldOverrides(overridesFile); err != nil {
+			slog.Warn("Could not load aggregation field overrides", "error", err.Error())
+		}
+	}
+	if mappingFile := os.Getenv("EPMC_FIELD_MAPPING_FILE"); mappingFile != "" {
+		if err := loadEPMCFieldMapping(mappingFile); err != nil {
+			slog.Warn("Could not load EPMC field mapping", "error", err.Error())
+		}
+	}
+	loadIndexMappings()
 }
 
 /*
@@ -61,14 +120,149 @@ where:
 - type is a string matching the name of an elasticsearch index e.g. "dataset"
 - key is a string matching a field in the elastic search index specified e.g. "publisherName"
 - value1 is a value matching values in the specified fields of the elastic index e.g. "publisher A"
+
+Optional fields adjust how the search is run:
+- from and size page through results, size defaults to SEARCH_NO_RECORDS and
+from + size may not exceed SEARCH_MAX_RESULT_WINDOW
+- highlight sets the highlighting options, see HighlightOptions
+- searchAfter requests cursor pagination of dataset results; pass [] for the
+first page and then the nextCursor from each response to fetch the next page
+- aggPercentages adds to each aggregation bucket the percentage of the total
+hits it represents
+- debug returns the full elastic _explanation of each hit instead of stripping it
+- aggregationSize sets the number of buckets returned for each terms aggregation,
+see aggregationSize
+- dedupKey names a field of _source identifying the same entity across indices,
+in which case the generic search drops all but the highest scoring occurrence
+- minimumShouldMatch sets how many of the query clauses a hit must match, e.g.
+"2" or "75%", see minimumShouldMatch
+- excludeIds lists the IDs of documents that must not be returned
+- minScore drops hits whose relevance score is below it.  Scores come from the
+main query only, as the filters are applied afterwards as a post_filter
+- filterInQuery applies the filters in the main query instead of a post_filter,
+so that they also restrict the hits counted in aggregations
+- analyzer sets the analyzer the query string is analysed with, see
+searchAnalyzer
+- exact only matches documents containing the query string as an exact phrase,
+with no fuzziness or synonyms
+- prefix and wildcard map a field to a prefix or wildcard pattern its value
+must match, e.g. {"name": "bio"} or {"datasetDOI": "10.1234/*"}.  Wildcard
+patterns starting with * or ? are slow and are rejected unless
+allowLeadingWildcard is set
+- collapseField returns only the highest scoring hit of those sharing a value of
+the field, e.g. "doi", with up to collapseInnerHits of the others under its
+inner_hits.  It is supported by datasets and publications, see withCollapse
+- returnQuery returns the body of the query sent to elastic in each response
+under _query, unless SEARCH_DISABLE_DEBUG_FEATURES is set
+- strict rejects filters on entity types or keys that are not in the index
+mappings, see validateFilterKeys
+- matchPhrasePrefix also matches documents whose title or name starts with
+the query string, treating its last word as a prefix, for searching as the user
+types.  It is supported by datasets, tools and collections
 */
 type Query struct {
-	QueryString  string                            `json:"query"`
-	Filters      map[string]map[string]interface{} `json:"filters"`
-	Aggregations []map[string]interface{}          `json:"aggs"`
-	IDs          []string                          `json:"ids"`
+	QueryString          string                            `json:"query"`
+	Filters              map[string]map[string]interface{} `json:"filters"`
+	Aggregations         []map[string]interface{}          `json:"aggs"`
+	IDs                  []string                          `json:"ids"`
+	From                 int                               `json:"from"`
+	Size                 int                               `json:"size"`
+	Highlight            HighlightOptions                  `json:"highlight"`
+	SearchAfter          []interface{}                     `json:"searchAfter"`
+	AggPercentages       bool                              `json:"aggPercentages"`
+	Debug                bool                              `json:"debug"`
+	AggregationSize      int                               `json:"aggregationSize"`
+	GlobalAggs           bool                              `json:"globalAggs"`
+	DedupKey             string                            `json:"dedupKey"`
+	MinimumShouldMatch   string                            `json:"minimumShouldMatch"`
+	ExcludeIDs           []string                          `json:"excludeIds"`
+	MinScore             float64                           `json:"minScore"`
+	FilterInQuery        bool                              `json:"filterInQuery"`
+	Analyzer             string                            `json:"analyzer"`
+	Exact                bool                              `json:"exact"`
+	TitleOnly            bool                              `json:"titleOnly"`
+	Operators            bool                              `json:"operators"`
+	DefaultOperator      string                            `json:"defaultOperator"`
+	Prefix               map[string]string                 `json:"prefix"`
+	Wildcard             map[string]string                 `json:"wildcard"`
+	AllowLeadingWildcard bool                              `json:"allowLeadingWildcard"`
+	MatchPhrasePrefix    bool                              `json:"matchPhrasePrefix"`
+	Strict               bool                              `json:"strict"`
+	ReturnQuery          bool                              `json:"returnQuery"`
+	CollapseField        string                            `json:"collapseField"`
+	CollapseInnerHits    int                               `json:"collapseInnerHits"`
+	RecencyBoost         *RecencyBoostOptions              `json:"recencyBoost"`
+	NormaliseScores      bool                              `json:"normaliseScores"`
+	PhraseSlop           int                               `json:"phraseSlop"`
+	EmptyQueryOrder      string                            `json:"emptyQueryOrder"`
+	Seed                 *int                              `json:"seed"`
+	RequestID            string                            `json:"-"`
+}
+
+// HighlightOptions controls how matches are snippeted in the highlight section
+// of each hit.  When left unset the whole of each highlighted field is returned.
+// Matched terms are wrapped in PreTags/PostTags, which default to <em> and </em>.
+// If Join is set the fragments for each field are also returned joined into a
+// single string (separated by Separator) under the hit's highlightText.
+// NoMatchSize sets, per field, how many characters from the start of the field
+// to return as a fallback snippet when nothing in it matched.  The fallback
+// snippets of a hit are limited to SEARCH_HIGHLIGHT_FALLBACK_CAP bytes in total.
+// Fields replaces the fields highlighted by default for each entity type, with
+// an empty list turning highlighting off.
+type HighlightOptions struct {
+	Fields            *[]string      `json:"fields"`
+	FragmentSize      int            `json:"fragmentSize"`
+	NumberOfFragments int            `json:"numberOfFragments"`
+	PreTags           []string       `json:"preTags"`
+	PostTags          []string       `json:"postTags"`
+	Join              bool           `json:"join"`
+	Separator         string         `json:"separator"`
+	NoMatchSize       map[string]int `json:"noMatchSize"`
+}
+
+// RecencyBoostOptions controls the boost given to recent entities, for the
+// entity types with a RecencyField, when set on a search with a query string.
+// The score of each hit is increased by up to Weight, decaying with the age of
+// the entity past Offset by the Function (gauss, exp or linear) such that an
+// entity Scale older than Offset gains Decay * Weight.  Unset options default
+// to SEARCH_RECENCY_SCALE, SEARCH_RECENCY_OFFSET, a Decay of 0.5 and a Weight
+// of 1.
+type RecencyBoostOptions struct {
+	Function string  `json:"function"`
+	Scale    string  `json:"scale"`
+	Offset   string  `json:"offset"`
+	Decay    float64 `json:"decay"`
+	Weight   float64 `json:"weight"`
 }
 
+// The orders of the hits of searches without a query string, see
+// emptyQuerySort.
+const (
+	emptyQueryOrderRandom       = "random"
+	emptyQueryOrderRecent       = "recent"
+	emptyQueryOrderAlphabetical = "alphabetical"
+)
+
+const (
+	defaultRecencyFunction = "gauss"
+	defaultRecencyScale    = "365d"
+	defaultRecencyOffset   = "30d"
+	defaultRecencyDecay    = 0.5
+	defaultRecencyWeight   = 1.0
+)
+
+const (
+	defaultHighlightPreTag      = "<em>"
+	defaultHighlightPostTag     = "</em>"
+	defaultHighlightSeparator   = " ... "
+	defaultHighlightFallbackCap = 2000
+)
+
+const (
+	defaultPhrasePrefixMaxExpansions = 10
+	maxPhrasePrefixMaxExpansions     = 50
+)
+
 type SimilarSearch struct {
 	ID string `json:"id"`
 }
@@ -80,20 +274,57 @@ type SearchResponse struct {
 	Shards       map[string]interface{} `json:"_shards"`
 	Hits         HitsField              `json:"hits"`
 	Aggregations map[string]interface{} `json:"aggregations"`
+	NextCursor   []interface{}          `json:"nextCursor,omitempty"`
+	MissingIDs   []string               `json:"missingIds,omitempty"`
+	Query        gin.H                  `json:"_query,omitempty"`
+	Seed         *int                   `json:"seed,omitempty"`
 }
 
 type HitsField struct {
-	Total    map[string]interface{} `json:"total"`
-	MaxScore float64                `json:"max_score"`
-	Hits     []Hit                  `json:"hits"`
+	Total      map[string]interface{} `json:"total"`
+	TotalLabel string                 `json:"totalLabel,omitempty"`
+	MaxScore   float64                `json:"max_score"`
+	Hits       []Hit                  `json:"hits"`
+}
+
+// TotalHits returns the total number of hits reported by elastic and whether
+// it is exact.  Unless track_total_hits allows it elastic stops counting at
+// 10,000, reporting that number with relation "gte" as a lower bound.
+func (h HitsField) TotalHits() (int, bool) {
+	total, _ := h.Total["value"].(float64)
+	relation, _ := h.Total["relation"].(string)
+	return int(total), relation != "gte"
+}
+
+// totalLabel formats the total number of hits for display, e.g. "1,234", or
+// "10,000+" when the total is only a lower bound.
+func totalLabel(hits HitsField) string {
+	total, exact := hits.TotalHits()
+	digits := strconv.Itoa(total)
+	var label strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			label.WriteByte(',')
+		}
+		label.WriteRune(digit)
+	}
+	if !exact {
+		label.WriteByte('+')
+	}
+	return label.String()
 }
 
 type Hit struct {
-	Explanation map[string]interface{} `json:"_explanation"`
-	Id          string                 `json:"_id"`
-	Score       float64                `json:"_score"`
-	Source      map[string]interface{} `json:"_source"`
-	Highlight   map[string][]string    `json:"highlight"`
+	Explanation     map[string]interface{} `json:"_explanation"`
+	Id              string                 `json:"_id"`
+	Score           float64                `json:"_score"`
+	NormalisedScore float64                `json:"_normalised_score,omitempty"`
+	Source          map[string]interface{} `json:"_source"`
+	Highlight       map[string][]string    `json:"highlight"`
+	HighlightText   map[string]string      `json:"highlightText,omitempty"`
+	Sort            []interface{}          `json:"sort,omitempty"`
+	Rank            int                    `json:"rank"`
+	InnerHits       map[string]interface{} `json:"inner_hits,omitempty"`
 }
 
 type SearchErrorResponse struct {
@@ -107,24 +338,44 @@ type RootCause struct {
 	Index  string `json:"index"`
 }
 
+// SearchAnalytics is a row of the search analytics table, recording the search
+// of a single entity type.  A generic search records a row for each entity
+// type, all with the same RequestID.  Timestamp is the UTC time of the search,
+// as the DATETIME column has no time zone.
 type SearchAnalytics struct {
 	UUID             string
-	Timestamp        string
+	Timestamp        civil.DateTime
 	EntityType       string
 	SearchTerm       string
 	FilterUsed       string
 	PageResults      string
 	EntitiesReturned int
+	RequestID        string
+}
+
+// searchAnalyticsSchema is the schema of the BigQuery table search analytics
+// are uploaded to, each row of which is saved by SearchAnalytics.Save.
+var searchAnalyticsSchema = bigquery.Schema{
+	{Name: "UUID", Required: true, Type: bigquery.StringFieldType},
+	{Name: "Timestamp", Required: false, Type: bigquery.DateTimeFieldType},
+	{Name: "EntityType", Required: true, Type: bigquery.StringFieldType},
+	{Name: "SearchTerm", Required: false, Type: bigquery.StringFieldType},
+	{Name: "FilterUsed", Repeated: false, Type: bigquery.JSONFieldType},
+	{Name: "PageResults", Required: false, Type: bigquery.JSONFieldType},
+	{Name: "EntitiesReturned", Required: true, Type: bigquery.IntegerFieldType},
+	{Name: "RequestID", Required: false, Type: bigquery.StringFieldType},
 }
 
 func (a *SearchAnalytics) Save() (map[string]bigquery.Value, string, error) {
 	return map[string]bigquery.Value{
 		"UUID":             a.UUID,
 		"Timestamp":        a.Timestamp,
+		"EntityType":       a.EntityType,
 		"SearchTerm":       a.SearchTerm,
 		"FilterUsed":       a.FilterUsed,
 		"PageResults":      a.PageResults,
 		"EntitiesReturned": a.EntitiesReturned,
+		"RequestID":        a.RequestID,
 	}, "", nil
 }
 
@@ -134,7 +385,7 @@ func HealthCheck(c *gin.Context) {
 	// Ping elastic
 	elasticResponse, err := ElasticClient.Info()
 	if err != nil {
-		slog.Debug(fmt.Sprintf("%v", err.Error()))
+		slog.Debug("Failed to ping elastic", "error", err.Error())
 	}
 	results["elastic_status"] = elasticResponse.StatusCode
 
@@ -143,10 +394,7 @@ func HealthCheck(c *gin.Context) {
 	if elasticResponse.StatusCode != 200 {
 		body, err := io.ReadAll(elasticResponse.Body)
 		if err != nil {
-			slog.Debug(fmt.Sprintf(
-				"Failed to read elastic response with %s",
-				err.Error()),
-			)
+			slog.Debug("Failed to read elastic response", "error", err.Error())
 		}
 		var elasticError SearchErrorResponse
 		json.Unmarshal(body, &elasticError)
@@ -154,11 +402,18 @@ func HealthCheck(c *gin.Context) {
 		results["elastic_error"] = rootCause.Type
 	}
 
-	// TODO: Ping search explanation extractor once it has a healthcheck endpoint of its own
+	// Ping search explanation extractor
+	if os.Getenv("SEARCH_EXPLANATION_EXTRACTOR") != "" {
+		status, extractorErr := pingExplanationExtractor()
+		results["explanation_extractor_status"] = status
+		if extractorErr != "" {
+			results["explanation_extractor_error"] = extractorErr
+		}
+	}
 
 	// Ping BigQuery 
 	ctx := context.Background()
-	_, bqErr := BigQueryClient.Dataset(os.Getenv("BQ_DATASET_NAME")).Metadata(ctx)
+	_, bqErr := BigQueryClient.Dataset(bigQueryTables().Dataset).Metadata(ctx)
 	if bqErr != nil {
 		var e *googleapi.Error
 		if errors.As(bqErr, &e) {
@@ -176,17 +431,22 @@ func HealthCheck(c *gin.Context) {
 	)
 	req, err := http.NewRequest("GET", urlPath, strings.NewReader(""))
 	if err != nil {
-		slog.Info(fmt.Sprintf("Failed to build EPMC query with: %s", err.Error()))
+		slog.Info("Failed to build EPMC query", "error", err.Error())
 	}
 	req.Header.Add("Content-Type", "application/json")
 
 	response, err := Client.Do(req)
 	if err != nil {
-		slog.Info(fmt.Sprintf("Failed to execute EPMC query with: %s", err.Error()))
+		slog.Info("Failed to execute EPMC query", "error", err.Error())
 	}
 	defer response.Body.Close()
 
 	results["epmc_status"] = response.StatusCode
+	results["epmc_circuit"] = epmcBreaker.State()
+	results["search_retries_exhausted"] = searchRetriesExhausted.Load()
+	results["explanation_extraction_paused"] = explanationExtractionPaused.Load()
+	results["elastic_queries_in_flight"] = elasticQueriesInFlight.Load()
+	results["elastic_queries_queued"] = elasticQueriesQueued.Load()
 
 	if response.StatusCode != 200 {
 		results["epmc_error"] = response.Status
@@ -200,170 +460,341 @@ func HealthCheck(c *gin.Context) {
 func EnsureTableExists() error {
 
 	ctx := context.Background()
-    dataset := BigQueryClient.Dataset(os.Getenv("BQ_DATASET_NAME"))
-    table := dataset.Table(os.Getenv("BQ_TABLE_NAME"))
+    table := bigQueryTables().analytics(BigQueryClient)
 
-	schema := bigquery.Schema{
-		{Name: "UUID", Required: true, Type: bigquery.StringFieldType},
-		{Name: "Timestamp", Required: false, Type: bigquery.DateTimeFieldType},
-		{Name: "EntityType", Required: true, Type: bigquery.StringFieldType},
-		{Name: "SearchTerm", Required: false, Type: bigquery.StringFieldType},
-		{Name: "FilterUsed", Repeated: false, Type: bigquery.JSONFieldType},
-		{Name: "PageResults", Required: false, Type: bigquery.JSONFieldType},
-		{Name: "EntitiesReturned", Required: true, Type: bigquery.IntegerFieldType},
+	// Clustering by entity type keeps queries of the analytics of a single
+	// entity type from scanning the whole table.
+	metadata := &bigquery.TableMetadata{
+		Schema:     searchAnalyticsSchema,
+		Clustering: &bigquery.Clustering{Fields: []string{"EntityType"}},
 	}
-
-	if err := table.Create(ctx, &bigquery.TableMetadata{Schema: schema}); err != nil {
+	if err := table.Create(ctx, metadata); err != nil {
 		var e *googleapi.Error
 		if errors.As(err, &e)  && e.Code == 409 {
-			slog.Debug(fmt.Sprintf("%s", err.Error()))
-			return nil
+			slog.Debug("BigQuery table already exists", "error", err.Error())
+			return addMissingAnalyticsColumns(ctx, table)
 		}
-		slog.Info(fmt.Sprintf("Could not create table: %s", err.Error()))
+		slog.Info("Could not create table", "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+
+// addMissingAnalyticsColumns adds the columns of searchAnalyticsSchema missing
+// from an existing analytics table, created before they were added.
+func addMissingAnalyticsColumns(ctx context.Context, table *bigquery.Table) error {
+	metadata, err := table.Metadata(ctx)
+	if err != nil {
+		slog.Info("Could not read table metadata", "error", err.Error())
+		return err
+	}
+
+	missing := missingColumns(metadata.Schema, searchAnalyticsSchema)
+	if len(missing) == 0 {
+		return nil
+	}
+	update := bigquery.TableMetadataToUpdate{Schema: append(metadata.Schema, missing...)}
+	if _, err := table.Update(ctx, update, metadata.ETag); err != nil {
+		slog.Info("Could not add columns to table", "error", err.Error())
 		return err
 	}
+	slog.Info("Added columns to BigQuery table", "columns", len(missing))
 	return nil
 }
 
+// missingColumns returns the fields of want that are not in schema.
+func missingColumns(schema bigquery.Schema, want bigquery.Schema) bigquery.Schema {
+	var missing bigquery.Schema
+	for _, field := range want {
+		found := slices.ContainsFunc(schema, func(existing *bigquery.FieldSchema) bool {
+			return existing.Name == field.Name
+		})
+		if !found {
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
 
-// SearchGeneric performs searches of the ElasticSearch indices for datasets,
-// tools and collections, using the query supplied in the gin.Context.
+// SearchGeneric performs searches of the ElasticSearch indices of each of the
+// registered entity types, using the query supplied in the gin.Context.
 // Search results are returned grouped by entity type.
 func SearchGeneric(c *gin.Context) {
 	var query Query
 	if err := c.BindJSON(&query); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
 		return
 	}
-	datasetResults := make(chan SearchResponse)
-	toolResults := make(chan SearchResponse)
-	collectionResults := make(chan SearchResponse)
-	dataUseResults := make(chan SearchResponse)
-	publicationResults := make(chan SearchResponse)
-	dataProviderResults := make(chan SearchResponse)
-	dataCustodianNetworkResults := make(chan SearchResponse)
-
-	results := make(map[string]interface{})
+	query.RequestID = requestIDFrom(c)
+	if err := validateQuery(query); err != nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+		return
+	}
+	query.Filters = mergeSharedFilters(normaliseFilterEntityTypes(query.Filters))
+	query = withSeed(query)
+	searchQuery := withoutStopPhrases(query)
 
-	go datasetChannel(query, datasetResults)
-	go toolChannel(query, toolResults)
-	go collectionChannel(query, collectionResults)
-	go dataUseChannel(query, dataUseResults)
-	go publicationChannel(query, publicationResults)
-	go dataProviderChannel(query, dataProviderResults)
-	go dataCustodianNetworkChannel(query, dataCustodianNetworkResults)
+	responses := make(chan entityResult)
+	for _, config := range entities {
+		go func() {
+			response, err := config.Search(defaultService(), searchQuery)
+			if err == nil {
+				BQUpload(query, response, config.AnalyticsType)
+			}
+			responses <- entityResult{entity: config.Name, response: response, err: err}
+		}()
+	}
 
-	for i := 0; i < 7; i++ {
-		select {
-		case datasets := <-datasetResults:
-			results["dataset"] = datasets
-		case tools := <-toolResults:
-			results["tool"] = tools
-		case collections := <-collectionResults:
-			results["collection"] = collections
-		case data_uses := <-dataUseResults:
-			results["dataUseRegister"] = data_uses
-		case publications := <-publicationResults:
-			results["publication"] = publications
-		case dataProviders := <-dataProviderResults:
-			results["dataProvider"] = dataProviders
-		case dataCustodianNetworks := <-dataCustodianNetworkResults:
-			results["datacustodiannetwork"] = dataCustodianNetworks
+	results := make(map[string]interface{})
+	failures := make(map[string]string)
+	for range entities {
+		result := <-responses
+		results[result.entity] = result.response
+		if result.err != nil {
+			query.logger().Warn("Search of entity type failed in generic search", "entity", result.entity, "error", result.err.Error())
+			failures[result.entity] = searchFailureReason(result.err)
 		}
 	}
+	if query.DedupKey != "" {
+		dedupeAcrossIndices(results, query.DedupKey)
+	}
+	if query.NormaliseScores {
+		normaliseScores(results)
+	}
+	results["matchedTypes"] = matchedTypes(results)
+	if len(failures) > 0 {
+		results[searchErrorsKey] = failures
+	}
 
 	c.JSON(http.StatusOK, results)
 }
 
-func DatasetSearch(c *gin.Context) {
-	var query Query
-	if err := c.BindJSON(&query); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
-		return
-	}
+// entityResult is the response of the search of one entity type in the
+// generic search, along with the error if the search failed.
+type entityResult struct {
+	entity   string
+	response SearchResponse
+	err      error
+}
 
-	results := datasetSearch(query)
-	BQUpload(query, results, "dataset")
-	c.JSON(http.StatusOK, results)
+// searchErrorsKey is the key of the generic search results listing the entity
+// types whose search failed, with why, so that their empty results can be
+// told apart from searches that found nothing.
+const searchErrorsKey = "_errors"
+
+// searchFailureReason describes why the search of an entity type failed for
+// the caller, without the details of the failure, which are logged instead.
+func searchFailureReason(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return "search timed out"
+	case errors.Is(err, errSearchRetriesExhausted):
+		return "search failed after retrying"
+	default:
+		return "search unavailable"
+	}
 }
 
-func datasetChannel(query Query, res chan SearchResponse) {
-	elasticResp := datasetSearch(query)
-	res <- elasticResp
+// sharedFilterKey is the key of the filters in a generic search that apply to
+// every entity type.
+const sharedFilterKey = "_all"
+
+// mergeSharedFilters returns the filters with those under sharedFilterKey
+// merged into the filters of every entity type.  A filter given for an entity
+// type takes precedence over a shared filter with the same key.
+func mergeSharedFilters(filters map[string]map[string]interface{}) map[string]map[string]interface{} {
+	shared, ok := filters[sharedFilterKey]
+	if !ok {
+		return filters
+	}
+
+	merged := make(map[string]map[string]interface{})
+	for entity, entityFilters := range filters {
+		if entity != sharedFilterKey {
+			merged[entity] = entityFilters
+		}
+	}
+	for _, entity := range entityTypes() {
+		entityFilters := make(map[string]interface{})
+		for key, terms := range shared {
+			entityFilters[key] = terms
+		}
+		for key, terms := range filters[entity] {
+			entityFilters[key] = terms
+		}
+		merged[entity] = entityFilters
+	}
+	return merged
 }
 
-// datasetSearch performs a search of the ElasticSearch datasets index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-func datasetSearch(query Query) SearchResponse {
-	var buf bytes.Buffer
+// matchedTypes returns the entity types in the generic search results with a
+// non-zero total number of hits.
+func matchedTypes(results map[string]interface{}) []string {
+	matched := []string{}
+	for _, entityType := range entityTypes() {
+		response, ok := results[entityType].(SearchResponse)
+		if !ok {
+			continue
+		}
+		if total, _ := response.Hits.Total["value"].(float64); total > 0 {
+			matched = append(matched, entityType)
+		}
+	}
+	return matched
+}
 
-	elasticQuery := datasetElasticConfig(query)
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic config %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
+// dedupeAcrossIndices removes hits that appear in the results of more than one
+// entity type, identified by the value of key in their _source, keeping only
+// the highest scoring occurrence.  Ties are kept in the entity type registered
+// first.  The total of each entity type is reduced by the number of hits
+// dropped from it.  Hits without the key are always kept.
+func dedupeAcrossIndices(results map[string]interface{}, key string) {
+	type occurrence struct {
+		entityType string
+		index      int
+		score      float64
+	}
+	best := make(map[string]occurrence)
+	for _, entityType := range entityTypes() {
+		response, ok := results[entityType].(SearchResponse)
+		if !ok {
+			continue
+		}
+		for i, hit := range response.Hits.Hits {
+			id, ok := hit.Source[key]
+			if !ok || id == nil {
+				continue
+			}
+			dedupID := fmt.Sprint(id)
+			if current, seen := best[dedupID]; seen && current.score >= hit.Score {
+				continue
+			}
+			best[dedupID] = occurrence{entityType: entityType, index: i, score: hit.Score}
+		}
 	}
 
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex("dataset"),
-		ElasticClient.Search.WithBody(&buf),
-	)
+	for _, entityType := range entityTypes() {
+		response, ok := results[entityType].(SearchResponse)
+		if !ok {
+			continue
+		}
+		kept := []Hit{}
+		for i, hit := range response.Hits.Hits {
+			id, ok := hit.Source[key]
+			if ok && id != nil {
+				winner := best[fmt.Sprint(id)]
+				if winner.entityType != entityType || winner.index != i {
+					continue
+				}
+			}
+			kept = append(kept, hit)
+		}
+		dropped := len(response.Hits.Hits) - len(kept)
+		if dropped == 0 {
+			continue
+		}
 
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
+		total := make(map[string]interface{})
+		for k, v := range response.Hits.Total {
+			total[k] = v
+		}
+		if value, ok := total["value"].(float64); ok {
+			total["value"] = max(value-float64(dropped), 0)
+		}
+		response.Hits.Total = total
+		response.Hits.Hits = kept
+		assignRanks(response.Hits.Hits)
+		results[entityType] = response
 	}
-	defer response.Body.Close()
+}
 
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
+// normaliseScores sets the normalised score of each hit in the results of each
+// entity type to its score divided by the highest score of the entity type's
+// hits, so between 0 and 1.  Each index is scored with different fields and
+// boosts, so raw scores cannot be compared across entity types; the normalised
+// scores are only a heuristic for interleaving the results, the best hit of an
+// entity type with only poor matches still scoring 1.  Raw scores are kept.
+func normaliseScores(results map[string]interface{}) {
+	for _, entityType := range entityTypes() {
+		response, ok := results[entityType].(SearchResponse)
+		if !ok {
+			continue
+		}
+		maxScore := 0.0
+		for _, hit := range response.Hits.Hits {
+			maxScore = max(maxScore, hit.Score)
+		}
+		if maxScore == 0 {
+			continue
+		}
+		for i := range response.Hits.Hits {
+			response.Hits.Hits[i].NormalisedScore = response.Hits.Hits[i].Score / maxScore
+		}
 	}
+}
 
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
+// EntitySearch returns the handler of the search endpoint of the entity type,
+// which searches its index and responds with the results.
+func EntitySearch(entityType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query Query
+		if err := c.BindJSON(&query); err != nil {
+			requestLogger(requestIDFrom(c)).Debug("Failed to interpret search query", "error", err.Error())
+			return
+		}
+		query.RequestID = requestIDFrom(c)
+		if err := validateQuery(query); err != nil {
+			c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+			return
+		}
+		query = withSeed(query)
 
-	if elasticResp.Hits.Hits == nil {
-		// When there are genuinely no matches elastic returns hits == [].
-		// When the hits == nil this implies something has actually gone wrong
-		// for example an aggregation that cannot be calculated.
-		// So we throw a warning in the case where hits == nil and more info
-		// if debug mode is on.
-		var elasticError SearchErrorResponse
-		json.Unmarshal(body, &elasticError)
-		// Try to extract the root cause message; if unable throw generic warning
-		rootCause := elasticError.Error["root_cause"][0]
-		if rootCause.Reason != "" {
-			slog.Warn(
-				fmt.Sprintf("Search query returned elastic error: %s",
-					rootCause.Reason,
-				))
-		} else {
-			slog.Warn("Hits from elastic are null, query may be malformed")
+		config, _ := entityConfig(entityType)
+		results, err := config.Search(defaultService(), withoutStopPhrases(query))
+		if err != nil {
+			c.JSON(http.StatusBadGateway, errorBody(c, fmt.Sprintf("Search of %s failed", config.Name)))
+			return
 		}
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
+		BQUpload(query, results, config.AnalyticsType)
+		c.JSON(http.StatusOK, results)
 	}
+}
 
-	stripExplanation(elasticResp, query, "dataset")
-	newAggs := flattenAggs(elasticResp)
+// searchEntity performs a search of the index of the entity type using the
+// provided query as the search term.  Results are returned in the format
+// returned by elastic (SearchResponse), along with an error if the search
+// could not be run or kept failing, see executeSearchWithRetry.
+func (s *SearchService) searchEntity(config EntityConfig, query Query) (SearchResponse, error) {
+	var elasticQuery gin.H
+	elasticResp, body, err := s.executeSearchWithRetry(config.Index, query.RequestID, func() gin.H {
+		elasticQuery = config.ElasticConfig(query)
+		return elasticQuery
+	})
+	if err != nil {
+		query.logger().Debug("Entity search failed", "index", config.Index, "error", err.Error())
+	}
 
-	elasticResp.Aggregations = newAggs
+	if elasticResp.Hits.Hits == nil && !logGeoPointErrors(config.Index, body) {
+		logElasticError(body, config.Index, query.RequestID)
+		query.logger().Debug("Null result elastic query", "query", elasticQuery)
+	}
 
-	return elasticResp
+	if config.CursorPaged && query.SearchAfter != nil {
+		elasticResp.NextCursor = nextCursor(elasticResp)
+	}
+
+	elasticResp = postProcessResponse(elasticResp, query, config.SettingName)
+	normaliseFunderBuckets(elasticResp.Aggregations)
+
+	return withExecutedQuery(elasticResp, query, elasticQuery), err
 }
 
-// datasetElasticConfig defines the body of the query to the elastic datasets index
-func datasetElasticConfig(query Query) gin.H {
+// entityElasticConfig defines the body of the query to the elastic index of
+// the entity type, matching the query string against its SearchFields and
+// filtering on the filters given under its name.
+func entityElasticConfig(config EntityConfig, query Query) gin.H {
 	var mainQuery gin.H
-	var sortQuery []gin.H
 
 	if query.QueryString == "" {
 		if len(query.IDs) == 0 {
@@ -372,7 +803,7 @@ func datasetElasticConfig(query Query) gin.H {
 					"query": gin.H{
 						"match_all": gin.H{},
 					},
-					"random_score": gin.H{},
+					"random_score": randomScore(query),
 				},
 			}
 		} else {
@@ -391,44 +822,23 @@ func datasetElasticConfig(query Query) gin.H {
 									},
 								},
 							},
-							"random_score": gin.H{},
-						},
-					},
-				},
-			}
-
-			sortQuery = []gin.H{
-				{
-					"_script": gin.H{
-						"type": "number",
-						"script": gin.H{
-							"lang":   "painless",
-							"source": "params.order.indexOf(doc['_id'].value)",
-							"params": gin.H{
-								"order": query.IDs,
-							},
+							"random_score": randomScore(query),
 						},
-						"order": "asc",
 					},
 				},
 			}
 		}
 	} else {
-		searchableFields := []string{
-			"abstract",
-			"keywords",
-			"description",
-			"shortTitle",
-			"title",
-			"named_entities",
-			"datasetDOI",
+		searchableFields := queryFields(config, query)
+		mm1Fields := searchableFields
+		if len(config.RelatedFields) > 0 {
+			mm1Fields = config.RelatedFields
 		}
 		mm1 := gin.H{
 			"multi_match": gin.H{
 				"query":     query.QueryString,
-				"fields":    searchableFields,
+				"fields":    mm1Fields,
 				"fuzziness": "AUTO:5,7",
-				"analyzer":  "medterms_search_analyzer",
 			},
 		}
 		mm2 := gin.H{
@@ -436,74 +846,70 @@ func datasetElasticConfig(query Query) gin.H {
 				"query":     query.QueryString,
 				"fields":    searchableFields,
 				"fuzziness": "AUTO:5,7",
-				"analyzer":  "medterms_search_analyzer",
-				"operator":  "and",
-				"boost":     2,
 			},
 		}
+		if !config.AnyTerms {
+			mm2["multi_match"].(gin.H)["operator"] = "and"
+		}
+		if config.MatchBoost > 0 {
+			mm2["multi_match"].(gin.H)["boost"] = config.MatchBoost
+		}
 		mm3 := gin.H{
 			"multi_match": gin.H{
-				"query":    query.QueryString,
-				"type":     "phrase",
-				"fields":   searchableFields,
-				"analyzer": "medterms_search_analyzer",
-				"boost":    3,
+				"query":  query.QueryString,
+				"fields": searchableFields,
+				"type":   "phrase",
+				"slop":   query.PhraseSlop,
+				"boost":  config.PhraseBoost,
 			},
 		}
+		clauses := []gin.H{mm1, mm2, mm3}
+		if query.TitleOnly && len(config.RelatedFields) > 0 {
+			clauses = clauses[1:]
+		}
+		should := append(clauses, synonymQueries(query.QueryString, searchableFields)...)
+		if config.StructuralMetadata && structuralMetadataEnabled() && !query.TitleOnly {
+			should = append(should, structuralMetadataQuery(query.QueryString))
+		}
 		mainQuery = gin.H{
 			"bool": gin.H{
-				"should": []gin.H{mm1, mm2, mm3},
+				"should": should,
 			},
 		}
+		if query.MatchPhrasePrefix && len(config.PrefixFields) > 0 {
+			applyMatchPhrasePrefix(mainQuery, query.QueryString, config.PrefixFields...)
+		}
+		if query.Operators {
+			applyQueryOperators(mainQuery, query, searchableFields)
+		}
+		applyMinimumShouldMatch(mainQuery, query, config.SettingName)
+		applyAnalyzer(mainQuery, searchAnalyzer(query, config.SettingName))
+		if query.Exact {
+			applyExactMode(mainQuery)
+		}
+		mainQuery = withRecencyBoost(mainQuery, query, config.RecencyField)
 	}
 
 	mustFilters := []gin.H{}
-	for key, terms := range query.Filters["dataset"] {
-		filters := []gin.H{}
-		if key == "dateRange" {
-			rangeFilter := gin.H{
-				"bool": gin.H{
-					"must": []gin.H{
-						{"range": gin.H{"startDate": gin.H{"lte": terms.([]interface{})[1]}}},
-						{"range": gin.H{"endDate": gin.H{"gte": terms.([]interface{})[0]}}},
-					},
-				},
-			}
-			mustFilters = append(mustFilters, rangeFilter)
-		} else if key == "populationSize" {
-			includeNull := terms.(map[string]interface{})["includeUnreported"].(bool)
-			from := terms.(map[string]interface{})["from"]
-			to := terms.(map[string]interface{})["to"]
-			var rangeFilter gin.H
-			if includeNull {
-				rangeFilter = gin.H{
-					"bool": gin.H{
-						"should": []gin.H{
-							{"range": gin.H{key: gin.H{"gte": from, "lte": to}}},
-							{"term": gin.H{"populationSize": -1}},
-						},
-					},
-				}
-			} else {
-				rangeFilter = gin.H{
-					"bool": gin.H{
-						"must": []gin.H{
-							{"range": gin.H{key: gin.H{"gte": from, "lte": to}}},
-						},
-					},
-				}
-			}
-			mustFilters = append(mustFilters, rangeFilter)
-		} else {
-			for _, t := range terms.([]interface{}) {
-				filters = append(filters, gin.H{"term": gin.H{key: t}})
-			}
-			mustFilters = append(mustFilters, gin.H{
-				"bool": gin.H{
-					"should": filters,
-				},
-			})
+	filters := normaliseFilterEntityTypes(query.Filters)[config.Name]
+	var types map[string]string
+	if len(filters) > 0 {
+		types = fieldTypes(config.Index)
+	}
+	for _, key := range slices.Sorted(maps.Keys(filters)) {
+		terms := filters[key]
+		var filter gin.H
+		ok := false
+		if buildFilter, custom := config.FilterBuilders[key]; custom {
+			filter, ok = buildFilter(terms)
+		} else if values, isList := terms.([]interface{}); isList {
+			filter, ok = valuesFilter(types, key, values), true
+		}
+		if !ok {
+			query.logger().Debug("Ignoring unusable filter", "entityType", config.Name, "key", key, "filter", terms)
+			continue
 		}
+		mustFilters = append(mustFilters, filter)
 	}
 
 	f1 := gin.H{
@@ -515,1267 +921,293 @@ func datasetElasticConfig(query Query) gin.H {
 	agg1 := buildAggregations(query, mustFilters)
 
 	response := gin.H{
-		"size":  os.Getenv("SEARCH_NO_RECORDS"),
-		"query": mainQuery,
-		"highlight": gin.H{
-			"fields": gin.H{
-				"description": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-				"abstract": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-			},
-		},
-		"explain":     true,
+		"size":        resultSize(query),
+		"from":        query.From,
+		"query":       excludeIDs(withPatternQueries(mainQuery, query), query.ExcludeIDs),
 		"post_filter": f1,
 		"aggs":        agg1,
 	}
 
+	response = withExplain(response, query, config.SettingName)
+
+	if highlight := buildHighlight(query, config.Name); highlight != nil {
+		response["highlight"] = highlight
+	}
+
+	if query.FilterInQuery {
+		response = withFiltersInQuery(response, mustFilters)
+	}
+
+	if query.MinScore > 0 {
+		response["min_score"] = query.MinScore
+	}
+
 	if len(query.IDs) > 0 {
-		response["sort"] = sortQuery
+		response["sort"] = idOrderSort(query.IDs)
+	} else if sort := emptyQuerySort(query, config.Name); sort != nil {
+		response["sort"] = sort
+	}
+
+	if config.Collapsible {
+		response = withCollapse(response, query, config.Index)
+	}
+
+	if config.CursorPaged && query.SearchAfter != nil {
+		response = withSearchAfter(response, query.SearchAfter)
 	}
 
 	return response
+}
+
+// buildHighlight constructs the "highlight" part of an elastic search query
+// of the entity type, applying any fragment options set on the query.  The
+// HighlightFields of the entity type are highlighted unless the query lists
+// the fields to highlight, of which those highlightable for the entity type
+// are used.  If there are no fields to highlight nil is returned.
+func buildHighlight(query Query, entityType string) gin.H {
+	config, _ := entityConfig(entityType)
+	fields := config.HighlightFields
+	if query.Highlight.Fields != nil {
+		fields = []string{}
+		for _, field := range *query.Highlight.Fields {
+			if slices.Contains(config.HighlightableFields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	highlightFields := gin.H{}
+	for _, field := range fields {
+		fieldConfig := gin.H{
+			"boundary_scanner": "sentence",
+			"fragment_size":    query.Highlight.FragmentSize,
+			"no_match_size":    highlightNoMatchSize(query, field),
+		}
+		if query.Highlight.NumberOfFragments > 0 {
+			fieldConfig["number_of_fragments"] = query.Highlight.NumberOfFragments
+		}
+		highlightFields[field] = fieldConfig
+	}
+
+	preTags := query.Highlight.PreTags
+	if len(preTags) == 0 {
+		preTags = []string{defaultHighlightPreTag}
+	}
+	postTags := query.Highlight.PostTags
+	if len(postTags) == 0 {
+		postTags = []string{defaultHighlightPostTag}
+	}
 
+	return gin.H{
+		"pre_tags":  preTags,
+		"post_tags": postTags,
+		"fields":    highlightFields,
+	}
 }
 
-func ToolSearch(c *gin.Context) {
-	var query Query
-	if err := c.BindJSON(&query); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
-		return
+// highlightNoMatchSize returns the fallback snippet size requested for the
+// field, limited to the fallback cap since no more than that can be returned.
+func highlightNoMatchSize(query Query, field string) int {
+	size := query.Highlight.NoMatchSize[field]
+	if size < 0 {
+		return 0
 	}
-	results := toolSearch(query)
-	BQUpload(query, results, "tool")
-	c.JSON(http.StatusOK, results)
+	return min(size, highlightFallbackCap())
 }
 
-func toolChannel(query Query, res chan SearchResponse) {
-	elasticResp := toolSearch(query)
-	res <- elasticResp
+func highlightFallbackCap() int {
+	return envInt("SEARCH_HIGHLIGHT_FALLBACK_CAP", defaultHighlightFallbackCap)
 }
 
-// toolSearch performs a search of the ElasticSearch tools index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-func toolSearch(query Query) SearchResponse {
-	var buf bytes.Buffer
+// capHighlightFallbacks trims the fallback snippets of each hit, those highlight
+// fields with no matched terms, so that their total size is at most maxBytes.
+// The longest fallback is trimmed first so that short snippets survive intact.
+func capHighlightFallbacks(hits []Hit, preTags []string, maxBytes int) {
+	if len(preTags) == 0 {
+		preTags = []string{defaultHighlightPreTag}
+	}
+	for i := range hits {
+		var fallbacks []string
+		total := 0
+		for field, fragments := range hits[i].Highlight {
+			if len(fragments) == 1 && !containsAny(fragments[0], preTags) {
+				fallbacks = append(fallbacks, field)
+				total += len(fragments[0])
+			}
+		}
+		if total <= maxBytes {
+			continue
+		}
 
-	elasticQuery := toolsElasticConfig(query)
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic query %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
+		sort.Slice(fallbacks, func(a, b int) bool {
+			return len(hits[i].Highlight[fallbacks[a]][0]) > len(hits[i].Highlight[fallbacks[b]][0])
+		})
+		excess := total - maxBytes
+		for _, field := range fallbacks {
+			if excess <= 0 {
+				break
+			}
+			snippet := hits[i].Highlight[field][0]
+			trimmed := truncateUTF8(snippet, max(len(snippet)-excess, 0))
+			excess -= len(snippet) - len(trimmed)
+			hits[i].Highlight[field] = []string{trimmed}
+		}
 	}
+}
 
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex("tool"),
-		ElasticClient.Search.WithBody(&buf),
-	)
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
 
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
+// truncateUTF8 cuts s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
 	}
-	defer response.Body.Close()
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
 
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
+// joinHighlights sets the HighlightText of each hit to its highlight fragments
+// joined into a single string per field.  The raw Highlight is left unchanged.
+func joinHighlights(hits []Hit, separator string) {
+	if separator == "" {
+		separator = defaultHighlightSeparator
+	}
+	for i := range hits {
+		if len(hits[i].Highlight) == 0 {
+			continue
+		}
+		joined := make(map[string]string, len(hits[i].Highlight))
+		for field, fragments := range hits[i].Highlight {
+			joined[field] = strings.Join(fragments, separator)
+		}
+		hits[i].HighlightText = joined
 	}
+}
 
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
+// valuesFilter builds the filter matching documents having any of the values
+// for key, expanded to all the equivalent funders or synonyms, given the field
+// types of the index searched.
+func valuesFilter(types map[string]string, key string, values []interface{}) gin.H {
+	if isFunderField(key) {
+		values = expandFunderTerms(values)
+	} else {
+		values = expandSynonymTerms(values)
+	}
+	filters := []gin.H{}
+	for _, t := range values {
+		filters = append(filters, filterTerm(types, key, t))
+	}
+	return gin.H{
+		"bool": gin.H{
+			"should": filters,
+		},
+	}
+}
 
-	if elasticResp.Hits.Hits == nil {
-		slog.Warn("Hits from elastic are null, query may be malformed")
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
+// dateRangeFilter builds a bool filter from a date range filter value of the
+// form [<from>, <to>].  Either bound may be left open, either by omitting it
+// (a single element array is read as a lower bound only) or by passing null or
+// an empty string in its place.  The upper bound is compared against startField
+// and the lower bound against endField, so a document matches if its own range
+// overlaps the requested one.
+// Returns false if the value is not an array or contains no usable bounds.
+func dateRangeFilter(terms interface{}, startField string, endField string) (gin.H, bool) {
+	bounds, ok := terms.([]interface{})
+	if !ok || len(bounds) == 0 {
+		return nil, false
+	}
+
+	rangeFilters := []gin.H{}
+	if from := bounds[0]; from != nil && from != "" {
+		rangeFilters = append(rangeFilters, gin.H{"range": gin.H{endField: gin.H{"gte": from}}})
+	}
+	if len(bounds) > 1 {
+		if to := bounds[1]; to != nil && to != "" {
+			rangeFilters = append(rangeFilters, gin.H{"range": gin.H{startField: gin.H{"lte": to}}})
+		}
+	}
+	if len(rangeFilters) == 0 {
+		return nil, false
 	}
 
-	stripExplanation(elasticResp, query, "tool")
-	newAggs := flattenAggs(elasticResp)
+	return gin.H{
+		"bool": gin.H{
+			"must": rangeFilters,
+		},
+	}, true
+}
 
-	elasticResp.Aggregations = newAggs
+// unreportedPopulationSize is the populationSize of datasets that do not
+// report their population size.
+const unreportedPopulationSize = -1
 
-	return elasticResp
-}
+// populationSizeFilter builds a bool filter from a population size filter value
+// of the form {"from": <from>, "to": <to>, "includeUnreported": <bool>}.
+// Either bound may be left open by omitting it or passing null or an empty
+// string, with an open lower bound still excluding the datasets that do not
+// report their population size unless includeUnreported, which defaults to
+// false, is set.
+// Returns false if the value is not an object, or sets no bounds and includes
+// the unreported datasets so would match every dataset.
+func populationSizeFilter(terms interface{}) (gin.H, bool) {
+	options, ok := terms.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	includeUnreported, _ := options["includeUnreported"].(bool)
 
-// toolsElasticConfig defines the body of the query to the elastic tools index
-func toolsElasticConfig(query Query) gin.H {
-	var mainQuery gin.H
-	var sortQuery []gin.H
+	bounds := gin.H{"gte": 0}
+	if from := options["from"]; from != nil && from != "" {
+		bounds["gte"] = from
+	}
+	if to := options["to"]; to != nil && to != "" {
+		bounds["lte"] = to
+	}
+	rangeFilter := gin.H{"range": gin.H{"populationSize": bounds}}
 
-	if query.QueryString == "" {
-		if len(query.IDs) == 0 {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"match_all": gin.H{},
-					},
-					"random_score": gin.H{},
-				},
-			}
-		} else {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"function_score": gin.H{
-							"query": gin.H{
-								"bool": gin.H{
-									"filter": []gin.H{
-										{
-											"terms": gin.H{
-												"_id": query.IDs,
-											},
-										},
-									},
-								},
-							},
-							"random_score": gin.H{},
-						},
-					},
-				},
-			}
-
-			sortQuery = []gin.H{
-				{
-					"_script": gin.H{
-						"type": "number",
-						"script": gin.H{
-							"lang":   "painless",
-							"source": "params.order.indexOf(doc['_id'].value)",
-							"params": gin.H{
-								"order": query.IDs,
-							},
-						},
-						"order": "asc",
-					},
-				},
-			}
-		}
-	} else {
-		searchableFields := []string{
-			"tags",
-			"programmingLanguage",
-			"name",
-			"link",
-			"description",
-			"resultsInsights",
-			"license",
-		}
-		mm1 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-			},
-		}
-		mm2 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-				"operator":  "and",
-			},
-		}
-		mm3 := gin.H{
-			"multi_match": gin.H{
-				"query":  query.QueryString,
-				"fields": searchableFields,
-				"type":   "phrase",
-				"boost":  2,
-			},
-		}
-		mainQuery = gin.H{
-			"bool": gin.H{
-				"should": []gin.H{mm1, mm2, mm3},
-			},
-		}
-	}
-
-	mustFilters := []gin.H{}
-	for key, terms := range query.Filters["tool"] {
-		filters := []gin.H{}
-		for _, t := range terms.([]interface{}) {
-			filters = append(filters, gin.H{"term": gin.H{key: t}})
-		}
-		mustFilters = append(mustFilters, gin.H{
-			"bool": gin.H{
-				"should": filters,
-			},
-		})
-	}
-
-	f1 := gin.H{
-		"bool": gin.H{
-			"must": mustFilters,
-		},
-	}
-
-	agg1 := buildAggregations(query, mustFilters)
-
-	response := gin.H{
-		"size":  os.Getenv("SEARCH_NO_RECORDS"),
-		"query": mainQuery,
-		"highlight": gin.H{
-			"fields": gin.H{
-				"name": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-				"description": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-			},
-		},
-		"explain":     true,
-		"post_filter": f1,
-		"aggs":        agg1,
-	}
-
-	if len(query.IDs) > 0 {
-		response["sort"] = sortQuery
-	}
-
-	return response
-}
-
-func CollectionSearch(c *gin.Context) {
-	var query Query
-	if err := c.BindJSON(&query); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
-		return
-	}
-	results := collectionSearch(query)
-	BQUpload(query, results, "collection")
-	c.JSON(http.StatusOK, results)
-}
-
-func collectionChannel(query Query, res chan SearchResponse) {
-	elasticResp := collectionSearch(query)
-	res <- elasticResp
-}
-
-// collectionsSearch performs a search of the ElasticSearch collections index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-func collectionSearch(query Query) SearchResponse {
-	var buf bytes.Buffer
-
-	elasticQuery := collectionsElasticConfig(query)
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic query %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
-	}
-
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex("collection"),
-		ElasticClient.Search.WithBody(&buf),
-	)
-
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
-	}
-
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
-
-	if elasticResp.Hits.Hits == nil {
-		slog.Warn("Hits from elastic are null, query may be malformed")
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
-	}
-
-	stripExplanation(elasticResp, query, "collection")
-	newAggs := flattenAggs(elasticResp)
-
-	elasticResp.Aggregations = newAggs
-
-	return elasticResp
-}
-
-// collectionsElasticConfig defines the body of the query to the elastic collections index
-func collectionsElasticConfig(query Query) gin.H {
-	var mainQuery gin.H
-	var sortQuery []gin.H
-
-	if query.QueryString == "" {
-		if len(query.IDs) == 0 {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"match_all": gin.H{},
-					},
-					"random_score": gin.H{},
-				},
-			}
-		} else {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"function_score": gin.H{
-							"query": gin.H{
-								"bool": gin.H{
-									"filter": []gin.H{
-										{
-											"terms": gin.H{
-												"_id": query.IDs,
-											},
-										},
-									},
-								},
-							},
-							"random_score": gin.H{},
-						},
-					},
-				},
-			}
-
-			sortQuery = []gin.H{
-				{
-					"_script": gin.H{
-						"type": "number",
-						"script": gin.H{
-							"lang":   "painless",
-							"source": "params.order.indexOf(doc['_id'].value)",
-							"params": gin.H{
-								"order": query.IDs,
-							},
-						},
-						"order": "asc",
-					},
-				},
-			}
-		}
-	} else {
-		relatedObjectFields := []string{
-			"datasetTitles",
-			"datasetAbstracts",
-		}
-		searchableFields := []string{
-			"description",
-			"name",
-			"keywords",
-		}
-		mm1 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    relatedObjectFields,
-				"fuzziness": "AUTO:5,7",
-			},
-		}
-		mm2 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-				"boost":     2,
-			},
-		}
-		mm3 := gin.H{
-			"multi_match": gin.H{
-				"query":  query.QueryString,
-				"type":   "phrase",
-				"fields": searchableFields,
-				"boost":  3,
-			},
-		}
-		mainQuery = gin.H{
-			"bool": gin.H{
-				"should": []gin.H{mm1, mm2, mm3},
-			},
-		}
-	}
-
-	mustFilters := []gin.H{}
-	for key, terms := range query.Filters["collection"] {
-		filters := []gin.H{}
-		for _, t := range terms.([]interface{}) {
-			filters = append(filters, gin.H{"term": gin.H{key: t}})
-		}
-		mustFilters = append(mustFilters, gin.H{
-			"bool": gin.H{
-				"should": filters,
-			},
-		})
-	}
-
-	f1 := gin.H{
-		"bool": gin.H{
-			"must": mustFilters,
-		},
-	}
-
-	agg1 := buildAggregations(query, mustFilters)
-
-	response := gin.H{
-		"size":  os.Getenv("SEARCH_NO_RECORDS"),
-		"query": mainQuery,
-		"highlight": gin.H{
-			"fields": gin.H{
-				"description": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-				"name": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-				"keywords": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-			},
-		},
-		"explain":     true,
-		"post_filter": f1,
-		"aggs":        agg1,
-	}
-
-	if len(query.IDs) > 0 {
-		response["sort"] = sortQuery
-	}
-
-	return response
-}
-
-func DataUseSearch(c *gin.Context) {
-	var query Query
-	if err := c.BindJSON(&query); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
-		return
-	}
-	results := dataUseSearch(query)
-	BQUpload(query, results, "datauseregister")
-	c.JSON(http.StatusOK, results)
-}
-
-func dataUseChannel(query Query, res chan SearchResponse) {
-	elasticResp := dataUseSearch(query)
-	res <- elasticResp
-}
-
-// dataUseSearch performs a search of the ElasticSearch data uses index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-func dataUseSearch(query Query) SearchResponse {
-	var buf bytes.Buffer
-
-	elasticQuery := dataUseElasticConfig(query)
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic query %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
-	}
-
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex("datauseregister"),
-		ElasticClient.Search.WithBody(&buf),
-	)
-
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
-	}
-
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
-
-	if elasticResp.Hits.Hits == nil {
-		slog.Warn("Hits from elastic are null, query may be malformed")
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
-	}
-
-	stripExplanation(elasticResp, query, "dur")
-	newAggs := flattenAggs(elasticResp)
-
-	elasticResp.Aggregations = newAggs
-
-	return elasticResp
-}
-
-// dataUseElasticConfig defines the body of the query to the elastic data uses index
-func dataUseElasticConfig(query Query) gin.H {
-	var mainQuery gin.H
-	var sortQuery []gin.H
-
-	if query.QueryString == "" {
-		if len(query.IDs) == 0 {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"match_all": gin.H{},
-					},
-					"random_score": gin.H{},
-				},
-			}
-		} else {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"function_score": gin.H{
-							"query": gin.H{
-								"bool": gin.H{
-									"filter": []gin.H{
-										{
-											"terms": gin.H{
-												"_id": query.IDs,
-											},
-										},
-									},
-								},
-							},
-							"random_score": gin.H{},
-						},
-					},
-				},
-			}
-
-			sortQuery = []gin.H{
-				{
-					"_script": gin.H{
-						"type": "number",
-						"script": gin.H{
-							"lang":   "painless",
-							"source": "params.order.indexOf(doc['_id'].value)",
-							"params": gin.H{
-								"order": query.IDs,
-							},
-						},
-						"order": "asc",
-					},
-				},
-			}
-		}
-	} else {
-		searchableFields := []string{
-			"projectTitle",
-			"laySummary",
-			"publicBenefitStatement",
-			"technicalSummary",
-			"fundersAndSponsors",
-			"datasetTitles",
-			"keywords",
-			"collectionNames",
-			"publisherName",
-		}
-		mm1 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-			},
-		}
-		mm2 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-				"operator":  "and",
-			},
-		}
-		mm3 := gin.H{
-			"multi_match": gin.H{
-				"query":  query.QueryString,
-				"fields": searchableFields,
-				"type":   "phrase",
-				"boost":  2,
-			},
-		}
-		mainQuery = gin.H{
-			"bool": gin.H{
-				"should": []gin.H{mm1, mm2, mm3},
-			},
-		}
-	}
-
-	mustFilters := []gin.H{}
-	for key, terms := range query.Filters["dataUseRegister"] {
-		filters := []gin.H{}
-		for _, t := range terms.([]interface{}) {
-			filters = append(filters, gin.H{"term": gin.H{key: t}})
-		}
-		mustFilters = append(mustFilters, gin.H{
-			"bool": gin.H{
-				"should": filters,
-			},
-		})
-	}
-
-	f1 := gin.H{
-		"bool": gin.H{
-			"must": mustFilters,
-		},
-	}
-
-	agg1 := buildAggregations(query, mustFilters)
-
-	response := gin.H{
-		"size":  os.Getenv("SEARCH_NO_RECORDS"),
-		"query": mainQuery,
-		"highlight": gin.H{
-			"fields": gin.H{
-				"laySummary": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-			},
-		},
-		"explain":     true,
-		"post_filter": f1,
-		"aggs":        agg1,
-	}
-
-	if len(query.IDs) > 0 {
-		response["sort"] = sortQuery
-	}
-
-	return response
-}
-
-func PublicationSearch(c *gin.Context) {
-	var query Query
-	if err := c.BindJSON(&query); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
-		return
-	}
-	results := publicationSearch(query)
-	BQUpload(query, results, "publication")
-	c.JSON(http.StatusOK, results)
-}
-
-func publicationChannel(query Query, res chan SearchResponse) {
-	elasticResp := publicationSearch(query)
-	res <- elasticResp
-}
-
-// publicationSearch performs a search of the ElasticSearch publications index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-// The publications index consists of the publications that are hosted on the
-// Gateway - this is not a federated search.
-func publicationSearch(query Query) SearchResponse {
-	var buf bytes.Buffer
-
-	elasticQuery := publicationElasticConfig(query)
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic query %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
-	}
-
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex("publication"),
-		ElasticClient.Search.WithBody(&buf),
-	)
-
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
-	}
-
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
-
-	if elasticResp.Hits.Hits == nil {
-		slog.Warn("Hits from elastic are null, query may be malformed")
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
-	}
-
-	stripExplanation(elasticResp, query, "publication")
-	newAggs := flattenAggs(elasticResp)
-
-	elasticResp.Aggregations = newAggs
-
-	return elasticResp
-}
-
-// publicationElasticConfig defines the body of the query to the elastic publications index
-func publicationElasticConfig(query Query) gin.H {
-	var mainQuery gin.H
-	var sortQuery []gin.H
-
-	if query.QueryString == "" {
-		if len(query.IDs) == 0 {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"match_all": gin.H{},
-					},
-					"random_score": gin.H{},
-				},
-			}
-		} else {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"function_score": gin.H{
-							"query": gin.H{
-								"bool": gin.H{
-									"filter": []gin.H{
-										{
-											"terms": gin.H{
-												"_id": query.IDs,
-											},
-										},
-									},
-								},
-							},
-							"random_score": gin.H{},
-						},
-					},
-				},
-			}
-
-			sortQuery = []gin.H{
-				{
-					"_script": gin.H{
-						"type": "number",
-						"script": gin.H{
-							"lang":   "painless",
-							"source": "params.order.indexOf(doc['_id'].value)",
-							"params": gin.H{
-								"order": query.IDs,
-							},
-						},
-						"order": "asc",
-					},
-				},
-			}
-		}
-	} else {
-		searchableFields := []string{
-			"title",
-			"journalName",
-			"abstract",
-			"publicationType",
-			"authors",
-			"datasetTitles",
-			"doi",
-		}
-		mm1 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-			},
-		}
-		mm2 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-				"operator":  "and",
-			},
-		}
-		mm3 := gin.H{
-			"multi_match": gin.H{
-				"query":  query.QueryString,
-				"fields": searchableFields,
-				"type":   "phrase",
-				"boost":  2,
-			},
-		}
-		mainQuery = gin.H{
-			"bool": gin.H{
-				"should": []gin.H{mm1, mm2, mm3},
-			},
-		}
-	}
-
-	mustFilters := []gin.H{}
-	for key, terms := range query.Filters["paper"] {
-		filters := []gin.H{}
-		if key == "publicationDate" {
-			rangeFilter := gin.H{
-				"bool": gin.H{
-					"must": []gin.H{
-						{"range": gin.H{"publicationDate": gin.H{"gte": terms.([]interface{})[0]}}},
-						{"range": gin.H{"publicationDate": gin.H{"lte": terms.([]interface{})[1]}}},
-					},
-				},
-			}
-			mustFilters = append(mustFilters, rangeFilter)
-		} else {
-			for _, t := range terms.([]interface{}) {
-				filters = append(filters, gin.H{"term": gin.H{key: t}})
-			}
-			mustFilters = append(mustFilters, gin.H{
-				"bool": gin.H{
-					"should": filters,
-				},
-			})
-		}
-	}
-
-	f1 := gin.H{
-		"bool": gin.H{
-			"must": mustFilters,
-		},
-	}
-
-	agg1 := buildAggregations(query, mustFilters)
-
-	response := gin.H{
-		"size":  os.Getenv("SEARCH_NO_RECORDS"),
-		"query": mainQuery,
-		"highlight": gin.H{
-			"fields": gin.H{
-				"title": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-				"abstract": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-			},
-		},
-		"explain":     true,
-		"post_filter": f1,
-		"aggs":        agg1,
-	}
-
-	if len(query.IDs) > 0 {
-		response["sort"] = sortQuery
-	}
-
-	return response
-}
-
-func DataProviderSearch(c *gin.Context) {
-	var query Query
-	if err := c.BindJSON(&query); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
-		return
-	}
-
-	results := dataProviderSearch(query)
-	BQUpload(query, results, "dataprovider")
-	c.JSON(http.StatusOK, results)
-}
-
-func dataProviderChannel(query Query, res chan SearchResponse) {
-	elasticResp := dataProviderSearch(query)
-	res <- elasticResp
-}
-
-// dataProviderSearch performs a search of the ElasticSearch dataproviders index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-func dataProviderSearch(query Query) SearchResponse {
-	var buf bytes.Buffer
-
-	elasticQuery := dataProviderElasticConfig(query)
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic query %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
-	}
-
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex("dataprovider"),
-		ElasticClient.Search.WithBody(&buf),
-	)
-
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
-	}
-
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
-
-	if elasticResp.Hits.Hits == nil {
-		slog.Warn("Hits from elastic are null, query may be malformed")
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
-	}
-
-	stripExplanation(elasticResp, query, "dataProvider")
-	newAggs := flattenAggs(elasticResp)
-
-	elasticResp.Aggregations = newAggs
-
-	return elasticResp
-}
-
-// dataProviderElasticConfig defines the body of the query to the elastic data providers index
-func dataProviderElasticConfig(query Query) gin.H {
-	var mainQuery gin.H
-	var sortQuery []gin.H
-
-	if query.QueryString == "" {
-		if len(query.IDs) == 0 {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"match_all": gin.H{},
-					},
-					"random_score": gin.H{},
-				},
-			}
-		} else {
-			mainQuery = gin.H{
-				"function_score": gin.H{
-					"query": gin.H{
-						"function_score": gin.H{
-							"query": gin.H{
-								"bool": gin.H{
-									"filter": []gin.H{
-										{
-											"terms": gin.H{
-												"_id": query.IDs,
-											},
-										},
-									},
-								},
-							},
-							"random_score": gin.H{},
-						},
-					},
-				},
-			}
-
-			sortQuery = []gin.H{
-				{
-					"_script": gin.H{
-						"type": "number",
-						"script": gin.H{
-							"lang":   "painless",
-							"source": "params.order.indexOf(doc['_id'].value)",
-							"params": gin.H{
-								"order": query.IDs,
-							},
-						},
-						"order": "asc",
-					},
-				},
-			}
-		}
-	} else {
-		searchableFields := []string{
-			"name",
-			"datasetTitles",
-			"geographicLocation",
-			"publicationTitles",
-			"collectionNames",
-			"durTitles",
-			"toolNames",
-			"teamAliases",
-		}
-		mm1 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-			},
-		}
-		mm2 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-				"operator":  "and",
-			},
-		}
-		mm3 := gin.H{
-			"multi_match": gin.H{
-				"query":  query.QueryString,
-				"fields": searchableFields,
-				"type":   "phrase",
-				"boost":  2,
-			},
-		}
-		mainQuery = gin.H{
-			"bool": gin.H{
-				"should": []gin.H{mm1, mm2, mm3},
-			},
-		}
-	}
-
-	mustFilters := []gin.H{}
-	for key, terms := range query.Filters["dataProvider"] {
-		filters := []gin.H{}
-		for _, t := range terms.([]interface{}) {
-			filters = append(filters, gin.H{"term": gin.H{key: t}})
-		}
-		mustFilters = append(mustFilters, gin.H{
-			"bool": gin.H{
-				"should": filters,
-			},
-		})
-	}
-
-	f1 := gin.H{
-		"bool": gin.H{
-			"must": mustFilters,
-		},
-	}
-
-	agg1 := buildAggregations(query, mustFilters)
-
-	response := gin.H{
-		"size":        os.Getenv("SEARCH_NO_RECORDS"),
-		"query":       mainQuery,
-		"explain":     true,
-		"post_filter": f1,
-		"aggs":        agg1,
-	}
-
-	if len(query.IDs) > 0 {
-		response["sort"] = sortQuery
-	}
-
-	return response
-}
-
-// DataCustodianNetworkSearch performs a search of the ElasticSearch dataCustodianNetworks index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-func DataCustodianNetworkSearch(c *gin.Context) {
-	var query Query
-	if err := c.BindJSON(&query); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
-		return
-	}
-	results := dataCustodianNetworkSearch(query)
-	BQUpload(query, results, "datacustodiannetwork")
-	c.JSON(http.StatusOK, results)
-}
-
-func dataCustodianNetworkChannel(query Query, res chan SearchResponse) {
-	elasticResp := dataCustodianNetworkSearch(query)
-	res <- elasticResp
-}
-
-// dataCustodianNetworkSearch performs a search of the ElasticSearch dataCustodianNetworks index using
-// the provided query as the search term.  Results are returned in the format
-// returned by elastic (SearchResponse).
-func dataCustodianNetworkSearch(query Query) SearchResponse {
-	var buf bytes.Buffer
-
-	elasticQuery := dataCustodianNetworkElasticConfig(query)
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic query %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
-	}
-
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex("datacustodiannetwork"),
-		ElasticClient.Search.WithBody(&buf),
-	)
-
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
-	}
-
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
-
-	if elasticResp.Hits.Hits == nil {
-		slog.Warn("Hits from elastic are null, query may be malformed")
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
-	}
-
-	stripExplanation(elasticResp, query, "datacustodiannetwork")
-	newAggs := flattenAggs(elasticResp)
-
-	elasticResp.Aggregations = newAggs
-
-	return elasticResp
-}
-
-// dataCustodianNetworkElasticConfig defines the body of the query to the elastic datacustodiannetwork index
-func dataCustodianNetworkElasticConfig(query Query) gin.H {
-	var mainQuery gin.H
-	if query.QueryString == "" {
-		mainQuery = gin.H{
-			"function_score": gin.H{
-				"query": gin.H{
-					"match_all": gin.H{},
-				},
-				"random_score": gin.H{},
-			},
-		}
-	} else {
-		relatedObjectFields := []string{
-			"publisherNames",
-			"datasetTitles",
-			"durTitles",
-			"toolNames",
-			"publicationTitles",
-			"collectionNames",
-		}
-		searchableFields := []string{
-			"name",
-			"summary",
-		}
-		mm1 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    relatedObjectFields,
-				"fuzziness": "AUTO:5,7",
-			},
-		}
-		mm2 := gin.H{
-			"multi_match": gin.H{
-				"query":     query.QueryString,
-				"fields":    searchableFields,
-				"fuzziness": "AUTO:5,7",
-				"boost":     2,
-			},
-		}
-		mm3 := gin.H{
-			"multi_match": gin.H{
-				"query":  query.QueryString,
-				"type":   "phrase",
-				"fields": searchableFields,
-				"boost":  3,
-			},
-		}
-		mainQuery = gin.H{
-			"bool": gin.H{
-				"should": []gin.H{mm1, mm2, mm3},
-			},
-		}
-	}
-
-	mustFilters := []gin.H{}
-	for key, terms := range query.Filters["datacustodiannetwork"] {
-		filters := []gin.H{}
-		for _, t := range terms.([]interface{}) {
-			filters = append(filters, gin.H{"term": gin.H{key: t}})
-		}
-		mustFilters = append(mustFilters, gin.H{
+	if !includeUnreported {
+		return gin.H{
 			"bool": gin.H{
-				"should": filters,
+				"must": []gin.H{rangeFilter},
 			},
-		})
+		}, true
 	}
-
-	f1 := gin.H{
-		"bool": gin.H{
-			"must": mustFilters,
-		},
+	if len(bounds) == 1 && bounds["gte"] == 0 {
+		return nil, false
 	}
-
-	agg1 := buildAggregations(query, mustFilters)
-
 	return gin.H{
-		"size":  os.Getenv("SEARCH_NO_RECORDS"),
-		"query": mainQuery,
-		"highlight": gin.H{
-			"fields": gin.H{
-				"name": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
-				"summary": gin.H{
-					"boundary_scanner": "sentence",
-					"fragment_size":    0,
-					"no_match_size":    0,
-				},
+		"bool": gin.H{
+			"should": []gin.H{
+				rangeFilter,
+				{"term": gin.H{"populationSize": unreportedPopulationSize}},
 			},
 		},
-		"explain":     true,
-		"post_filter": f1,
-		"aggs":        agg1,
-	}
+	}, true
 }
 
 // buildAggregations constructs the "aggs" part of an elastic search query
 // from provided Aggregations.
 // Aggregations are expected to be an array of `{'type': string, 'keys': string}`
+// Terms aggregations may also set `minDocCount` to hide buckets with fewer
+// documents and `order` as "count" (the default) or "key", and may break each
+// bucket down further with `subAggregation`, given either as the key of the
+// sub-field or as an aggregation object of its own e.g.
+// `{'type': 'dataset', 'keys': 'publisherName', 'subAggregation': 'containsTissue'}`
+// Each aggregation is filtered by the mustFilters other than those on its own
+// key, unless the query applies its filters in the main query (filterInQuery),
+// in which case the aggregations only see the filtered hits.
 func buildAggregations(query Query, mustFilters []gin.H) gin.H {
 	agg1 := gin.H{}
 	for _, agg := range query.Aggregations {
@@ -1783,9 +1215,16 @@ func buildAggregations(query Query, mustFilters []gin.H) gin.H {
 		if !ok {
 			log.Printf("Filter key in %s not recognised", agg)
 		}
+		aggType, _ := agg["type"].(string)
+		index := entityIndex(aggType)
 		aggInner := gin.H{}
 		filters := []gin.H{}
-		if k == "dateRange" {
+		metric, isMetric := metricAggregation(agg, k)
+		if histogram, ok := dateHistogramAggregation(agg, k); ok {
+			aggInner[k] = histogram
+		} else if isMetric {
+			aggInner[k] = metric
+		} else if k == "dateRange" {
 			aggInner["startDate"] = gin.H{"min": gin.H{"field": "startDate"}}
 			aggInner["endDate"] = gin.H{"max": gin.H{"field": "endDate"}}
 		} else if k == "publicationDate" {
@@ -1796,14 +1235,23 @@ func buildAggregations(query Query, mustFilters []gin.H) gin.H {
 			aggInner[k] = gin.H{
 				"range": gin.H{"field": k, "ranges": ranges},
 			}
+		} else if geoAgg, ok := geoDistanceAggregation(agg, k); k == geoLocationField && ok {
+			aggInner[k] = geoAgg
 		} else {
-			aggInner[k] = gin.H{"terms": gin.H{"field": k, "size": os.Getenv("SEARCH_NO_RECORDS_AGGREGATION")}}
+			aggInner[k] = gin.H{"terms": termsAggregation(query, index, agg, k)}
 		}
 
-		for _, fil := range mustFilters {
+		// Filters in the main query already apply to query scoped
+		// aggregations, but global aggregations ignore the query.
+		global := isGlobalAggregation(query, agg)
+		aggFilters := mustFilters
+		if query.FilterInQuery && !global {
+			aggFilters = nil
+		}
+		for _, fil := range aggFilters {
 			filJson, err := json.Marshal(fil)
 			if err != nil {
-				slog.Info("Could not marshal filter")
+				query.logger().Info("Could not marshal filter")
 			}
 			filStr := string(filJson)
 			if (strings.Contains(filStr, k)) {
@@ -1813,14 +1261,158 @@ func buildAggregations(query Query, mustFilters []gin.H) gin.H {
 			}
 		}
 
+		if reported, ok := reportedValuesFilter(k); ok && isMetric {
+			filters = append(filters, reported)
+		}
+
 		agg1[k] = gin.H{
 			"aggs": aggInner, 
 			"filter": gin.H{"bool": gin.H{"must": filters}},
 		}
+		if global {
+			agg1[k] = gin.H{
+				"global": gin.H{},
+				"aggs":   gin.H{globalAggregationName: agg1[k]},
+			}
+		}
 	}
 	return agg1
 }
 
+// globalAggregationName names the filter aggregation nested in a global
+// aggregation by buildAggregations.
+const globalAggregationName = "_filtered"
+
+// isGlobalAggregation reports whether the aggregation counts documents across
+// the whole index, ignoring the query string, rather than only the documents
+// matching the query.  This is its "global" option if set, otherwise the
+// globalAggs of the query.
+func isGlobalAggregation(query Query, agg map[string]interface{}) bool {
+	if global, ok := agg["global"].(bool); ok {
+		return global
+	}
+	return query.GlobalAggs
+}
+
+// calendarIntervalFormats maps the calendar intervals a date histogram may be
+// requested with to the format of its bucket keys, if not the full date.
+var calendarIntervalFormats = map[string]string{
+	"minute":  "",
+	"hour":    "",
+	"day":     "yyyy-MM-dd",
+	"week":    "yyyy-MM-dd",
+	"month":   "yyyy-MM",
+	"quarter": "yyyy-MM",
+	"year":    "yyyy",
+}
+
+// dateHistogramAggregation builds a date_histogram aggregation on the date
+// field key if the requested aggregation asks for one, e.g.
+//
+//	{"type": "publication", "keys": "publicationDate", "dateHistogram": true, "calendarInterval": "month"}
+//
+// counting the documents in each calendar interval, by default each year.
+func dateHistogramAggregation(agg map[string]interface{}, key string) (gin.H, bool) {
+	if histogram, _ := agg["dateHistogram"].(bool); !histogram {
+		return nil, false
+	}
+	interval, ok := agg["calendarInterval"].(string)
+	if !ok || interval == "" {
+		interval = "year"
+	}
+	histogram := gin.H{"field": key, "calendar_interval": interval}
+	if format := calendarIntervalFormats[interval]; format != "" {
+		histogram["format"] = format
+	}
+	return gin.H{"date_histogram": histogram}, true
+}
+
+// defaultPercents are the percentiles computed by a percentiles aggregation
+// that does not list its own.
+var defaultPercents = []float64{25, 50, 75}
+
+// metricAggregation builds a stats or percentiles aggregation on the numeric
+// field key if the requested aggregation asks for one with its metric, e.g.
+//
+//	{"type": "dataset", "keys": "populationSize", "metric": "percentiles", "percents": [10, 50, 90]}
+//
+// Stats are returned as the count, min, max, avg and sum of the field, and
+// percentiles as a list of {"key": percent, "value": value}, by default of
+// the quartiles.
+func metricAggregation(agg map[string]interface{}, key string) (gin.H, bool) {
+	switch agg["metric"] {
+	case "stats":
+		return gin.H{"stats": gin.H{"field": key}}, true
+	case "percentiles":
+		percents := defaultPercents
+		if requested, ok := agg["percents"].([]interface{}); ok && len(requested) > 0 {
+			percents = []float64{}
+			for _, percent := range requested {
+				if value, ok := percent.(float64); ok {
+					percents = append(percents, value)
+				}
+			}
+		}
+		return gin.H{
+			"percentiles": gin.H{"field": key, "percents": percents, "keyed": false},
+		}, true
+	default:
+		return nil, false
+	}
+}
+
+// reportedValuesFilter returns the filter excluding the placeholder values of
+// the numeric field key from metric aggregations, such as the
+// unreportedPopulationSize of datasets, so that they do not skew its stats.
+func reportedValuesFilter(key string) (gin.H, bool) {
+	if key == "populationSize" {
+		return gin.H{"range": gin.H{key: gin.H{"gt": unreportedPopulationSize}}}, true
+	}
+	return nil, false
+}
+
+// termsAggregation builds the body of the terms aggregation on key, applying
+// the minDocCount and order options of the requested aggregation.
+func termsAggregation(query Query, index string, agg map[string]interface{}, key string) gin.H {
+	size := aggregationSize(query.AggregationSize)
+	terms := gin.H{
+		"field": resolveAggregationField(index, key),
+		"size":  size,
+	}
+	if minDocCount, ok := agg["minDocCount"].(float64); ok {
+		terms["min_doc_count"] = int(minDocCount)
+	}
+	switch agg["order"] {
+	case "count":
+		terms["order"] = gin.H{"_count": "desc"}
+	case "key":
+		terms["order"] = gin.H{"_key": "asc"}
+	}
+	if subAgg, ok := subAggregation(agg); ok {
+		subKey := subAgg["keys"].(string)
+		subTerms := termsAggregation(query, index, subAgg, subKey)
+		subTerms["size"] = subAggregationSize(query.AggregationSize, size)
+		terms["aggs"] = gin.H{
+			subKey: gin.H{"terms": subTerms},
+		}
+	}
+	return terms
+}
+
+// subAggregation returns the sub-aggregation requested by agg, if any, as an
+// aggregation object.
+func subAggregation(agg map[string]interface{}) (map[string]interface{}, bool) {
+	switch sub := agg["subAggregation"].(type) {
+	case string:
+		return map[string]interface{}{"keys": sub}, sub != ""
+	case map[string]interface{}:
+		key, ok := sub["keys"].(string)
+		return sub, ok && key != ""
+	default:
+		return nil, false
+	}
+}
+
 func populationRanges() []gin.H {
 	var ranges []gin.H
 	ranges = append(ranges, gin.H{"from": -1.0, "to": 1.0, "key": "Unreported"})
@@ -1830,34 +1422,282 @@ func populationRanges() []gin.H {
 	return ranges
 }
 
-func flattenAggs(elasticResp SearchResponse) map[string]any {
+// flattenAggs lifts each aggregation result out of the filter aggregation it
+// is wrapped in by buildAggregations, and the global aggregation around that
+// if any.  The doc_count of the filter, the number of documents matching the
+// other filters, is kept on the result as filtered_doc_count.
+func flattenAggs(elasticResp SearchResponse, withPercentages bool) map[string]any {
 	newAggs := make(map[string]any)
+	queryTotal, _ := elasticResp.Hits.Total["value"].(float64)
 
 	for k, agg := range elasticResp.Aggregations {
-		if k == "dateRange" || k == "publicationDate" {
+		// percentages of global aggregations are of the whole index
+		total := queryTotal
+		if global, ok := agg.(map[string]any)[globalAggregationName]; ok {
+			total, _ = agg.(map[string]any)["doc_count"].(float64)
+			agg = global
+		}
+		if _, histogram := agg.(map[string]any)[k]; !histogram && (k == "dateRange" || k == "publicationDate") {
 			newAggs["startDate"] = agg.(map[string]any)["startDate"]
 			newAggs["endDate"] = agg.(map[string]any)["endDate"]
 		} else {
 			newAggs[k] = agg.(map[string]any)[k]
+			if inner, ok := newAggs[k].(map[string]any); ok {
+				inner["filtered_doc_count"] = agg.(map[string]any)["doc_count"]
+			}
+			if withPercentages {
+				addBucketPercentages(newAggs[k], total)
+			}
+			flattenSubAggregations(newAggs[k])
 		}
 	}
 
 	return newAggs
 }
 
-// Remove the explanations from a SearchResponse to reduce its size
+// flattenSubAggregations replaces any sub-aggregation result nested in the
+// buckets of agg with just its list of buckets, so that a bucket broken down
+// by a sub-field reads as
+//
+//	{"key": "Publisher A", "doc_count": 3, "containsTissue": [{"key": "true", "doc_count": 2}]}
+func flattenSubAggregations(agg any) {
+	aggMap, ok := agg.(map[string]any)
+	if !ok {
+		return
+	}
+	buckets, ok := aggMap["buckets"].([]any)
+	if !ok {
+		return
+	}
+	for _, b := range buckets {
+		bucket, ok := b.(map[string]any)
+		if !ok {
+			continue
+		}
+		for field, value := range bucket {
+			subAgg, ok := value.(map[string]any)
+			if !ok {
+				continue
+			}
+			if subBuckets, ok := subAgg["buckets"].([]any); ok {
+				bucket[field] = subBuckets
+			}
+		}
+	}
+}
+
+// addBucketPercentages sets a percentage field on each bucket of the given
+// aggregation, giving the bucket doc_count as a percentage of total.
+// Note elastic only counts total hits accurately up to 10000 by default, so
+// beyond that the percentages are an upper bound.
+func addBucketPercentages(agg any, total float64) {
+	aggMap, ok := agg.(map[string]any)
+	if !ok {
+		return
+	}
+	buckets, ok := aggMap["buckets"].([]any)
+	if !ok {
+		return
+	}
+	for _, b := range buckets {
+		bucket, ok := b.(map[string]any)
+		if !ok {
+			continue
+		}
+		count, _ := bucket["doc_count"].(float64)
+		if total > 0 {
+			bucket["percentage"] = count / total * 100
+		} else {
+			bucket["percentage"] = 0.0
+		}
+		// buckets of a sub-aggregation are a percentage of their parent bucket
+		for _, value := range bucket {
+			addBucketPercentages(value, count)
+		}
+	}
+}
+
+// postProcessResponse applies the processing common to every entity search to
+// the response returned by elastic, before it is passed back to the caller.
+func postProcessResponse(elasticResp SearchResponse, query Query, entityType string) SearchResponse {
+	stripExplanation(elasticResp, query, entityType)
+	elasticResp.Aggregations = flattenAggs(elasticResp, query.AggPercentages)
+	if len(query.Highlight.NoMatchSize) > 0 {
+		capHighlightFallbacks(elasticResp.Hits.Hits, query.Highlight.PreTags, highlightFallbackCap())
+	}
+	if query.Highlight.Join {
+		joinHighlights(elasticResp.Hits.Hits, query.Highlight.Separator)
+	}
+	assignRanks(elasticResp.Hits.Hits)
+	if len(query.IDs) > 0 {
+		elasticResp.MissingIDs = missingIDs(query.IDs, elasticResp.Hits.Hits)
+	}
+	if elasticResp.Hits.Total != nil {
+		elasticResp.Hits.TotalLabel = totalLabel(elasticResp.Hits)
+	}
+	if randomOrder(query) {
+		elasticResp.Seed = query.Seed
+	}
+
+	return elasticResp
+}
+
+// withExecutedQuery adds the elastic query executed for the search to the
+// response if the query asks for it and debug features are enabled.
+func withExecutedQuery(elasticResp SearchResponse, query Query, elasticQuery gin.H) SearchResponse {
+	if query.ReturnQuery && debugFeaturesEnabled() {
+		elasticResp.Query = elasticQuery
+	}
+	return elasticResp
+}
+
+// debugFeaturesEnabled reports whether options for debugging searches, such
+// as returnQuery, may be used.  They are disabled by setting
+// SEARCH_DISABLE_DEBUG_FEATURES="true", e.g. in production.
+func debugFeaturesEnabled() bool {
+	return os.Getenv("SEARCH_DISABLE_DEBUG_FEATURES") != "true"
+}
+
+// missingIDs returns the requested ids, in the order requested, that are not
+// the id of any of the hits.  Only the hits returned are checked, so an id
+// may be reported missing because its hit is on a later page.
+func missingIDs(ids []string, hits []Hit) []string {
+	found := make(map[string]bool, len(hits))
+	for _, hit := range hits {
+		found[hit.Id] = true
+	}
+
+	missing := []string{}
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+			found[id] = true
+		}
+	}
+	return missing
+}
+
+// assignRanks annotates each hit with its 1-based position in the given slice.
+// It should be called again whenever the hits are reordered or removed so that
+// the rank always reflects the order in which results are returned.
+func assignRanks(hits []Hit) {
+	for i := range hits {
+		hits[i].Rank = i + 1
+	}
+}
+
+const (
+	defaultExplanationConcurrency = 10
+	defaultExplanationTimeout     = 10 * time.Second
+)
+
+// explanationSlots bounds the number of search explanation extractions that
+// can be in progress at once, set with SEARCH_EXPLANATION_CONCURRENCY.
+// Extractions are dropped rather than queued once all slots are taken.
+var explanationSlots = make(chan struct{}, defaultExplanationConcurrency)
+
+// newExplanationSlots returns the slots bounding concurrent search explanation
+// extractions, with SEARCH_EXPLANATION_CONCURRENCY taken as the default if it
+// is negative.
+func newExplanationSlots() chan struct{} {
+	concurrency := envInt("SEARCH_EXPLANATION_CONCURRENCY", defaultExplanationConcurrency)
+	if concurrency < 0 {
+		slog.Warn(
+			"Ignoring negative SEARCH_EXPLANATION_CONCURRENCY",
+			"concurrency", concurrency,
+			"default", defaultExplanationConcurrency,
+		)
+		concurrency = defaultExplanationConcurrency
+	}
+	return make(chan struct{}, concurrency)
+}
+
+// Remove the explanations from a SearchResponse to reduce its size, unless
+// the query asked for them with debug
 // And send explanation to search explanation extractor
 func stripExplanation(elasticResp SearchResponse, query Query, entityType string) {
-	_, expEnabled := os.LookupEnv("SEARCH_EXPLANATION_EXTRACTOR")
-	// Send explanation if enabled, entity is dataset and query is not empty
-	if expEnabled && entityType == "dataset" && !reflect.ValueOf(query).IsZero() {
+	if explanationExtractionEnabled(query, entityType) {
 		respCopy := copyResponseHits(elasticResp)
-		go extractExplanation(respCopy, query)
+		slots := explanationSlots
+		select {
+		case slots <- struct{}{}:
+			if !startBackgroundWork() {
+				<-slots
+				break
+			}
+			go func() {
+				defer backgroundWork.Done()
+				defer func() { <-slots }()
+				extractExplanation(respCopy, query, entityType)
+			}()
+		default:
+			query.logger().Debug("Skipping search explanation extraction, too many extractions in progress")
+		}
 	}
 
+	if query.Debug {
+		return
+	}
 	for i := range elasticResp.Hits.Hits {
 		elasticResp.Hits.Hits[i].Explanation = make(map[string]interface{}, 0)
+		elasticResp.Hits.Hits[i].InnerHits = withoutExplanations(elasticResp.Hits.Hits[i].InnerHits)
+	}
+}
+
+// explanationExtractionEnabled reports whether the explanations of the search
+// are sent to the search explanation extractor: when SEARCH_EXPLANATION_EXTRACTOR
+// is set and not paused, for the entity types it is enabled for and queries
+// that are not empty.
+func explanationExtractionEnabled(query Query, entityType string) bool {
+	_, expEnabled := os.LookupEnv("SEARCH_EXPLANATION_EXTRACTOR")
+	expEnabled = expEnabled && !explanationExtractionPaused.Load()
+	return expEnabled && explanationEnabledFor(entityType) && strings.TrimSpace(query.QueryString) != ""
+}
+
+// withExplain asks elastic to explain the score of each hit only if the
+// explanations are used, either returned with debug or sent to the search
+// explanation extractor, as computing them is far from free.
+func withExplain(elasticQuery gin.H, query Query, entityType string) gin.H {
+	if query.Debug || explanationExtractionEnabled(query, entityType) {
+		elasticQuery["explain"] = true
+	}
+	return elasticQuery
+}
+
+// explanationExtractionPaused is set to stop sending searches to the search
+// explanation extractor without a restart, e.g. while it is overloaded, see
+// SetExplanationExtraction.
+var explanationExtractionPaused atomic.Bool
+
+// ExplanationSettings turns the extraction of search explanations on or off.
+type ExplanationSettings struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// SetExplanationExtraction pauses or resumes sending searches to the search
+// explanation extractor, e.g. {"enabled": false}, responding with whether
+// extraction is now enabled.  Extraction still requires
+// SEARCH_EXPLANATION_EXTRACTOR to be set, and is enabled again on restart.
+// Search responses are the same either way.
+func SetExplanationExtraction(c *gin.Context) {
+	var settings ExplanationSettings
+	if err := c.BindJSON(&settings); err != nil {
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret explanation settings", "error", err.Error())
+		return
+	}
+	if settings.Enabled == nil {
+		c.JSON(http.StatusBadRequest, errorBody(c, "enabled is required"))
+		return
 	}
+
+	paused := !*settings.Enabled
+	if explanationExtractionPaused.Swap(paused) != paused {
+		requestLogger(requestIDFrom(c)).Warn(
+			"Search explanation extraction toggled",
+			"enabled", *settings.Enabled,
+		)
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": !paused})
 }
 
 func copyResponseHits(r SearchResponse) SearchResponse {
@@ -1871,40 +1711,256 @@ func copyResponseHits(r SearchResponse) SearchResponse {
 	}
 }
 
-func extractExplanation(elasticResp SearchResponse, query Query) {
+// minimumShouldMatch returns the minimum_should_match for the main query of a
+// search of the entity type.  This is the minimumShouldMatch of the query if
+// set, otherwise SEARCH_MINIMUM_SHOULD_MATCH_<TYPE>, e.g.
+// SEARCH_MINIMUM_SHOULD_MATCH_DATASET.  An empty string means elastic's
+// default of a single matching clause.
+func minimumShouldMatch(query Query, entityType string) string {
+	if query.MinimumShouldMatch != "" {
+		return query.MinimumShouldMatch
+	}
+	return os.Getenv("SEARCH_MINIMUM_SHOULD_MATCH_" + strings.ToUpper(entityType))
+}
+
+// queryOperatorFlags are the simple_query_string operators honoured in the
+// query string of an operators search: quoted phrases, +, -, |, parentheses
+// and trailing * for prefixes.
+const queryOperatorFlags = "AND|OR|NOT|PHRASE|PRECEDENCE|PREFIX|WHITESPACE|ESCAPE"
+
+// applyQueryOperators replaces the clauses of the main query with a single
+// simple_query_string query on the fields, so that operators in the query
+// string such as "lung cancer" -smoking are honoured rather than matched as
+// words.  The other clauses are dropped as they would match documents the
+// operators exclude.  Terms are required unless defaultOperator is "or".
+func applyQueryOperators(mainQuery gin.H, query Query, fields []string) {
+	defaultOperator := strings.ToLower(query.DefaultOperator)
+	if defaultOperator == "" {
+		defaultOperator = "and"
+	}
+	mainQuery["bool"].(gin.H)["should"] = []gin.H{
+		{
+			"simple_query_string": gin.H{
+				"query":            balancedQuotes(query.QueryString),
+				"fields":           fields,
+				"default_operator": defaultOperator,
+				"flags":            queryOperatorFlags,
+			},
+		},
+	}
+}
+
+// balancedQuotes escapes the last double quote of the query string if it is
+// left unclosed, so that it is searched for as a character rather than
+// quoting the rest of the query string as a phrase.
+func balancedQuotes(queryString string) string {
+	quotes, last := 0, 0
+	for i := 0; i < len(queryString); i++ {
+		switch queryString[i] {
+		case '\\':
+			i++
+		case '"':
+			quotes++
+			last = i
+		}
+	}
+	if quotes%2 == 0 {
+		return queryString
+	}
+	return queryString[:last] + `\` + queryString[last:]
+}
+
+// queryFields returns the fields of the entity type the query string is
+// matched against, which are only its title fields in a titleOnly search, with
+// the boost of any boosted field, e.g. "named_entities^4", see fieldBoosts.
+func queryFields(config EntityConfig, query Query) []string {
+	fields := config.SearchFields
+	if query.TitleOnly && len(config.TitleFields) > 0 {
+		fields = config.TitleFields
+	}
+	boosts := fieldBoosts(config, query)
+	if len(boosts) == 0 {
+		return fields
+	}
+	boosted := make([]string, len(fields))
+	for i, field := range fields {
+		boosted[i] = field
+		if boost, ok := boosts[field]; ok && boost != 1 {
+			boosted[i] = field + "^" + strconv.FormatFloat(boost, 'f', -1, 64)
+		}
+	}
+	return boosted
+}
+
+// fieldBoosts returns the boosts of the search fields of the entity type.
+// These are its FieldBoosts unless SEARCH_FIELD_BOOSTS_<TYPE> is set, e.g.
+// SEARCH_FIELD_BOOSTS_DATASET="named_entities^4,title^2", in which case only
+// the boosts it lists are applied.  Entries that are not a field and a
+// positive boost are ignored.
+func fieldBoosts(config EntityConfig, query Query) map[string]float64 {
+	setting, ok := os.LookupEnv("SEARCH_FIELD_BOOSTS_" + strings.ToUpper(config.Name))
+	if !ok {
+		return config.FieldBoosts
+	}
+
+	boosts := make(map[string]float64)
+	for _, entry := range strings.Split(setting, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		field, value, _ := strings.Cut(entry, "^")
+		boost, err := strconv.ParseFloat(value, 64)
+		if field == "" || err != nil || boost <= 0 {
+			query.logger().Warn("Ignoring invalid search field boost", "entity", config.Name, "boost", entry)
+			continue
+		}
+		boosts[field] = boost
+	}
+	return boosts
+}
+
+// applyExactMode restricts the main query to its phrase clauses, dropping the
+// fuzzy, synonym and other looser clauses, so that only documents containing
+// the query string exactly as given are matched.
+func applyExactMode(mainQuery gin.H) {
+	boolQuery := mainQuery["bool"].(gin.H)
+	exact := []gin.H{}
+	for _, clause := range boolQuery["should"].([]gin.H) {
+		multiMatch, ok := clause["multi_match"].(gin.H)
+		if ok && multiMatch["type"] == "phrase" {
+			multiMatch["slop"] = 0
+			exact = append(exact, clause)
+		}
+	}
+	boolQuery["should"] = exact
+}
+
+// applyMatchPhrasePrefix adds a clause to the main query matching the query
+// string as a phrase whose last word may be incomplete against the given
+// fields, so that e.g. "asth" matches a title containing "asthma".  The number
+// of terms the last word is expanded to is limited by
+// SEARCH_PHRASE_PREFIX_MAX_EXPANSIONS to keep the query fast.
+func applyMatchPhrasePrefix(mainQuery gin.H, queryString string, fields ...string) {
+	maxExpansions := envInt("SEARCH_PHRASE_PREFIX_MAX_EXPANSIONS", defaultPhrasePrefixMaxExpansions)
+	if maxExpansions <= 0 || maxExpansions > maxPhrasePrefixMaxExpansions {
+		maxExpansions = maxPhrasePrefixMaxExpansions
+	}
+	boolQuery := mainQuery["bool"].(gin.H)
+	boolQuery["should"] = append(boolQuery["should"].([]gin.H), gin.H{
+		"multi_match": gin.H{
+			"query":          queryString,
+			"type":           "phrase_prefix",
+			"fields":         fields,
+			"max_expansions": maxExpansions,
+		},
+	})
+}
+
+// applyMinimumShouldMatch sets minimum_should_match on the bool query of the
+// main query when one is configured for the entity type or requested.
+func applyMinimumShouldMatch(mainQuery gin.H, query Query, entityType string) {
+	if msm := minimumShouldMatch(query, entityType); msm != "" {
+		mainQuery["bool"].(gin.H)["minimum_should_match"] = msm
+	}
+}
+
+// explanationEnabledFor reports whether explanations of searches of the entity
+// type are sent to the extractor.  The entity types are set as a comma
+// separated list in SEARCH_EXPLANATION_ENTITY_TYPES, defaulting to dataset only.
+func explanationEnabledFor(entityType string) bool {
+	entityTypes, ok := os.LookupEnv("SEARCH_EXPLANATION_ENTITY_TYPES")
+	if !ok {
+		entityTypes = "dataset"
+	}
+	for _, t := range strings.Split(entityTypes, ",") {
+		if strings.TrimSpace(t) == entityType {
+			return true
+		}
+	}
+	return false
+}
+
+// extractExplanation sends the hits of the response to the search explanation
+// extractor, giving up after SEARCH_EXPLANATION_TIMEOUT_SECONDS.
+func extractExplanation(elasticResp SearchResponse, query Query, entityType string) {
 	bodyContent := gin.H{
 		"data":              elasticResp,
-		"query":             fmt.Sprintf("%s", query),
-		"destination_table": os.Getenv("SEARCH_EXPLANATION_TABLE"),
+		"query":             query,
+		"destination_table": explanationTable(entityType),
+		"request_id":        query.RequestID,
 	}
 	body, err := json.Marshal(bodyContent)
 	if err != nil {
-		slog.Info(fmt.Sprintf("Failed to marshal search explanation payload: %s", err.Error()))
+		query.logger().Info("Failed to marshal search explanation payload", "error", err.Error())
 	}
 
+	timeout := time.Duration(envInt(
+		"SEARCH_EXPLANATION_TIMEOUT_SECONDS",
+		int(defaultExplanationTimeout.Seconds()),
+	)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
 	urlPath := fmt.Sprintf("%s/process_data", os.Getenv("SEARCH_EXPLANATION_EXTRACTOR"))
-	req, err := http.NewRequest("POST", urlPath, bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", urlPath, bytes.NewBuffer(body))
 	if err != nil {
-		slog.Info(fmt.Sprintf("Failed to build search explanation payload with: %s", err.Error()))
+		query.logger().Info("Failed to build search explanation payload", "error", err.Error())
+		return
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.SetBasicAuth(os.Getenv("SEARCH_EXPLANATION_USER"), os.Getenv("SEARCH_EXPLANATION_PASSWORD"))
 
 	response, err := Client.Do(req)
 	if err != nil {
-		slog.Info(fmt.Sprintf("Failed to execute query with: %s", err.Error()))
+		query.logger().Info("Failed to execute query", "error", err.Error())
+		return
 	}
 	defer response.Body.Close()
 
 	respBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		slog.Info(fmt.Sprintf(
-			"Failed to extract search explanation with error %s", err.Error(),
-		))
+		query.logger().Info("Failed to extract search explanation", "error", err.Error())
+	}
+	query.logger().Debug(
+		"Search explanation extraction routine exited",
+		"response", string(respBody),
+	)
+}
+
+// pingExplanationExtractor requests the health endpoint of the search
+// explanation extractor, SEARCH_EXPLANATION_HEALTH_PATH (default /health)
+// under SEARCH_EXPLANATION_EXTRACTOR, giving up after
+// SEARCH_EXPLANATION_TIMEOUT_SECONDS as extractions do.  It returns the status
+// of the response, 0 if there was none, and describes the failure if the
+// extractor is not healthy.
+func pingExplanationExtractor() (int, string) {
+	timeout := time.Duration(envInt(
+		"SEARCH_EXPLANATION_TIMEOUT_SECONDS",
+		int(defaultExplanationTimeout.Seconds()),
+	)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	urlPath := os.Getenv("SEARCH_EXPLANATION_EXTRACTOR") + cmp.Or(os.Getenv("SEARCH_EXPLANATION_HEALTH_PATH"), "/health")
+	req, err := http.NewRequestWithContext(ctx, "GET", urlPath, nil)
+	if err != nil {
+		slog.Info("Failed to build search explanation extractor health check", "error", err.Error())
+		return 0, "invalid extractor url"
+	}
+	req.SetBasicAuth(os.Getenv("SEARCH_EXPLANATION_USER"), os.Getenv("SEARCH_EXPLANATION_PASSWORD"))
+
+	response, err := Client.Do(req)
+	if err != nil {
+		slog.Info("Failed to ping search explanation extractor", "error", err.Error())
+		return 0, "extractor unreachable"
 	}
-	slog.Debug(fmt.Sprintf(
-		"Search explanation extraction routine exited with response: %s", respBody,
-	))
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return response.StatusCode, response.Status
+	}
+	return response.StatusCode, ""
 }
 
 // SearchSimilarDatasets returns the top 3 datasets similar to the document with
@@ -1912,75 +1968,43 @@ func extractExplanation(elasticResp SearchResponse, query Query) {
 func SearchSimilarDatasets(c *gin.Context) {
 	var querySimilar SimilarSearch
 	if err := c.BindJSON(&querySimilar); err != nil {
-		slog.Debug(fmt.Sprintf("Failed to interpret search query with %s", err.Error()))
+		requestLogger(requestIDFrom(c)).Debug("Failed to interpret search query", "error", err.Error())
 		return
 	}
 
-	results := similarSearch(querySimilar.ID, "dataset")
+	results := similarSearch(querySimilar.ID, "dataset", requestIDFrom(c))
 	c.JSON(http.StatusOK, results)
 }
 
-func similarSearch(id string, index string) SearchResponse {
-	var buf bytes.Buffer
-
+func (s *SearchService) similarSearch(id string, index string, requestID string) SearchResponse {
 	elasticQuery := gin.H{
 		"size": os.Getenv("SEARCH_NO_RECORDS_SIMILAR_SEARCH"),
 		"query": gin.H{
 			"more_like_this": gin.H{
 				"like": []gin.H{
-					{"_index": index, "_id": id},
+					{"_index": indexName(index), "_id": id},
 				},
 			},
 		},
 	}
 
-	if err := json.NewEncoder(&buf).Encode(elasticQuery); err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to encode elastic query %s with %s",
-			elasticQuery,
-			err.Error()),
-		)
-	}
-
-	response, err := ElasticClient.Search(
-		ElasticClient.Search.WithIndex(index),
-		ElasticClient.Search.WithBody(&buf),
-	)
-
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to execute elastic query with %s",
-			err.Error()),
-		)
-	}
-	defer response.Body.Close()
-
-	body, err := io.ReadAll(response.Body)
-	if err != nil {
-		slog.Debug(fmt.Sprintf(
-			"Failed to read elastic response with %s",
-			err.Error()),
-		)
-	}
-
-	var elasticResp SearchResponse
-	json.Unmarshal(body, &elasticResp)
+	elasticResp, body, _ := s.executeElasticQuery(index, requestID, elasticQuery)
 
 	if elasticResp.Hits.Hits == nil {
-		slog.Warn("Hits from elastic are null, query may be malformed")
-		slog.Debug(fmt.Sprintf("Null result elastic query: %s", elasticQuery))
+		logElasticError(body, index, requestID)
+		requestLogger(requestID).Debug("Null result elastic query", "query", elasticQuery)
 	}
 
 	return elasticResp
 }
 
-func uploadSearchAnalytics(query Query, results SearchResponse, entityType string) {
-
-	ctx := context.Background()
-	analyticsDataset := BigQueryClient.Dataset(os.Getenv("BQ_DATASET_NAME"))
-	table := analyticsDataset.Table(os.Getenv("BQ_TABLE_NAME"))
-
-	u := table.Inserter()
+// uploadSearchAnalytics records the search in the search analytics table.  The
+// record is built from the results straight away, while the insert into
+// BigQuery runs in the background so that it does not hold up the response.
+func (s *SearchService) uploadSearchAnalytics(query Query, results SearchResponse, entityType string) {
+	if !analyticsSampled(query) {
+		return
+	}
 
 	var datasetIds []string
 	for _, r := range results.Hits.Hits {
@@ -1988,25 +2012,43 @@ func uploadSearchAnalytics(query Query, results SearchResponse, entityType strin
 	}
 	pageResults, err := json.Marshal(gin.H{"entity_ids": datasetIds})
 	if err != nil {
-		slog.Info(fmt.Sprintf("Could not marshal page results: %s", err.Error()))
+		query.logger().Info("Could not marshal page results", "error", err.Error())
 	}
 
 	filterUsed, err := json.Marshal(query.Filters)
 	if err != nil {
-		slog.Info(fmt.Sprintf("Could not marshal filters: %s", err.Error()))
+		query.logger().Info("Could not marshal filters", "error", err.Error())
+	}
+
+	entitiesReturned, exact := results.Hits.TotalHits()
+	if !exact {
+		query.logger().Debug(
+			"Search analytics total is a lower bound, set SEARCH_TRACK_TOTAL_HITS for exact totals",
+			"entity_type", entityType,
+			"total", entitiesReturned,
+		)
 	}
 
 	searchResult := SearchAnalytics{
 		UUID:             uuid.New().String(),
-		Timestamp:        time.Now().Format("2006-01-02 15:04:05"),
+		Timestamp:        civil.DateTimeOf(time.Now().UTC()),
 		EntityType:       entityType,
 		SearchTerm:       query.QueryString,
 		FilterUsed:       string(filterUsed),
 		PageResults:      string(pageResults),
-		EntitiesReturned: int(results.Hits.Total["value"].(float64)),
+		EntitiesReturned: entitiesReturned,
+		RequestID:        query.RequestID,
 	}
 
-	if err := u.Put(ctx, searchResult); err != nil {
-		slog.Info(fmt.Sprintf("Failed to upload search analytics to BigQuery: %s", err.Error()))
+	if !startBackgroundWork() {
+		query.logger().Debug("Skipping search analytics upload, the service is shutting down")
+		return
 	}
+	go func() {
+		defer backgroundWork.Done()
+		table := bigQueryTables().analytics(s.BigQuery)
+		if err := table.Inserter().Put(context.Background(), &searchResult); err != nil {
+			query.logger().Info("Failed to upload search analytics to BigQuery", "error", err.Error())
+		}
+	}()
 }
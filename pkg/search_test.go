@@ -2,13 +2,22 @@ package search
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 
@@ -28,6 +37,12 @@ func init() {
 	}
 
 	BQUpload = func(query Query, results SearchResponse, entityType string) {}
+
+	// The mock elastic client has no index mappings, so fall back to the
+	// aggregation field overrides without requesting them.
+	for _, index := range searchIndices() {
+		setIndexFieldTypes(index, map[string]string{})
+	}
 }
 
 func GetTestGinContext(w *httptest.ResponseRecorder) *gin.Context {
@@ -53,6 +68,71 @@ func MockPostToSearch(c *gin.Context) {
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 }
 
+func MockPostWithBody(c *gin.Context, bodyContent gin.H) {
+	c.Request.Method = "POST"
+	c.Request.Header.Set("Content-Type", "application/json")
+	bodyBytes, err := json.Marshal(bodyContent)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+}
+
+// capturedLogs records the slog records logged while it is the default handler,
+// see captureLogs.
+type capturedLogs struct {
+	mu      *sync.Mutex
+	records *[]slog.Record
+	attrs   []slog.Attr
+}
+
+func (h capturedLogs) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h capturedLogs) Handle(_ context.Context, r slog.Record) error {
+	r = r.Clone()
+	r.AddAttrs(h.attrs...)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.records = append(*h.records, r)
+	return nil
+}
+
+func (h capturedLogs) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.attrs = append(slices.Clone(h.attrs), attrs...)
+	return h
+}
+
+func (h capturedLogs) WithGroup(string) slog.Handler { return h }
+
+// find returns the level and attributes of the first record logged with
+// message, and whether there was one.
+func (h capturedLogs) find(message string) (map[string]interface{}, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range *h.records {
+		if r.Message != message {
+			continue
+		}
+		attrs := map[string]interface{}{"level": r.Level.String()}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.Any()
+			return true
+		})
+		return attrs, true
+	}
+	return nil, false
+}
+
+// captureLogs installs a capturedLogs as the default slog handler for the
+// duration of the test.
+func captureLogs(t *testing.T) capturedLogs {
+	logs := capturedLogs{mu: &sync.Mutex{}, records: &[]slog.Record{}}
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(logs))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+	return logs
+}
+
 func MockPostToSimilarSearch(c *gin.Context) {
 	c.Request.Method = "POST"
 	c.Request.Header.Set("Content-Type", "application/json")
@@ -88,17 +168,233 @@ func TestSearchGeneric(t *testing.T) {
 	assert.Contains(t, testResp, "publication")
 	assert.Contains(t, testResp, "dataProvider")
 	assert.Contains(t, testResp, "datacustodiannetwork")
+	assert.Contains(t, testResp, "matchedTypes")
 
 	datasetResp := testResp["dataset"].(map[string]interface{})
 	assert.EqualValues(t, 3, int(datasetResp["took"].(float64)))
 }
 
+func TestSearchGenericPartialFailure(t *testing.T) {
+	resetAggregationFieldOverrides(t)
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		if strings.HasPrefix(req.URL.Path, "/tool/") {
+			return http.StatusBadRequest, fielddataErrorResponse
+		}
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 0, "relation": "eq"}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostToSearch(c)
+
+	SearchGeneric(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var testResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &testResp)
+	assert.Contains(t, testResp, "tool")
+	assert.EqualValues(t, map[string]interface{}{"tool": "search failed after retrying"}, testResp["_errors"])
+
+	// there are no errors to report when every search succeeds
+	ElasticClient = mocks.MockElasticClient()
+	w = httptest.NewRecorder()
+	c = GetTestGinContext(w)
+	MockPostToSearch(c)
+
+	SearchGeneric(c)
+
+	var okResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &okResp)
+	assert.NotContains(t, okResp, "_errors")
+}
+
+func TestSearchElasticFailure(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		if strings.HasPrefix(req.URL.Path, "/collection/") {
+			return http.StatusInternalServerError, `{"error": {"root_cause": [{"type": "exception", "reason": "shard failure"}]}, "status": 500}`
+		}
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 0, "relation": "eq"}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	_, err := defaultService().Search("collection", Query{QueryString: "asthma"})
+	assert.ErrorIs(t, err, errElasticResponse)
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostToSearch(c)
+	SearchGeneric(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var testResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &testResp)
+	assert.EqualValues(t, map[string]interface{}{"collection": "search unavailable"}, testResp["_errors"])
+
+	w = httptest.NewRecorder()
+	c = GetTestGinContext(w)
+	MockPostToSearch(c)
+	EntitySearch("collection")(c)
+	assert.EqualValues(t, http.StatusBadGateway, w.Code)
+}
+
+func TestSearchGenericAnalytics(t *testing.T) {
+	var mu sync.Mutex
+	uploads := make(map[string]Query)
+	upload := BQUpload
+	BQUpload = func(query Query, results SearchResponse, entityType string) {
+		mu.Lock()
+		defer mu.Unlock()
+		uploads[entityType] = query
+	}
+	defer func() { BQUpload = upload }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	c.Set(requestIDKey, "generic-search")
+	MockPostToSearch(c)
+
+	SearchGeneric(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.Len(t, uploads, len(entities))
+	for _, config := range entities {
+		assert.Contains(t, uploads, config.AnalyticsType)
+		assert.EqualValues(t, "test query", uploads[config.AnalyticsType].QueryString)
+		assert.EqualValues(t, "generic-search", uploads[config.AnalyticsType].RequestID)
+	}
+}
+
+func TestMatchedTypes(t *testing.T) {
+	withTotal := func(total float64) SearchResponse {
+		return SearchResponse{
+			Hits: HitsField{Total: map[string]interface{}{"value": total}},
+		}
+	}
+	results := map[string]interface{}{
+		"dataset":              withTotal(12),
+		"tool":                 withTotal(0),
+		"collection":           withTotal(3),
+		"dataUseRegister":      withTotal(0),
+		"publication":          SearchResponse{},
+		"dataProvider":         withTotal(0),
+		"datacustodiannetwork": withTotal(1),
+	}
+
+	assert.EqualValues(
+		t,
+		[]string{"dataset", "collection", "datacustodiannetwork"},
+		matchedTypes(results),
+	)
+	assert.EqualValues(t, []string{}, matchedTypes(map[string]interface{}{}))
+}
+
+func TestDedupeAcrossIndices(t *testing.T) {
+	hit := func(doi string, score float64) Hit {
+		return Hit{Score: score, Source: map[string]interface{}{"doi": doi}}
+	}
+	results := map[string]interface{}{
+		"collection": SearchResponse{Hits: HitsField{
+			Total: map[string]interface{}{"value": float64(2), "relation": "eq"},
+			Hits:  []Hit{hit("10.1/a", 3.5), hit("10.1/b", 2)},
+		}},
+		"publication": SearchResponse{Hits: HitsField{
+			Total: map[string]interface{}{"value": float64(3), "relation": "eq"},
+			Hits:  []Hit{hit("10.1/b", 4), hit("10.1/a", 1), {Score: 0.5}},
+		}},
+	}
+
+	dedupeAcrossIndices(results, "doi")
+
+	collections := results["collection"].(SearchResponse)
+	assert.Len(t, collections.Hits.Hits, 1)
+	assert.EqualValues(t, "10.1/a", collections.Hits.Hits[0].Source["doi"])
+	assert.EqualValues(t, 1, collections.Hits.Total["value"])
+	assert.EqualValues(t, "eq", collections.Hits.Total["relation"])
+
+	publications := results["publication"].(SearchResponse)
+	assert.Len(t, publications.Hits.Hits, 2)
+	assert.EqualValues(t, "10.1/b", publications.Hits.Hits[0].Source["doi"])
+	assert.EqualValues(t, 2, publications.Hits.Hits[1].Rank)
+	assert.EqualValues(t, 2, publications.Hits.Total["value"])
+}
+
+func TestSearchGenericSharedObjectFilter(t *testing.T) {
+	var mu sync.Mutex
+	postFilters := make(map[string]string)
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		var elasticQuery map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&elasticQuery)
+		postFilter, _ := json.Marshal(elasticQuery["post_filter"])
+		mu.Lock()
+		postFilters[strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]] = string(postFilter)
+		mu.Unlock()
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 0, "relation": "eq"}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query":   "asthma",
+		"filters": gin.H{"_all": gin.H{"populationSize": gin.H{"from": 10, "to": 100}}},
+	})
+
+	SearchGeneric(c)
+
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NotContains(t, response, "_errors")
+	// the filter is used where it applies and ignored elsewhere
+	assert.Contains(t, postFilters["dataset"], `"populationSize":{"gte":10,"lte":100}`)
+	assert.NotContains(t, postFilters["tool"], "populationSize")
+
+	w = httptest.NewRecorder()
+	c = GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{
+		"query":   "asthma",
+		"filters": gin.H{"_all": gin.H{"keywords": gin.H{"from": 10}}},
+	})
+
+	SearchGeneric(c)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+}
+
+func TestMergeSharedFilters(t *testing.T) {
+	filters := map[string]map[string]interface{}{
+		"_all": {
+			"publicationDate": []interface{}{"2020", "2024"},
+			"keywords":        []interface{}{"cancer"},
+		},
+		"dataset": {
+			"keywords": []interface{}{"diabetes"},
+		},
+	}
+	merged := mergeSharedFilters(filters)
+
+	assert.NotContains(t, merged, "_all")
+	assert.EqualValues(t, []interface{}{"diabetes"}, merged["dataset"]["keywords"])
+	assert.EqualValues(t, []interface{}{"2020", "2024"}, merged["dataset"]["publicationDate"])
+	assert.EqualValues(t, []interface{}{"cancer"}, merged["publication"]["keywords"])
+	assert.Len(t, merged, len(entities))
+
+	// the request's own filters are left untouched
+	assert.Len(t, filters["dataset"], 1)
+
+	withoutShared := map[string]map[string]interface{}{
+		"tool": {"programmingLanguage": []interface{}{"Go"}},
+	}
+	assert.EqualValues(t, withoutShared, mergeSharedFilters(withoutShared))
+}
+
 func TestDatasetSearch(t *testing.T) {
 	w := httptest.NewRecorder()
 	c := GetTestGinContext(w)
 	MockPostToSearch(c)
 
-	DatasetSearch(c)
+	EntitySearch("dataset")(c)
 
 	assert.EqualValues(t, http.StatusOK, w.Code)
 
@@ -115,12 +411,32 @@ func TestDatasetSearch(t *testing.T) {
 	assert.EqualValues(t, 3, int(testResp["took"].(float64)))
 }
 
+func TestDatasetSearchLogsElasticError(t *testing.T) {
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		return http.StatusBadRequest, `{
+			"error": {"root_cause": [{"type": "query_shard_exception", "reason": "failed to create query"}]},
+			"status": 400
+		}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+	logs := captureLogs(t)
+
+	defaultService().Search("dataset", Query{QueryString: "asthma", RequestID: "abc-123"})
+
+	attrs, ok := logs.find("Search query returned elastic error")
+	assert.True(t, ok)
+	assert.EqualValues(t, "WARN", attrs["level"])
+	assert.EqualValues(t, "dataset", attrs["index"])
+	assert.EqualValues(t, "failed to create query", attrs["reason"])
+	assert.EqualValues(t, "abc-123", attrs["request_id"])
+}
+
 func TestToolSearch(t *testing.T) {
 	w := httptest.NewRecorder()
 	c := GetTestGinContext(w)
 	MockPostToSearch(c)
 
-	ToolSearch(c)
+	EntitySearch("tool")(c)
 
 	assert.EqualValues(t, http.StatusOK, w.Code)
 
@@ -142,7 +458,7 @@ func TestCollectionSearch(t *testing.T) {
 	c := GetTestGinContext(w)
 	MockPostToSearch(c)
 
-	CollectionSearch(c)
+	EntitySearch("collection")(c)
 
 	assert.EqualValues(t, http.StatusOK, w.Code)
 
@@ -164,7 +480,7 @@ func TestDataCostodianNetworkSearch(t *testing.T) {
 	c := GetTestGinContext(w)
 	MockPostToSearch(c)
 
-	DataCustodianNetworkSearch(c)
+	EntitySearch("datacustodiannetwork")(c)
 
 	assert.EqualValues(t, http.StatusOK, w.Code)
 
@@ -186,7 +502,7 @@ func TestDataUseSearch(t *testing.T) {
 	c := GetTestGinContext(w)
 	MockPostToSearch(c)
 
-	DataUseSearch(c)
+	EntitySearch("dataUseRegister")(c)
 
 	assert.EqualValues(t, http.StatusOK, w.Code)
 
@@ -208,7 +524,7 @@ func TestPublicationSearch(t *testing.T) {
 	c := GetTestGinContext(w)
 	MockPostToSearch(c)
 
-	PublicationSearch(c)
+	EntitySearch("publication")(c)
 
 	assert.EqualValues(t, http.StatusOK, w.Code)
 
@@ -230,7 +546,7 @@ func TestDataProviderSearch(t *testing.T) {
 	c := GetTestGinContext(w)
 	MockPostToSearch(c)
 
-	DataProviderSearch(c)
+	EntitySearch("dataProvider")(c)
 
 	assert.EqualValues(t, http.StatusOK, w.Code)
 
@@ -269,6 +585,87 @@ func TestSimilarDatasetSearch(t *testing.T) {
 	assert.EqualValues(t, 3, int(testResp["took"].(float64)))
 }
 
+func TestSearchAnalyticsSave(t *testing.T) {
+	analytics := SearchAnalytics{
+		UUID:             "5b0f7c5e-2d1a-4c3b-9e8f-1a2b3c4d5e6f",
+		EntityType:       "dataset",
+		SearchTerm:       "asthma",
+		EntitiesReturned: 3,
+	}
+	row, insertID, err := analytics.Save()
+	assert.Nil(t, err)
+	assert.Empty(t, insertID)
+	assert.EqualValues(t, "dataset", row["EntityType"])
+
+	for _, field := range searchAnalyticsSchema {
+		if field.Required {
+			assert.Contains(t, row, field.Name)
+		}
+	}
+}
+
+func TestSearchAnalyticsSchema(t *testing.T) {
+	inferred, err := bigquery.InferSchema(SearchAnalytics{})
+	assert.Nil(t, err)
+	assert.Len(t, inferred, len(searchAnalyticsSchema))
+
+	types := make(map[string]bigquery.FieldType)
+	for _, field := range inferred {
+		types[field.Name] = field.Type
+	}
+	for _, field := range searchAnalyticsSchema {
+		// JSON columns are uploaded as marshalled strings
+		if field.Type == bigquery.JSONFieldType {
+			assert.EqualValues(t, bigquery.StringFieldType, types[field.Name], field.Name)
+			continue
+		}
+		assert.EqualValues(t, field.Type, types[field.Name], field.Name)
+	}
+
+	searched := time.Date(2024, 3, 1, 9, 30, 15, 0, time.FixedZone("BST", 3600))
+	analytics := SearchAnalytics{Timestamp: civil.DateTimeOf(searched.UTC())}
+	row, _, _ := analytics.Save()
+	timestamp := row["Timestamp"].(civil.DateTime)
+	assert.EqualValues(t, "2024-03-01T08:30:15", timestamp.String())
+
+	parsed, err := civil.ParseDateTime(timestamp.String())
+	assert.Nil(t, err)
+	assert.EqualValues(t, timestamp, parsed)
+}
+
+func TestMissingColumns(t *testing.T) {
+	existing := bigquery.Schema{}
+	for _, field := range searchAnalyticsSchema {
+		if field.Name != "RequestID" {
+			existing = append(existing, field)
+		}
+	}
+	missing := missingColumns(existing, searchAnalyticsSchema)
+	assert.Len(t, missing, 1)
+	assert.EqualValues(t, "RequestID", missing[0].Name)
+	assert.False(t, missing[0].Required)
+
+	assert.Empty(t, missingColumns(searchAnalyticsSchema, searchAnalyticsSchema))
+}
+
+// The table is created by EnsureTableExists with searchAnalyticsSchema while
+// rows are uploaded by uploadSearchAnalytics with SearchAnalytics.Save, so
+// every column of the schema must be saved and nothing else.
+func TestSearchAnalyticsSaveMatchesSchema(t *testing.T) {
+	row, _, err := (&SearchAnalytics{}).Save()
+	assert.Nil(t, err)
+
+	columns := []string{}
+	for _, field := range searchAnalyticsSchema {
+		columns = append(columns, field.Name)
+	}
+	saved := []string{}
+	for column := range row {
+		saved = append(saved, column)
+	}
+	assert.ElementsMatch(t, columns, saved)
+}
+
 func TestDatasetElasticConfig(t *testing.T) {
 	TestQuery := Query{
 		QueryString: "search term test",
@@ -308,7 +705,7 @@ func TestDatasetElasticConfig(t *testing.T) {
 		},
 	}
 
-	datasetConfig := datasetElasticConfig(TestQuery)
+	datasetConfig := entityQuery("dataset", TestQuery)
 
 	// assert query clause exists and that it contains query term
 	assert.Contains(t, datasetConfig, "query")
@@ -373,7 +770,7 @@ func TestCollectionElasticConfig(t *testing.T) {
 		},
 	}
 
-	collectionConfig := collectionsElasticConfig(TestQuery)
+	collectionConfig := entityQuery("collection", TestQuery)
 
 	// assert query clause exists and that it contains query term
 	assert.Contains(t, collectionConfig, "query")
@@ -439,7 +836,7 @@ func TestDataUseElasticConfig(t *testing.T) {
 		},
 	}
 
-	durConfig := dataUseElasticConfig(TestQuery)
+	durConfig := entityQuery("dataUseRegister", TestQuery)
 
 	// assert query clause exists and that it contains query term
 	assert.Contains(t, durConfig, "query")
@@ -497,7 +894,7 @@ func TestPublicationElasticConfig(t *testing.T) {
 		},
 	}
 
-	pubConfig := publicationElasticConfig(TestQuery)
+	pubConfig := entityQuery("publication", TestQuery)
 
 	// assert query clause exists and that it contains query term
 	assert.Contains(t, pubConfig, "query")
@@ -554,7 +951,7 @@ func TestDataProviderElasticConfig(t *testing.T) {
 		},
 	}
 
-	durConfig := dataProviderElasticConfig(TestQuery)
+	durConfig := entityQuery("dataProvider", TestQuery)
 
 	// assert query clause exists and that it contains query term
 	assert.Contains(t, durConfig, "query")
@@ -576,3 +973,1505 @@ func TestDataProviderElasticConfig(t *testing.T) {
 	aggsClause := durConfig["aggs"].(gin.H)
 	assert.Contains(t, aggsClause, "datasetTitles")
 }
+
+func TestDateRangeFilter(t *testing.T) {
+	bothBounds, ok := dateRangeFilter([]interface{}{"2020", "2021"}, "startDate", "endDate")
+	assert.True(t, ok)
+	bothJson, _ := json.Marshal(bothBounds)
+	assert.Contains(t, string(bothJson), "\"endDate\":{\"gte\":\"2020\"}")
+	assert.Contains(t, string(bothJson), "\"startDate\":{\"lte\":\"2021\"}")
+
+	lowerOnly, ok := dateRangeFilter([]interface{}{"2020"}, "startDate", "endDate")
+	assert.True(t, ok)
+	lowerJson, _ := json.Marshal(lowerOnly)
+	assert.Contains(t, string(lowerJson), "\"endDate\":{\"gte\":\"2020\"}")
+	assert.NotContains(t, string(lowerJson), "lte")
+
+	upperOnly, ok := dateRangeFilter([]interface{}{nil, "2021"}, "startDate", "endDate")
+	assert.True(t, ok)
+	upperJson, _ := json.Marshal(upperOnly)
+	assert.Contains(t, string(upperJson), "\"startDate\":{\"lte\":\"2021\"}")
+	assert.NotContains(t, string(upperJson), "gte")
+
+	upperOnlyEmptyString, ok := dateRangeFilter([]interface{}{"", "2021"}, "startDate", "endDate")
+	assert.True(t, ok)
+	assert.EqualValues(t, upperOnly, upperOnlyEmptyString)
+
+	_, ok = dateRangeFilter([]interface{}{}, "startDate", "endDate")
+	assert.False(t, ok)
+
+	_, ok = dateRangeFilter([]interface{}{nil, ""}, "startDate", "endDate")
+	assert.False(t, ok)
+
+	_, ok = dateRangeFilter("2020", "startDate", "endDate")
+	assert.False(t, ok)
+}
+
+func TestDatasetElasticConfigOpenDateRange(t *testing.T) {
+	TestQuery := Query{
+		QueryString: "search term test",
+		Filters: map[string]map[string]interface{}{
+			"dataset": {
+				"dateRange": []interface{}{"2020"},
+			},
+		},
+	}
+
+	datasetConfig := entityQuery("dataset", TestQuery)
+	queryJson, _ := json.Marshal(datasetConfig["post_filter"])
+	assert.Contains(t, string(queryJson), "\"gte\":\"2020\"")
+	assert.NotContains(t, string(queryJson), "lte")
+
+	TestQuery.Filters["dataset"]["dateRange"] = []interface{}{}
+	datasetConfig = entityQuery("dataset", TestQuery)
+	queryJson, _ = json.Marshal(datasetConfig["post_filter"])
+	assert.NotContains(t, string(queryJson), "range")
+	assert.Empty(t, datasetConfig["post_filter"].(gin.H)["bool"].(gin.H)["must"])
+}
+
+func TestPublicationElasticConfigOpenDateRange(t *testing.T) {
+	TestQuery := Query{
+		QueryString: "search term test",
+		Filters: map[string]map[string]interface{}{
+			"paper": {
+				"publicationDate": []interface{}{nil, "2021"},
+			},
+		},
+	}
+
+	pubConfig := entityQuery("publication", TestQuery)
+	queryJson, _ := json.Marshal(pubConfig["post_filter"])
+	assert.Contains(t, string(queryJson), "\"publicationDate\":{\"lte\":\"2021\"}")
+	assert.NotContains(t, string(queryJson), "gte")
+
+	TestQuery.Filters["paper"]["publicationDate"] = []interface{}{}
+	pubConfig = entityQuery("publication", TestQuery)
+	queryJson, _ = json.Marshal(pubConfig["post_filter"])
+	assert.NotContains(t, string(queryJson), "range")
+}
+
+func TestMinimumShouldMatch(t *testing.T) {
+	TestQuery := Query{QueryString: "search term test"}
+
+	toolConfig := entityQuery("tool", TestQuery)
+	assert.NotContains(t, toolConfig["query"].(gin.H)["bool"], "minimum_should_match")
+
+	t.Setenv("SEARCH_MINIMUM_SHOULD_MATCH_TOOL", "2")
+	toolConfig = entityQuery("tool", TestQuery)
+	assert.EqualValues(t, "2", toolConfig["query"].(gin.H)["bool"].(gin.H)["minimum_should_match"])
+
+	TestQuery.MinimumShouldMatch = "75%"
+	toolConfig = entityQuery("tool", TestQuery)
+	assert.EqualValues(t, "75%", toolConfig["query"].(gin.H)["bool"].(gin.H)["minimum_should_match"])
+
+	collectionConfig := entityQuery("collection", Query{QueryString: "search term test"})
+	assert.NotContains(t, collectionConfig["query"].(gin.H)["bool"], "minimum_should_match")
+}
+
+func TestDatasetElasticConfigStructuralMetadata(t *testing.T) {
+	TestQuery := Query{QueryString: "patient_id"}
+
+	queryJson, _ := json.Marshal(entityQuery("dataset", TestQuery)["query"])
+	assert.NotContains(t, string(queryJson), "nested")
+
+	t.Setenv("SEARCH_STRUCTURAL_METADATA", "true")
+	should := entityQuery("dataset", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.Contains(t, should, structuralMetadataQuery("patient_id"))
+
+	queryJson, _ = json.Marshal(should[len(should)-1])
+	assert.Contains(t, string(queryJson), "\"path\":\"structuralMetadata\"")
+	assert.Contains(t, string(queryJson), "\"path\":\"structuralMetadata.columns\"")
+	assert.Contains(t, string(queryJson), "structuralMetadata.columns.description")
+}
+
+func TestStructuralMetadataInnerHits(t *testing.T) {
+	nested := structuralMetadataQuery("patient_id")["nested"].(gin.H)
+	assert.EqualValues(t, structuralMetadataPath, nested["inner_hits"].(gin.H)["name"])
+	assert.EqualValues(t, defaultStructuralMetadataInnerHits, nested["inner_hits"].(gin.H)["size"])
+	columns := nested["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)[1]["nested"].(gin.H)
+	assert.EqualValues(t, structuralMetadataColumnsPath, columns["inner_hits"].(gin.H)["name"])
+	assert.EqualValues(t, []string{"structuralMetadata.columns.name", "structuralMetadata.columns.description"}, columns["inner_hits"].(gin.H)["_source"])
+
+	t.Setenv("SEARCH_STRUCTURAL_METADATA_INNER_HITS", "1000")
+	nested = structuralMetadataQuery("patient_id")["nested"].(gin.H)
+	assert.EqualValues(t, maxCollapseInnerHits, nested["inner_hits"].(gin.H)["size"])
+
+	t.Setenv("SEARCH_STRUCTURAL_METADATA_INNER_HITS", "0")
+	nested = structuralMetadataQuery("patient_id")["nested"].(gin.H)
+	assert.NotContains(t, nested, "inner_hits")
+}
+
+func TestStripExplanationInnerHits(t *testing.T) {
+	var innerHits map[string]interface{}
+	json.Unmarshal([]byte(`{"structuralMetadata": {"hits": {"hits": [{
+		"_source": {"name": "patients"},
+		"_explanation": {"value": 1},
+		"inner_hits": {"structuralMetadata.columns": {"hits": {"hits": [
+			{"_source": {"name": "patient_id"}, "_explanation": {"value": 1}}
+		]}}}
+	}]}}}`), &innerHits)
+	response := func() SearchResponse {
+		return SearchResponse{Hits: HitsField{Hits: []Hit{{Id: "1", InnerHits: innerHits}}}}
+	}
+
+	stripped := response()
+	stripExplanation(stripped, Query{}, "dataset")
+	strippedJson, _ := json.Marshal(stripped.Hits.Hits[0].InnerHits)
+	assert.NotContains(t, string(strippedJson), "_explanation")
+	assert.Contains(t, string(strippedJson), "patient_id")
+	// the original inner hits are left as they were
+	innerHitsJson, _ := json.Marshal(innerHits)
+	assert.Contains(t, string(innerHitsJson), "_explanation")
+
+	debug := response()
+	stripExplanation(debug, Query{Debug: true}, "dataset")
+	debugJson, _ := json.Marshal(debug.Hits.Hits[0].InnerHits)
+	assert.Contains(t, string(debugJson), "_explanation")
+}
+
+func TestExactMode(t *testing.T) {
+	setTestSynonyms(t)
+	TestQuery := Query{QueryString: "MI registry", Exact: true}
+
+	for _, config := range []gin.H{
+		entityQuery("dataset", TestQuery),
+		entityQuery("tool", TestQuery),
+		entityQuery("collection", TestQuery),
+		entityQuery("dataUseRegister", TestQuery),
+		entityQuery("publication", TestQuery),
+		entityQuery("dataProvider", TestQuery),
+		entityQuery("datacustodiannetwork", TestQuery),
+	} {
+		should := config["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+		assert.Len(t, should, 1)
+
+		multiMatch := should[0]["multi_match"].(gin.H)
+		assert.EqualValues(t, "phrase", multiMatch["type"])
+		assert.EqualValues(t, "MI registry", multiMatch["query"])
+		assert.EqualValues(t, 0, multiMatch["slop"])
+		assert.NotContains(t, multiMatch, "fuzziness")
+	}
+
+	TestQuery.Exact = false
+	should := entityQuery("tool", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.Greater(t, len(should), 3)
+}
+
+func TestMatchPhrasePrefix(t *testing.T) {
+	TestQuery := Query{QueryString: "severe asth"}
+	should := entityQuery("tool", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	for _, clause := range should {
+		assert.NotEqualValues(t, "phrase_prefix", clause["multi_match"].(gin.H)["type"])
+	}
+
+	TestQuery.MatchPhrasePrefix = true
+	for _, test := range []struct {
+		config gin.H
+		fields []string
+	}{
+		{entityQuery("dataset", TestQuery), []string{"title", "shortTitle"}},
+		{entityQuery("tool", TestQuery), []string{"name"}},
+		{entityQuery("collection", TestQuery), []string{"name"}},
+	} {
+		should := test.config["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+		prefix := should[len(should)-1]["multi_match"].(gin.H)
+		assert.EqualValues(t, "phrase_prefix", prefix["type"])
+		assert.EqualValues(t, "severe asth", prefix["query"])
+		assert.EqualValues(t, test.fields, prefix["fields"])
+		assert.EqualValues(t, defaultPhrasePrefixMaxExpansions, prefix["max_expansions"])
+	}
+
+	t.Setenv("SEARCH_PHRASE_PREFIX_MAX_EXPANSIONS", "500")
+	should = entityQuery("tool", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.EqualValues(t, maxPhrasePrefixMaxExpansions, should[len(should)-1]["multi_match"].(gin.H)["max_expansions"])
+
+	TestQuery.Exact = true
+	should = entityQuery("tool", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.Len(t, should, 1)
+}
+
+func TestTitleOnly(t *testing.T) {
+	TestQuery := Query{QueryString: "UK Biobank", TitleOnly: true}
+
+	for _, test := range []struct {
+		config gin.H
+		fields []string
+	}{
+		{entityQuery("dataset", TestQuery), []string{"title", "shortTitle"}},
+		{entityQuery("tool", TestQuery), []string{"name"}},
+		{entityQuery("collection", TestQuery), []string{"name"}},
+		{entityQuery("dataUseRegister", TestQuery), []string{"projectTitle"}},
+		{entityQuery("publication", TestQuery), []string{"title"}},
+		{entityQuery("dataProvider", TestQuery), []string{"name", "teamAliases"}},
+		{entityQuery("datacustodiannetwork", TestQuery), []string{"name"}},
+	} {
+		should := test.config["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+		assert.NotEmpty(t, should)
+		for _, clause := range should {
+			assert.EqualValues(t, test.fields, clause["multi_match"].(gin.H)["fields"])
+		}
+		assert.EqualValues(t, "AUTO:5,7", should[0]["multi_match"].(gin.H)["fuzziness"])
+	}
+
+	TestQuery.TitleOnly = false
+	should := entityQuery("collection", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.EqualValues(t, []string{"datasetTitles", "datasetAbstracts"}, should[0]["multi_match"].(gin.H)["fields"])
+}
+
+func TestFieldBoosts(t *testing.T) {
+	TestQuery := Query{QueryString: "asthma"}
+	datasetFields := []string{"abstract", "keywords", "description", "shortTitle", "title", "named_entities^4", "datasetDOI"}
+
+	should := entityQuery("dataset", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	for _, clause := range should[:3] {
+		assert.EqualValues(t, datasetFields, clause["multi_match"].(gin.H)["fields"])
+	}
+	queryJson, _ := json.Marshal(entityQuery("dataset", TestQuery)["query"])
+	assert.NotContains(t, string(queryJson), `"named_entities"`)
+
+	// other entity types are not boosted
+	toolShould := entityQuery("tool", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	toolConfig, _ := entityConfig("tool")
+	assert.EqualValues(t, toolConfig.SearchFields, toolShould[0]["multi_match"].(gin.H)["fields"])
+
+	t.Setenv("SEARCH_FIELD_BOOSTS_DATASET", "title^2.5, named_entities^1, abstract^-1, keywords")
+	should = entityQuery("dataset", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.EqualValues(t,
+		[]string{"abstract", "keywords", "description", "shortTitle", "title^2.5", "named_entities", "datasetDOI"},
+		should[0]["multi_match"].(gin.H)["fields"],
+	)
+
+	t.Setenv("SEARCH_FIELD_BOOSTS_TOOL", "name^3")
+	toolShould = entityQuery("tool", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.Contains(t, toolShould[0]["multi_match"].(gin.H)["fields"], "name^3")
+}
+
+func TestQueryOperators(t *testing.T) {
+	TestQuery := Query{QueryString: `"lung cancer" -smoking`, Operators: true, Analyzer: "english"}
+
+	for _, test := range []struct {
+		config gin.H
+		fields []string
+	}{
+		{entityQuery("dataset", TestQuery), []string{"abstract", "keywords", "description", "shortTitle", "title", "named_entities^4", "datasetDOI"}},
+		{entityQuery("tool", TestQuery), nil},
+		{entityQuery("collection", TestQuery), []string{"description", "name", "keywords"}},
+		{entityQuery("dataUseRegister", TestQuery), nil},
+		{entityQuery("publication", TestQuery), nil},
+		{entityQuery("dataProvider", TestQuery), nil},
+		{entityQuery("datacustodiannetwork", TestQuery), []string{"name", "summary"}},
+	} {
+		should := test.config["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+		assert.Len(t, should, 1)
+		simpleQuery := should[0]["simple_query_string"].(gin.H)
+		assert.EqualValues(t, `"lung cancer" -smoking`, simpleQuery["query"])
+		assert.EqualValues(t, "and", simpleQuery["default_operator"])
+		assert.EqualValues(t, "english", simpleQuery["analyzer"])
+		if test.fields != nil {
+			assert.EqualValues(t, test.fields, simpleQuery["fields"])
+		}
+	}
+
+	TestQuery.DefaultOperator = "OR"
+	should := entityQuery("tool", TestQuery)["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.EqualValues(t, "or", should[0]["simple_query_string"].(gin.H)["default_operator"])
+
+	TestQuery.Operators = false
+	should = entityQuery("tool", Query{QueryString: TestQuery.QueryString})["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.Contains(t, should[0], "multi_match")
+}
+
+func TestBalancedQuotes(t *testing.T) {
+	assert.EqualValues(t, `"lung cancer" -smoking`, balancedQuotes(`"lung cancer" -smoking`))
+	assert.EqualValues(t, `\"lung cancer`, balancedQuotes(`"lung cancer`))
+	assert.EqualValues(t, `"lung cancer" 5\"`, balancedQuotes(`"lung cancer" 5"`))
+	assert.EqualValues(t, `12\" ruler \"`, balancedQuotes(`12\" ruler "`))
+	assert.EqualValues(t, "asthma", balancedQuotes("asthma"))
+}
+
+func TestValidateOperators(t *testing.T) {
+	assert.Nil(t, validateQuery(Query{Operators: true, DefaultOperator: "or"}))
+	assert.NotNil(t, validateQuery(Query{DefaultOperator: "and"}))
+	assert.NotNil(t, validateQuery(Query{Operators: true, DefaultOperator: "xor"}))
+	assert.NotNil(t, validateQuery(Query{Operators: true, Exact: true}))
+}
+
+func TestReturnQuery(t *testing.T) {
+	results, _ := defaultService().Search("tool", Query{QueryString: "sequencing"})
+	assert.Nil(t, results.Query)
+	resultsJson, _ := json.Marshal(results)
+	assert.NotContains(t, string(resultsJson), "_query")
+
+	query := Query{QueryString: "sequencing", ReturnQuery: true}
+	results, _ = defaultService().Search("tool", query)
+	assert.EqualValues(t, entityQuery("tool", query), results.Query)
+	resultsJson, _ = json.Marshal(results)
+	assert.Contains(t, string(resultsJson), "\"_query\":{")
+
+	results, _ = defaultService().Search("dataset", query)
+	assert.EqualValues(t, entityQuery("dataset", query), results.Query)
+
+	t.Setenv("SEARCH_DISABLE_DEBUG_FEATURES", "true")
+	results, _ = defaultService().Search("tool", query)
+	assert.Nil(t, results.Query)
+}
+
+func TestMinScore(t *testing.T) {
+	TestQuery := Query{
+		QueryString: "search term test",
+		Filters: map[string]map[string]interface{}{
+			"collection": {"keywords": []interface{}{"cancer"}},
+		},
+	}
+	assert.NotContains(t, entityQuery("collection", TestQuery), "min_score")
+
+	TestQuery.MinScore = 2.5
+	for _, config := range []gin.H{
+		entityQuery("collection", TestQuery),
+		entityQuery("dataset", TestQuery),
+		entityQuery("datacustodiannetwork", TestQuery),
+	} {
+		assert.EqualValues(t, 2.5, config["min_score"])
+
+		// min_score is applied to the scored main query, the post_filter
+		// is separate and does not contribute to the score
+		postFilter, _ := json.Marshal(config["post_filter"])
+		assert.NotContains(t, string(postFilter), "min_score")
+	}
+
+	TestQuery.MinScore = -1
+	assert.NotNil(t, validateQuery(TestQuery))
+}
+
+func TestBuildHighlight(t *testing.T) {
+	defaultHighlight := buildHighlight(Query{}, "dataset")
+	fields := defaultHighlight["fields"].(gin.H)
+	assert.Contains(t, fields, "description")
+	assert.Contains(t, fields, "abstract")
+	assert.EqualValues(t, 0, fields["description"].(gin.H)["fragment_size"])
+	assert.NotContains(t, fields["description"], "number_of_fragments")
+
+	snippetQuery := Query{
+		Highlight: HighlightOptions{FragmentSize: 150, NumberOfFragments: 3},
+	}
+	snippetHighlight := buildHighlight(snippetQuery, "tool")
+	nameConfig := snippetHighlight["fields"].(gin.H)["name"].(gin.H)
+	assert.EqualValues(t, 150, nameConfig["fragment_size"])
+	assert.EqualValues(t, 3, nameConfig["number_of_fragments"])
+
+	toolConfig := entityQuery("tool", snippetQuery)
+	toolHighlight, _ := json.Marshal(toolConfig["highlight"])
+	assert.Contains(t, string(toolHighlight), "\"fragment_size\":150")
+	assert.Contains(t, string(toolHighlight), "\"number_of_fragments\":3")
+}
+
+func TestHighlightFields(t *testing.T) {
+	fields := []string{"abstract", "name"}
+	query := Query{QueryString: "asthma", Highlight: HighlightOptions{Fields: &fields}}
+	assert.Nil(t, validateQuery(query))
+
+	datasetHighlight := entityQuery("dataset", query)["highlight"].(gin.H)["fields"].(gin.H)
+	assert.Len(t, datasetHighlight, 1)
+	assert.Contains(t, datasetHighlight, "abstract")
+	collectionHighlight := entityQuery("collection", query)["highlight"].(gin.H)["fields"].(gin.H)
+	assert.Len(t, collectionHighlight, 1)
+	assert.Contains(t, entityQuery("tool", query)["highlight"].(gin.H)["fields"], "name")
+	assert.NotContains(t, entityQuery("dataUseRegister", query), "highlight")
+
+	noFields := []string{}
+	query.Highlight.Fields = &noFields
+	assert.NotContains(t, entityQuery("dataset", query), "highlight")
+	assert.NotContains(t, entityQuery("dataProvider", Query{QueryString: "asthma"}), "highlight")
+
+	unknownFields := []string{"description", "datasetDOI"}
+	query.Highlight.Fields = &unknownFields
+	err := validateQuery(query)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "datasetDOI")
+}
+
+func TestPostProcessResponseAssignsRanks(t *testing.T) {
+	elasticResp := SearchResponse{
+		Hits: HitsField{
+			Hits: []Hit{
+				{Id: "3", Score: 1.5},
+				{Id: "1", Score: 4.0},
+				{Id: "2", Score: 2.5},
+			},
+		},
+	}
+
+	processed := postProcessResponse(elasticResp, Query{}, "tool")
+	for i, hit := range processed.Hits.Hits {
+		assert.EqualValues(t, i+1, hit.Rank)
+	}
+
+	// reorder the hits as later processing might and check ranks follow
+	hits := processed.Hits.Hits
+	hits[0], hits[1] = hits[1], hits[0]
+	hits = hits[:2]
+	assignRanks(hits)
+	assert.EqualValues(t, "1", hits[0].Id)
+	assert.EqualValues(t, 1, hits[0].Rank)
+	assert.EqualValues(t, "3", hits[1].Id)
+	assert.EqualValues(t, 2, hits[1].Rank)
+}
+
+func TestBuildHighlightTags(t *testing.T) {
+	defaultHighlight := buildHighlight(Query{}, "tool")
+	assert.EqualValues(t, []string{"<em>"}, defaultHighlight["pre_tags"])
+	assert.EqualValues(t, []string{"</em>"}, defaultHighlight["post_tags"])
+
+	customHighlight := buildHighlight(Query{
+		Highlight: HighlightOptions{
+			PreTags:  []string{"<mark>"},
+			PostTags: []string{"</mark>"},
+		},
+	}, "tool")
+	assert.EqualValues(t, []string{"<mark>"}, customHighlight["pre_tags"])
+	assert.EqualValues(t, []string{"</mark>"}, customHighlight["post_tags"])
+}
+
+func TestHighlightFallbackCap(t *testing.T) {
+	t.Setenv("SEARCH_HIGHLIGHT_FALLBACK_CAP", "100")
+
+	highlight := buildHighlight(Query{
+		Highlight: HighlightOptions{
+			Fields:      &[]string{"description", "abstract", "title"},
+			NoMatchSize: map[string]int{"description": 500, "abstract": 50},
+		},
+	}, "dataset")
+	fields := highlight["fields"].(gin.H)
+	assert.EqualValues(t, 100, fields["description"].(gin.H)["no_match_size"])
+	assert.EqualValues(t, 50, fields["abstract"].(gin.H)["no_match_size"])
+	assert.EqualValues(t, 0, fields["title"].(gin.H)["no_match_size"])
+
+	hits := []Hit{
+		{
+			Id: "1",
+			Highlight: map[string][]string{
+				"description": {strings.Repeat("d", 90)},
+				"abstract":    {strings.Repeat("a", 40)},
+				"title":       {strings.Repeat("t", 30)},
+				"keywords":    {"an <em>asthma</em> study"},
+			},
+		},
+		{
+			Id: "2",
+			Highlight: map[string][]string{
+				"description": {strings.Repeat("d", 60)},
+			},
+		},
+	}
+	capHighlightFallbacks(hits, nil, highlightFallbackCap())
+
+	fallbackBytes := 0
+	for field, fragments := range hits[0].Highlight {
+		if field != "keywords" {
+			fallbackBytes += len(fragments[0])
+		}
+	}
+	assert.LessOrEqual(t, fallbackBytes, 100)
+	// the longest fallback is trimmed, the shorter ones are left intact
+	assert.Len(t, hits[0].Highlight["description"][0], 30)
+	assert.Len(t, hits[0].Highlight["abstract"][0], 40)
+	assert.Len(t, hits[0].Highlight["title"][0], 30)
+	assert.EqualValues(t, []string{"an <em>asthma</em> study"}, hits[0].Highlight["keywords"])
+	assert.Len(t, hits[1].Highlight["description"][0], 60)
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	assert.EqualValues(t, "abc", truncateUTF8("abc", 5))
+	assert.EqualValues(t, "ab", truncateUTF8("abc", 2))
+	// "é" is two bytes so is dropped rather than split
+	assert.EqualValues(t, "caf", truncateUTF8("café", 4))
+}
+
+func TestJoinHighlights(t *testing.T) {
+	elasticResp := SearchResponse{
+		Hits: HitsField{
+			Hits: []Hit{
+				{
+					Id: "1",
+					Highlight: map[string][]string{
+						"abstract": {"first <em>asthma</em> match", "second <em>asthma</em> match"},
+						"title":    {"<em>Asthma</em> study"},
+					},
+				},
+				{Id: "2"},
+			},
+		},
+	}
+
+	unjoined := postProcessResponse(copyResponseHits(elasticResp), Query{}, "dataset")
+	assert.Nil(t, unjoined.Hits.Hits[0].HighlightText)
+
+	joinQuery := Query{Highlight: HighlightOptions{Join: true}}
+	joined := postProcessResponse(elasticResp, joinQuery, "dataset")
+	firstHit := joined.Hits.Hits[0]
+	assert.EqualValues(
+		t,
+		"first <em>asthma</em> match ... second <em>asthma</em> match",
+		firstHit.HighlightText["abstract"],
+	)
+	assert.EqualValues(t, "<em>Asthma</em> study", firstHit.HighlightText["title"])
+	assert.Len(t, firstHit.Highlight["abstract"], 2)
+	assert.Nil(t, joined.Hits.Hits[1].HighlightText)
+}
+
+func TestFlattenAggsPercentages(t *testing.T) {
+	fixture := `{
+		"hits": {"total": {"value": 8, "relation": "eq"}, "hits": []},
+		"aggregations": {
+			"publisherName": {
+				"doc_count": 8,
+				"publisherName": {
+					"buckets": [
+						{"key": "Publisher A", "doc_count": 4},
+						{"key": "Publisher B", "doc_count": 2},
+						{"key": "Publisher C", "doc_count": 1}
+					]
+				}
+			},
+			"dateRange": {
+				"doc_count": 8,
+				"startDate": {"value": 1.0},
+				"endDate": {"value": 2.0}
+			}
+		}
+	}`
+	var elasticResp SearchResponse
+	err := json.Unmarshal([]byte(fixture), &elasticResp)
+	assert.Nil(t, err)
+
+	aggs := flattenAggs(elasticResp, true)
+	buckets := aggs["publisherName"].(map[string]any)["buckets"].([]any)
+	expected := []float64{50, 25, 12.5}
+	for i, b := range buckets {
+		assert.EqualValues(t, expected[i], b.(map[string]any)["percentage"])
+	}
+	assert.EqualValues(t, map[string]any{"value": 1.0}, aggs["startDate"])
+
+	var emptyResp SearchResponse
+	json.Unmarshal([]byte(strings.Replace(fixture, `"value": 8`, `"value": 0`, 1)), &emptyResp)
+	emptyBuckets := flattenAggs(emptyResp, true)["publisherName"].(map[string]any)["buckets"].([]any)
+	assert.EqualValues(t, 0.0, emptyBuckets[0].(map[string]any)["percentage"])
+
+	var plainResp SearchResponse
+	json.Unmarshal([]byte(fixture), &plainResp)
+	plainBuckets := flattenAggs(plainResp, false)["publisherName"].(map[string]any)["buckets"].([]any)
+	assert.NotContains(t, plainBuckets[0], "percentage")
+}
+
+func TestExtractExplanationPayload(t *testing.T) {
+	defaultPostDoFunc := mocks.PostDoFunc
+	t.Cleanup(func() { mocks.PostDoFunc = defaultPostDoFunc })
+
+	var payload map[string]interface{}
+	mocks.PostDoFunc = func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &payload)
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader([]byte(``))),
+		}, nil
+	}
+
+	query := Query{
+		QueryString: "asthma",
+		Filters: map[string]map[string]interface{}{
+			"dataset": {"publisherName": []interface{}{"Publisher A"}},
+		},
+	}
+	extractExplanation(SearchResponse{}, query, "dataset")
+
+	queryPayload, ok := payload["query"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.EqualValues(t, "asthma", queryPayload["query"])
+	assert.EqualValues(
+		t,
+		map[string]interface{}{
+			"dataset": map[string]interface{}{"publisherName": []interface{}{"Publisher A"}},
+		},
+		queryPayload["filters"],
+	)
+}
+
+func TestExtractExplanationRequest(t *testing.T) {
+	t.Setenv("SEARCH_EXPLANATION_EXTRACTOR", "http://extractor")
+	t.Setenv("SEARCH_EXPLANATION_USER", "search")
+	t.Setenv("SEARCH_EXPLANATION_PASSWORD", "secret")
+	t.Setenv("SEARCH_EXPLANATION_TABLE", "explanations")
+	recorder := &mocks.RecordingClient{}
+	defaultClient := Client
+	Client = recorder
+	t.Cleanup(func() { Client = defaultClient })
+
+	extractExplanation(SearchResponse{Took: 4}, Query{QueryString: "asthma"}, "dataset")
+
+	requests, bodies := recorder.Requests()
+	assert.Len(t, requests, 1)
+	assert.EqualValues(t, http.MethodPost, requests[0].Method)
+	assert.EqualValues(t, "http://extractor/process_data", requests[0].URL.String())
+	assert.EqualValues(t, "application/json", requests[0].Header.Get("Content-Type"))
+	user, password, ok := requests[0].BasicAuth()
+	assert.True(t, ok)
+	assert.EqualValues(t, "search", user)
+	assert.EqualValues(t, "secret", password)
+
+	var payload map[string]interface{}
+	assert.Nil(t, json.Unmarshal(bodies[0], &payload))
+	assert.EqualValues(t, "explanations", payload["destination_table"])
+	assert.EqualValues(t, 4, payload["data"].(map[string]interface{})["took"])
+	assert.EqualValues(t, "asthma", payload["query"].(map[string]interface{})["query"])
+}
+
+func TestExplainOnlyWhenUsed(t *testing.T) {
+	query := Query{QueryString: "asthma"}
+	for _, entityType := range entityTypes() {
+		config, _ := entityConfig(entityType)
+		assert.NotContains(t, config.ElasticConfig(query), "explain", entityType)
+	}
+
+	debugQuery := Query{QueryString: "asthma", Debug: true}
+	assert.EqualValues(t, true, entityQuery("dataset", debugQuery)["explain"])
+
+	t.Setenv("SEARCH_EXPLANATION_EXTRACTOR", "http://extractor")
+	assert.EqualValues(t, true, entityQuery("dataset", query)["explain"])
+	assert.NotContains(t, entityQuery("tool", query), "explain")
+	assert.NotContains(t, entityQuery("dataset", Query{}), "explain")
+	seed := 42
+	emptyQuery := Query{QueryString: "  ", RequestID: "request-1", Seed: &seed}
+	assert.False(t, explanationExtractionEnabled(emptyQuery, "dataset"))
+	assert.NotContains(t, entityQuery("dataset", emptyQuery), "explain")
+
+	explanationExtractionPaused.Store(true)
+	defer explanationExtractionPaused.Store(false)
+	assert.NotContains(t, entityQuery("dataset", query), "explain")
+}
+
+func TestPingExplanationExtractor(t *testing.T) {
+	t.Setenv("SEARCH_EXPLANATION_EXTRACTOR", "http://extractor")
+	t.Setenv("SEARCH_EXPLANATION_USER", "user")
+	t.Setenv("SEARCH_EXPLANATION_PASSWORD", "password")
+	defaultGetDoFunc := mocks.GetDoFunc
+	t.Cleanup(func() { mocks.GetDoFunc = defaultGetDoFunc })
+
+	var pinged *http.Request
+	mocks.GetDoFunc = func(req *http.Request) (*http.Response, error) {
+		pinged = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Body:       io.NopCloser(strings.NewReader(`{"status": "ok"}`)),
+		}, nil
+	}
+	status, failure := pingExplanationExtractor()
+	assert.EqualValues(t, http.StatusOK, status)
+	assert.Empty(t, failure)
+	assert.EqualValues(t, "http://extractor/health", pinged.URL.String())
+	user, password, _ := pinged.BasicAuth()
+	assert.EqualValues(t, "user", user)
+	assert.EqualValues(t, "password", password)
+	_, hasDeadline := pinged.Context().Deadline()
+	assert.True(t, hasDeadline)
+
+	mocks.GetDoFunc = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Status:     "503 Service Unavailable",
+			Body:       io.NopCloser(strings.NewReader("")),
+		}, nil
+	}
+	status, failure = pingExplanationExtractor()
+	assert.EqualValues(t, http.StatusServiceUnavailable, status)
+	assert.EqualValues(t, "503 Service Unavailable", failure)
+
+	mocks.GetDoFunc = func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}
+	status, failure = pingExplanationExtractor()
+	assert.EqualValues(t, 0, status)
+	assert.EqualValues(t, "extractor unreachable", failure)
+}
+
+func TestNewExplanationSlots(t *testing.T) {
+	assert.EqualValues(t, defaultExplanationConcurrency, cap(newExplanationSlots()))
+
+	t.Setenv("SEARCH_EXPLANATION_CONCURRENCY", "3")
+	assert.EqualValues(t, 3, cap(newExplanationSlots()))
+
+	t.Setenv("SEARCH_EXPLANATION_CONCURRENCY", "-1")
+	assert.EqualValues(t, defaultExplanationConcurrency, cap(newExplanationSlots()))
+}
+
+func TestStripExplanationBoundedExtraction(t *testing.T) {
+	t.Setenv("SEARCH_EXPLANATION_EXTRACTOR", "http://extractor")
+	defaultPostDoFunc := mocks.PostDoFunc
+	defaultSlots := explanationSlots
+	t.Cleanup(func() {
+		mocks.PostDoFunc = defaultPostDoFunc
+		explanationSlots = defaultSlots
+	})
+
+	requests := make(chan *http.Request, 2)
+	mocks.PostDoFunc = func(req *http.Request) (*http.Response, error) {
+		requests <- req
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader([]byte(``))),
+		}, nil
+	}
+	explanationSlots = make(chan struct{}, 1)
+
+	newResponse := func() SearchResponse {
+		return SearchResponse{
+			Hits: HitsField{
+				Hits: []Hit{{Id: "1", Explanation: map[string]interface{}{"value": 1.0}}},
+			},
+		}
+	}
+	query := Query{QueryString: "asthma"}
+
+	// with the only slot taken the extraction is dropped, but the explanation
+	// is still stripped from the response
+	explanationSlots <- struct{}{}
+	elasticResp := newResponse()
+	stripExplanation(elasticResp, query, "dataset")
+	assert.Empty(t, elasticResp.Hits.Hits[0].Explanation)
+	assert.Len(t, requests, 0)
+	<-explanationSlots
+
+	elasticResp = newResponse()
+	stripExplanation(elasticResp, query, "dataset")
+	assert.Empty(t, elasticResp.Hits.Hits[0].Explanation)
+
+	req := <-requests
+	_, hasDeadline := req.Context().Deadline()
+	assert.True(t, hasDeadline)
+}
+
+func TestSetExplanationExtraction(t *testing.T) {
+	t.Setenv("SEARCH_EXPLANATION_EXTRACTOR", "http://extractor")
+	defaultPostDoFunc := mocks.PostDoFunc
+	t.Cleanup(func() {
+		mocks.PostDoFunc = defaultPostDoFunc
+		explanationExtractionPaused.Store(false)
+	})
+
+	requests := make(chan *http.Request, 2)
+	mocks.PostDoFunc = func(req *http.Request) (*http.Response, error) {
+		requests <- req
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader([]byte(``))),
+		}, nil
+	}
+	logs := captureLogs(t)
+
+	setEnabled := func(body gin.H) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c := GetTestGinContext(w)
+		MockPostWithBody(c, body)
+		SetExplanationExtraction(c)
+		return w
+	}
+
+	w := setEnabled(gin.H{"enabled": false})
+	assert.EqualValues(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"enabled": false}`, w.Body.String())
+	record, ok := logs.find("Search explanation extraction toggled")
+	assert.True(t, ok)
+	assert.EqualValues(t, false, record["enabled"])
+
+	elasticResp := SearchResponse{
+		Hits: HitsField{Hits: []Hit{{Id: "1", Explanation: map[string]interface{}{"value": 1.0}}}},
+	}
+	stripExplanation(elasticResp, Query{QueryString: "asthma"}, "dataset")
+	assert.Empty(t, elasticResp.Hits.Hits[0].Explanation)
+	assert.Len(t, requests, 0)
+
+	assert.EqualValues(t, http.StatusBadRequest, setEnabled(gin.H{}).Code)
+
+	w = setEnabled(gin.H{"enabled": true})
+	assert.JSONEq(t, `{"enabled": true}`, w.Body.String())
+	stripExplanation(elasticResp, Query{QueryString: "asthma"}, "dataset")
+	<-requests
+}
+
+func TestExplanationEnabledFor(t *testing.T) {
+	assert.True(t, explanationEnabledFor("dataset"))
+	assert.False(t, explanationEnabledFor("tool"))
+
+	t.Setenv("SEARCH_EXPLANATION_ENTITY_TYPES", "dataset, tool,publication")
+	assert.True(t, explanationEnabledFor("dataset"))
+	assert.True(t, explanationEnabledFor("tool"))
+	assert.True(t, explanationEnabledFor("publication"))
+	assert.False(t, explanationEnabledFor("collection"))
+}
+
+func TestExplanationTable(t *testing.T) {
+	t.Setenv("SEARCH_EXPLANATION_TABLE", "explanations")
+	t.Setenv("SEARCH_EXPLANATION_TABLE_PUBLICATION", "publication_explanations")
+
+	assert.EqualValues(t, "explanations", explanationTable("dataset"))
+	assert.EqualValues(t, "explanations_tool", explanationTable("tool"))
+	assert.EqualValues(t, "publication_explanations", explanationTable("publication"))
+	assert.EqualValues(t, "explanations_dur", explanationTable("dur"))
+
+	t.Setenv("SEARCH_EXPLANATION_TABLE_DUR", "dur_explanations")
+	assert.EqualValues(t, "dur_explanations", explanationTable("dur"))
+	config, _ := entityConfig("dataUseRegister")
+	assert.EqualValues(t, "dur_explanations", explanationTable(config.SettingName))
+}
+
+func TestBigQueryTables(t *testing.T) {
+	t.Setenv("BQ_DATASET_NAME", "search")
+	t.Setenv("BQ_TABLE_NAME", "analytics")
+	t.Setenv("SEARCH_EXPLANATION_TABLE", "explanations")
+	t.Setenv("SEARCH_EXPLANATION_TABLE_TOOL", "tool_explanations")
+
+	tables := bigQueryTables()
+	assert.EqualValues(t, BigQueryTables{
+		Dataset:           "search",
+		AnalyticsTable:    "analytics",
+		ExplanationTable:  "explanations",
+		ExplanationTables: map[string]string{"tool": "tool_explanations"},
+	}, tables)
+	assert.EqualValues(t, "tool_explanations", tables.explanation("tool"))
+	assert.EqualValues(t, "explanations_collection", tables.explanation("collection"))
+}
+
+func TestStripExplanationSendsConfiguredEntityTypes(t *testing.T) {
+	t.Setenv("SEARCH_EXPLANATION_EXTRACTOR", "http://extractor")
+	t.Setenv("SEARCH_EXPLANATION_ENTITY_TYPES", "tool")
+	t.Setenv("SEARCH_EXPLANATION_TABLE", "explanations")
+	defaultPostDoFunc := mocks.PostDoFunc
+	t.Cleanup(func() { mocks.PostDoFunc = defaultPostDoFunc })
+
+	payloads := make(chan map[string]interface{}, 2)
+	mocks.PostDoFunc = func(req *http.Request) (*http.Response, error) {
+		var payload map[string]interface{}
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &payload)
+		payloads <- payload
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader([]byte(``))),
+		}, nil
+	}
+
+	query := Query{QueryString: "asthma"}
+	stripExplanation(SearchResponse{}, query, "dataset")
+	stripExplanation(SearchResponse{}, query, "tool")
+
+	payload := <-payloads
+	assert.EqualValues(t, "explanations_tool", payload["destination_table"])
+	assert.Len(t, payloads, 0)
+}
+
+func TestStripExplanationDebug(t *testing.T) {
+	t.Setenv("SEARCH_EXPLANATION_EXTRACTOR", "http://extractor")
+	defaultPostDoFunc := mocks.PostDoFunc
+	t.Cleanup(func() { mocks.PostDoFunc = defaultPostDoFunc })
+
+	requests := make(chan *http.Request, 2)
+	mocks.PostDoFunc = func(req *http.Request) (*http.Response, error) {
+		requests <- req
+		return &http.Response{
+			StatusCode: 200,
+			Body:       io.NopCloser(bytes.NewReader([]byte(``))),
+		}, nil
+	}
+
+	explanation := map[string]interface{}{"value": 1.0, "description": "sum of:"}
+	elasticResp := SearchResponse{
+		Hits: HitsField{Hits: []Hit{{Id: "1", Explanation: explanation}}},
+	}
+	processed := postProcessResponse(elasticResp, Query{QueryString: "asthma", Debug: true}, "dataset")
+
+	assert.EqualValues(t, explanation, processed.Hits.Hits[0].Explanation)
+	<-requests
+	assert.Len(t, requests, 0)
+
+	processed = postProcessResponse(elasticResp, Query{QueryString: "asthma"}, "dataset")
+	assert.Empty(t, processed.Hits.Hits[0].Explanation)
+	<-requests
+}
+
+func TestBuildAggregationsSize(t *testing.T) {
+	t.Setenv("SEARCH_NO_RECORDS_AGGREGATION", "100")
+	t.Setenv("SEARCH_MAX_AGGREGATION_SIZE", "5000")
+
+	aggSize := func(query Query) interface{} {
+		query.Aggregations = []map[string]interface{}{
+			{"type": "dataset", "keys": "publisherName"},
+		}
+		aggs := buildAggregations(query, []gin.H{})
+		inner := aggs["publisherName"].(gin.H)["aggs"].(gin.H)
+		return inner["publisherName"].(gin.H)["terms"].(gin.H)["size"]
+	}
+
+	assert.EqualValues(t, 100, aggSize(Query{}))
+	assert.EqualValues(t, 2500, aggSize(Query{AggregationSize: 2500}))
+	assert.EqualValues(t, 5000, aggSize(Query{AggregationSize: 100000}))
+	assert.NotNil(t, validateQuery(Query{AggregationSize: -1}))
+}
+
+func TestTermsAggregationOptions(t *testing.T) {
+	terms := termsAggregation(Query{}, "dataset", map[string]interface{}{"keys": "publisherName"}, "publisherName")
+	assert.NotContains(t, terms, "min_doc_count")
+	assert.NotContains(t, terms, "order")
+
+	terms = termsAggregation(
+		Query{},
+		"dataset",
+		map[string]interface{}{"keys": "publisherName", "minDocCount": 5.0, "order": "key"},
+		"publisherName",
+	)
+	assert.EqualValues(t, 5, terms["min_doc_count"])
+	assert.EqualValues(t, gin.H{"_key": "asc"}, terms["order"])
+
+	terms = termsAggregation(
+		Query{},
+		"dataset",
+		map[string]interface{}{"keys": "publisherName", "order": "count"},
+		"publisherName",
+	)
+	assert.EqualValues(t, gin.H{"_count": "desc"}, terms["order"])
+}
+
+func TestBuildAggregationsSubAggregation(t *testing.T) {
+	query := Query{
+		Aggregations: []map[string]interface{}{
+			{"type": "dataset", "keys": "publisherName", "subAggregation": "containsTissue"},
+			{"type": "dataset", "keys": "dataType"},
+		},
+	}
+	aggs := buildAggregations(query, []gin.H{})
+
+	publisherTerms := aggs["publisherName"].(gin.H)["aggs"].(gin.H)["publisherName"].(gin.H)["terms"].(gin.H)
+	subAggs := publisherTerms["aggs"].(gin.H)
+	assert.EqualValues(
+		t,
+		"containsTissue",
+		subAggs["containsTissue"].(gin.H)["terms"].(gin.H)["field"],
+	)
+
+	dataTypeTerms := aggs["dataType"].(gin.H)["aggs"].(gin.H)["dataType"].(gin.H)["terms"].(gin.H)
+	assert.NotContains(t, dataTypeTerms, "aggs")
+}
+
+func TestBuildAggregationsSubAggregationSize(t *testing.T) {
+	t.Setenv("SEARCH_MAX_AGGREGATION_SIZE", "1000")
+	query := Query{
+		AggregationSize: 100,
+		Aggregations: []map[string]interface{}{
+			{"type": "dataset", "keys": "publisherName", "subAggregation": "containsTissue"},
+		},
+	}
+	aggs := buildAggregations(query, []gin.H{})
+
+	publisherTerms := aggs["publisherName"].(gin.H)["aggs"].(gin.H)["publisherName"].(gin.H)["terms"].(gin.H)
+	subTerms := publisherTerms["aggs"].(gin.H)["containsTissue"].(gin.H)["terms"].(gin.H)
+	assert.EqualValues(t, 100, publisherTerms["size"])
+	assert.EqualValues(t, 10, subTerms["size"])
+
+	query.AggregationSize = 5
+	aggs = buildAggregations(query, []gin.H{})
+	publisherTerms = aggs["publisherName"].(gin.H)["aggs"].(gin.H)["publisherName"].(gin.H)["terms"].(gin.H)
+	subTerms = publisherTerms["aggs"].(gin.H)["containsTissue"].(gin.H)["terms"].(gin.H)
+	assert.EqualValues(t, 5, subTerms["size"])
+
+	assert.EqualValues(t, 1, subAggregationSize(5000, 1000))
+}
+
+func TestBuildAggregationsGlobal(t *testing.T) {
+	mustFilters := []gin.H{
+		{"terms": gin.H{"dataType": []string{"Health"}}},
+		{"terms": gin.H{"publisherName": []string{"Publisher A"}}},
+	}
+	query := Query{
+		GlobalAggs: true,
+		Aggregations: []map[string]interface{}{
+			{"type": "dataset", "keys": "publisherName"},
+			{"type": "dataset", "keys": "dataType", "global": false},
+		},
+	}
+	aggs := buildAggregations(query, mustFilters)
+
+	publisherName := aggs["publisherName"].(gin.H)
+	assert.EqualValues(t, gin.H{}, publisherName["global"])
+	filtered := publisherName["aggs"].(gin.H)[globalAggregationName].(gin.H)
+	assert.EqualValues(t, []gin.H{mustFilters[0]}, filtered["filter"].(gin.H)["bool"].(gin.H)["must"])
+	assert.Contains(t, filtered["aggs"], "publisherName")
+
+	assert.NotContains(t, aggs["dataType"], "global")
+	assert.Contains(t, aggs["dataType"].(gin.H)["aggs"], "dataType")
+
+	// Filters in the main query still narrow global aggregations.
+	query.FilterInQuery = true
+	aggs = buildAggregations(query, mustFilters)
+	filtered = aggs["publisherName"].(gin.H)["aggs"].(gin.H)[globalAggregationName].(gin.H)
+	assert.Len(t, filtered["filter"].(gin.H)["bool"].(gin.H)["must"], 1)
+	assert.Empty(t, aggs["dataType"].(gin.H)["filter"].(gin.H)["bool"].(gin.H)["must"])
+
+	assert.NotNil(t, validateQuery(Query{Aggregations: []map[string]interface{}{
+		{"type": "dataset", "keys": "publisherName", "global": "yes"},
+	}}))
+}
+
+func TestBuildAggregationsDateHistogram(t *testing.T) {
+	query := Query{
+		Aggregations: []map[string]interface{}{
+			{"type": "publication", "keys": "publicationDate", "dateHistogram": true},
+			{"type": "dataset", "keys": "startDate", "dateHistogram": true, "calendarInterval": "month"},
+			{"type": "dataset", "keys": "dateRange"},
+		},
+	}
+	aggs := buildAggregations(query, []gin.H{})
+
+	publicationDate := aggs["publicationDate"].(gin.H)["aggs"].(gin.H)["publicationDate"].(gin.H)
+	assert.EqualValues(t, gin.H{
+		"date_histogram": gin.H{"field": "publicationDate", "calendar_interval": "year", "format": "yyyy"},
+	}, publicationDate)
+
+	startDate := aggs["startDate"].(gin.H)["aggs"].(gin.H)["startDate"].(gin.H)["date_histogram"].(gin.H)
+	assert.EqualValues(t, "month", startDate["calendar_interval"])
+	assert.EqualValues(t, "yyyy-MM", startDate["format"])
+
+	assert.Contains(t, aggs["dateRange"].(gin.H)["aggs"], "startDate")
+}
+
+func TestValidateDateHistogram(t *testing.T) {
+	setIndexFieldTypes("publication", map[string]string{"publicationDate": "date", "title": "text"})
+	t.Cleanup(func() { setIndexFieldTypes("publication", map[string]string{}) })
+
+	validate := func(agg map[string]interface{}) error {
+		return validateQuery(Query{Aggregations: []map[string]interface{}{agg}})
+	}
+	assert.Nil(t, validate(map[string]interface{}{
+		"type": "publication", "keys": "publicationDate", "dateHistogram": true, "calendarInterval": "quarter",
+	}))
+	assert.Nil(t, validate(map[string]interface{}{"type": "tool", "keys": "createdAt", "dateHistogram": true}))
+
+	err := validate(map[string]interface{}{"type": "publication", "keys": "title", "dateHistogram": true})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "requires a date field, not text")
+
+	err = validate(map[string]interface{}{
+		"type": "publication", "keys": "publicationDate", "dateHistogram": true, "calendarInterval": "decade",
+	})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "day, hour, minute, month, quarter, week, year")
+
+	assert.NotNil(t, validate(map[string]interface{}{
+		"type": "publication", "keys": "publicationDate", "calendarInterval": "year",
+	}))
+	assert.NotNil(t, validate(map[string]interface{}{
+		"type": "publication", "keys": "publicationDate", "dateHistogram": "yes",
+	}))
+}
+
+func TestFlattenAggsDateHistogram(t *testing.T) {
+	fixture := `{
+		"hits": {"total": {"value": 5, "relation": "eq"}, "hits": []},
+		"aggregations": {
+			"publicationDate": {
+				"doc_count": 5,
+				"publicationDate": {
+					"buckets": [
+						{"key_as_string": "2020", "key": 1577836800000, "doc_count": 3},
+						{"key_as_string": "2021", "key": 1609459200000, "doc_count": 2}
+					]
+				}
+			}
+		}
+	}`
+	var elasticResp SearchResponse
+	err := json.Unmarshal([]byte(fixture), &elasticResp)
+	assert.Nil(t, err)
+
+	aggs := flattenAggs(elasticResp, true)
+	assert.NotContains(t, aggs, "startDate")
+	buckets := aggs["publicationDate"].(map[string]any)["buckets"].([]any)
+	assert.EqualValues(t, "2020", buckets[0].(map[string]any)["key_as_string"])
+	assert.EqualValues(t, 60, buckets[0].(map[string]any)["percentage"])
+}
+
+func TestBuildAggregationsMetric(t *testing.T) {
+	query := Query{
+		Aggregations: []map[string]interface{}{
+			{"type": "dataset", "keys": "populationSize", "metric": "percentiles", "percents": []interface{}{10.0, 90.0}},
+			{"type": "tool", "keys": "downloads", "metric": "stats"},
+		},
+	}
+	aggs := buildAggregations(query, []gin.H{})
+
+	populationSize := aggs["populationSize"].(gin.H)
+	assert.EqualValues(t, gin.H{
+		"percentiles": gin.H{"field": "populationSize", "percents": []float64{10, 90}, "keyed": false},
+	}, populationSize["aggs"].(gin.H)["populationSize"])
+	assert.EqualValues(t, []gin.H{
+		{"range": gin.H{"populationSize": gin.H{"gt": unreportedPopulationSize}}},
+	}, populationSize["filter"].(gin.H)["bool"].(gin.H)["must"])
+
+	downloads := aggs["downloads"].(gin.H)
+	assert.EqualValues(t, gin.H{"stats": gin.H{"field": "downloads"}}, downloads["aggs"].(gin.H)["downloads"])
+	assert.Empty(t, downloads["filter"].(gin.H)["bool"].(gin.H)["must"])
+
+	percentiles, _ := metricAggregation(map[string]interface{}{"metric": "percentiles"}, "populationSize")
+	assert.EqualValues(t, defaultPercents, percentiles["percentiles"].(gin.H)["percents"])
+
+	// Without a metric population sizes are still bucketed into ranges.
+	query.Aggregations = []map[string]interface{}{{"type": "dataset", "keys": "populationSize"}}
+	aggs = buildAggregations(query, []gin.H{})
+	assert.Contains(t, aggs["populationSize"].(gin.H)["aggs"].(gin.H)["populationSize"], "range")
+}
+
+func TestValidateMetric(t *testing.T) {
+	setIndexFieldTypes("dataset", map[string]string{"populationSize": "long", "title": "text"})
+	t.Cleanup(func() { setIndexFieldTypes("dataset", map[string]string{}) })
+
+	validate := func(agg map[string]interface{}) error {
+		return validateQuery(Query{Aggregations: []map[string]interface{}{agg}})
+	}
+	assert.Nil(t, validate(map[string]interface{}{"type": "dataset", "keys": "populationSize", "metric": "stats"}))
+	assert.Nil(t, validate(map[string]interface{}{
+		"type": "dataset", "keys": "populationSize", "metric": "percentiles", "percents": []interface{}{0.0, 99.9},
+	}))
+
+	err := validate(map[string]interface{}{"type": "dataset", "keys": "title", "metric": "stats"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "requires a numeric field, not text")
+
+	for _, agg := range []map[string]interface{}{
+		{"type": "dataset", "keys": "populationSize", "metric": "average"},
+		{"type": "dataset", "keys": "populationSize", "metric": "stats", "percents": []interface{}{50.0}},
+		{"type": "dataset", "keys": "populationSize", "percents": []interface{}{50.0}},
+		{"type": "dataset", "keys": "populationSize", "metric": "percentiles", "percents": []interface{}{}},
+		{"type": "dataset", "keys": "populationSize", "metric": "percentiles", "percents": []interface{}{150.0}},
+		{"type": "dataset", "keys": "populationSize", "metric": "percentiles", "percents": "50"},
+	} {
+		assert.NotNil(t, validate(agg), "%v", agg)
+	}
+}
+
+func TestFlattenAggsMetric(t *testing.T) {
+	fixture := `{
+		"hits": {"total": {"value": 5, "relation": "eq"}, "hits": []},
+		"aggregations": {
+			"populationSize": {
+				"doc_count": 4,
+				"populationSize": {"values": [{"key": 50.0, "value": 1200.0}]}
+			}
+		}
+	}`
+	var elasticResp SearchResponse
+	err := json.Unmarshal([]byte(fixture), &elasticResp)
+	assert.Nil(t, err)
+
+	populationSize := flattenAggs(elasticResp, true)["populationSize"].(map[string]any)
+	assert.EqualValues(t, 4, populationSize["filtered_doc_count"])
+	assert.EqualValues(t, 1200, populationSize["values"].([]any)[0].(map[string]any)["value"])
+}
+
+func TestFlattenAggsGlobal(t *testing.T) {
+	fixture := `{
+		"hits": {"total": {"value": 2, "relation": "eq"}, "hits": []},
+		"aggregations": {
+			"publisherName": {
+				"doc_count": 20,
+				"_filtered": {
+					"doc_count": 10,
+					"publisherName": {
+						"buckets": [{"key": "Publisher A", "doc_count": 5}]
+					}
+				}
+			}
+		}
+	}`
+	var elasticResp SearchResponse
+	err := json.Unmarshal([]byte(fixture), &elasticResp)
+	assert.Nil(t, err)
+
+	publisherName := flattenAggs(elasticResp, true)["publisherName"].(map[string]any)
+	assert.EqualValues(t, 10, publisherName["filtered_doc_count"])
+	bucket := publisherName["buckets"].([]any)[0].(map[string]any)
+	assert.EqualValues(t, 25, bucket["percentage"])
+}
+
+func TestFlattenAggsSubAggregation(t *testing.T) {
+	fixture := `{
+		"hits": {"total": {"value": 4, "relation": "eq"}, "hits": []},
+		"aggregations": {
+			"publisherName": {
+				"doc_count": 4,
+				"publisherName": {
+					"buckets": [
+						{
+							"key": "Publisher A",
+							"doc_count": 4,
+							"containsTissue": {
+								"sum_other_doc_count": 0,
+								"buckets": [
+									{"key": "true", "doc_count": 3},
+									{"key": "false", "doc_count": 1}
+								]
+							}
+						}
+					]
+				}
+			}
+		}
+	}`
+	var elasticResp SearchResponse
+	json.Unmarshal([]byte(fixture), &elasticResp)
+
+	aggs := flattenAggs(elasticResp, true)
+	bucket := aggs["publisherName"].(map[string]any)["buckets"].([]any)[0].(map[string]any)
+	subBuckets := bucket["containsTissue"].([]any)
+
+	assert.Len(t, subBuckets, 2)
+	assert.EqualValues(t, "true", subBuckets[0].(map[string]any)["key"])
+	assert.EqualValues(t, 75.0, subBuckets[0].(map[string]any)["percentage"])
+	assert.EqualValues(t, 100.0, bucket["percentage"])
+}
+
+func TestFlattenAggsFilteredDocCount(t *testing.T) {
+	fixture := `{
+		"hits": {"total": {"value": 10, "relation": "eq"}, "hits": []},
+		"aggregations": {
+			"publisherName": {
+				"doc_count": 6,
+				"publisherName": {
+					"sum_other_doc_count": 0,
+					"buckets": [{"key": "Publisher A", "doc_count": 6}]
+				}
+			},
+			"dateRange": {
+				"doc_count": 10,
+				"startDate": {"value": 1.0},
+				"endDate": {"value": 2.0}
+			}
+		}
+	}`
+	var elasticResp SearchResponse
+	json.Unmarshal([]byte(fixture), &elasticResp)
+
+	aggs := flattenAggs(elasticResp, false)
+	publisherAgg := aggs["publisherName"].(map[string]any)
+
+	assert.EqualValues(t, 6.0, publisherAgg["filtered_doc_count"])
+	assert.Len(t, publisherAgg["buckets"], 1)
+	assert.EqualValues(t, 0.0, publisherAgg["sum_other_doc_count"])
+	assert.EqualValues(t, map[string]any{"value": 1.0}, aggs["startDate"])
+}
+
+func TestRecencyBoost(t *testing.T) {
+	t.Setenv("SEARCH_RECENCY_SCALE", "180d")
+
+	config := entityQuery("dataset", Query{
+		QueryString:  "asthma",
+		RecencyBoost: &RecencyBoostOptions{Function: "exp", Weight: 2},
+	})
+	functionScore := config["query"].(gin.H)["function_score"].(gin.H)
+	assert.Contains(t, functionScore["query"], "bool")
+	function := functionScore["functions"].([]gin.H)[0]
+	assert.EqualValues(t, 2, function["weight"])
+	assert.EqualValues(t, gin.H{
+		"origin": "now",
+		"scale":  "180d",
+		"offset": defaultRecencyOffset,
+		"decay":  defaultRecencyDecay,
+	}, function["exp"].(gin.H)["startDate"])
+	assert.EqualValues(t, "sum", functionScore["boost_mode"])
+
+	config = entityQuery("publication", Query{QueryString: "asthma", RecencyBoost: &RecencyBoostOptions{}})
+	function = config["query"].(gin.H)["function_score"].(gin.H)["functions"].([]gin.H)[0]
+	assert.Contains(t, function["gauss"], "publicationDate")
+
+	// Entity types without a date field and empty queries are left unboosted.
+	config = entityQuery("tool", Query{QueryString: "asthma", RecencyBoost: &RecencyBoostOptions{}})
+	assert.Contains(t, config["query"], "bool")
+	config = entityQuery("dataset", Query{RecencyBoost: &RecencyBoostOptions{}})
+	assert.Contains(t, config["query"].(gin.H)["function_score"], "random_score")
+	assert.NotContains(t, config["query"].(gin.H)["function_score"], "functions")
+}
+
+func TestNormaliseScores(t *testing.T) {
+	results := map[string]interface{}{
+		"dataset":    SearchResponse{Hits: HitsField{Hits: []Hit{{Id: "1", Score: 20}, {Id: "2", Score: 5}}}},
+		"tool":       SearchResponse{Hits: HitsField{Hits: []Hit{{Id: "3", Score: 0.8}, {Id: "4", Score: 0.2}}}},
+		"collection": SearchResponse{Hits: HitsField{Hits: []Hit{{Id: "5", Score: 0}}}},
+	}
+
+	normaliseScores(results)
+
+	datasets := results["dataset"].(SearchResponse).Hits.Hits
+	assert.EqualValues(t, 1, datasets[0].NormalisedScore)
+	assert.EqualValues(t, 0.25, datasets[1].NormalisedScore)
+	assert.EqualValues(t, 20, datasets[0].Score)
+	tools := results["tool"].(SearchResponse).Hits.Hits
+	assert.EqualValues(t, 1, tools[0].NormalisedScore)
+	assert.EqualValues(t, 0.25, tools[1].NormalisedScore)
+	assert.EqualValues(t, 0, results["collection"].(SearchResponse).Hits.Hits[0].NormalisedScore)
+}
+
+func TestPhraseSlop(t *testing.T) {
+	phraseSlops := func(config gin.H) []interface{} {
+		slops := []interface{}{}
+		for _, clause := range config["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H) {
+			if multiMatch, ok := clause["multi_match"].(gin.H); ok && multiMatch["type"] == "phrase" {
+				slops = append(slops, multiMatch["slop"])
+			}
+		}
+		return slops
+	}
+
+	assert.EqualValues(t, []interface{}{0}, phraseSlops(entityQuery("dataset", Query{QueryString: "lung cancer"})))
+	assert.EqualValues(t, []interface{}{3}, phraseSlops(entityQuery("dataset", Query{QueryString: "lung cancer", PhraseSlop: 3})))
+	assert.EqualValues(t, []interface{}{3}, phraseSlops(entityQuery("tool", Query{QueryString: "lung cancer", PhraseSlop: 3})))
+	assert.EqualValues(t, []interface{}{3}, phraseSlops(entityQuery("publication", Query{QueryString: "lung cancer", PhraseSlop: 3})))
+	assert.EqualValues(t, []interface{}{0}, phraseSlops(entityQuery("dataset", Query{QueryString: "lung cancer", PhraseSlop: 3, Exact: true})))
+}
+
+func TestEmptyQueryOrder(t *testing.T) {
+	config := entityQuery("dataset", Query{})
+	assert.EqualValues(t, gin.H{}, config["query"].(gin.H)["function_score"].(gin.H)["random_score"])
+	assert.NotContains(t, config, "sort")
+
+	seed := 42
+	config = entityQuery("tool", Query{Seed: &seed})
+	assert.EqualValues(t, gin.H{"seed": 42, "field": "_seq_no"}, config["query"].(gin.H)["function_score"].(gin.H)["random_score"])
+
+	config = entityQuery("dataUseRegister", Query{EmptyQueryOrder: "alphabetical"})
+	assert.EqualValues(t, []gin.H{
+		{"projectTitle.keyword": gin.H{"order": "asc", "missing": "_last"}},
+	}, config["sort"])
+
+	config = entityQuery("publication", Query{EmptyQueryOrder: "recent"})
+	assert.EqualValues(t, []gin.H{
+		{"publicationDate": gin.H{"order": "desc", "missing": "_last"}},
+		{"title.keyword": gin.H{"order": "asc", "missing": "_last"}},
+	}, config["sort"])
+
+	// Entity types without a date field fall back to the alphabetical order.
+	config = entityQuery("datacustodiannetwork", Query{EmptyQueryOrder: "recent"})
+	assert.EqualValues(t, []gin.H{
+		{"name.keyword": gin.H{"order": "asc", "missing": "_last"}},
+	}, config["sort"])
+
+	config = entityQuery("dataset", Query{EmptyQueryOrder: "recent", SearchAfter: []interface{}{}})
+	assert.EqualValues(t, []gin.H{
+		{"startDate": gin.H{"order": "desc", "missing": "_last"}},
+		{"title.keyword": gin.H{"order": "asc", "missing": "_last"}},
+		cursorTiebreak,
+	}, config["sort"])
+
+	// Searches with a query string are ordered by relevance.
+	config = entityQuery("collection", Query{QueryString: "asthma", EmptyQueryOrder: "alphabetical"})
+	assert.NotContains(t, config, "sort")
+}
+
+func TestSearchSeed(t *testing.T) {
+	var elasticQuery map[string]interface{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		body, _ := io.ReadAll(req.Body)
+		json.Unmarshal(body, &elasticQuery)
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 0, "relation": "eq"}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	search := func(body gin.H) (map[string]interface{}, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		c := GetTestGinContext(w)
+		MockPostWithBody(c, body)
+		EntitySearch("tool")(c)
+		assert.EqualValues(t, http.StatusOK, w.Code)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		randomScore := elasticQuery["query"].(map[string]interface{})["function_score"].(map[string]interface{})["random_score"]
+		return response, randomScore.(map[string]interface{})
+	}
+
+	// A seed is generated and returned when none is given.
+	response, randomScore := search(gin.H{"query": ""})
+	assert.Contains(t, response, "seed")
+	assert.EqualValues(t, response["seed"], randomScore["seed"])
+	assert.EqualValues(t, "_seq_no", randomScore["field"])
+
+	response, randomScore = search(gin.H{"query": "", "seed": 1234})
+	assert.EqualValues(t, 1234, response["seed"])
+	assert.EqualValues(t, 1234, randomScore["seed"])
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "asthma", "seed": 1234})
+	EntitySearch("tool")(c)
+	assert.NotContains(t, w.Body.String(), "seed")
+}
+
+func TestPopulationSizeFilter(t *testing.T) {
+	unreported := gin.H{"term": gin.H{"populationSize": -1}}
+	tests := []struct {
+		name   string
+		terms  interface{}
+		filter gin.H
+	}{
+		{
+			name:  "both bounds",
+			terms: map[string]interface{}{"from": 1000.0, "to": 10000.0, "includeUnreported": false},
+			filter: gin.H{"bool": gin.H{"must": []gin.H{
+				{"range": gin.H{"populationSize": gin.H{"gte": 1000.0, "lte": 10000.0}}},
+			}}},
+		},
+		{
+			name:  "missing includeUnreported",
+			terms: map[string]interface{}{"from": 1000.0, "to": 10000.0},
+			filter: gin.H{"bool": gin.H{"must": []gin.H{
+				{"range": gin.H{"populationSize": gin.H{"gte": 1000.0, "lte": 10000.0}}},
+			}}},
+		},
+		{
+			name:  "missing from excludes unreported",
+			terms: map[string]interface{}{"to": 500.0},
+			filter: gin.H{"bool": gin.H{"must": []gin.H{
+				{"range": gin.H{"populationSize": gin.H{"gte": 0, "lte": 500.0}}},
+			}}},
+		},
+		{
+			name:  "null to",
+			terms: map[string]interface{}{"from": 100.0, "to": nil, "includeUnreported": true},
+			filter: gin.H{"bool": gin.H{"should": []gin.H{
+				{"range": gin.H{"populationSize": gin.H{"gte": 100.0}}},
+				unreported,
+			}}},
+		},
+		{
+			name:  "no bounds excludes unreported",
+			terms: map[string]interface{}{},
+			filter: gin.H{"bool": gin.H{"must": []gin.H{
+				{"range": gin.H{"populationSize": gin.H{"gte": 0}}},
+			}}},
+		},
+	}
+	for _, test := range tests {
+		filter, ok := populationSizeFilter(test.terms)
+		assert.True(t, ok, test.name)
+		assert.EqualValues(t, test.filter, filter, test.name)
+	}
+
+	_, ok := populationSizeFilter(map[string]interface{}{"includeUnreported": true, "from": ""})
+	assert.False(t, ok)
+	_, ok = populationSizeFilter([]interface{}{1, 2})
+	assert.False(t, ok)
+
+	config := entityQuery("dataset", Query{
+		QueryString: "asthma",
+		Filters: map[string]map[string]interface{}{
+			"dataset": {"populationSize": map[string]interface{}{"includeUnreported": true}},
+		},
+	})
+	assert.Empty(t, config["post_filter"].(gin.H)["bool"].(gin.H)["must"])
+}
@@ -0,0 +1,75 @@
+package search
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/gin-gonic/gin"
+)
+
+// SearchService runs searches against an elastic client and uploads search
+// analytics with a BigQuery client.  The package level search functions use
+// the service built from ElasticClient and BigQueryClient, see defaultService,
+// construct a SearchService with NewSearchService to search with other clients,
+// for example a mock elastic transport in tests.
+type SearchService struct {
+	Elastic  *elasticsearch.Client
+	BigQuery *bigquery.Client
+}
+
+// NewSearchService returns a SearchService using the given clients.
+func NewSearchService(elastic *elasticsearch.Client, bigQuery *bigquery.Client) *SearchService {
+	return &SearchService{Elastic: elastic, BigQuery: bigQuery}
+}
+
+// defaultService returns the service using the package level clients set by
+// DefineElasticClient.  It is built on each call so that it always uses the
+// current clients.
+func defaultService() *SearchService {
+	return NewSearchService(ElasticClient, BigQueryClient)
+}
+
+// Search searches the index of the entity type, named as in the generic search
+// results, returning an error if the entity type is not searchable.
+func (s *SearchService) Search(entityType string, query Query) (SearchResponse, error) {
+	config, ok := entityConfig(entityType)
+	if !ok {
+		return SearchResponse{}, fmt.Errorf("searches of type %s are not supported", entityType)
+	}
+	return config.Search(s, query)
+}
+
+// Document fetches the document of the entity type with the given ID, see
+// getDocument.
+func (s *SearchService) Document(entityType string, id string, requestID string) (GetDocumentResponse, error) {
+	return s.getDocument(entityIndex(canonicalEntityType(entityType)), id, requestID)
+}
+
+// SimilarDatasets returns the datasets most like the dataset with the given ID.
+func (s *SearchService) SimilarDatasets(id string, requestID string) SearchResponse {
+	return s.similarSearch(id, "dataset", requestID)
+}
+
+// The functions below run the SearchService methods of the same name with the
+// default service.
+
+func executeElasticQuery(index string, requestID string, elasticQuery gin.H) (SearchResponse, []byte, error) {
+	return defaultService().executeElasticQuery(index, requestID, elasticQuery)
+}
+
+func executeSearchWithRetry(index string, requestID string, buildQuery func() gin.H) (SearchResponse, []byte, error) {
+	return defaultService().executeSearchWithRetry(index, requestID, buildQuery)
+}
+
+func getDocument(index string, id string, requestID string) (GetDocumentResponse, error) {
+	return defaultService().getDocument(index, id, requestID)
+}
+
+func similarSearch(id string, index string, requestID string) SearchResponse {
+	return defaultService().similarSearch(id, index, requestID)
+}
+
+func uploadSearchAnalytics(query Query, results SearchResponse, entityType string) {
+	defaultService().uploadSearchAnalytics(query, results, entityType)
+}
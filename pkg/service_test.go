@@ -0,0 +1,42 @@
+package search
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"hdruk/search-service/utils/mocks"
+)
+
+func TestSearchServiceUsesItsOwnClient(t *testing.T) {
+	var paths []string
+	service := NewSearchService(mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		paths = append(paths, req.URL.Path)
+		if req.Method == http.MethodGet {
+			return http.StatusOK, `{"_index": "tool", "_id": "7", "found": true, "_source": {"name": "A tool"}}`
+		}
+		return http.StatusOK, `{"took": 5, "hits": {"total": {"value": 1, "relation": "eq"}, "hits": [{"_id": "7", "_score": 1.5}]}}`
+	}), nil)
+	globalClient := ElasticClient
+
+	results, err := service.Search("tool", Query{QueryString: "sequencing"})
+	assert.Nil(t, err)
+	assert.EqualValues(t, 5, results.Took)
+	assert.EqualValues(t, "7", results.Hits.Hits[0].Id)
+
+	results, err = service.Search("paper", Query{QueryString: "sequencing"})
+	assert.Nil(t, err)
+	assert.Len(t, results.Hits.Hits, 1)
+
+	document, err := service.Document("tool", "7", "")
+	assert.Nil(t, err)
+	assert.True(t, document.Found)
+	assert.EqualValues(t, "A tool", document.Source["name"])
+
+	assert.EqualValues(t, []string{"/tool/_search", "/publication/_search", "/tool/_doc/7"}, paths)
+	assert.Same(t, globalClient, ElasticClient)
+
+	_, err = service.Search("unknown", Query{})
+	assert.NotNil(t, err)
+}
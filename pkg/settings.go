@@ -124,6 +124,7 @@ func DefineDatasetMappings(c *gin.Context) {
 				"dataType":           gin.H{"type": "keyword"},
 				"dataSubType":        gin.H{"type": "keyword"},
 				"formatAndStandards": gin.H{"type": "keyword"},
+				"structuralMetadata": structuralMetadataMapping,
 			},
 		},
 	}
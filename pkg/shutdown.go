@@ -0,0 +1,65 @@
+package search
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// backgroundWork tracks the analytics uploads and search explanation
+// extractions in progress, so that Shutdown can wait for them to finish.
+var (
+	backgroundWork   sync.WaitGroup
+	backgroundWorkMu sync.Mutex
+	shuttingDown     bool
+)
+
+// startBackgroundWork registers an analytics upload or explanation extraction
+// with backgroundWork, returning false if the service is shutting down and the
+// work should be skipped.  Callers must call backgroundWork.Done once the work
+// has finished.
+func startBackgroundWork() bool {
+	backgroundWorkMu.Lock()
+	defer backgroundWorkMu.Unlock()
+
+	if shuttingDown {
+		return false
+	}
+	backgroundWork.Add(1)
+	return true
+}
+
+// Shutdown stops the service starting any further analytics uploads or search
+// explanation extractions, waits for those in progress to finish and closes the
+// BigQuery client.  Analytics are uploaded as each search completes, so there
+// is nothing buffered to flush.  If ctx is done before the work in progress
+// finishes the client is closed regardless and ctx's error is returned.
+func Shutdown(ctx context.Context) error {
+	backgroundWorkMu.Lock()
+	shuttingDown = true
+	backgroundWorkMu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		backgroundWork.Wait()
+		close(finished)
+	}()
+
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		slog.Warn("Shutting down before analytics uploads and explanation extractions finished")
+		err = ctx.Err()
+	}
+
+	if BigQueryClient != nil {
+		if closeErr := BigQueryClient.Close(); closeErr != nil {
+			slog.Warn("Failed to close BigQuery client", "error", closeErr.Error())
+			if err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package search
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownWaitsForBackgroundWork(t *testing.T) {
+	t.Cleanup(func() {
+		backgroundWorkMu.Lock()
+		shuttingDown = false
+		backgroundWorkMu.Unlock()
+	})
+
+	assert.True(t, startBackgroundWork())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, Shutdown(ctx), context.DeadlineExceeded)
+
+	// no further work is started once shutting down
+	assert.False(t, startBackgroundWork())
+
+	backgroundWork.Done()
+	assert.Nil(t, Shutdown(context.Background()))
+}
+
+func TestUploadSearchAnalyticsSkippedWhenShuttingDown(t *testing.T) {
+	t.Cleanup(func() {
+		backgroundWorkMu.Lock()
+		shuttingDown = false
+		backgroundWorkMu.Unlock()
+	})
+	assert.Nil(t, Shutdown(context.Background()))
+
+	// without a BigQuery client an upload started in the background would
+	// panic, so none must be started
+	service := &SearchService{}
+	service.uploadSearchAnalytics(Query{QueryString: "asthma"}, SearchResponse{}, "dataset")
+	assert.Nil(t, Shutdown(context.Background()))
+}
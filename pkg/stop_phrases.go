@@ -0,0 +1,131 @@
+package search
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stopPhrases matches each of the phrases, such as "datasets about", stripped
+// from query strings before they are searched for, see withoutStopPhrases.
+// They are stripped from the query string rather than by an analyzer so that
+// they are removed the same way from the searches of every index, whichever
+// analyzer it uses.
+// The phrases are replaced as a whole when they are reloaded, so readers take
+// the current list with currentStopPhrases and never modify it.
+var stopPhrases = []*regexp.Regexp{}
+var stopPhrasesMu sync.RWMutex
+
+const defaultStopPhrasesReloadInterval = 60 * time.Second
+
+// loadStopPhrases reads the stop phrases from the JSON file at path, which is
+// expected to hold a list of phrases:
+//
+//	["datasets about", "studies on"]
+func loadStopPhrases(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var phrases []string
+	if err := json.Unmarshal(content, &phrases); err != nil {
+		return err
+	}
+
+	setStopPhrases(phrases)
+	return nil
+}
+
+// setStopPhrases replaces the current stop phrases.  Each phrase only matches
+// as a whole, case insensitively, with any whitespace between its words.
+func setStopPhrases(phrases []string) {
+	patterns := []*regexp.Regexp{}
+	for _, phrase := range phrases {
+		words := strings.Fields(phrase)
+		if len(words) == 0 {
+			continue
+		}
+		for i, word := range words {
+			words[i] = regexp.QuoteMeta(word)
+		}
+		patterns = append(patterns, regexp.MustCompile(
+			`(?i)(^|\s)`+strings.Join(words, `\s+`)+`(\s|$)`,
+		))
+	}
+	stopPhrasesMu.Lock()
+	stopPhrases = patterns
+	stopPhrasesMu.Unlock()
+}
+
+func currentStopPhrases() []*regexp.Regexp {
+	stopPhrasesMu.RLock()
+	defer stopPhrasesMu.RUnlock()
+
+	return stopPhrases
+}
+
+// watchStopPhrases reloads the stop phrases from the file at path every
+// interval if the file has been modified since it was last loaded, so that
+// phrases can be added without restarting the service.  If the file cannot be
+// read or parsed the stop phrases already loaded are kept.
+func watchStopPhrases(path string, interval time.Duration) {
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		lastModified = reloadStopPhrasesIfModified(path, lastModified)
+	}
+}
+
+// reloadStopPhrasesIfModified reloads the stop phrases from the file at path
+// if it was modified after lastModified, returning the modification time of
+// the stop phrases now loaded.
+func reloadStopPhrasesIfModified(path string, lastModified time.Time) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		slog.Warn("Could not check search stop phrases for changes", "path", path, "error", err.Error())
+		return lastModified
+	}
+	if !info.ModTime().After(lastModified) {
+		return lastModified
+	}
+	if err := loadStopPhrases(path); err != nil {
+		slog.Warn("Could not reload search stop phrases", "path", path, "error", err.Error())
+		return lastModified
+	}
+	slog.Info("Reloaded search stop phrases", "path", path)
+	return info.ModTime()
+}
+
+// withoutStopPhrases returns the query with the stop phrases stripped from its
+// query string.  The query string is left as it is if it consists only of
+// stop phrases, so that e.g. a search for "studies on" is not turned into a
+// search for everything.
+func withoutStopPhrases(query Query) Query {
+	stripped := query.QueryString
+	for _, pattern := range currentStopPhrases() {
+		// Adjacent stop phrases share the whitespace between them, so each
+		// phrase is replaced until no more matches are found.
+		for pattern.MatchString(stripped) {
+			stripped = pattern.ReplaceAllString(stripped, " ")
+		}
+	}
+	stripped = strings.Join(strings.Fields(stripped), " ")
+
+	if stripped == strings.Join(strings.Fields(query.QueryString), " ") {
+		return query
+	}
+	if stripped == "" {
+		query.logger().Debug("Query string is only stop phrases, keeping it", "query", query.QueryString)
+		return query
+	}
+	query.logger().Debug("Stripped stop phrases from query string", "query", query.QueryString, "stripped", stripped)
+	query.QueryString = stripped
+	return query
+}
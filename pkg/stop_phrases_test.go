@@ -0,0 +1,95 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hdruk/search-service/utils/mocks"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setTestStopPhrases(t *testing.T) {
+	setStopPhrases([]string{"datasets about", "studies on", "data"})
+	t.Cleanup(func() { setStopPhrases([]string{}) })
+}
+
+func TestWithoutStopPhrases(t *testing.T) {
+	setTestStopPhrases(t)
+	logs := captureLogs(t)
+
+	assert.EqualValues(t, "asthma in children", withoutStopPhrases(Query{QueryString: "Datasets  About asthma in children"}).QueryString)
+	assert.EqualValues(t, "asthma", withoutStopPhrases(Query{QueryString: "studies on datasets about asthma"}).QueryString)
+	assert.EqualValues(t, "asthma", withoutStopPhrases(Query{QueryString: "data data asthma"}).QueryString)
+	// phrases are only matched as whole words
+	assert.EqualValues(t, "database studies online", withoutStopPhrases(Query{QueryString: "database studies online"}).QueryString)
+	// a query string of only stop phrases is kept
+	assert.EqualValues(t, "studies on", withoutStopPhrases(Query{QueryString: "studies on"}).QueryString)
+
+	attrs, ok := logs.find("Stripped stop phrases from query string")
+	assert.True(t, ok)
+	assert.EqualValues(t, "DEBUG", attrs["level"])
+	assert.EqualValues(t, "Datasets  About asthma in children", attrs["query"])
+	assert.EqualValues(t, "asthma in children", attrs["stripped"])
+}
+
+func TestStopPhrasesStrippedFromSearch(t *testing.T) {
+	setTestStopPhrases(t)
+	var elasticQuery map[string]interface{}
+	ElasticClient = mocks.MockElasticClientFunc(func(req *http.Request) (int, string) {
+		json.NewDecoder(req.Body).Decode(&elasticQuery)
+		return http.StatusOK, `{"hits": {"hits": [], "total": {"value": 0, "relation": "eq"}}}`
+	})
+	defer func() { ElasticClient = mocks.MockElasticClient() }()
+
+	var searchTerm string
+	upload := BQUpload
+	BQUpload = func(query Query, results SearchResponse, entityType string) {
+		searchTerm = query.QueryString
+	}
+	defer func() { BQUpload = upload }()
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "studies on sequencing"})
+	EntitySearch("tool")(c)
+
+	should := elasticQuery["query"].(map[string]interface{})["bool"].(map[string]interface{})["should"].([]interface{})
+	multiMatch := should[0].(map[string]interface{})["multi_match"].(map[string]interface{})
+	assert.EqualValues(t, "sequencing", multiMatch["query"])
+	// the analytics record the search term as given
+	assert.EqualValues(t, "studies on sequencing", searchTerm)
+}
+
+func TestReloadStopPhrasesIfModified(t *testing.T) {
+	t.Cleanup(func() { setStopPhrases([]string{}) })
+
+	path := filepath.Join(t.TempDir(), "stop_phrases.json")
+	content, _ := json.Marshal([]string{"studies on"})
+	os.WriteFile(path, content, 0644)
+	loaded := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, loaded, loaded)
+	assert.Nil(t, loadStopPhrases(path))
+	assert.EqualValues(t, "asthma", withoutStopPhrases(Query{QueryString: "studies on asthma"}).QueryString)
+
+	content, _ = json.Marshal([]string{"datasets about"})
+	os.WriteFile(path, content, 0644)
+	modified := loaded.Add(time.Minute)
+	os.Chtimes(path, modified, modified)
+	assert.Equal(t, modified, reloadStopPhrasesIfModified(path, loaded))
+	assert.EqualValues(t, "studies on asthma", withoutStopPhrases(Query{QueryString: "studies on asthma"}).QueryString)
+	assert.EqualValues(t, "asthma", withoutStopPhrases(Query{QueryString: "datasets about asthma"}).QueryString)
+
+	// a broken file keeps the stop phrases already loaded
+	os.WriteFile(path, []byte("["), 0644)
+	broken := modified.Add(time.Minute)
+	os.Chtimes(path, broken, broken)
+	assert.Equal(t, modified, reloadStopPhrasesIfModified(path, modified))
+	assert.EqualValues(t, "asthma", withoutStopPhrases(Query{QueryString: "datasets about asthma"}).QueryString)
+}
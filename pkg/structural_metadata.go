@@ -0,0 +1,143 @@
+package search
+
+import (
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The structural metadata of a dataset describes its tables, each with a name,
+// a description and the columns it contains, which in turn have a name and a
+// description.  Both the tables and the columns are nested documents.
+const (
+	structuralMetadataPath        = "structuralMetadata"
+	structuralMetadataColumnsPath = "structuralMetadata.columns"
+)
+
+// structuralMetadataMapping is the mapping of the structural metadata of a
+// dataset, see DefineDatasetMappings.
+var structuralMetadataMapping = gin.H{
+	"type": "nested",
+	"properties": gin.H{
+		"name":        gin.H{"type": "text", "analyzer": "medterms_index_analyzer"},
+		"description": gin.H{"type": "text", "analyzer": "medterms_index_analyzer"},
+		"columns": gin.H{
+			"type": "nested",
+			"properties": gin.H{
+				"name":        gin.H{"type": "text", "analyzer": "medterms_index_analyzer"},
+				"description": gin.H{"type": "text", "analyzer": "medterms_index_analyzer"},
+			},
+		},
+	},
+}
+
+// structuralMetadataEnabled reports whether dataset searches also match on the
+// table and column names and descriptions of the structural metadata, set with
+// SEARCH_STRUCTURAL_METADATA="true".  It is off by default as not every
+// deployment indexes structural metadata.
+func structuralMetadataEnabled() bool {
+	return os.Getenv("SEARCH_STRUCTURAL_METADATA") == "true"
+}
+
+// defaultStructuralMetadataInnerHits is the number of matching tables, and of
+// matching columns within each of them, returned with each dataset hit.
+const defaultStructuralMetadataInnerHits = 3
+
+// structuralMetadataInnerHits returns the inner_hits of the nested query on
+// the path, returning the names and descriptions of up to
+// SEARCH_STRUCTURAL_METADATA_INNER_HITS matching nested documents, or nil if
+// it is 0.
+func structuralMetadataInnerHits(path string) gin.H {
+	size := envInt("SEARCH_STRUCTURAL_METADATA_INNER_HITS", defaultStructuralMetadataInnerHits)
+	if size <= 0 {
+		return nil
+	}
+	return gin.H{
+		"name":    path,
+		"size":    min(size, maxCollapseInnerHits),
+		"_source": []string{path + ".name", path + ".description"},
+	}
+}
+
+// structuralMetadataQuery returns the nested query matching the query string
+// against the names and descriptions of a dataset's tables and their columns.
+// The matching tables are returned under the inner_hits of each hit, named
+// "structuralMetadata", with the matching columns of each table under its
+// own inner_hits, named "structuralMetadata.columns".
+func structuralMetadataQuery(queryString string) gin.H {
+	columns := gin.H{
+		"path":            structuralMetadataColumnsPath,
+		"ignore_unmapped": true,
+		"query": gin.H{
+			"multi_match": gin.H{
+				"query": queryString,
+				"fields": []string{
+					structuralMetadataColumnsPath + ".name",
+					structuralMetadataColumnsPath + ".description",
+				},
+				"fuzziness": "AUTO:5,7",
+				"analyzer":  "medterms_search_analyzer",
+			},
+		},
+	}
+	tables := gin.H{
+		"path":            structuralMetadataPath,
+		"ignore_unmapped": true,
+		"query": gin.H{
+			"bool": gin.H{
+				"should": []gin.H{
+					{
+						"multi_match": gin.H{
+							"query": queryString,
+							"fields": []string{
+								structuralMetadataPath + ".name",
+								structuralMetadataPath + ".description",
+							},
+							"fuzziness": "AUTO:5,7",
+							"analyzer":  "medterms_search_analyzer",
+						},
+					},
+					{"nested": columns},
+				},
+			},
+		},
+	}
+	if innerHits := structuralMetadataInnerHits(structuralMetadataPath); innerHits != nil {
+		tables["inner_hits"] = innerHits
+		columns["inner_hits"] = structuralMetadataInnerHits(structuralMetadataColumnsPath)
+	}
+	return gin.H{"nested": tables}
+}
+
+// withoutExplanations returns a copy of the inner_hits of a hit without the
+// _explanation of each inner hit, or of the inner hits nested within them.
+// The inner_hits are copied rather than changed as the hits may still be read
+// by the search explanation extractor, see stripExplanation.
+func withoutExplanations(innerHits map[string]interface{}) map[string]interface{} {
+	if innerHits == nil {
+		return nil
+	}
+	return withoutExplanationsValue(innerHits).(map[string]interface{})
+}
+
+func withoutExplanationsValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		stripped := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			if k == "_explanation" {
+				continue
+			}
+			stripped[k] = withoutExplanationsValue(v)
+		}
+		return stripped
+	case []interface{}:
+		stripped := make([]interface{}, len(value))
+		for i, v := range value {
+			stripped[i] = withoutExplanationsValue(v)
+		}
+		return stripped
+	default:
+		return value
+	}
+}
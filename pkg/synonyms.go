@@ -0,0 +1,224 @@
+package search
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// synonymGroups maps the lower case form of every known synonym to the full
+// group of terms it is equivalent to, including itself.  The same groups are
+// used to expand both free text queries and filter values so that the two
+// always agree on which terms are equivalent.
+// The groups are replaced as a whole when the synonyms are reloaded, so
+// readers take the current map with currentSynonymGroups and never modify it.
+var synonymGroups = map[string][]string{}
+var synonymGroupsMu sync.RWMutex
+
+// synonymPatterns matches each known synonym as a whole word or phrase in a
+// query string, in order of the synonym, compiled once when the synonyms are
+// loaded rather than for every query.  It is replaced along with
+// synonymGroups under synonymGroupsMu.
+var synonymPatterns = []synonymPattern{}
+
+// synonymPattern is a known synonym, its pattern and the group of terms it
+// is equivalent to.
+type synonymPattern struct {
+	key     string
+	pattern *regexp.Regexp
+	group   []string
+}
+
+// synonymQueryBoost is the boost of the clauses matching synonym expansions of
+// the query string.  It is below that of every clause matching the query
+// string as given so that documents using the searched for term rank above
+// those using one of its synonyms.
+const synonymQueryBoost = 0.5
+
+const defaultSynonymsReloadInterval = 60 * time.Second
+
+// loadSynonyms reads the shared synonym registry from the JSON file at path.
+// The file is expected to map a preferred term to the list of its synonyms
+// and abbreviations:
+//
+//	{
+//		"myocardial infarction": ["MI", "heart attack"]
+//	}
+func loadSynonyms(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var synonyms map[string][]string
+	if err := json.Unmarshal(content, &synonyms); err != nil {
+		return err
+	}
+
+	setSynonyms(synonyms)
+	return nil
+}
+
+// setSynonyms replaces the current synonym registry.
+func setSynonyms(synonyms map[string][]string) {
+	groups := make(map[string][]string)
+	for term, variants := range synonyms {
+		group := append([]string{term}, variants...)
+		for _, variant := range group {
+			groups[normaliseSynonymKey(variant)] = group
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	patterns := make([]synonymPattern, 0, len(keys))
+	for _, key := range keys {
+		pattern, err := regexp.Compile(`(?i)\b` + regexp.QuoteMeta(key) + `\b`)
+		if err != nil {
+			slog.Debug("Could not match synonym", "synonym", key, "error", err.Error())
+			continue
+		}
+		patterns = append(patterns, synonymPattern{key: key, pattern: pattern, group: groups[key]})
+	}
+
+	synonymGroupsMu.Lock()
+	synonymGroups = groups
+	synonymPatterns = patterns
+	synonymGroupsMu.Unlock()
+}
+
+func currentSynonymGroups() map[string][]string {
+	synonymGroupsMu.RLock()
+	defer synonymGroupsMu.RUnlock()
+
+	return synonymGroups
+}
+
+func currentSynonymPatterns() []synonymPattern {
+	synonymGroupsMu.RLock()
+	defer synonymGroupsMu.RUnlock()
+
+	return synonymPatterns
+}
+
+// watchSynonyms reloads the synonyms from the file at path every interval if
+// the file has been modified since it was last loaded, so that synonyms can be
+// added without restarting the service.  If the file cannot be read or parsed
+// the synonyms already loaded are kept.
+func watchSynonyms(path string, interval time.Duration) {
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		lastModified = reloadSynonymsIfModified(path, lastModified)
+	}
+}
+
+// reloadSynonymsIfModified reloads the synonyms from the file at path if it
+// was modified after lastModified, returning the modification time of the
+// synonyms now loaded.
+func reloadSynonymsIfModified(path string, lastModified time.Time) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		slog.Warn("Could not check search synonyms for changes", "path", path, "error", err.Error())
+		return lastModified
+	}
+	if !info.ModTime().After(lastModified) {
+		return lastModified
+	}
+	if err := loadSynonyms(path); err != nil {
+		slog.Warn("Could not reload search synonyms", "path", path, "error", err.Error())
+		return lastModified
+	}
+	slog.Info("Reloaded search synonyms", "path", path)
+	return info.ModTime()
+}
+
+func normaliseSynonymKey(term string) string {
+	return strings.ToLower(strings.TrimSpace(term))
+}
+
+// synonymsFor returns every term equivalent to the given term, including the
+// term itself, or just the term if it has no known synonyms.
+func synonymsFor(term string) []string {
+	if group, ok := currentSynonymGroups()[normaliseSynonymKey(term)]; ok {
+		return group
+	}
+	return []string{term}
+}
+
+// expandSynonymTerms returns the filter values with each value expanded to
+// all of its synonyms, so that selecting one form of a term as a filter also
+// matches documents using any of the others.
+func expandSynonymTerms(terms []interface{}) []interface{} {
+	if len(currentSynonymGroups()) == 0 {
+		return terms
+	}
+	expanded := []interface{}{}
+	seen := make(map[string]bool)
+	for _, t := range terms {
+		term, ok := t.(string)
+		if !ok {
+			expanded = append(expanded, t)
+			continue
+		}
+		for _, variant := range synonymsFor(term) {
+			if !seen[variant] {
+				seen[variant] = true
+				expanded = append(expanded, variant)
+			}
+		}
+	}
+	return expanded
+}
+
+// synonymQueryStrings returns the alternative forms of the query string made
+// by replacing each known synonym found in it, as a whole word or phrase, with
+// each of its equivalent terms.
+func synonymQueryStrings(queryString string) []string {
+	alternatives := []string{}
+	seen := map[string]bool{normaliseSynonymKey(queryString): true}
+
+	for _, synonym := range currentSynonymPatterns() {
+		if !synonym.pattern.MatchString(queryString) {
+			continue
+		}
+		for _, variant := range synonym.group {
+			alternative := synonym.pattern.ReplaceAllLiteralString(queryString, variant)
+			if !seen[normaliseSynonymKey(alternative)] {
+				seen[normaliseSynonymKey(alternative)] = true
+				alternatives = append(alternatives, alternative)
+			}
+		}
+	}
+	return alternatives
+}
+
+// synonymQueries returns a match clause for each synonym expanded form of the
+// query string, to be added alongside the original query clauses so that
+// documents using any form of a term are found.
+func synonymQueries(queryString string, fields []string) []gin.H {
+	queries := []gin.H{}
+	for _, alternative := range synonymQueryStrings(queryString) {
+		queries = append(queries, gin.H{
+			"multi_match": gin.H{
+				"query":    alternative,
+				"fields":   fields,
+				"operator": "and",
+				"boost":    synonymQueryBoost,
+			},
+		})
+	}
+	return queries
+}
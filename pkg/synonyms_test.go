@@ -0,0 +1,130 @@
+package search
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func setTestSynonyms(t *testing.T) {
+	setSynonyms(map[string][]string{
+		"myocardial infarction": {"MI", "heart attack"},
+	})
+	t.Cleanup(func() { setSynonyms(map[string][]string{}) })
+}
+
+func TestLoadSynonyms(t *testing.T) {
+	t.Cleanup(func() { setSynonyms(map[string][]string{}) })
+
+	path := filepath.Join(t.TempDir(), "synonyms.json")
+	content, _ := json.Marshal(map[string][]string{"chronic kidney disease": {"CKD"}})
+	os.WriteFile(path, content, 0644)
+
+	err := loadSynonyms(path)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"chronic kidney disease", "CKD"}, synonymsFor("ckd "))
+	assert.EqualValues(t, []string{"asthma"}, synonymsFor("asthma"))
+	// the patterns matching the synonyms in query strings are compiled on load
+	patterns := currentSynonymPatterns()
+	assert.Len(t, patterns, 2)
+	assert.EqualValues(t, "chronic kidney disease", patterns[0].key)
+	assert.EqualValues(t, "ckd", patterns[1].key)
+	assert.True(t, patterns[1].pattern.MatchString("CKD in adults"))
+
+	err = loadSynonyms(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestSynonymQueryStrings(t *testing.T) {
+	setTestSynonyms(t)
+
+	assert.ElementsMatch(
+		t,
+		[]string{"myocardial infarction in adults", "heart attack in adults"},
+		synonymQueryStrings("MI in adults"),
+	)
+	// synonyms are only matched as whole words
+	assert.Empty(t, synonymQueryStrings("MIMIC cohort"))
+	assert.Empty(t, synonymQueryStrings("asthma"))
+}
+
+func TestSynonymsExpandQueryAndFilterAlike(t *testing.T) {
+	setTestSynonyms(t)
+
+	query := Query{
+		QueryString: "MI",
+		Filters: map[string]map[string]interface{}{
+			"tool": {"keywords": []interface{}{"MI"}},
+		},
+	}
+	elasticQuery := entityQuery("tool", query)
+
+	queryTerms := []string{query.QueryString}
+	should := elasticQuery["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	for _, clause := range should[3:] {
+		queryTerms = append(queryTerms, clause["multi_match"].(gin.H)["query"].(string))
+	}
+
+	filterTerms := []string{}
+	mustFilters := elasticQuery["post_filter"].(gin.H)["bool"].(gin.H)["must"].([]gin.H)
+	for _, term := range mustFilters[0]["bool"].(gin.H)["should"].([]gin.H) {
+		filterTerms = append(filterTerms, term["term"].(gin.H)["keywords"].(string))
+	}
+
+	assert.ElementsMatch(t, synonymsFor("MI"), queryTerms)
+	assert.ElementsMatch(t, synonymsFor("MI"), filterTerms)
+}
+
+func TestReloadSynonymsIfModified(t *testing.T) {
+	t.Cleanup(func() { setSynonyms(map[string][]string{}) })
+
+	path := filepath.Join(t.TempDir(), "synonyms.json")
+	content, _ := json.Marshal(map[string][]string{"chronic kidney disease": {"CKD"}})
+	os.WriteFile(path, content, 0644)
+	loaded := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(path, loaded, loaded)
+	loadSynonyms(path)
+
+	// unchanged files are not reloaded
+	content, _ = json.Marshal(map[string][]string{"myocardial infarction": {"MI"}})
+	os.WriteFile(path, content, 0644)
+	os.Chtimes(path, loaded, loaded)
+	assert.Equal(t, loaded, reloadSynonymsIfModified(path, loaded))
+	assert.EqualValues(t, []string{"MI"}, synonymsFor("MI"))
+
+	modified := loaded.Add(time.Minute)
+	os.Chtimes(path, modified, modified)
+	assert.Equal(t, modified, reloadSynonymsIfModified(path, loaded))
+	assert.EqualValues(t, []string{"myocardial infarction", "MI"}, synonymsFor("MI"))
+
+	// a broken file keeps the synonyms already loaded
+	os.WriteFile(path, []byte("{"), 0644)
+	broken := modified.Add(time.Minute)
+	os.Chtimes(path, broken, broken)
+	assert.Equal(t, modified, reloadSynonymsIfModified(path, modified))
+	assert.EqualValues(t, []string{"myocardial infarction", "MI"}, synonymsFor("MI"))
+}
+
+func TestSynonymQueriesBoostedBelowOriginal(t *testing.T) {
+	setTestSynonyms(t)
+
+	elasticQuery := entityQuery("tool", Query{QueryString: "MI"})
+	should := elasticQuery["query"].(gin.H)["bool"].(gin.H)["should"].([]gin.H)
+	assert.Greater(t, len(should), 3)
+
+	for _, clause := range should[:3] {
+		boost, ok := clause["multi_match"].(gin.H)["boost"]
+		if !ok {
+			boost = 1
+		}
+		assert.Greater(t, float64(boost.(int)), synonymQueryBoost)
+	}
+	for _, clause := range should[3:] {
+		assert.EqualValues(t, synonymQueryBoost, clause["multi_match"].(gin.H)["boost"])
+	}
+}
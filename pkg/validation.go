@@ -0,0 +1,545 @@
+package search
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultMaxResultWindow matches elastic's default index.max_result_window.
+	defaultMaxResultWindow = 10000
+	defaultMaxAggregations = 20
+	defaultMaxFilterKeys   = 50
+	// maxCollapseInnerHits matches elastic's default index.max_inner_result_window.
+	maxCollapseInnerHits = 100
+	// maxPhraseSlop bounds phraseSlop, as large slops make phrase queries slow
+	// while matching little more than the other clauses.
+	maxPhraseSlop = 10
+)
+
+// idRegex matches the entity IDs accepted in query.IDs, which are either
+// numeric database IDs or UUIDs.
+var idRegex = regexp.MustCompile(
+	`^(?:[0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})$`,
+)
+
+// validateQuery checks an incoming search query for options that cannot be
+// satisfied, returning an error describing the problem if one is found.
+func validateQuery(query Query) error {
+	if err := validateIDs(query); err != nil {
+		return err
+	}
+	if err := validateAnalyzer(query); err != nil {
+		return err
+	}
+	if err := validatePatterns(query); err != nil {
+		return err
+	}
+	if err := validateQueryLimits(query); err != nil {
+		return err
+	}
+	if err := validateAggregationOptions(query); err != nil {
+		return err
+	}
+	if err := validateFilterKeys(query); err != nil {
+		return err
+	}
+	if err := validateFilterValues(query); err != nil {
+		return err
+	}
+	if err := validateHighlightFields(query); err != nil {
+		return err
+	}
+	if err := validateRecencyBoost(query); err != nil {
+		return err
+	}
+	if err := validateEmptyQueryOrder(query); err != nil {
+		return err
+	}
+	if err := validateOperators(query); err != nil {
+		return err
+	}
+	return validatePagination(query)
+}
+
+// validateOperators checks the options of a search honouring query operators,
+// see applyQueryOperators.
+func validateOperators(query Query) error {
+	if query.DefaultOperator != "" {
+		if !query.Operators {
+			return fmt.Errorf("defaultOperator requires operators")
+		}
+		if operator := strings.ToLower(query.DefaultOperator); operator != "and" && operator != "or" {
+			return fmt.Errorf("defaultOperator must be and or or, got %q", query.DefaultOperator)
+		}
+	}
+	if query.Operators && query.Exact {
+		return fmt.Errorf("operators cannot be combined with exact, quote the phrase instead")
+	}
+	return nil
+}
+
+// validateIDs checks that each of the IDs the search is restricted to, or
+// excludes, is a numeric ID or a UUID.  The IDs are passed to elastic in terms
+// queries and as the params of the painless script that sorts the results into
+// their order, so anything else is rejected rather than passed on.
+func validateIDs(query Query) error {
+	for _, id := range slices.Concat(query.IDs, query.ExcludeIDs) {
+		if !idRegex.MatchString(id) {
+			return fmt.Errorf("ids must be numeric or UUIDs, got %q", id)
+		}
+	}
+	return nil
+}
+
+// validateRecencyBoost checks the options of the recency boost, if requested,
+// see RecencyBoostOptions.
+func validateRecencyBoost(query Query) error {
+	options := query.RecencyBoost
+	if options == nil {
+		return nil
+	}
+	if !slices.Contains([]string{"", "gauss", "exp", "linear"}, options.Function) {
+		return fmt.Errorf("recencyBoost function must be gauss, exp or linear, got %q", options.Function)
+	}
+	if options.Decay < 0 || options.Decay >= 1 {
+		return fmt.Errorf("recencyBoost decay must be between 0 and 1")
+	}
+	if options.Weight < 0 {
+		return fmt.Errorf("recencyBoost weight must not be negative")
+	}
+	return nil
+}
+
+// validateEmptyQueryOrder checks the order requested for the hits of searches
+// without a query string, see emptyQuerySort.  A seed only applies to
+// the random order.
+func validateEmptyQueryOrder(query Query) error {
+	orders := []string{emptyQueryOrderRandom, emptyQueryOrderRecent, emptyQueryOrderAlphabetical}
+	if query.EmptyQueryOrder != "" && !slices.Contains(orders, query.EmptyQueryOrder) {
+		return fmt.Errorf(
+			"emptyQueryOrder must be one of %s, got %q",
+			strings.Join(orders, ", "),
+			query.EmptyQueryOrder,
+		)
+	}
+	if query.Seed != nil && query.EmptyQueryOrder != "" && query.EmptyQueryOrder != emptyQueryOrderRandom {
+		return fmt.Errorf("seed only applies to the random emptyQueryOrder")
+	}
+	return nil
+}
+
+// validatePatterns checks the prefix and wildcard queries requested.  Wildcard
+// patterns starting with a wildcard must scan every term of the field, so are
+// rejected unless the query explicitly allows them with allowLeadingWildcard.
+func validatePatterns(query Query) error {
+	for field, prefix := range query.Prefix {
+		if field == "" || prefix == "" {
+			return fmt.Errorf("prefix queries must name a field and a prefix")
+		}
+	}
+	for field, pattern := range query.Wildcard {
+		if field == "" || pattern == "" {
+			return fmt.Errorf("wildcard queries must name a field and a pattern")
+		}
+		if strings.IndexAny(pattern, "*?") == 0 && !query.AllowLeadingWildcard {
+			return fmt.Errorf(
+				"wildcard pattern %q for %s starts with a wildcard, set allowLeadingWildcard to allow this",
+				pattern,
+				field,
+			)
+		}
+	}
+	return nil
+}
+
+// validateQueryLimits bounds the number of aggregations, and of filter keys
+// across all entity types, that a single query may request so that one
+// request cannot trigger an unbounded number of sub-aggregations in elastic.
+// Each subAggregation counts as an aggregation of its own.
+// The limits are set with SEARCH_MAX_AGGREGATIONS and SEARCH_MAX_FILTER_KEYS.
+func validateQueryLimits(query Query) error {
+	if query.AggregationSize < 0 {
+		return fmt.Errorf("aggregationSize must not be negative")
+	}
+	if query.MinScore < 0 {
+		return fmt.Errorf("minScore must not be negative")
+	}
+	if query.PhraseSlop < 0 || query.PhraseSlop > maxPhraseSlop {
+		return fmt.Errorf("phraseSlop must be between 0 and %d", maxPhraseSlop)
+	}
+	aggregations := len(query.Aggregations)
+	for _, agg := range query.Aggregations {
+		if _, ok := subAggregation(agg); ok {
+			aggregations++
+		}
+	}
+	maxAggregations := envInt("SEARCH_MAX_AGGREGATIONS", defaultMaxAggregations)
+	if aggregations > maxAggregations {
+		return fmt.Errorf(
+			"%d aggregations requested, including sub-aggregations, the maximum is %d",
+			aggregations,
+			maxAggregations,
+		)
+	}
+
+	filterKeys := 0
+	for _, filters := range query.Filters {
+		filterKeys += len(filters)
+	}
+	maxFilterKeys := envInt("SEARCH_MAX_FILTER_KEYS", defaultMaxFilterKeys)
+	if filterKeys > maxFilterKeys {
+		return fmt.Errorf(
+			"%d filter keys requested, the maximum is %d",
+			filterKeys,
+			maxFilterKeys,
+		)
+	}
+	return nil
+}
+
+// validateAggregationOptions checks the options set on each requested
+// aggregation, see buildAggregations.
+func validateAggregationOptions(query Query) error {
+	for _, agg := range query.Aggregations {
+		if err := validateAggregation(agg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateAggregation(agg map[string]interface{}) error {
+	if minDocCount, ok := agg["minDocCount"]; ok {
+		count, isNumber := minDocCount.(float64)
+		if !isNumber || count < 0 {
+			return fmt.Errorf("minDocCount of aggregation %v must be a non-negative number", agg["keys"])
+		}
+	}
+	if global, ok := agg["global"]; ok {
+		if _, isBool := global.(bool); !isBool {
+			return fmt.Errorf("global of aggregation %v must be true or false", agg["keys"])
+		}
+	}
+	if err := validateDateHistogram(agg); err != nil {
+		return err
+	}
+	if err := validateMetric(agg); err != nil {
+		return err
+	}
+	if order, ok := agg["order"]; ok && order != "count" && order != "key" {
+		return fmt.Errorf("order of aggregation %v must be count or key", agg["keys"])
+	}
+	if sub, ok := agg["subAggregation"]; ok {
+		subAgg, valid := subAggregation(agg)
+		if !valid {
+			return fmt.Errorf("subAggregation of aggregation %v must name a field", agg["keys"])
+		}
+		if _, nested := sub.(map[string]interface{}); nested {
+			if _, ok := subAgg["subAggregation"]; ok {
+				return fmt.Errorf("subAggregation of aggregation %v cannot be nested further", agg["keys"])
+			}
+			return validateAggregation(subAgg)
+		}
+	}
+	return nil
+}
+
+// validateDateHistogram checks the options of an aggregation requesting a date
+// histogram, see dateHistogramAggregation, and that its field is a date in the
+// mapping of the index, if the mapping is available.
+func validateDateHistogram(agg map[string]interface{}) error {
+	histogram, ok := agg["dateHistogram"]
+	if !ok {
+		if _, ok := agg["calendarInterval"]; ok {
+			return fmt.Errorf("calendarInterval of aggregation %v requires dateHistogram", agg["keys"])
+		}
+		return nil
+	}
+	if _, isBool := histogram.(bool); !isBool {
+		return fmt.Errorf("dateHistogram of aggregation %v must be true or false", agg["keys"])
+	}
+	if interval, ok := agg["calendarInterval"]; ok {
+		name, _ := interval.(string)
+		if _, known := calendarIntervalFormats[name]; !known {
+			intervals := slices.Sorted(maps.Keys(calendarIntervalFormats))
+			return fmt.Errorf(
+				"calendarInterval of aggregation %v must be one of %s",
+				agg["keys"],
+				strings.Join(intervals, ", "),
+			)
+		}
+	}
+
+	aggType, _ := agg["type"].(string)
+	key, _ := agg["keys"].(string)
+	fieldType, mapped := fieldTypes(entityIndex(aggType))[key]
+	if mapped && fieldType != "date" && fieldType != "date_nanos" {
+		return fmt.Errorf("dateHistogram of aggregation %v requires a date field, not %s", key, fieldType)
+	}
+	return nil
+}
+
+// numericFieldTypes are the mapping types that metric aggregations can be
+// computed over.
+var numericFieldTypes = []string{
+	"byte", "double", "float", "half_float", "integer", "long", "scaled_float", "short", "unsigned_long",
+}
+
+// validateMetric checks the options of an aggregation requesting stats or
+// percentiles, see metricAggregation, and that its field is numeric in the
+// mapping of the index, if the mapping is available.
+func validateMetric(agg map[string]interface{}) error {
+	metric, ok := agg["metric"]
+	if !ok {
+		if _, ok := agg["percents"]; ok {
+			return fmt.Errorf("percents of aggregation %v requires the percentiles metric", agg["keys"])
+		}
+		return nil
+	}
+	if metric != "stats" && metric != "percentiles" {
+		return fmt.Errorf("metric of aggregation %v must be stats or percentiles", agg["keys"])
+	}
+	if percents, ok := agg["percents"]; ok {
+		if metric != "percentiles" {
+			return fmt.Errorf("percents of aggregation %v requires the percentiles metric", agg["keys"])
+		}
+		list, isList := percents.([]interface{})
+		if !isList || len(list) == 0 {
+			return fmt.Errorf("percents of aggregation %v must be a list of numbers", agg["keys"])
+		}
+		for _, percent := range list {
+			value, isNumber := percent.(float64)
+			if !isNumber || value < 0 || value > 100 {
+				return fmt.Errorf("percents of aggregation %v must be between 0 and 100", agg["keys"])
+			}
+		}
+	}
+
+	aggType, _ := agg["type"].(string)
+	key, _ := agg["keys"].(string)
+	fieldType, mapped := fieldTypes(entityIndex(aggType))[key]
+	if mapped && !slices.Contains(numericFieldTypes, fieldType) {
+		return fmt.Errorf("%s of aggregation %v requires a numeric field, not %s", metric, key, fieldType)
+	}
+	return nil
+}
+
+// validateHighlightFields checks that each of the fields the query asks to be
+// highlighted can be highlighted for at least one entity type.
+func validateHighlightFields(query Query) error {
+	if query.Highlight.Fields == nil {
+		return nil
+	}
+	for _, field := range *query.Highlight.Fields {
+		highlightable := false
+		for _, config := range entities {
+			highlightable = highlightable || slices.Contains(config.HighlightableFields, field)
+		}
+		if !highlightable {
+			return fmt.Errorf("highlight field %s is not a highlightable field", field)
+		}
+	}
+	return nil
+}
+
+// filterPseudoKeys lists, per index, the filter keys that are not fields of the
+// index but are turned into filters on other fields, see dateRangeFilter.
+var filterPseudoKeys = map[string][]string{
+	"dataset": {"dateRange"},
+}
+
+// maxFilterKeySuggestionDistance is the largest edit distance between an
+// unknown filter key and a field of the index for the field to be suggested.
+const maxFilterKeySuggestionDistance = 2
+
+// validateFilterValues checks that the value of each filter is a list of
+// values, or an object for the keys with their own FilterBuilders, such as
+// populationSize.  Keys shared by all entity types may be objects if they are
+// for any entity type.
+func validateFilterValues(query Query) error {
+	for entityType, filters := range normaliseFilterEntityTypes(query.Filters) {
+		for key, value := range filters {
+			switch value.(type) {
+			case []interface{}:
+				continue
+			case map[string]interface{}:
+				if hasFilterBuilder(entityType, key) {
+					continue
+				}
+			}
+			return fmt.Errorf("filter %s.%s must be a list of values", entityType, key)
+		}
+	}
+	return nil
+}
+
+// hasFilterBuilder reports whether the filter key has its own FilterBuilder
+// for the entity type, or for any entity type if it is sharedFilterKey.
+func hasFilterBuilder(entityType string, key string) bool {
+	for _, config := range entities {
+		if entityType != sharedFilterKey && config.Name != canonicalEntityType(entityType) {
+			continue
+		}
+		if _, ok := config.FilterBuilders[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFilterKeys checks, if the query is strict, that each entity type
+// filtered on exists and that each filter key is a field of its index, as a
+// misspelt key would otherwise silently match nothing.  Keys shared by all
+// entity types must be a field of at least one index.  The error lists each
+// unknown key along with the closest fields to it.  Indices whose mappings are
+// not available are not checked.
+func validateFilterKeys(query Query) error {
+	if !query.Strict {
+		return nil
+	}
+
+	unknown := []string{}
+	for entityType, filters := range normaliseFilterEntityTypes(query.Filters) {
+		var fields []string
+		if entityType == sharedFilterKey {
+			for _, index := range searchIndices() {
+				fields = append(fields, filterFields(index)...)
+			}
+			slices.Sort(fields)
+			fields = slices.Compact(fields)
+		} else if config, ok := entityConfig(entityType); ok {
+			fields = filterFields(config.Index)
+		} else {
+			unknown = append(unknown, unknownFilterKey(entityType, "", entityTypes()))
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		for key := range filters {
+			if !slices.Contains(fields, key) {
+				unknown = append(unknown, unknownFilterKey(key, entityType+".", fields))
+			}
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	slices.Sort(unknown)
+	return fmt.Errorf("unknown filters %s", strings.Join(unknown, ", "))
+}
+
+// filterFields returns the keys that the index can be filtered on, which are
+// its mapped fields other than multi-fields, plus any filterPseudoKeys.  If the
+// mapping of the index is not available nil is returned.
+func filterFields(index string) []string {
+	types := fieldTypes(index)
+	if len(types) == 0 {
+		return nil
+	}
+	fields := slices.Clone(filterPseudoKeys[index])
+	for field := range types {
+		if !strings.HasSuffix(field, ".keyword") {
+			fields = append(fields, field)
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// unknownFilterKey describes the unknown key, suggesting those of the known
+// keys within maxFilterKeySuggestionDistance edits of it.
+func unknownFilterKey(key string, prefix string, known []string) string {
+	suggestions := []string{}
+	for _, candidate := range known {
+		if editDistance(strings.ToLower(key), strings.ToLower(candidate)) <= maxFilterKeySuggestionDistance {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	if len(suggestions) == 0 {
+		return prefix + key
+	}
+	slices.Sort(suggestions)
+	return fmt.Sprintf("%s%s (did you mean %s?)", prefix, key, strings.Join(suggestions, " or "))
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// validatePagination checks the from/size pagination options of the query,
+// rejecting any page that would reach past the maximum result window.
+// The maximum window defaults to elastic's own limit of 10000 results and can
+// be lowered (or raised, if the indices allow it) with SEARCH_MAX_RESULT_WINDOW.
+func validatePagination(query Query) error {
+	if query.From < 0 || query.Size < 0 {
+		return fmt.Errorf("from and size must not be negative")
+	}
+	if query.From > 0 && query.SearchAfter != nil {
+		return fmt.Errorf("from cannot be used together with searchAfter")
+	}
+	if query.CollapseField != "" && query.SearchAfter != nil {
+		return fmt.Errorf("collapseField cannot be used together with searchAfter")
+	}
+	if query.CollapseInnerHits < 0 || query.CollapseInnerHits > maxCollapseInnerHits {
+		return fmt.Errorf("collapseInnerHits must be between 0 and %d", maxCollapseInnerHits)
+	}
+
+	size := query.Size
+	if size == 0 {
+		size = envInt("SEARCH_NO_RECORDS", 0)
+	}
+	maxWindow := envInt("SEARCH_MAX_RESULT_WINDOW", defaultMaxResultWindow)
+	if query.From+size > maxWindow {
+		return fmt.Errorf(
+			"requested results window from + size = %d exceeds the maximum of %d, "+
+				"use searchAfter to page through results beyond this point",
+			query.From+size,
+			maxWindow,
+		)
+	}
+	return nil
+}
+
+// resultSize returns the number of hits to request from elastic for the
+// query, defaulting to SEARCH_NO_RECORDS if the query does not set a size.
+func resultSize(query Query) interface{} {
+	if query.Size > 0 {
+		return query.Size
+	}
+	return os.Getenv("SEARCH_NO_RECORDS")
+}
+
+// envInt reads an integer from the named environment variable, returning
+// fallback if it is unset or not a valid integer.
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,303 @@
+package search
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePagination(t *testing.T) {
+	t.Setenv("SEARCH_NO_RECORDS", "100")
+	t.Setenv("SEARCH_MAX_RESULT_WINDOW", "1000")
+
+	assert.Nil(t, validatePagination(Query{}))
+	assert.Nil(t, validatePagination(Query{From: 900}))
+	assert.Nil(t, validatePagination(Query{From: 950, Size: 50}))
+
+	err := validatePagination(Query{From: 901})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "from + size = 1001 exceeds the maximum of 1000")
+	assert.Contains(t, err.Error(), "searchAfter")
+
+	assert.NotNil(t, validatePagination(Query{Size: 1001}))
+	assert.NotNil(t, validatePagination(Query{From: -1}))
+	assert.NotNil(t, validatePagination(Query{From: 10, SearchAfter: []interface{}{}}))
+}
+
+func TestValidatePaginationDefaultWindow(t *testing.T) {
+	t.Setenv("SEARCH_NO_RECORDS", "100")
+	t.Setenv("SEARCH_MAX_RESULT_WINDOW", "")
+
+	assert.Nil(t, validatePagination(Query{From: 9900}))
+	assert.NotNil(t, validatePagination(Query{From: 500000}))
+}
+
+func TestDatasetSearchRejectsDeepPagination(t *testing.T) {
+	t.Setenv("SEARCH_MAX_RESULT_WINDOW", "1000")
+
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "from": 500000, "size": 10})
+
+	EntitySearch("dataset")(c)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+
+	bodyBytes, err := io.ReadAll(w.Body)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	var testResp map[string]interface{}
+	json.Unmarshal(bodyBytes, &testResp)
+
+	assert.Contains(t, testResp["error"], "searchAfter")
+}
+
+func TestResultSize(t *testing.T) {
+	t.Setenv("SEARCH_NO_RECORDS", "100")
+
+	assert.EqualValues(t, "100", resultSize(Query{}))
+	assert.EqualValues(t, 25, resultSize(Query{Size: 25}))
+}
+
+func TestValidateQueryLimits(t *testing.T) {
+	t.Setenv("SEARCH_MAX_AGGREGATIONS", "2")
+	t.Setenv("SEARCH_MAX_FILTER_KEYS", "3")
+
+	aggs := []map[string]interface{}{
+		{"type": "dataset", "keys": "publisherName"},
+		{"type": "dataset", "keys": "dataType"},
+	}
+	filters := map[string]map[string]interface{}{
+		"dataset": {"publisherName": []interface{}{"A"}, "dataType": []interface{}{"B"}},
+		"tool":    {"license": []interface{}{"MIT"}},
+	}
+	assert.Nil(t, validateQueryLimits(Query{Aggregations: aggs, Filters: filters}))
+
+	err := validateQueryLimits(Query{
+		Aggregations: append(aggs, map[string]interface{}{"type": "dataset", "keys": "x"}),
+	})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "3 aggregations requested, including sub-aggregations, the maximum is 2")
+
+	err = validateQueryLimits(Query{Aggregations: []map[string]interface{}{
+		{"type": "dataset", "keys": "publisherName", "subAggregation": "containsTissue"},
+		{"type": "dataset", "keys": "dataType"},
+	}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "3 aggregations requested")
+
+	filters["collection"] = map[string]interface{}{"keywords": []interface{}{"C"}}
+	err = validateQueryLimits(Query{Filters: filters})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "4 filter keys requested, the maximum is 3")
+
+	assert.Nil(t, validateQueryLimits(Query{PhraseSlop: maxPhraseSlop}))
+	assert.NotNil(t, validateQueryLimits(Query{PhraseSlop: maxPhraseSlop + 1}))
+	assert.NotNil(t, validateQueryLimits(Query{PhraseSlop: -1}))
+}
+
+func TestValidateAggregationOptions(t *testing.T) {
+	valid := Query{Aggregations: []map[string]interface{}{
+		{"type": "dataset", "keys": "publisherName", "minDocCount": 2.0, "order": "key"},
+	}}
+	assert.Nil(t, validateQuery(valid))
+
+	badOrder := Query{Aggregations: []map[string]interface{}{
+		{"type": "dataset", "keys": "publisherName", "order": "alphabetical"},
+	}}
+	err := validateQuery(badOrder)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "must be count or key")
+
+	badCount := Query{Aggregations: []map[string]interface{}{
+		{"type": "dataset", "keys": "publisherName", "minDocCount": -1.0},
+	}}
+	assert.NotNil(t, validateQuery(badCount))
+}
+
+func TestValidateSubAggregation(t *testing.T) {
+	valid := Query{Aggregations: []map[string]interface{}{
+		{"type": "dataset", "keys": "publisherName", "subAggregation": "containsTissue"},
+		{
+			"type":           "dataset",
+			"keys":           "publisherName",
+			"subAggregation": map[string]interface{}{"keys": "dataType", "order": "key"},
+		},
+	}}
+	assert.Nil(t, validateQuery(valid))
+
+	for _, sub := range []interface{}{
+		"",
+		3.0,
+		map[string]interface{}{"order": "key"},
+		map[string]interface{}{"keys": "dataType", "order": "alphabetical"},
+		map[string]interface{}{"keys": "dataType", "subAggregation": "containsTissue"},
+	} {
+		query := Query{Aggregations: []map[string]interface{}{
+			{"type": "dataset", "keys": "publisherName", "subAggregation": sub},
+		}}
+		assert.NotNil(t, validateQuery(query), "subAggregation %v", sub)
+	}
+}
+
+func TestValidateIDs(t *testing.T) {
+	valid := Query{IDs: []string{"1", "20345", "5b0f7c5e-2d1a-4c3b-9e8f-1a2b3c4d5e6f"}}
+	assert.Nil(t, validateQuery(valid))
+
+	for _, id := range []string{
+		"",
+		"-1",
+		"1.5",
+		"abc",
+		"1; return 0",
+		"1' || true",
+		"5b0f7c5e-2d1a-4c3b-9e8f",
+		" 12",
+		"12\n",
+	} {
+		err := validateQuery(Query{IDs: []string{"1", id}})
+		assert.NotNil(t, err, "id %q", id)
+
+		err = validateQuery(Query{ExcludeIDs: []string{id}})
+		assert.NotNil(t, err, "excluded id %q", id)
+	}
+}
+
+func TestDatasetSearchRejectsMalformedIDs(t *testing.T) {
+	w := httptest.NewRecorder()
+	c := GetTestGinContext(w)
+	MockPostWithBody(c, gin.H{"query": "test query", "ids": []string{"1", "params.order[0]"}})
+
+	EntitySearch("dataset")(c)
+
+	assert.EqualValues(t, http.StatusBadRequest, w.Code)
+
+	var testResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &testResp)
+
+	assert.Contains(t, testResp["error"], "ids must be numeric or UUIDs")
+}
+
+func TestValidatePatterns(t *testing.T) {
+	assert.Nil(t, validateQuery(Query{
+		Prefix:   map[string]string{"name": "bio"},
+		Wildcard: map[string]string{"datasetDOI": "10.1234/*"},
+	}))
+
+	err := validateQuery(Query{Wildcard: map[string]string{"name": "*seq"}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "allowLeadingWildcard")
+	assert.NotNil(t, validateQuery(Query{Wildcard: map[string]string{"name": "?seq"}}))
+	assert.Nil(t, validateQuery(Query{
+		Wildcard:             map[string]string{"name": "*seq"},
+		AllowLeadingWildcard: true,
+	}))
+
+	assert.NotNil(t, validateQuery(Query{Prefix: map[string]string{"name": ""}}))
+	assert.NotNil(t, validateQuery(Query{Wildcard: map[string]string{"": "bio*"}}))
+}
+
+func TestValidateRecencyBoost(t *testing.T) {
+	assert.Nil(t, validateQuery(Query{RecencyBoost: &RecencyBoostOptions{}}))
+	assert.Nil(t, validateQuery(Query{RecencyBoost: &RecencyBoostOptions{Function: "linear", Decay: 0.3}}))
+
+	err := validateQuery(Query{RecencyBoost: &RecencyBoostOptions{Function: "sigmoid"}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "gauss, exp or linear")
+	assert.NotNil(t, validateQuery(Query{RecencyBoost: &RecencyBoostOptions{Decay: 1}}))
+	assert.NotNil(t, validateQuery(Query{RecencyBoost: &RecencyBoostOptions{Weight: -1}}))
+}
+
+func TestValidateEmptyQueryOrder(t *testing.T) {
+	seed := 7
+	assert.Nil(t, validateQuery(Query{EmptyQueryOrder: "recent"}))
+	assert.Nil(t, validateQuery(Query{Seed: &seed}))
+	assert.Nil(t, validateQuery(Query{EmptyQueryOrder: "random", Seed: &seed}))
+
+	err := validateQuery(Query{EmptyQueryOrder: "newest"})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "random, recent, alphabetical")
+	assert.NotNil(t, validateQuery(Query{EmptyQueryOrder: "alphabetical", Seed: &seed}))
+}
+
+func TestValidateFilterKeys(t *testing.T) {
+	setIndexFieldTypes("dataset", map[string]string{
+		"publisherName":         "text",
+		"publisherName.keyword": "keyword",
+		"populationSize":        "integer",
+	})
+	setIndexFieldTypes("tool", map[string]string{"programmingLanguage": "keyword"})
+	t.Cleanup(func() {
+		setIndexFieldTypes("dataset", map[string]string{})
+		setIndexFieldTypes("tool", map[string]string{})
+	})
+
+	filters := map[string]map[string]interface{}{
+		"dataset":    {"publsherName": []interface{}{"Publisher A"}, "dateRange": []interface{}{"2020"}},
+		"tool":       {"programmingLanguage": []interface{}{"Go"}},
+		"collection": {"anything": []interface{}{"x"}},
+		"datset":     {"publisherName": []interface{}{"Publisher A"}},
+		"_all":       {"populationSize": []interface{}{1}, "colour": []interface{}{"red"}},
+	}
+	assert.Nil(t, validateQuery(Query{Filters: filters}))
+
+	err := validateQuery(Query{Filters: filters, Strict: true})
+	assert.NotNil(t, err)
+	assert.EqualValues(
+		t,
+		"unknown filters _all.colour, dataset.publsherName (did you mean publisherName?), "+
+			"datset (did you mean dataset?)",
+		err.Error(),
+	)
+
+	assert.Nil(t, validateQuery(Query{
+		Filters: map[string]map[string]interface{}{
+			"dataset": {"publisherName": []interface{}{"Publisher A"}},
+			"paper":   {"anything": []interface{}{"x"}},
+		},
+		Strict: true,
+	}))
+}
+
+func TestValidateFilterValues(t *testing.T) {
+	for _, filters := range []map[string]map[string]interface{}{
+		{"dataset": {"publisherName": []interface{}{"Publisher A"}}},
+		{"dataset": {"populationSize": map[string]interface{}{"from": 10}}},
+		{"_all": {"populationSize": map[string]interface{}{"from": 10, "to": 100}}},
+		{"dataProvider": {geoLocationField: map[string]interface{}{"lat": 51.5, "lon": -0.12}}},
+	} {
+		assert.Nil(t, validateQuery(Query{Filters: filters}), "filters %v", filters)
+	}
+
+	for message, filters := range map[string]map[string]map[string]interface{}{
+		"filter dataset.publisherName must be a list of values": {
+			"dataset": {"publisherName": "Publisher A"},
+		},
+		"filter tool.populationSize must be a list of values": {
+			"tool": {"populationSize": map[string]interface{}{"from": 10}},
+		},
+		"filter _all.keywords must be a list of values": {
+			"_all": {"keywords": map[string]interface{}{"from": 10}},
+		},
+	} {
+		err := validateQuery(Query{Filters: filters})
+		if assert.NotNil(t, err) {
+			assert.EqualValues(t, message, err.Error())
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.EqualValues(t, 0, editDistance("name", "name"))
+	assert.EqualValues(t, 1, editDistance("publsherName", "publisherName"))
+	assert.EqualValues(t, 3, editDistance("kitten", "sitting"))
+	assert.EqualValues(t, 4, editDistance("", "name"))
+}
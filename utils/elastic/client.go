@@ -5,30 +5,69 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 )
 
+// Defaults of the connection pool to elastic.  Every generic search queries
+// each of the seven indices at once, and up to SEARCH_MAX_CONCURRENT_QUERIES
+// (default 50) queries are run at once, so far more connections are kept idle
+// for reuse than Go's default of 2 per host, which closes most of them as soon
+// as a burst of searches finishes.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 50
+	defaultMaxConnsPerHost     = 0
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
 // Defines the ElasticSearch client, authentication and elastic deployment
 // endpoint are required environment variables.
 func DefaultClient() *elasticsearch.Client {
+	es, err := elasticsearch.NewClient(clientConfig())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return es
+}
+
+// clientConfig returns the config of the client from the environment.
+func clientConfig() elasticsearch.Config {
+	return elasticsearch.Config{
+		Addresses: []string{os.Getenv("ELASTIC_URL")},
+		Username:  os.Getenv("ELASTIC_USERNAME"),
+		Password:  os.Getenv("ELASTIC_PASSWORD"),
+		Transport: newTransport(),
+	}
+}
+
+// newTransport returns the HTTP transport to elastic, with its connection pool
+// set by ELASTIC_MAX_IDLE_CONNS, ELASTIC_MAX_IDLE_CONNS_PER_HOST,
+// ELASTIC_MAX_CONNS_PER_HOST (0 for no limit) and
+// ELASTIC_IDLE_CONN_TIMEOUT_SECONDS.
+func newTransport() *http.Transport {
 	// Note: we might not need to define custom transport with infra hosted elastic
 	// It is defined here in order to disable SSL cert verification
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	return &http.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		MaxIdleConns:        envInt("ELASTIC_MAX_IDLE_CONNS", defaultMaxIdleConns),
+		MaxIdleConnsPerHost: envInt("ELASTIC_MAX_IDLE_CONNS_PER_HOST", defaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:     envInt("ELASTIC_MAX_CONNS_PER_HOST", defaultMaxConnsPerHost),
+		IdleConnTimeout: time.Duration(envInt(
+			"ELASTIC_IDLE_CONN_TIMEOUT_SECONDS",
+			int(defaultIdleConnTimeout.Seconds()),
+		)) * time.Second,
 	}
-	clusterURLs := []string{os.Getenv("ELASTIC_URL")}
-	username := os.Getenv("ELASTIC_USERNAME")
-	password := os.Getenv("ELASTIC_PASSWORD")
+}
 
-	es, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses: clusterURLs,
-		Username:  username,
-		Password:  password,
-		Transport: tr,
-	})
+// envInt returns the integer value of the environment variable, or fallback if
+// it is unset or not an integer.
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
 	if err != nil {
-		log.Fatal(err.Error())
+		return fallback
 	}
-	return es
+	return value
 }
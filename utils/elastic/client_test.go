@@ -0,0 +1,31 @@
+package elastic
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientConfigTransport(t *testing.T) {
+	transport := clientConfig().Transport.(*http.Transport)
+	assert.EqualValues(t, defaultMaxIdleConns, transport.MaxIdleConns)
+	assert.EqualValues(t, defaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.EqualValues(t, defaultMaxConnsPerHost, transport.MaxConnsPerHost)
+	assert.EqualValues(t, defaultIdleConnTimeout, transport.IdleConnTimeout)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+
+	t.Setenv("ELASTIC_MAX_IDLE_CONNS", "20")
+	t.Setenv("ELASTIC_MAX_IDLE_CONNS_PER_HOST", "10")
+	t.Setenv("ELASTIC_MAX_CONNS_PER_HOST", "30")
+	t.Setenv("ELASTIC_IDLE_CONN_TIMEOUT_SECONDS", "15")
+	transport = clientConfig().Transport.(*http.Transport)
+	assert.EqualValues(t, 20, transport.MaxIdleConns)
+	assert.EqualValues(t, 10, transport.MaxIdleConnsPerHost)
+	assert.EqualValues(t, 30, transport.MaxConnsPerHost)
+	assert.EqualValues(t, 15*time.Second, transport.IdleConnTimeout)
+
+	t.Setenv("ELASTIC_URL", "http://localhost:9200")
+	assert.NotNil(t, DefaultClient())
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/elastic/go-elasticsearch/v8"
 )
@@ -30,6 +31,46 @@ func (m *MockClient) Do(req *http.Request) (*http.Response, error) {
 	}
 }
 
+// RecordingClient is a mock client that records the requests sent with it,
+// along with their bodies, and responds to each with StatusCode and Body.
+type RecordingClient struct {
+	StatusCode int
+	Body       string
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+// Do records the request and responds with the client's status code and body.
+func (m *RecordingClient) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+
+	m.mu.Lock()
+	m.requests = append(m.requests, req)
+	m.bodies = append(m.bodies, body)
+	m.mu.Unlock()
+
+	statusCode := m.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: statusCode,
+		Body:       io.NopCloser(strings.NewReader(m.Body)),
+	}, nil
+}
+
+// Requests returns the requests recorded so far, along with their bodies.
+func (m *RecordingClient) Requests() ([]*http.Request, [][]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*http.Request{}, m.requests...), append([][]byte{}, m.bodies...)
+}
+
 // Recommended method for mocking the elasticsearch client in tests
 // See [go-elasticsearch](https://github.com/elastic/go-elasticsearch/tree/main#examples)
 type MockTransport struct {
@@ -74,3 +115,27 @@ func MockElasticClient() *elasticsearch.Client {
 	}
 	return client
 }
+
+// MockElasticClientFunc returns an elasticsearch client whose responses are
+// built by responseFn, which returns the status code and body to respond to
+// each request with.
+func MockElasticClientFunc(responseFn func(req *http.Request) (int, string)) *elasticsearch.Client {
+	mocktrans := MockTransport{}
+	mocktrans.RoundTripFn = func(req *http.Request) (*http.Response, error) {
+		statusCode, responseBody := responseFn(req)
+		resp := &http.Response{
+			StatusCode: statusCode,
+			Body:       io.NopCloser(strings.NewReader(responseBody)),
+			Header:     http.Header{"X-Elastic-Product": []string{"Elasticsearch"}},
+		}
+		return resp, nil
+	}
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{
+		Transport: &mocktrans,
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	return client
+}